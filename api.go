@@ -17,14 +17,26 @@ type Event struct {
 	ForeignID string
 	Timestamp time.Time
 	MetaData  []byte
+
+	// Extra contains additional values populated by some stream
+	// implementations, ex. rsql.WithEventScanner. Note it is not
+	// transmitted via gRPC.
+	Extra map[string]interface{}
 }
 
 // IDInt returns the event id as an int64 or 0 if it is not an integer.
+// See IDUint for ids of unsigned columns that may exceed math.MaxInt64.
 func (e *Event) IDInt() int64 {
 	i, _ := strconv.ParseInt(e.ID, 10, 64)
 	return i
 }
 
+// IDUint returns the event id as an uint64 or 0 if it is not an unsigned integer.
+func (e *Event) IDUint() uint64 {
+	i, _ := strconv.ParseUint(e.ID, 10, 64)
+	return i
+}
+
 // IsIDInt returns true if the event id is an integer.
 func (e *Event) IsIDInt() bool {
 	_, err := strconv.ParseInt(e.ID, 10, 64)
@@ -49,6 +61,24 @@ type EventType interface {
 	ReflexType() int
 }
 
+// NamedEventType is an optional interface that event types can implement
+// to provide a human-readable name for logging and metrics.
+type NamedEventType interface {
+	EventType
+
+	// ReflexName returns the name of the type.
+	ReflexName() string
+}
+
+// EventTypeName returns the name of the event type if it implements NamedEventType,
+// otherwise it returns the type as an int string.
+func EventTypeName(typ EventType) string {
+	if named, ok := typ.(NamedEventType); ok {
+		return named.ReflexName()
+	}
+	return strconv.Itoa(typ.ReflexType())
+}
+
 // IsType returns true if the source reflex type equals the target type.
 func IsType(source, target EventType) bool {
 	return source.ReflexType() == target.ReflexType()
@@ -113,6 +143,32 @@ type resetter interface {
 	Reset() error
 }
 
+// startChecker is an optional interface that a consumer can implement
+// to validate the stored cursor at the start of each run.
+type startChecker interface {
+	checkStart(cursor string) error
+}
+
+// recvObserver is an optional interface that a consumer can implement
+// to observe the time spent in StreamClient.Recv for each event.
+type recvObserver interface {
+	observeRecv(d time.Duration)
+}
+
+// idleLagUpdater is an optional interface that a consumer can implement
+// to update its lag metric while idle for the duration of each run and
+// when the stream returns ErrHeadReached.
+type idleLagUpdater interface {
+	updateIdleLag(ctx context.Context, head headReporter)
+	headReached()
+}
+
+// headReporter is an optional interface that a stream client can implement
+// to report whether it is idle at the head of the stream, ex. rsql streams.
+type headReporter interface {
+	AtHead() bool
+}
+
 // StreamClient is a stream interface providing subsequent events on calls to Recv.
 type StreamClient interface {
 	// Recv blocks until the next event is found. Either the event or error is non-nil.
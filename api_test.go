@@ -0,0 +1,23 @@
+package reflex_test
+
+import (
+	"testing"
+
+	"github.com/luno/reflex"
+	"github.com/stretchr/testify/require"
+)
+
+type namedType int
+
+func (t namedType) ReflexType() int {
+	return int(t)
+}
+
+func (t namedType) ReflexName() string {
+	return "named"
+}
+
+func TestEventTypeName(t *testing.T) {
+	require.Equal(t, "named", reflex.EventTypeName(namedType(1)))
+	require.Equal(t, "2", reflex.EventTypeName(TestEventType(2)))
+}
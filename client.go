@@ -2,6 +2,8 @@ package reflex
 
 import (
 	"context"
+	"io"
+	"time"
 
 	"github.com/luno/reflex/reflexpb"
 )
@@ -13,6 +15,8 @@ type StreamClientPB interface {
 }
 
 // WrapStreamPB wraps a gRPC client's stream method and returns a StreamFunc.
+// The WithStreamLimit and WithSkipMetadataPredicate options are applied by
+// the returned StreamClient since they are not sent to the server.
 func WrapStreamPB(wrap func(context.Context, *reflexpb.StreamRequest) (
 	StreamClientPB, error)) StreamFunc {
 	return func(ctx context.Context, after string, opts ...StreamOption) (StreamClient, error) {
@@ -29,6 +33,143 @@ func WrapStreamPB(wrap func(context.Context, *reflexpb.StreamRequest) (
 			return nil, err
 		}
 
-		return streamClientFromProto(cspb), nil
+		sc := streamClientFromProto(cspb)
+
+		var o StreamOptions
+		for _, opt := range opts {
+			opt(&o)
+		}
+		if o.SkipMetadata != nil {
+			sc = &skipclient{StreamClient: sc, skip: o.SkipMetadata}
+		}
+		if o.Limit > 0 {
+			return &limitclient{StreamClient: sc, remaining: o.Limit}, nil
+		}
+
+		return sc, nil
+	}
+}
+
+// limitclient is a StreamClient that returns ErrLimitReached
+// after the remaining events have been received.
+type limitclient struct {
+	StreamClient
+	remaining int
+}
+
+func (c *limitclient) Recv() (*Event, error) {
+	if c.remaining <= 0 {
+		return nil, ErrLimitReached
+	}
+
+	e, err := c.StreamClient.Recv()
+	if err != nil {
+		return nil, err
+	}
+	c.remaining--
+
+	return e, nil
+}
+
+// skipclient is a StreamClient that skips events for which
+// skip returns true given the event metadata.
+type skipclient struct {
+	StreamClient
+	skip func(metadata []byte) bool
+}
+
+func (c *skipclient) Recv() (*Event, error) {
+	for {
+		e, err := c.StreamClient.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if c.skip(e.MetaData) {
+			continue
+		}
+		return e, nil
+	}
+}
+
+// TeeStream returns a StreamClient that calls sink with each event received
+// from the provided client, after it is received and before it is returned
+// by Recv. The sink is only called for returned events, not for errors, so
+// each delivered event is teed exactly once. The sink is called synchronously
+// so it must not block, since that blocks delivery; hand off to a buffered
+// channel or goroutine if it performs IO.
+func TeeStream(client StreamClient, sink func(*Event)) StreamClient {
+	return &teeclient{
+		StreamClient: client,
+		sink:         sink,
+	}
+}
+
+type teeclient struct {
+	StreamClient
+	sink func(*Event)
+}
+
+func (c *teeclient) Recv() (*Event, error) {
+	e, err := c.StreamClient.Recv()
+	if err != nil {
+		return nil, err
+	}
+	c.sink(e)
+	return e, nil
+}
+
+// Close closes the underlying client if it implements io.Closer.
+func (c *teeclient) Close() error {
+	if closer, ok := c.StreamClient.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// throttlePeriod is the period at which throttled streams
+// check whether delivery is allowed again.
+const throttlePeriod = time.Millisecond * 100
+
+// ThrottledStream returns a StreamClient that only receives and returns the
+// next event from the provided client while allow returns true. Otherwise
+// Recv waits, checking allow again periodically, until it returns true or
+// the context is done, in which case the context error is returned. Unlike
+// rate limiting, this is demand-driven, eg. allow can report whether a fragile
+// downstream has capacity, so delivery pauses while it signals backpressure.
+// The allow function must not block and must be safe to call from the
+// goroutine calling Recv.
+func ThrottledStream(ctx context.Context, client StreamClient, allow func() bool) StreamClient {
+	return &throttleclient{
+		StreamClient: client,
+		ctx:          ctx,
+		allow:        allow,
+	}
+}
+
+type throttleclient struct {
+	StreamClient
+	ctx   context.Context
+	allow func() bool
+}
+
+func (c *throttleclient) Recv() (*Event, error) {
+	for !c.allow() {
+		t := time.NewTimer(throttlePeriod)
+		select {
+		case <-c.ctx.Done():
+			t.Stop()
+			return nil, c.ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	return c.StreamClient.Recv()
+}
+
+// Close closes the underlying client if it implements io.Closer.
+func (c *throttleclient) Close() error {
+	if closer, ok := c.StreamClient.(io.Closer); ok {
+		return closer.Close()
 	}
+	return nil
 }
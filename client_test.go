@@ -0,0 +1,93 @@
+package reflex_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/reflex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTeeStream(t *testing.T) {
+	errEnd := errors.New("end")
+	events := []*reflex.Event{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+	s := newMockStreamer(events, errEnd)
+
+	sc, err := s.Stream(context.Background(), "")
+	require.NoError(t, err)
+
+	var teed []*reflex.Event
+	sc = reflex.TeeStream(sc, func(e *reflex.Event) {
+		teed = append(teed, e)
+	})
+
+	var delivered []*reflex.Event
+	for {
+		e, err := sc.Recv()
+		if err != nil {
+			require.True(t, errors.Is(err, errEnd))
+			break
+		}
+		delivered = append(delivered, e)
+	}
+
+	// Errors are not teed.
+	_, err = sc.Recv()
+	require.True(t, errors.Is(err, errEnd))
+
+	require.Equal(t, events, delivered)
+	require.Equal(t, delivered, teed)
+}
+
+func TestThrottledStream(t *testing.T) {
+	errEnd := errors.New("end")
+	events := []*reflex.Event{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+	s := newMockStreamer(events, errEnd)
+
+	sc, err := s.Stream(context.Background(), "")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var allowed int32 = 1
+	sc = reflex.ThrottledStream(ctx, sc, func() bool {
+		return atomic.LoadInt32(&allowed) == 1
+	})
+
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "1", e.ID)
+
+	// Delivery pauses until allowed again.
+	atomic.StoreInt32(&allowed, 0)
+	go func() {
+		time.Sleep(time.Millisecond * 300)
+		atomic.StoreInt32(&allowed, 1)
+	}()
+
+	t0 := time.Now()
+	e, err = sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "2", e.ID)
+	require.True(t, time.Since(t0) >= time.Millisecond*300)
+
+	// Waiting is cancelled with the context.
+	atomic.StoreInt32(&allowed, 0)
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+
+	_, err = sc.Recv()
+	require.True(t, errors.Is(err, context.Canceled))
+
+	// No event was received while waiting.
+	atomic.StoreInt32(&allowed, 1)
+	e, err = sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "3", e.ID)
+}
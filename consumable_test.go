@@ -163,3 +163,60 @@ func ItoE(i int) *reflex.Event {
 		Type:      TestEventType(i),
 	}
 }
+
+func TestMinStartCursor(t *testing.T) {
+	const name = "min_start"
+
+	cases := []struct {
+		name   string
+		cursor string
+		expErr error
+	}{
+		{
+			name:   "empty",
+			cursor: "",
+			expErr: reflex.ErrCursorBelowMin,
+		},
+		{
+			name:   "below",
+			cursor: "9",
+			expErr: reflex.ErrCursorBelowMin,
+		},
+		{
+			name:   "at",
+			cursor: "10",
+		},
+		{
+			name:   "above",
+			cursor: "11",
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			cstore := mock.NewMockCStore()
+			_ = cstore.SetCursor(nil, name, test.cursor)
+
+			errEnd := errors.New("end")
+			streamer := newMockStreamer(ItoEList(9, 10, 11, 12), errEnd)
+
+			var consumed int
+			consumer := reflex.NewConsumer(name,
+				func(context.Context, fate.Fate, *reflex.Event) error {
+					consumed++
+					return nil
+				}, reflex.WithMinStartCursor("10"))
+
+			err := reflex.Run(context.Background(),
+				reflex.NewSpec(streamer.Stream, cstore, consumer))
+			if test.expErr != nil {
+				assert.True(t, errors.Is(err, test.expErr))
+				assert.Zero(t, consumed)
+				return
+			}
+
+			assert.True(t, errors.Is(err, errEnd))
+			assert.NotZero(t, consumed)
+		})
+	}
+}
@@ -2,18 +2,26 @@ package reflex
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/luno/fate"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const defaultLagAlert = 30 * time.Minute
 const defaultActivityTTL = 24 * time.Hour
 
+// maxMetricNameLen is the maximum length of a metric consumer name.
+const maxMetricNameLen = 64
+
 type consumer struct {
 	fn          func(context.Context, fate.Fate, *Event) error
 	name        string
+	metricName  string // Metric label overriding name, see WithMetricConsumerName.
+	metricErr   error  // Invalid metricName error returned by Run.
 	lagAlert    time.Duration
 	activityTTL time.Duration
 
@@ -21,13 +29,26 @@ type consumer struct {
 	lagAlertGauge prometheus.Gauge
 	errorCounter  prometheus.Counter
 	latencyHist   prometheus.Observer
+	recvHist      prometheus.Observer
+	processedTime prometheus.Gauge
 	activityKey   string
+
+	minStart Cursor
+
+	tracer Tracer // Traces handler invocations if not nil.
+
+	idleLagPeriod time.Duration
+	idleMu        sync.Mutex
+	lastEventTime time.Time
+	lastConsumed  time.Time
 }
 
 type ConsumerOption func(*consumer)
 
 // WithConsumerLagAlert provides an option to set the consumer lag alert
-// threshold.
+// threshold. The lag alert gauge is set to 1 when the lag of a consumed
+// event exceeds the threshold and to 0 otherwise. It defaults to 30 minutes,
+// a zero or negative threshold disables the alert (always 0).
 func WithConsumerLagAlert(d time.Duration) ConsumerOption {
 	return func(c *consumer) {
 		c.lagAlert = d
@@ -65,27 +86,75 @@ func WithoutConsumerActivityTTL() ConsumerOption {
 	}
 }
 
+// WithConsumerIdleLagUpdate provides an option to update the consumer lag metric
+// every period while no events are consumed. The lag is set to zero while the
+// stream is idle at its head and to the duration since the last consumed
+// event's timestamp while it is behind, so it keeps growing if the stream stops
+// delivering events. This requires a stream that reports whether it is at its
+// head, ex. rsql streams, otherwise the lag is only set to zero when the stream
+// returns ErrHeadReached. The lag alert gauge is only updated when events are
+// consumed. The lag is only updated while the consumer is executed by Run.
+func WithConsumerIdleLagUpdate(period time.Duration) ConsumerOption {
+	return func(c *consumer) {
+		c.idleLagPeriod = period
+	}
+}
+
+// WithMinStartCursor provides an option to refuse to run the consumer
+// if its stored cursor is before the provided minimum cursor. Runs return
+// ErrCursorBelowMin before streaming any events. This guards against
+// replaying the whole stream due to a misconfigured or missing cursor.
+func WithMinStartCursor(cursor string) ConsumerOption {
+	return func(c *consumer) {
+		c.minStart = ParseCursor(cursor)
+	}
+}
+
+// WithMetricConsumerName provides an option to set the consumer_name label of
+// the consumer metrics instead of the consumer name, ex. to share one metric
+// series between consumers with per-pod name suffixes. The label must start
+// with a lowercase letter and only contain lowercase letters, digits and
+// underscores (at most 64 characters), otherwise the consumer name is used
+// as label and Run returns ErrInvalidMetricName.
+func WithMetricConsumerName(name string) ConsumerOption {
+	return func(c *consumer) {
+		c.metricName = name
+	}
+}
+
 // NewConsumer returns a new instrumented consumer of events.
 func NewConsumer(name string, fn func(context.Context, fate.Fate, *Event) error,
 	opts ...ConsumerOption) Consumer {
 
-	labels := prometheus.Labels{consumerLabel: name}
-
 	c := &consumer{
-		fn:            fn,
-		name:          name,
-		lagAlert:      defaultLagAlert,
-		activityTTL:   defaultActivityTTL,
-		lagGauge:      consumerLag.With(labels),
-		lagAlertGauge: consumerLagAlert.With(labels),
-		errorCounter:  consumerErrors.With(labels),
-		latencyHist:   consumerLatency.With(labels),
+		fn:          fn,
+		name:        name,
+		lagAlert:    defaultLagAlert,
+		activityTTL: defaultActivityTTL,
 	}
 
 	for _, o := range opts {
 		o(c)
 	}
 
+	labelName := name
+	if c.metricName != "" && !validMetricName(c.metricName) {
+		c.metricErr = errors.Wrap(ErrInvalidMetricName, "check metric name",
+			j.MKV{"consumer": name, "metric_name": c.metricName})
+	} else if c.metricName != "" {
+		labelName = c.metricName
+	}
+	labels := prometheus.Labels{consumerLabel: labelName}
+
+	c.lagGauge = consumerLag.With(labels)
+	c.errorCounter = consumerErrors.With(labels)
+	c.latencyHist = consumerLatency.With(labels)
+	c.recvHist = consumerRecv.With(labels)
+	c.processedTime = consumerLastProcessed.With(labels)
+	if c.lagAlertGauge == nil {
+		c.lagAlertGauge = consumerLagAlert.With(labels)
+	}
+
 	c.activityKey = consumerActivityGauge.Register(labels, c.activityTTL)
 
 	return c
@@ -95,6 +164,46 @@ func (c *consumer) Name() string {
 	return c.name
 }
 
+// checkStart returns ErrCursorBelowMin if the cursor is before the
+// minimum start cursor or ErrInvalidMetricName if the metric consumer
+// name is invalid. It implements the startChecker interface.
+func (c *consumer) checkStart(cursor string) error {
+	if c.metricErr != nil {
+		return c.metricErr
+	}
+
+	if ParseCursor(cursor).Before(c.minStart) {
+		return errors.Wrap(ErrCursorBelowMin, "check start cursor",
+			j.MKV{"consumer": c.name, "cursor": cursor, "min": c.minStart.String()})
+	}
+	return nil
+}
+
+// validMetricName returns true if the name is a low-cardinality friendly
+// metric label, see WithMetricConsumerName.
+func validMetricName(name string) bool {
+	if name == "" || len(name) > maxMetricNameLen {
+		return false
+	} else if name[0] < 'a' || name[0] > 'z' {
+		return false
+	}
+
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// observeRecv records the time spent receiving an event from the stream,
+// as opposed to the handler time recorded by Consume. It implements the
+// recvObserver interface.
+func (c *consumer) observeRecv(d time.Duration) {
+	c.recvHist.Observe(d.Seconds())
+}
+
 func (c *consumer) Consume(ctx context.Context, fate fate.Fate,
 	event *Event) error {
 	t0 := time.Now()
@@ -104,15 +213,21 @@ func (c *consumer) Consume(ctx context.Context, fate fate.Fate,
 	lag := t0.Sub(event.Timestamp)
 	c.lagGauge.Set(lag.Seconds())
 
+	if c.idleLagPeriod > 0 {
+		c.trackIdleLag(t0, event.Timestamp)
+	}
+
 	alert := 0.0
 	if lag > c.lagAlert && c.lagAlert > 0 {
 		alert = 1
 	}
 	c.lagAlertGauge.Set(alert)
 
-	err := c.fn(ctx, fate, event)
+	err := c.handle(ctx, fate, event)
 	if err != nil {
 		c.errorCounter.Inc()
+	} else {
+		c.processedTime.SetToCurrentTime()
 	}
 
 	latency := time.Since(t0)
@@ -120,3 +235,73 @@ func (c *consumer) Consume(ctx context.Context, fate fate.Fate,
 
 	return err
 }
+
+// trackIdleLag records the consumed event for the idle lag updater.
+func (c *consumer) trackIdleLag(now, eventTime time.Time) {
+	c.idleMu.Lock()
+	defer c.idleMu.Unlock()
+
+	c.lastEventTime = eventTime
+	c.lastConsumed = now
+}
+
+// handle calls the handler function in a span if a tracer is configured.
+func (c *consumer) handle(ctx context.Context, fate fate.Fate, event *Event) error {
+	if c.tracer == nil {
+		return c.fn(ctx, fate, event)
+	}
+
+	attrs := map[string]string{
+		SpanAttrConsumer: c.name,
+		SpanAttrEventID:  event.ID,
+	}
+	if event.Type != nil {
+		attrs[SpanAttrEventType] = EventTypeName(event.Type)
+	}
+
+	ctx, span := c.tracer.Start(ctx, "reflex.consume", attrs)
+	err := c.fn(ctx, fate, event)
+	span.End(err)
+
+	return err
+}
+
+// updateIdleLag updates the lag metric every period while idle
+// until the context is cancelled, see WithConsumerIdleLagUpdate. It
+// implements the idleLagUpdater interface and is started by Run for
+// the duration of each run with the stream's head reporter if any.
+func (c *consumer) updateIdleLag(ctx context.Context, head headReporter) {
+	if c.idleLagPeriod <= 0 || head == nil {
+		return
+	}
+
+	t := time.NewTicker(c.idleLagPeriod)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		c.idleMu.Lock()
+		idle := time.Since(c.lastConsumed) >= c.idleLagPeriod
+		if idle && head.AtHead() {
+			c.lagGauge.Set(0)
+		} else if idle && !c.lastConsumed.IsZero() {
+			// Behind, so the lag grows until events are consumed.
+			c.lagGauge.Set(time.Since(c.lastEventTime).Seconds())
+		}
+		c.idleMu.Unlock()
+	}
+}
+
+// headReached sets the lag metric to zero if configured to update it while
+// idle, since the stream reached its head. It implements the idleLagUpdater
+// interface.
+func (c *consumer) headReached() {
+	if c.idleLagPeriod > 0 {
+		c.lagGauge.Set(0)
+	}
+}
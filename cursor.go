@@ -0,0 +1,129 @@
+package reflex
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+)
+
+// CursorKind identifies the kind of stream source a cursor belongs to.
+type CursorKind int
+
+const (
+	// CursorKindUnknown is the kind of empty or unrecognised cursors.
+	CursorKindUnknown CursorKind = 0
+
+	// CursorKindInt is the kind of int64 (or uint64) event ID cursors, ex. rsql.
+	CursorKindInt CursorKind = 1
+
+	// CursorKindBlob is the kind of "key|offset" and compact cursors, ex. rblob.
+	CursorKindBlob CursorKind = 2
+)
+
+// CompactBlobCursorPrefix is the prefix of compact blob cursors
+// (see rblob.WithCompactCursors) which identifies them as CursorKindBlob.
+const CompactBlobCursorPrefix = "rblob~"
+
+func (k CursorKind) String() string {
+	switch k {
+	case CursorKindInt:
+		return "int"
+	case CursorKindBlob:
+		return "blob"
+	default:
+		return "unknown"
+	}
+}
+
+// Cursor is a typed stream cursor. Cursors are persisted and passed
+// to stream functions as strings, see String and ParseCursor.
+type Cursor struct {
+	kind  CursorKind
+	value string
+}
+
+// ParseCursor returns the typed cursor of the string. The kind is
+// determined by the format of the string.
+func ParseCursor(s string) Cursor {
+	kind := CursorKindUnknown
+	if strings.Contains(s, "|") || strings.HasPrefix(s, CompactBlobCursorPrefix) {
+		kind = CursorKindBlob
+	} else if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		kind = CursorKindInt
+	} else if _, err := strconv.ParseUint(s, 10, 64); err == nil {
+		kind = CursorKindInt
+	}
+
+	return Cursor{kind: kind, value: s}
+}
+
+// IntCursor returns an int cursor for the event ID.
+func IntCursor(id int64) Cursor {
+	return Cursor{kind: CursorKindInt, value: strconv.FormatInt(id, 10)}
+}
+
+// Kind returns the kind of the cursor.
+func (c Cursor) Kind() CursorKind {
+	return c.kind
+}
+
+// IsZero returns true if the cursor is empty, ie. the start of a stream.
+func (c Cursor) IsZero() bool {
+	return c.value == ""
+}
+
+// String returns the cursor as a string which can be persisted or
+// provided as the after parameter of a StreamFunc.
+func (c Cursor) String() string {
+	return c.value
+}
+
+// Int returns the event ID of an int cursor. It returns ErrCursorKind
+// if the cursor is of another known kind.
+func (c Cursor) Int() (int64, error) {
+	if c.kind != CursorKindInt && c.kind != CursorKindUnknown {
+		return 0, errors.Wrap(ErrCursorKind, "int cursor",
+			j.MKV{"expected": CursorKindInt.String(), "actual": c.kind.String()})
+	}
+
+	return strconv.ParseInt(c.value, 10, 64)
+}
+
+// Uint returns the event ID of an int cursor as an uint64, which supports
+// IDs of unsigned columns that exceed math.MaxInt64. It returns ErrCursorKind
+// if the cursor is of another known kind.
+func (c Cursor) Uint() (uint64, error) {
+	if c.kind != CursorKindInt && c.kind != CursorKindUnknown {
+		return 0, errors.Wrap(ErrCursorKind, "uint cursor",
+			j.MKV{"expected": CursorKindInt.String(), "actual": c.kind.String()})
+	}
+
+	return strconv.ParseUint(c.value, 10, 64)
+}
+
+// Before returns true if c is before o in the stream. Int cursors are
+// compared numerically, other cursors lexicographically, so a zero cursor
+// is before any non-zero cursor.
+func (c Cursor) Before(o Cursor) bool {
+	if c.kind == CursorKindInt && o.kind == CursorKindInt {
+		ci, cerr := strconv.ParseInt(c.value, 10, 64)
+		oi, oerr := strconv.ParseInt(o.value, 10, 64)
+		if cerr == nil && oerr == nil {
+			return ci < oi
+		}
+
+		// At least one exceeds math.MaxInt64, so both are unsigned.
+		cu, _ := strconv.ParseUint(c.value, 10, 64)
+		ou, _ := strconv.ParseUint(o.value, 10, 64)
+		return cu < ou
+	}
+
+	return c.value < o.value
+}
+
+// Cursor returns the typed cursor of the event.
+func (e *Event) Cursor() Cursor {
+	return ParseCursor(e.ID)
+}
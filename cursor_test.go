@@ -0,0 +1,87 @@
+package reflex_test
+
+import (
+	"testing"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCursor(t *testing.T) {
+	cases := []struct {
+		cursor string
+		kind   reflex.CursorKind
+	}{
+		{cursor: "", kind: reflex.CursorKindUnknown},
+		{cursor: "abc", kind: reflex.CursorKindUnknown},
+		{cursor: "123", kind: reflex.CursorKindInt},
+		{cursor: "-1", kind: reflex.CursorKindInt},
+		{cursor: "18446744073709551615", kind: reflex.CursorKindInt},
+		{cursor: "path/to/file|01|9", kind: reflex.CursorKindBlob},
+		{cursor: "path/to/file|eof", kind: reflex.CursorKindBlob},
+		{cursor: reflex.CompactBlobCursorPrefix + "Kkks", kind: reflex.CursorKindBlob},
+	}
+
+	for _, test := range cases {
+		t.Run(test.cursor, func(t *testing.T) {
+			c := reflex.ParseCursor(test.cursor)
+			require.Equal(t, test.kind, c.Kind())
+			require.Equal(t, test.cursor, c.String())
+			require.Equal(t, test.cursor == "", c.IsZero())
+		})
+	}
+}
+
+func TestCursorInt(t *testing.T) {
+	i, err := reflex.IntCursor(123).Int()
+	jtest.RequireNil(t, err)
+	require.Equal(t, int64(123), i)
+
+	_, err = reflex.ParseCursor("file|01|9").Int()
+	jtest.Require(t, reflex.ErrCursorKind, err)
+
+	_, err = reflex.ParseCursor("abc").Int()
+	require.Error(t, err)
+	require.False(t, errors.Is(err, reflex.ErrCursorKind))
+
+	e := &reflex.Event{ID: "5"}
+	require.Equal(t, reflex.IntCursor(5), e.Cursor())
+
+	u, err := reflex.ParseCursor("9223372036854775808").Uint()
+	jtest.RequireNil(t, err)
+	require.Equal(t, uint64(1)<<63, u)
+
+	_, err = reflex.ParseCursor("file|01|9").Uint()
+	jtest.Require(t, reflex.ErrCursorKind, err)
+
+	_, err = reflex.ParseCursor(reflex.CompactBlobCursorPrefix + "Kkks").Int()
+	jtest.Require(t, reflex.ErrCursorKind, err)
+
+	e = &reflex.Event{ID: "9223372036854775808"}
+	require.Equal(t, uint64(1)<<63, e.IDUint())
+}
+
+func TestCursorBefore(t *testing.T) {
+	cases := []struct {
+		c, o   string
+		before bool
+	}{
+		{c: "", o: "", before: false},
+		{c: "", o: "1", before: true},
+		{c: "9", o: "10", before: true},
+		{c: "10", o: "9", before: false},
+		{c: "10", o: "10", before: false},
+		{c: "9223372036854775807", o: "9223372036854775808", before: true},
+		{c: "18446744073709551615", o: "9", before: false},
+		{c: "a|01|9", o: "a|02|10", before: true},
+		{c: "a|eof", o: "b|01|0", before: true},
+		{c: "b|01|0", o: "a|eof", before: false},
+	}
+
+	for _, test := range cases {
+		c, o := reflex.ParseCursor(test.c), reflex.ParseCursor(test.o)
+		require.Equal(t, test.before, c.Before(o), "%q before %q", test.c, test.o)
+	}
+}
@@ -11,6 +11,22 @@ import (
 var (
 	ErrStopped     = errors.New("the event stream has been stopped", j.C("ERR_09290f5944cb8671"))
 	ErrHeadReached = errors.New("the event stream has reached the current head", j.C("ERR_b4b155d2a91cfcd0"))
+
+	// ErrLimitReached is returned by streams configured with
+	// WithStreamLimit after the limit of events has been streamed.
+	ErrLimitReached = errors.New("the event stream has reached the limit", j.C("ERR_e07a1d46c35b9f82"))
+
+	// ErrCursorKind is returned when a cursor of one kind is provided to
+	// a stream expecting another kind, ex. an rblob cursor to an rsql stream.
+	ErrCursorKind = errors.New("cursor of unexpected kind", j.C("ERR_22f2f34c648902e9"))
+
+	// ErrCursorBelowMin is returned when a consumer configured with
+	// WithMinStartCursor is run from a stored cursor before the minimum.
+	ErrCursorBelowMin = errors.New("stored cursor before minimum start cursor", j.C("ERR_5b0e3c8d71a4f926"))
+
+	// ErrInvalidMetricName is returned when a consumer configured with
+	// WithMetricConsumerName is run with an invalid metric label.
+	ErrInvalidMetricName = errors.New("invalid metric consumer name", j.C("ERR_f19de0bacfd89eea"))
 )
 
 func IsStoppedErr(err error) bool {
@@ -20,3 +36,7 @@ func IsStoppedErr(err error) bool {
 func IsHeadReachedErr(err error) bool {
 	return errors.Is(err, ErrHeadReached)
 }
+
+func IsLimitReachedErr(err error) bool {
+	return errors.Is(err, ErrLimitReached)
+}
@@ -0,0 +1,47 @@
+//go:build go1.23
+// +build go1.23
+
+package reflex
+
+import (
+	"context"
+	"io"
+	"iter"
+)
+
+// Events returns an iterator over the events received from the stream
+// client, ex:
+//
+//	for e, err := range reflex.Events(ctx, sc) {
+//	  if err != nil {
+//	    return err
+//	  }
+//	  ...
+//	}
+//
+// Iteration ends without an error when the stream reaches its terminus
+// (see WithStreamToHead and WithStreamLimit) or when ctx is cancelled.
+// Other errors are yielded once after which iteration ends. If the stream
+// client implements io.Closer, it is closed when iteration ends, including
+// on break, so the iterator can only be used once.
+func Events(ctx context.Context, sc StreamClient) iter.Seq2[*Event, error] {
+	return func(yield func(*Event, error) bool) {
+		if closer, ok := sc.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		for {
+			e, err := sc.Recv()
+			if ctx.Err() != nil || IsHeadReachedErr(err) || IsLimitReachedErr(err) {
+				return
+			} else if err != nil {
+				yield(nil, err)
+				return
+			}
+
+			if !yield(e, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//go:build go1.23
+// +build go1.23
+
+package reflex_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex"
+	"github.com/luno/reflex/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func makeIterEvents(n int) []*reflex.Event {
+	var res []*reflex.Event
+	for i := 1; i <= n; i++ {
+		res = append(res, &reflex.Event{ID: strconv.Itoa(i), Timestamp: time.Now()})
+	}
+	return res
+}
+
+// closeStream wraps a stream client and records whether it was closed.
+type closeStream struct {
+	reflex.StreamClient
+	closed bool
+}
+
+func (s *closeStream) Close() error {
+	s.closed = true
+	return nil
+}
+
+// errStream returns the error after the events.
+type errStream struct {
+	events []*reflex.Event
+	err    error
+}
+
+func (s *errStream) Recv() (*reflex.Event, error) {
+	if len(s.events) == 0 {
+		return nil, s.err
+	}
+	e := s.events[0]
+	s.events = s.events[1:]
+	return e, nil
+}
+
+func TestEventsIter(t *testing.T) {
+	ctx := context.Background()
+	stream := mock.NewStream(makeIterEvents(5))
+
+	// Runs to the head terminus without an error.
+	sc, err := stream(ctx, "", reflex.WithStreamToHead())
+	jtest.RequireNil(t, err)
+
+	var ids []string
+	for e, err := range reflex.Events(ctx, sc) {
+		jtest.RequireNil(t, err)
+		ids = append(ids, e.ID)
+	}
+	require.Equal(t, []string{"1", "2", "3", "4", "5"}, ids)
+
+	// Breaking early closes the stream.
+	sc, err = stream(ctx, "")
+	jtest.RequireNil(t, err)
+	cs := &closeStream{StreamClient: sc}
+
+	ids = nil
+	for e, err := range reflex.Events(ctx, cs) {
+		jtest.RequireNil(t, err)
+		ids = append(ids, e.ID)
+		if len(ids) == 2 {
+			break
+		}
+	}
+	require.Equal(t, []string{"1", "2"}, ids)
+	require.True(t, cs.closed)
+
+	// Runs to the limit terminus without an error.
+	ids = nil
+	es := &errStream{events: makeIterEvents(1), err: reflex.ErrLimitReached}
+	for e, err := range reflex.Events(ctx, es) {
+		jtest.RequireNil(t, err)
+		ids = append(ids, e.ID)
+	}
+	require.Equal(t, []string{"1"}, ids)
+}
+
+func TestEventsIterError(t *testing.T) {
+	errFoo := errors.New("foo")
+	sc := &errStream{events: makeIterEvents(2), err: errFoo}
+
+	var (
+		ids  []string
+		errs []error
+	)
+	for e, err := range reflex.Events(context.Background(), sc) {
+		if err != nil {
+			require.Nil(t, e)
+			errs = append(errs, err)
+			continue
+		}
+		ids = append(ids, e.ID)
+	}
+	require.Equal(t, []string{"1", "2"}, ids)
+	require.Len(t, errs, 1)
+	jtest.Require(t, errFoo, errs[0])
+}
+
+func TestEventsIterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sc, err := mock.NewStream(makeIterEvents(3), mock.WithBlockAtHead())(ctx, "")
+	jtest.RequireNil(t, err)
+
+	var ids []string
+	for e, err := range reflex.Events(ctx, sc) {
+		jtest.RequireNil(t, err)
+		ids = append(ids, e.ID)
+		if len(ids) == 3 {
+			// Cancel while blocked at head.
+			time.AfterFunc(time.Millisecond*10, cancel)
+		}
+	}
+	require.Equal(t, []string{"1", "2", "3"}, ids)
+}
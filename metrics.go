@@ -42,20 +42,37 @@ var (
 		Buckets:   []float64{0.001, 0.01, 0.1, 1.0, 2.0, 5.0, 10.0, 30.0, 60.0, 120.0, 300.0},
 	}, []string{consumerLabel})
 
+	consumerRecv = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "reflex",
+		Subsystem: "consumer",
+		Name:      "recv_seconds",
+		Help:      "Time spent waiting for the next event from the stream in seconds",
+		Buckets:   []float64{0.001, 0.01, 0.1, 1.0, 2.0, 5.0, 10.0, 30.0, 60.0, 120.0, 300.0},
+	}, []string{consumerLabel})
+
 	consumerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "reflex",
 		Subsystem: "consumer",
 		Name:      "error_count",
 		Help:      "Number of errors processing events",
 	}, []string{consumerLabel})
+
+	consumerLastProcessed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "reflex",
+		Subsystem: "consumer",
+		Name:      "last_processed_timestamp_seconds",
+		Help:      "Unix time the consumer last successfully processed an event",
+	}, []string{consumerLabel})
 )
 
 func init() {
 	prometheus.MustRegister(consumerLagAlert)
 	prometheus.MustRegister(consumerLag)
 	prometheus.MustRegister(consumerLatency)
+	prometheus.MustRegister(consumerRecv)
 	prometheus.MustRegister(consumerErrors)
 	prometheus.MustRegister(consumerActivityGauge)
+	prometheus.MustRegister(consumerLastProcessed)
 }
 
 func newActivityGauge(g *prometheus.GaugeVec) *activityGauge {
@@ -1,10 +1,17 @@
 package reflex
 
 import (
+	"context"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/luno/fate"
+	"github.com/luno/jettison/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 )
@@ -49,3 +56,294 @@ func TestActivityGauge(t *testing.T) {
 	g.Collect(ch)
 	assertMetric(ch)
 }
+
+func TestLastProcessedGauge(t *testing.T) {
+	var fail bool
+	c := NewConsumer("last_processed", func(context.Context, fate.Fate, *Event) error {
+		if fail {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	g := consumerLastProcessed.WithLabelValues("last_processed")
+	g.Set(0)
+
+	var prev float64
+	for i := 0; i < 3; i++ {
+		t0 := time.Now()
+		err := c.Consume(context.Background(), fate.New(), &Event{Timestamp: t0})
+		require.NoError(t, err)
+
+		ts := testutil.ToFloat64(g)
+		require.True(t, ts > prev)
+		require.InDelta(t, float64(t0.UnixNano())/1e9, ts, 1)
+		prev = ts
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// Not updated on error.
+	fail = true
+	err := c.Consume(context.Background(), fate.New(), &Event{Timestamp: time.Now()})
+	require.Error(t, err)
+	require.Equal(t, prev, testutil.ToFloat64(g))
+}
+
+func TestIdleLagUpdate(t *testing.T) {
+	c := NewConsumer("idle_lag", func(context.Context, fate.Fate, *Event) error {
+		return nil
+	}, WithConsumerIdleLagUpdate(time.Millisecond*5))
+
+	g := consumerLag.WithLabelValues("idle_lag")
+
+	// Consuming outside of Run doesn't start updaters.
+	n := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		err := c.Consume(ctx, fate.New(), &Event{Timestamp: time.Now()})
+		require.NoError(t, err)
+		cancel()
+	}
+	require.True(t, runtime.NumGoroutine() <= n)
+
+	run := func(atHead bool) (context.CancelFunc, chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream := func(ctx context.Context, after string, opts ...StreamOption) (StreamClient, error) {
+			return &blockStream{
+				ctx:    ctx,
+				events: []*Event{{Timestamp: time.Now().Add(-time.Minute)}},
+				atHead: atHead,
+			}, nil
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- Run(ctx, NewSpec(stream, nopCStore{}, c))
+		}()
+		return cancel, done
+	}
+
+	// Lag increases while idle behind.
+	cancel, done := run(false)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(g) >= 60.05
+	}, time.Second, time.Millisecond)
+
+	// Updates stop when the run ends.
+	cancel()
+	<-done
+	time.Sleep(time.Millisecond * 20)
+	lag := testutil.ToFloat64(g)
+	time.Sleep(time.Millisecond * 20)
+	require.Equal(t, lag, testutil.ToFloat64(g))
+
+	// Lag decays to zero while idle at head.
+	cancel, done = run(true)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(g) == 0
+	}, time.Second, time.Millisecond)
+	time.Sleep(time.Millisecond * 20)
+	require.Zero(t, testutil.ToFloat64(g))
+	cancel()
+	<-done
+
+	// Lag is zero when the stream returns ErrHeadReached.
+	require.NoError(t, c.Consume(context.Background(), fate.New(), &Event{Timestamp: time.Now().Add(-time.Minute)}))
+	require.True(t, testutil.ToFloat64(g) >= 60)
+	stream := func(ctx context.Context, after string, opts ...StreamOption) (StreamClient, error) {
+		return &headStream{}, nil
+	}
+	err := Run(context.Background(), NewSpec(stream, nopCStore{}, c))
+	require.True(t, IsHeadReachedErr(err))
+	require.Zero(t, testutil.ToFloat64(g))
+}
+
+// headStream is a StreamClient that always returns ErrHeadReached.
+type headStream struct{}
+
+func (s *headStream) Recv() (*Event, error) {
+	return nil, ErrHeadReached
+}
+
+// blockStream is a StreamClient that returns the events and then
+// blocks until the context is cancelled. It reports whether it is
+// at head.
+type blockStream struct {
+	ctx    context.Context
+	events []*Event
+	atHead bool
+}
+
+func (s *blockStream) AtHead() bool {
+	return s.atHead
+}
+
+func (s *blockStream) Recv() (*Event, error) {
+	if len(s.events) > 0 {
+		e := s.events[0]
+		s.events = s.events[1:]
+		return e, nil
+	}
+
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func TestLagAlertGauge(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Opts      []ConsumerOption
+		Lags      []time.Duration
+		ExpAlerts []float64
+	}{
+		{
+			Name:      "threshold",
+			Opts:      []ConsumerOption{WithConsumerLagAlert(time.Minute)},
+			Lags:      []time.Duration{time.Second, time.Hour, time.Second},
+			ExpAlerts: []float64{0, 1, 0},
+		}, {
+			Name:      "default",
+			Lags:      []time.Duration{time.Minute, time.Hour, time.Minute},
+			ExpAlerts: []float64{0, 1, 0},
+		}, {
+			Name:      "disabled",
+			Opts:      []ConsumerOption{WithoutConsumerLag()},
+			Lags:      []time.Duration{time.Minute, time.Hour, time.Minute},
+			ExpAlerts: []float64{0, 0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "lag_alert"})
+			opts := append(test.Opts, WithConsumerLagAlertGauge(g))
+			c := NewConsumer("lag_alert_"+test.Name, func(context.Context, fate.Fate, *Event) error {
+				return nil
+			}, opts...)
+
+			for i, lag := range test.Lags {
+				e := &Event{Timestamp: time.Now().Add(-lag)}
+				err := c.Consume(context.Background(), fate.New(), e)
+				require.NoError(t, err)
+				require.Equal(t, test.ExpAlerts[i], testutil.ToFloat64(g))
+			}
+		})
+	}
+}
+
+func TestRecvHistogram(t *testing.T) {
+	const name = "recv_hist"
+	errEnd := errors.New("end")
+
+	stream := func(ctx context.Context, after string, opts ...StreamOption) (StreamClient, error) {
+		return &sleepStream{n: 3, sleep: time.Millisecond * 10, end: errEnd}, nil
+	}
+	c := NewConsumer(name, func(context.Context, fate.Fate, *Event) error {
+		return nil
+	})
+
+	err := Run(context.Background(), NewSpec(stream, nopCStore{}, c))
+	require.True(t, errors.Is(err, errEnd))
+
+	sample := func(hv *prometheus.HistogramVec) *dto.Histogram {
+		var m dto.Metric
+		require.NoError(t, hv.WithLabelValues(name).(prometheus.Histogram).Write(&m))
+		return m.Histogram
+	}
+
+	recv := sample(consumerRecv)
+	require.Equal(t, uint64(3), recv.GetSampleCount())
+	require.True(t, recv.GetSampleSum() >= 0.03)
+	require.Equal(t, uint64(3), sample(consumerLatency).GetSampleCount())
+}
+
+// sleepStream is a StreamClient that sleeps before returning each of n
+// events and then returns the end error.
+type sleepStream struct {
+	n     int
+	sleep time.Duration
+	end   error
+}
+
+func (s *sleepStream) Recv() (*Event, error) {
+	if s.n == 0 {
+		return nil, s.end
+	}
+	s.n--
+	time.Sleep(s.sleep)
+	return &Event{ID: strconv.Itoa(s.n), Timestamp: time.Now()}, nil
+}
+
+type nopCStore struct{}
+
+func (nopCStore) GetCursor(context.Context, string) (string, error) { return "", nil }
+func (nopCStore) SetCursor(context.Context, string, string) error   { return nil }
+func (nopCStore) Flush(context.Context) error                       { return nil }
+
+func TestMetricConsumerName(t *testing.T) {
+	const label = "metric_pod"
+	names := []string{"metric_pod_7f9c2", "metric_pod_a41e8"}
+
+	var m dto.Metric
+	require.NoError(t, consumerLatency.WithLabelValues(label).(prometheus.Histogram).Write(&m))
+	baseline := m.Histogram.GetSampleCount()
+
+	for _, name := range names {
+		c := NewConsumer(name, func(context.Context, fate.Fate, *Event) error {
+			return nil
+		}, WithMetricConsumerName(label))
+		require.Equal(t, name, c.Name())
+
+		err := Run(context.Background(), NewSpec(func(ctx context.Context, after string,
+			opts ...StreamOption) (StreamClient, error) {
+			return &sleepStream{n: 1, end: errors.New("end")}, nil
+		}, nopCStore{}, c))
+		require.Error(t, err)
+		require.False(t, errors.Is(err, ErrInvalidMetricName))
+	}
+
+	// Both consumers share the label series.
+	require.NoError(t, consumerLatency.WithLabelValues(label).(prometheus.Histogram).Write(&m))
+	require.Equal(t, baseline+2, m.Histogram.GetSampleCount())
+
+	// No series with the full consumer names.
+	ch := make(chan prometheus.Metric, 100)
+	consumerLatency.Collect(ch)
+	close(ch)
+	for metric := range ch {
+		require.NoError(t, metric.Write(&m))
+		for _, lp := range m.Label {
+			require.NotContains(t, names, lp.GetValue())
+		}
+	}
+
+	// Invalid labels are rejected at run.
+	invalids := []string{"Metric", "metric-pod", "1metric", strings.Repeat("a", 65)}
+	for _, invalid := range invalids {
+		c := NewConsumer("invalid", func(context.Context, fate.Fate, *Event) error {
+			return nil
+		}, WithMetricConsumerName(invalid))
+
+		err := Run(context.Background(), NewSpec(func(ctx context.Context, after string,
+			opts ...StreamOption) (StreamClient, error) {
+			return &sleepStream{}, nil
+		}, nopCStore{}, c))
+		require.True(t, errors.Is(err, ErrInvalidMetricName), invalid)
+	}
+
+	// No series with the invalid labels.
+	for _, c := range []prometheus.Collector{consumerLag, consumerErrors,
+		consumerLatency, consumerRecv, consumerLastProcessed, consumerLagAlert,
+		consumerActivityGauge} {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		for metric := range ch {
+			require.NoError(t, metric.Write(&m))
+			for _, lp := range m.Label {
+				require.NotContains(t, invalids, lp.GetValue())
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package mock
+
+import (
+	"context"
+	"time"
+
+	"github.com/luno/reflex"
+)
+
+// StreamOption configures a mock stream, see NewStream.
+type StreamOption func(*stream)
+
+// WithBlockAtHead provides an option for mock streams to block at the end of
+// the events until the context is cancelled, like a live stream at head,
+// instead of returning reflex.ErrHeadReached. Streams with the
+// reflex.WithStreamToHead option always return reflex.ErrHeadReached.
+func WithBlockAtHead() StreamOption {
+	return func(s *stream) {
+		s.block = true
+	}
+}
+
+// NewStream returns a reflex.StreamFunc that streams the provided in-memory
+// events deterministically without a database or backoff. The events must
+// be ordered by ID. It supports the after cursor and the reflex.StreamFromHead,
+// StreamToHead and Lag stream options. By default it returns
+// reflex.ErrHeadReached after the last event, see WithBlockAtHead.
+//
+// Events within the lag period are only streamed once they are older than
+// the lag; until then the stream is at head.
+func NewStream(events []*reflex.Event, opts ...StreamOption) reflex.StreamFunc {
+	return func(ctx context.Context, after string,
+		sopts ...reflex.StreamOption) (reflex.StreamClient, error) {
+
+		s := &stream{ctx: ctx, events: events}
+		for _, opt := range opts {
+			opt(s)
+		}
+		for _, opt := range sopts {
+			opt(&s.StreamOptions)
+		}
+
+		if s.StreamFromHead {
+			s.events = nil
+		} else if after != "" {
+			cursor := reflex.ParseCursor(after)
+			for len(s.events) > 0 && !cursor.Before(s.events[0].Cursor()) {
+				s.events = s.events[1:]
+			}
+		}
+
+		return s, nil
+	}
+}
+
+type stream struct {
+	reflex.StreamOptions
+
+	ctx    context.Context
+	events []*reflex.Event
+	block  bool
+}
+
+func (s *stream) Recv() (*reflex.Event, error) {
+	for {
+		if err := s.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var wait <-chan time.Time
+		if len(s.events) > 0 {
+			e := s.events[0]
+			delay := s.Lag - time.Since(e.Timestamp)
+			if s.Lag <= 0 || delay <= 0 {
+				s.events = s.events[1:]
+				return e, nil
+			}
+			wait = time.After(delay)
+		}
+
+		if s.StreamToHead || !s.block {
+			return nil, reflex.ErrHeadReached
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return nil, s.ctx.Err()
+		case <-wait:
+		}
+	}
+}
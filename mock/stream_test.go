@@ -0,0 +1,108 @@
+package mock_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/luno/reflex"
+	"github.com/luno/reflex/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream(t *testing.T) {
+	t0 := time.Now()
+	events := func() []*reflex.Event {
+		var res []*reflex.Event
+		for i := 1; i <= 5; i++ {
+			res = append(res, &reflex.Event{
+				ID:        strconv.Itoa(i),
+				Timestamp: t0.Add(-time.Hour * time.Duration(5-i)),
+			})
+		}
+		return res
+	}
+
+	tests := []struct {
+		Name   string
+		After  string
+		Opts   []reflex.StreamOption
+		Expect []string
+	}{
+		{
+			Name:   "all",
+			Expect: []string{"1", "2", "3", "4", "5"},
+		}, {
+			Name:   "after",
+			After:  "3",
+			Expect: []string{"4", "5"},
+		}, {
+			Name:  "from head",
+			After: "3",
+			Opts:  []reflex.StreamOption{reflex.WithStreamFromHead()},
+		}, {
+			Name:   "to head",
+			Opts:   []reflex.StreamOption{reflex.WithStreamToHead()},
+			Expect: []string{"1", "2", "3", "4", "5"},
+		}, {
+			Name:   "lag",
+			Opts:   []reflex.StreamOption{reflex.WithStreamLag(time.Minute * 90)},
+			Expect: []string{"1", "2", "3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			sc, err := mock.NewStream(events())(context.Background(), test.After, test.Opts...)
+			require.NoError(t, err)
+
+			for _, id := range test.Expect {
+				e, err := sc.Recv()
+				require.NoError(t, err)
+				require.Equal(t, id, e.ID)
+			}
+
+			_, err = sc.Recv()
+			require.True(t, reflex.IsHeadReachedErr(err))
+		})
+	}
+}
+
+func TestStreamBlockAtHead(t *testing.T) {
+	events := []*reflex.Event{
+		{ID: "1", Timestamp: time.Now().Add(-time.Hour)},
+		{ID: "2", Timestamp: time.Now()},
+	}
+	stream := mock.NewStream(events, mock.WithBlockAtHead())
+
+	// Blocks until the lagged event is older than the lag.
+	sc, err := stream(context.Background(), "1", reflex.WithStreamLag(time.Millisecond*50))
+	require.NoError(t, err)
+
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "2", e.ID)
+	require.True(t, time.Since(events[1].Timestamp) >= time.Millisecond*50)
+
+	// Blocks at head until cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	sc, err = stream(ctx, "")
+	require.NoError(t, err)
+
+	for _, exp := range events {
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, exp.ID, e.ID)
+	}
+
+	_, err = sc.Recv()
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	// StreamToHead overrides blocking.
+	sc, err = stream(context.Background(), "2", reflex.WithStreamToHead())
+	require.NoError(t, err)
+	_, err = sc.Recv()
+	require.True(t, reflex.IsHeadReachedErr(err))
+}
@@ -17,6 +17,14 @@ type StreamOptions struct {
 	// StreamToHead defines that ErrHeadReached be returned as soon
 	// as no more events are available.
 	StreamToHead bool
+
+	// Limit defines that ErrLimitReached be returned after streaming
+	// this many events. Zero means no limit.
+	Limit int
+
+	// SkipMetadata defines that events for which it returns true are not
+	// returned, while the cursor still advances past them.
+	SkipMetadata func(metadata []byte) bool
 }
 
 // StreamOption defines a functional option that configures StreamOptions.
@@ -38,6 +46,26 @@ func WithStreamToHead() StreamOption {
 	}
 }
 
+// WithStreamLimit provides an option to return ErrLimitReached after n events
+// have been streamed, even if more events are available. Only events returned
+// by Recv are counted. This is useful for sampling streams.
+func WithStreamLimit(n int) StreamOption {
+	return func(sc *StreamOptions) {
+		sc.Limit = n
+	}
+}
+
+// WithSkipMetadataPredicate provides an option to skip events for which
+// skip returns true given the event metadata. Skipped events are not returned
+// (nor counted by WithStreamLimit) but the cursor still advances past them.
+// This is useful to avoid loops in bidirectional sync by skipping events
+// marked as originating from the consumer itself.
+func WithSkipMetadataPredicate(skip func(metadata []byte) bool) StreamOption {
+	return func(sc *StreamOptions) {
+		sc.SkipMetadata = skip
+	}
+}
+
 // WithStreamLag provides an option to stream events only after they are older than a duration.
 func WithStreamLag(d time.Duration) StreamOption {
 	return func(sc *StreamOptions) {
@@ -1,9 +1,13 @@
 package reflex
 
 import (
+	"context"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/ptypes"
+	"github.com/luno/reflex/reflexpb"
 	"github.com/stretchr/testify/require"
 )
 
@@ -45,6 +49,10 @@ func Test_optsToProto(t *testing.T) {
 			Output: StreamOptions{StreamToHead: true},
 			Count:  1,
 		},
+		{
+			Name:  "limit applied by client",
+			Input: []StreamOption{WithStreamLimit(5)},
+		},
 	}
 
 	for _, test := range tests {
@@ -67,3 +75,64 @@ func Test_optsToProto(t *testing.T) {
 	}
 
 }
+
+func TestWrapStreamPBLimit(t *testing.T) {
+	var req *reflexpb.StreamRequest
+	stream := WrapStreamPB(func(_ context.Context,
+		r *reflexpb.StreamRequest) (StreamClientPB, error) {
+		req = r
+		return &pbClient{}, nil
+	})
+
+	sc, err := stream(context.Background(), "", WithStreamLimit(2))
+	require.NoError(t, err)
+	require.Equal(t, &reflexpb.StreamOptions{}, req.Options)
+
+	for _, id := range []string{"1", "2"} {
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, id, e.ID)
+	}
+
+	_, err = sc.Recv()
+	require.True(t, IsLimitReachedErr(err))
+}
+
+func TestWrapStreamPBSkipMetadata(t *testing.T) {
+	stream := WrapStreamPB(func(_ context.Context,
+		r *reflexpb.StreamRequest) (StreamClientPB, error) {
+		return &pbClient{}, nil
+	})
+
+	skipEven := func(metadata []byte) bool {
+		n, _ := strconv.Atoi(string(metadata))
+		return n%2 == 0
+	}
+
+	sc, err := stream(context.Background(), "",
+		WithSkipMetadataPredicate(skipEven), WithStreamLimit(2))
+	require.NoError(t, err)
+
+	for _, id := range []string{"1", "3"} {
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, id, e.ID)
+	}
+
+	_, err = sc.Recv()
+	require.True(t, IsLimitReachedErr(err))
+}
+
+// pbClient is a StreamClientPB that returns events with incrementing ids.
+type pbClient struct {
+	n int
+}
+
+func (c *pbClient) Recv() (*reflexpb.Event, error) {
+	c.n++
+	return &reflexpb.Event{
+		Id:        strconv.Itoa(c.n),
+		Timestamp: ptypes.TimestampNow(),
+		Metadata:  []byte(strconv.Itoa(c.n)),
+	}, nil
+}
@@ -1,31 +1,52 @@
 package rblob
 
 import (
+	"bytes"
+	"compress/flate"
 	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
-	"path"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/luno/jettison/errors"
 	"github.com/luno/jettison/j"
 	"github.com/luno/jettison/log"
 	"github.com/luno/reflex"
 	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
 )
 
 // Decoder decodes a blob into event byte slices (usually DTOs) which
 // are streamed as event metadata.
 type Decoder interface {
-	// Decode returns the next non-empty byte slice or an error. It returns io.EOF if no more
-	// are available.
+	// Decode returns the next byte slice or an error. It returns io.EOF if no more
+	// are available. Nil byte slices are skipped by the stream as are empty
+	// byte slices unless WithKeepEmptyRecords is enabled.
 	Decode() ([]byte, error)
 }
 
+// OffsetDecoder is an optional interface implemented by decoders that can
+// report the byte offset in the blob after the last decoded value. Such
+// decoders must support decoding a blob from any reported offset.
+//
+// Byte offsets are stored in the cursors of events decoded by an
+// OffsetDecoder which allows resuming mid-blob using range reads if the
+// provider implements RangeProvider.
+type OffsetDecoder interface {
+	Decoder
+
+	// InputOffset returns the byte offset after the last decoded value
+	// relative to the start of the decoded reader.
+	InputOffset() int64
+}
+
 // WithBackoff returns an option to configure the backoff duration
 // before querying the underlying bucket for new blobs. It defaults
 // to one minute.
@@ -35,6 +56,25 @@ func WithBackoff(d time.Duration) Option {
 	}
 }
 
+// WithBucketRetry returns an option to retry transient bucket errors
+// when listing or reading blobs. Up to maxAttempts attempts are made,
+// waiting backoff between them. It defaults to no retries.
+func WithBucketRetry(maxAttempts int, backoff time.Duration) Option {
+	return func(b *Bucket) {
+		b.retryAttempts = maxAttempts
+		b.retryBackoff = backoff
+	}
+}
+
+// WithListPageSize returns an option to configure the maximum number of keys
+// requested per list page from s3 gocloud buckets (see NewBucket). It has no
+// effect on other drivers or providers. It defaults to the driver default.
+func WithListPageSize(n int) Option {
+	return func(b *Bucket) {
+		b.listPageSize = n
+	}
+}
+
 // WithDecoder returns an option to configure the blob content decoder
 // function. It defaults to the JSONDecoder.
 func WithDecoder(fn func(io.Reader) (Decoder, error)) Option {
@@ -43,6 +83,100 @@ func WithDecoder(fn func(io.Reader) (Decoder, error)) Option {
 	}
 }
 
+// WithDecoderSelector returns an option to configure a function that selects
+// the blob content decoder function by blob key. This allows streaming
+// buckets containing blobs of different formats. The default decoder
+// function (see WithDecoder) is used if the selector returns nil.
+func WithDecoderSelector(fn func(key string) (func(io.Reader) (Decoder, error), error)) Option {
+	return func(b *Bucket) {
+		b.decoderSelector = fn
+	}
+}
+
+// WithKeepEmptyRecords returns an option to configure whether empty
+// (zero-length but non-nil) records returned by the decoder are streamed
+// as events with empty metadata. Nil records are always skipped.
+// It defaults to false, skipping empty records.
+func WithKeepEmptyRecords(keep bool) Option {
+	return func(b *Bucket) {
+		b.keepEmpty = keep
+	}
+}
+
+// WithTimestampFromKey returns an option to configure a function that
+// derives the event timestamp from the blob key. It falls back to the
+// blob modification time if the function returns an error.
+// It defaults to the blob modification time.
+func WithTimestampFromKey(fn func(key string) (time.Time, error)) Option {
+	return func(b *Bucket) {
+		b.keyTimeFunc = fn
+	}
+}
+
+// WithEmitBlobBoundaries returns an option to emit a synthetic event at the end
+// of each blob (including empty blobs) before advancing to the next blob.
+// The event has the BlobCompletedType type and the completed blob key
+// as foreign ID.
+func WithEmitBlobBoundaries() Option {
+	return func(b *Bucket) {
+		b.emitBoundaries = true
+	}
+}
+
+// WithKeyStream returns an option to configure a function that returns the key
+// of the blob to stream after the previous key, overriding the default
+// lexicographical listing of the bucket. The function is called with the
+// bucket label and an empty previous key when starting from scratch. It
+// should return io.EOF if no next blob is available yet, in which case it
+// is called again after the backoff. This supports layouts where
+// lexicographical order doesn't define the event order, eg. sharded
+// keys streamed round-robin by timestamp. Cursors still contain the key,
+// so the function must be able to continue after any key it returned.
+func WithKeyStream(fn func(ctx context.Context, bucket, prev string) (next string, err error)) Option {
+	return func(b *Bucket) {
+		b.keyStream = fn
+	}
+}
+
+// WithStableBlobCheck returns an option to defer streaming a newly discovered
+// blob until its modification time is at least minAge in the past. This avoids
+// consuming blobs that are still being written by providers that expose partial
+// blobs. Deferred blobs are checked again after the backoff (see WithBackoff).
+// Subsequent blobs are not streamed while a blob is deferred.
+func WithStableBlobCheck(minAge time.Duration) Option {
+	return func(b *Bucket) {
+		b.stableAge = minAge
+	}
+}
+
+// WithChecksumVerification returns an option to verify the content of each blob
+// against the MD5 checksum exposed by the provider (see ChecksumProvider), ie.
+// the gocloud blob attributes, before streaming any of its records. This guards
+// against truncated or corrupt uploads. Each blob is read into memory once and
+// verified before it is decoded, so blobs must fit in memory. Blobs resumed from
+// a cursor in the middle of the blob are also read and verified from the start.
+// Streams return ErrChecksumMismatch if the content doesn't match and
+// ErrChecksumUnavailable if the provider doesn't expose the checksum.
+// Validate also verifies the checksums if configured.
+func WithChecksumVerification() Option {
+	return func(b *Bucket) {
+		b.verifyChecksum = true
+	}
+}
+
+// WithCompactCursors returns an option to stream events with compact cursors,
+// ie. compressed and base64 (URL) encoded, which are opaque and smaller for
+// long keys, eg. with nested prefixes. Compact cursors are prefixed by
+// reflex.CompactBlobCursorPrefix so that reflex.ParseCursor identifies them as
+// blob cursors. Unlike the default cursors, compact cursors are not
+// lexicographically ordered. Streams always accept both forms,
+// so the option can be enabled or disabled for existing consumers.
+func WithCompactCursors() Option {
+	return func(b *Bucket) {
+		b.compactCursors = true
+	}
+}
+
 // Option is a functional option that configures a bucket.
 type Option func(*Bucket)
 
@@ -64,7 +198,7 @@ func OpenBucket(ctx context.Context, label, urlstr string,
 
 	prefix := u.Query().Get("prefix")
 	if prefix != "" && !strings.HasSuffix(prefix, "/") {
-		return nil, errors.New("prefix should end with '/'")
+		return nil, ErrInvalidPrefix
 	}
 
 	bucket, err := blob.OpenBucket(ctx, urlstr)
@@ -77,12 +211,21 @@ func OpenBucket(ctx context.Context, label, urlstr string,
 
 // NewBucket returns a bucket using the provided underlying bucket.
 func NewBucket(label string, bucket *blob.Bucket, opts ...Option) *Bucket {
+	p := &gocloudProvider{bucket: bucket}
+	b := NewBucketFromProvider(label, p, opts...)
+	p.pageSize = b.listPageSize
+	return b
+}
+
+// NewBucketFromProvider returns a bucket using the provided underlying store.
+func NewBucketFromProvider(label string, provider Provider, opts ...Option) *Bucket {
 
 	b := &Bucket{
 		label:       label,
-		bucket:      bucket,
+		provider:    provider,
 		decoderFunc: JSONDecoder,
 		backoff:     time.Minute,
+		now:         time.Now,
 	}
 
 	for _, opt := range opts {
@@ -96,17 +239,119 @@ func NewBucket(label string, bucket *blob.Bucket, opts ...Option) *Bucket {
 // consecutive blobs as events.
 type Bucket struct {
 	label       string
-	bucket      *blob.Bucket
+	provider    Provider
 	decoderFunc func(io.Reader) (Decoder, error)
 	backoff     time.Duration
 
+	keyTimeFunc     func(key string) (time.Time, error)
+	emitBoundaries  bool
+	decoderSelector func(key string) (func(io.Reader) (Decoder, error), error)
+	keepEmpty       bool
+	retryAttempts   int
+	retryBackoff    time.Duration
+	listPageSize    int
+	keyStream       func(ctx context.Context, bucket, prev string) (string, error)
+	stableAge       time.Duration
+	now             func() time.Time
+	verifyChecksum  bool
+	compactCursors  bool
+
 	cursor  cursor
 	decoder Decoder
 }
 
 // Close releases any resources used by the underlying bucket.
 func (b *Bucket) Close() error {
-	return b.bucket.Close()
+	return b.provider.Close()
+}
+
+// Validate checks that the bucket can be streamed by listing all keys and
+// ensuring that they are strictly increasing in lexicographical order, since
+// that defines the event order, and that the first record of each blob can be
+// decoded. It returns an error describing the first offending key. It reads
+// every blob, so it is intended as a preflight check before deploying.
+//
+// If WithKeyStream is configured, the keys it returns are validated instead
+// and they need not be increasing.
+func (b *Bucket) Validate(ctx context.Context) error {
+	if b.keyStream != nil {
+		return b.validateKeyStream(ctx)
+	}
+
+	iter := b.provider.List("")
+
+	var prev string
+	for {
+		key, err := iter.Next(ctx)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "list iter")
+		}
+
+		if prev != "" && key <= prev {
+			return errors.Wrap(ErrKeysNotIncreasing, "validate",
+				j.MKV{"key": key, "prev": prev})
+		}
+		prev = key
+
+		if err := b.validateBlob(ctx, key); err != nil {
+			return err
+		}
+	}
+}
+
+// validateKeyStream validates the blobs of all the keys returned by
+// the key stream until it returns io.EOF.
+func (b *Bucket) validateKeyStream(ctx context.Context) error {
+	var prev string
+	for {
+		key, err := b.keyStream(ctx, b.label, prev)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "key stream")
+		}
+		prev = key
+
+		if err := b.validateBlob(ctx, key); err != nil {
+			return err
+		}
+	}
+}
+
+// validateBlob returns an error if the first record of the blob
+// cannot be decoded or, if configured, its checksum doesn't match.
+func (b *Bucket) validateBlob(ctx context.Context, key string) error {
+	fn, err := selectDecoderFunc(b.decoderFunc, b.decoderSelector, key)
+	if err != nil {
+		return err
+	}
+
+	r, err := b.provider.NewReader(ctx, key)
+	if err != nil {
+		return errors.Wrap(err, "new reader", j.KS("key", key))
+	}
+	defer r.Close()
+
+	if b.verifyChecksum {
+		r, err = readVerified(ctx, b.provider, key, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	d, err := fn(r)
+	if err != nil {
+		return errors.Wrap(err, "new decoder", j.KS("key", key))
+	}
+
+	_, err = d.Decode()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.Wrap(err, "decode first record", j.KS("key", key))
+	}
+
+	return nil
 }
 
 // Stream implements reflex.StreamFunc and returns a StreamClient that
@@ -117,11 +362,14 @@ func (b *Bucket) Close() error {
 // Note: The returned StreamClient implementation also exposes a
 // Close method which releases underlying resources. Close is
 // called internally when Recv returns an error.
+//
+// It also exposes a RecvCtx method which allows cancelling a single
+// call without closing the stream.
 func (b *Bucket) Stream(ctx context.Context, after string,
 	opts ...reflex.StreamOption) (reflex.StreamClient, error) {
 
 	if len(opts) > 0 {
-		return nil, errors.New("options not supported yet")
+		return nil, ErrOptionsNotSupported
 	}
 
 	cursor, err := parseCursor(after)
@@ -129,14 +377,60 @@ func (b *Bucket) Stream(ctx context.Context, after string,
 		return nil, err
 	}
 
+	return b.newStream(ctx, cursor), nil
+}
+
+// StreamFrom returns a StreamClient that streams events starting at the
+// record with the provided zero based offset in the blob with the provided
+// key, followed by events of subsequent blobs. It returns an error if the
+// blob does not exist. It is useful to reprocess a known blob without
+// streaming from the start of the bucket.
+//
+// The returned StreamClient is the same as that returned by Stream.
+func (b *Bucket) StreamFrom(ctx context.Context, key string, offset int64,
+	opts ...reflex.StreamOption) (reflex.StreamClient, error) {
+
+	if len(opts) > 0 {
+		return nil, ErrOptionsNotSupported
+	} else if key == "" || offset < 0 {
+		return nil, errors.Wrap(ErrInvalidCursor, "invalid key or offset",
+			j.MKV{"key": key, "offset": offset})
+	}
+
+	r, err := b.provider.NewReader(ctx, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "new reader", j.KS("key", key))
+	}
+	if err := r.Close(); err != nil {
+		return nil, errors.Wrap(err, "reader close", j.KS("key", key))
+	}
+
+	// The cursor is the previous record, which is gobbled when loading the blob.
+	return b.newStream(ctx, cursor{Key: key, Offset: offset - 1}), nil
+}
+
+// newStream returns a stream of the bucket after the cursor.
+func (b *Bucket) newStream(ctx context.Context, cursor cursor) *stream {
 	return &stream{
 		ctx:         ctx,
 		label:       b.label,
-		bucket:      b.bucket,
+		provider:    b.provider,
 		decoderFunc: b.decoderFunc,
 		backoff:     b.backoff,
 		cursor:      cursor,
-	}, nil
+
+		keyTimeFunc:     b.keyTimeFunc,
+		emitBoundaries:  b.emitBoundaries,
+		decoderSelector: b.decoderSelector,
+		keepEmpty:       b.keepEmpty,
+		retryAttempts:   b.retryAttempts,
+		retryBackoff:    b.retryBackoff,
+		keyStream:       b.keyStream,
+		stableAge:       b.stableAge,
+		now:             b.now,
+		verifyChecksum:  b.verifyChecksum,
+		compactCursors:  b.compactCursors,
+	}
 }
 
 var (
@@ -146,17 +440,39 @@ var (
 
 type stream struct {
 	ctx         context.Context
+	callCtx     context.Context // Context of the current Recv call.
 	label       string
-	bucket      *blob.Bucket
+	provider    Provider
 	decoderFunc func(io.Reader) (Decoder, error)
 	backoff     time.Duration
 
-	next     []byte
-	cursor   cursor
-	blobTime time.Time
-	reader   *blob.Reader
-	decoder  Decoder
-	err      error
+	keyTimeFunc     func(key string) (time.Time, error)
+	emitBoundaries  bool
+	boundary        bool // Boundary event pending.
+	decoderSelector func(key string) (func(io.Reader) (Decoder, error), error)
+	keepEmpty       bool
+	retryAttempts   int
+	retryBackoff    time.Duration
+	keyStream       func(ctx context.Context, bucket, prev string) (string, error)
+	stableAge       time.Duration
+	now             func() time.Time
+	verifyChecksum  bool
+	compactCursors  bool
+
+	// iter is the listing iterator reused by subsequent nextKey calls
+	// if iterKey, the last key it returned, is still the cursor key.
+	iter    Iterator
+	iterKey string
+
+	next      []byte
+	nextBytes int64 // Byte offset after next, zero if unknown.
+	base      int64 // Byte offset in the blob the reader starts at.
+	cursor    cursor
+	blobSize  int64 // Size of the current blob, negative if unknown.
+	blobTime  time.Time
+	reader    Reader
+	decoder   Decoder
+	err       error
 }
 
 // Close closes this stream and the current reader.
@@ -167,7 +483,7 @@ func (s *stream) Close() error {
 		return s.err
 	}
 
-	s.err = errors.New("closed")
+	s.err = ErrStreamClosed
 
 	if s.reader == nil {
 		return nil
@@ -181,12 +497,55 @@ func (s *stream) Recv() (*reflex.Event, error) {
 		return nil, s.err
 	}
 
+	s.callCtx = s.ctx
+	e, err := s.recv()
+	if err == nil {
+		return e, nil
+	}
+
+	return nil, s.closeOnErr(err)
+}
+
+// RecvCtx works as Recv except that the provided context only applies to
+// this call. If it is cancelled, its error is returned but the
+// stream remains usable.
+func (s *stream) RecvCtx(ctx context.Context) (*reflex.Event, error) {
+	if s.err != nil {
+		return nil, s.err
+	} else if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	callCtx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-done:
+		}
+	}()
+
+	s.callCtx = callCtx
 	e, err := s.recv()
 	if err == nil {
 		return e, nil
 	}
 
-	// Handle receive error
+	if ctx.Err() != nil && s.ctx.Err() == nil {
+		// Only this call was cancelled, reload the current blob on next call.
+		s.resetBlob()
+		return nil, ctx.Err()
+	}
+
+	return nil, s.closeOnErr(err)
+}
+
+// closeOnErr closes the stream due to the receive error and returns it.
+func (s *stream) closeOnErr(err error) error {
 	s.err = err
 
 	if s.reader != nil {
@@ -196,70 +555,190 @@ func (s *stream) Recv() (*reflex.Event, error) {
 		}
 	}
 
-	return nil, err
+	return err
+}
+
+// resetBlob closes and clears the current blob reader and decoder
+// so that it is reloaded from the current cursor.
+func (s *stream) resetBlob() {
+	if s.reader != nil {
+		if err := s.reader.Close(); err != nil {
+			log.Error(s.ctx, errors.Wrap(err, "reader close"))
+		}
+	}
+
+	s.reader = nil
+	s.decoder = nil
+	s.blobTime = time.Time{}
+	s.blobSize = 0
+	s.next = nil
+	s.nextBytes = 0
+	s.base = 0
 }
 
 func (s *stream) recv() (*reflex.Event, error) {
-	for s.cursor.Key == "" || s.cursor.EOF {
+	for !s.boundary && (s.cursor.Key == "" || s.cursor.EOF) {
 		// Starting from scratch or at end of a blob.
 		if err := s.loadNextBlob(); err != nil {
 			return nil, err
 		}
 	}
 
-	if s.decoder == nil {
+	if !s.boundary && s.decoder == nil {
 		// Starting from middle of a blob.
 		if err := s.loadCurrentBlob(); err != nil {
 			return nil, err
 		}
 	}
 
-	peek, err := s.decoder.Decode()
-	if errors.Is(err, io.EOF) {
-		s.cursor.EOF = true
-	} else if err != nil {
+	if s.boundary {
+		return s.popBoundary(), nil
+	}
+
+	peek, peekBytes, err := s.decode(s.decoder)
+	eof := errors.Is(err, io.EOF)
+	if eof && s.emitBoundaries {
+		s.boundary = true
+	} else if err != nil && !eof {
 		return nil, errors.Wrap(err, "decode")
 	}
 
 	s.cursor.Offset++
+	s.cursor.Bytes = s.nextBytes
+	if eof && !s.emitBoundaries {
+		s.completeBlob(&s.cursor)
+	}
+	keyOffsetGauge.WithLabelValues(s.label).Set(float64(s.cursor.Offset))
 
 	e := &reflex.Event{
-		ID:        s.cursor.String(),
-		Type:      etype{},
+		ID:        s.cursorID(),
+		Type:      etype(0),
 		ForeignID: "",
 		Timestamp: s.blobTime,
 		MetaData:  s.next,
 	}
 
 	s.next = peek
+	s.nextBytes = peekBytes
 
 	return e, nil
 }
 
+// cursorID returns the current cursor formatted as event ID.
+func (s *stream) cursorID() string {
+	if s.compactCursors {
+		return s.cursor.Compact()
+	}
+	return s.cursor.String()
+}
+
+// decode returns the next record from the decoder, skipping nil and
+// (if configured) empty records, and the byte offset in the blob after
+// it if the decoder is an OffsetDecoder.
+func (s *stream) decode(d Decoder) ([]byte, int64, error) {
+	var (
+		b   []byte
+		err error
+	)
+	for {
+		b, err = d.Decode()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if b != nil && (len(b) > 0 || s.keepEmpty) {
+			break
+		}
+	}
+
+	od, ok := d.(OffsetDecoder)
+	if !ok {
+		return b, 0, nil
+	}
+
+	return b, s.base + od.InputOffset(), nil
+}
+
+// popBoundary returns the pending blob boundary event and
+// marks the cursor as at the end of the blob.
+func (s *stream) popBoundary() *reflex.Event {
+	s.boundary = false
+	s.completeBlob(&s.cursor)
+
+	return &reflex.Event{
+		ID:        s.cursorID(),
+		Type:      BlobCompletedType,
+		ForeignID: s.cursor.Key,
+		Timestamp: s.blobTime,
+	}
+}
+
+// completeBlob marks the cursor as at the end of its blob.
+// It assumes the cursor offset is that of the last record.
+func (s *stream) completeBlob(c *cursor) {
+	blobRecordsHistogram.WithLabelValues(s.label).Observe(float64(c.Offset + 1))
+	if s.blobSize >= 0 {
+		blobBytesHistogram.WithLabelValues(s.label).Observe(float64(s.blobSize))
+	}
+
+	c.EOF = true
+	blobsProcessedCounter.WithLabelValues(s.label).Inc()
+}
+
 // loadCurrentBlob loads the blob decoder for the current cursor.
 // It assumes the cursor is not at the end of the blob.
 func (s *stream) loadCurrentBlob() error {
 	if !s.blobTime.IsZero() {
-		return errors.New("loading current while time set")
+		return errors.Wrap(ErrUnexpectedState, "loading current while time set")
 	}
 
-	r, err := s.bucket.NewReader(s.ctx, s.cursor.Key, nil)
+	rp, seek := s.provider.(RangeProvider)
+	seek = (seek || s.verifyChecksum) && s.cursor.Bytes > 0
+
+	var r Reader
+	err := s.retry(func() error {
+		var err error
+		if seek && !s.verifyChecksum {
+			// Range read from the byte offset after the cursor.
+			r, err = rp.NewRangeReader(s.ctx, s.cursor.Key, s.cursor.Bytes)
+		} else {
+			r, err = s.provider.NewReader(s.ctx, s.cursor.Key)
+		}
+		return err
+	})
+	if seek {
+		s.base = s.cursor.Bytes
+	} else {
+		s.base = 0
+	}
 	if err != nil {
 		return errors.Wrap(err, "new reader")
 	}
 
+	if s.verifyChecksum {
+		// Verify the whole blob, then seek to the byte offset after the cursor.
+		vr, err := s.readVerified(s.cursor.Key, r)
+		if err != nil {
+			return err
+		}
+		if _, err := vr.Seek(s.base, io.SeekStart); err != nil {
+			return errors.Wrap(err, "seek")
+		}
+		r = vr
+	}
+
 	readCounter.WithLabelValues(s.label).Inc()
 
-	d, err := s.decoderFunc(r)
+	d, err := s.newDecoder(s.cursor.Key, r)
 	if err != nil {
 		return err
 	}
 
-	// Gobble events up to cursor.
-	for i := int64(0); i <= s.cursor.Offset; i++ {
-		_, err := d.Decode()
+	// Gobble events up to cursor if not seeked.
+	for i := int64(0); !seek && i <= s.cursor.Offset; i++ {
+		_, _, err := s.decode(d)
 		if errors.Is(err, io.EOF) {
-			return errors.New("cursor out of range")
+			return ErrCursorOutOfRange
 		} else if err != nil {
 			return errors.Wrap(err, "decode")
 		}
@@ -267,10 +746,15 @@ func (s *stream) loadCurrentBlob() error {
 
 	s.reader = r
 	s.decoder = d
-	s.blobTime = r.ModTime()
-	s.next, err = d.Decode()
-	if errors.Is(err, io.EOF) {
-		return errors.New("cursor was eof")
+	s.blobTime = s.getBlobTime(s.cursor.Key, r)
+	s.blobSize = getBlobSize(r)
+	s.next, s.nextBytes, err = s.decode(d)
+	if errors.Is(err, io.EOF) && s.emitBoundaries {
+		// Only the boundary event remains.
+		s.boundary = true
+		return nil
+	} else if errors.Is(err, io.EOF) {
+		return ErrCursorEOF
 	} else if err != nil {
 		return errors.Wrap(err, "decode")
 	}
@@ -283,13 +767,16 @@ func (s *stream) loadCurrentBlob() error {
 func (s *stream) loadNextBlob() error {
 	var key string
 	for {
-		var err error
-		key, err = getNextKey(s.ctx, s.label, s.bucket, s.cursor.Key)
+		err := s.retry(func() error {
+			var err error
+			key, err = s.nextKey()
+			return err
+		})
 		if errors.Is(err, io.EOF) {
 			// No key keys, wait.
 			select {
-			case <-s.ctx.Done():
-				return s.ctx.Err()
+			case <-s.callCtx.Done():
+				return s.callCtx.Err()
 			case <-time.After(s.backoff):
 				continue
 			}
@@ -304,21 +791,56 @@ func (s *stream) loadNextBlob() error {
 		Offset: -1,
 	}
 
-	r, err := s.bucket.NewReader(s.ctx, key, nil)
+	var r Reader
+	err := s.retry(func() error {
+		var err error
+		r, err = s.provider.NewReader(s.ctx, key)
+		return err
+	})
 	if err != nil {
 		return errors.Wrap(err, "new reader")
 	}
 
+	if s.stableAge > 0 && s.now().Sub(r.ModTime()) < s.stableAge {
+		// The blob may still be written, defer it without updating the cursor.
+		if err := r.Close(); err != nil {
+			return errors.Wrap(err, "reader close")
+		}
+		unstableDeferCounter.WithLabelValues(s.label).Inc()
+
+		select {
+		case <-s.callCtx.Done():
+			return s.callCtx.Err()
+		case <-time.After(s.backoff):
+			return nil
+		}
+	}
+
+	if s.verifyChecksum {
+		r, err = s.readVerified(key, r)
+		if err != nil {
+			return err
+		}
+	}
+
 	readCounter.WithLabelValues(s.label).Inc()
 
-	d, err := s.decoderFunc(r)
+	d, err := s.newDecoder(key, r)
 	if err != nil {
 		return err
 	}
 
-	next, err := d.Decode()
-	if errors.Is(err, io.EOF) {
-		c.EOF = true
+	s.base = 0
+	s.blobSize = getBlobSize(r)
+
+	var boundary bool
+	next, nextBytes, err := s.decode(d)
+	if errors.Is(err, io.EOF) && s.emitBoundaries {
+		// Empty blob, only emit the boundary event.
+		boundary = true
+	} else if errors.Is(err, io.EOF) {
+		// Empty blob.
+		s.completeBlob(&c)
 	} else if err != nil {
 		return errors.Wrap(err, "decode")
 	}
@@ -332,44 +854,231 @@ func (s *stream) loadNextBlob() error {
 
 	s.reader = r
 	s.decoder = d
-	s.blobTime = r.ModTime()
+	s.blobTime = s.getBlobTime(key, r)
 	s.cursor = c
 	s.next = next
+	s.nextBytes = nextBytes
+	s.boundary = boundary
 
 	return nil
 }
 
-func getNextKey(ctx context.Context, label string, bucket *blob.Bucket, prev string) (string, error) {
-	iter := bucket.List(&blob.ListOptions{
-		BeforeList: makeStartAfter(prev),
-	})
+// readVerified reads the blob into memory, closing the reader, and returns
+// a reader of the content if it matches the blob checksum.
+func (s *stream) readVerified(key string, r Reader) (*verifiedReader, error) {
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Error(s.ctx, errors.Wrap(err, "reader close"))
+		}
+	}()
 
-	for {
-		o, err := iter.Next(ctx)
-		if err != nil {
-			return "", errors.Wrap(err, "list iter")
+	return readVerified(s.callCtx, s.provider, key, &ctxReader{Reader: r, s: s})
+}
+
+// readVerified reads the blob into memory and returns a reader of the content,
+// or ErrChecksumMismatch if it doesn't match the MD5 checksum exposed by the
+// provider. It doesn't close the reader.
+func readVerified(ctx context.Context, p Provider, key string, r Reader) (*verifiedReader, error) {
+	cp, ok := p.(ChecksumProvider)
+	if !ok {
+		return nil, errors.Wrap(ErrChecksumUnavailable, "provider not supported", j.KS("key", key))
+	}
+
+	want, err := cp.MD5(ctx, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "get checksum", j.KS("key", key))
+	} else if len(want) == 0 {
+		return nil, errors.Wrap(ErrChecksumUnavailable, "no blob checksum", j.KS("key", key))
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "checksum read", j.KS("key", key))
+	}
+
+	if got := md5.Sum(b); !bytes.Equal(got[:], want) {
+		return nil, errors.Wrap(ErrChecksumMismatch, "verify checksum", j.MKV{
+			"key":  key,
+			"want": hex.EncodeToString(want),
+			"got":  hex.EncodeToString(got[:]),
+		})
+	}
+
+	return &verifiedReader{
+		Reader:  bytes.NewReader(b),
+		modTime: r.ModTime(),
+	}, nil
+}
+
+// verifiedReader is a Reader of verified blob content read into memory.
+type verifiedReader struct {
+	*bytes.Reader
+	modTime time.Time
+}
+
+func (r *verifiedReader) ModTime() time.Time {
+	return r.modTime
+}
+
+func (r *verifiedReader) Close() error {
+	return nil
+}
+
+// newDecoder returns a decoder of the blob reader using the decoder
+// function selected for the key.
+func (s *stream) newDecoder(key string, r Reader) (Decoder, error) {
+	fn, err := selectDecoderFunc(s.decoderFunc, s.decoderSelector, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return fn(&ctxReader{Reader: r, s: s})
+}
+
+// selectDecoderFunc returns the decoder function selected for the key
+// by the optional selector or else the default decoder function.
+func selectDecoderFunc(def func(io.Reader) (Decoder, error),
+	selector func(key string) (func(io.Reader) (Decoder, error), error),
+	key string) (func(io.Reader) (Decoder, error), error) {
+
+	if selector == nil {
+		return def, nil
+	}
+
+	selected, err := selector(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "select decoder", j.KS("key", key))
+	} else if selected == nil {
+		return def, nil
+	}
+
+	return selected, nil
+}
+
+// retry calls fn until it succeeds, returns a non-transient error or the
+// configured maximum attempts are reached. It waits the configured
+// backoff between attempts.
+func (s *stream) retry(fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= s.retryAttempts || !isTransient(err) {
+			return err
 		}
 
-		if o.Key > prev {
-			return o.Key, nil
+		bucketRetryCounter.WithLabelValues(s.label).Inc()
+
+		t := time.NewTimer(s.retryBackoff)
+		select {
+		case <-s.callCtx.Done():
+			t.Stop()
+			return s.callCtx.Err()
+		case <-t.C:
 		}
+	}
+}
 
-		listSkipCounter.WithLabelValues(label).Inc()
+// isTransient returns true if the bucket error is possibly transient
+// and may succeed if retried.
+func isTransient(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	switch gcerrors.Code(err) {
+	case gcerrors.Unknown, gcerrors.Internal, gcerrors.ResourceExhausted:
+		// Note that gocloud drivers map most server errors to Unknown.
+		return true
+	default:
+		return false
 	}
 }
 
-// makeStartAfter returns a blob.BeforeList function that starts listing after
-// the provided key for improved performance when scanning large buckets.
-func makeStartAfter(key string) func(func(interface{}) bool) error {
-	return func(asFunc func(interface{}) bool) error {
-		s3input := new(s3.ListObjectsV2Input)
-		if asFunc(&s3input) {
-			if s3input.Prefix != nil {
-				key = path.Join(*s3input.Prefix, key)
-			}
-			s3input.StartAfter = &key
+// ctxReader wraps a blob reader and returns the error of the current
+// Recv call's context if it is cancelled.
+type ctxReader struct {
+	Reader
+	s *stream
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.s.callCtx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// getBlobTime returns the timestamp of the blob derived from the key if
+// configured, or else the modification time.
+func (s *stream) getBlobTime(key string, r Reader) time.Time {
+	if s.keyTimeFunc == nil {
+		return r.ModTime()
+	}
+
+	t, err := s.keyTimeFunc(key)
+	if err != nil {
+		return r.ModTime()
+	}
+
+	return t
+}
+
+// getBlobSize returns the size of the blob if the reader exposes it
+// (like gocloud blob readers) or -1.
+func getBlobSize(r Reader) int64 {
+	sizer, ok := r.(interface{ Size() int64 })
+	if !ok {
+		return -1
+	}
+	return sizer.Size()
+}
+
+// nextKey returns the next key after the cursor key. It continues the
+// listing of the previous call if that returned the cursor key, avoiding
+// relisting large buckets for each blob. Otherwise, or after any error
+// including io.EOF, it starts a new listing after the cursor key so that
+// subsequently added keys are found. Like keys added before the cursor,
+// keys added out of order before the current listing position are skipped.
+//
+// If a key stream is configured, it returns its next key instead.
+func (s *stream) nextKey() (string, error) {
+	prev := s.cursor.Key
+	if s.keyStream != nil {
+		key, err := s.keyStream(s.callCtx, s.label, prev)
+		if err != nil {
+			return "", errors.Wrap(err, "key stream")
 		}
-		return nil
+		return key, nil
+	}
+
+	if s.iter == nil || s.iterKey != prev {
+		s.iter = s.provider.List(prev)
+	}
+
+	key, err := getNextKey(s.callCtx, s.label, s.iter, prev)
+	if err != nil {
+		s.iter = nil
+		return "", err
+	}
+
+	s.iterKey = key
+
+	return key, nil
+}
+
+func getNextKey(ctx context.Context, label string, iter Iterator, prev string) (string, error) {
+
+	for {
+		key, err := iter.Next(ctx)
+		if err != nil {
+			return "", errors.Wrap(err, "list iter")
+		}
+
+		if key > prev {
+			return key, nil
+		}
+
+		listSkipCounter.WithLabelValues(label).Inc()
 	}
 }
 
@@ -378,6 +1087,7 @@ func makeStartAfter(key string) func(func(interface{}) bool) error {
 type cursor struct {
 	Key    string // Key of blob in the bucket.
 	Offset int64  // Offset of event in the blob.
+	Bytes  int64  // Byte offset after the event in the blob, zero if unknown.
 	EOF    bool   // End of blob reached (overrides Offset).
 }
 
@@ -385,7 +1095,7 @@ type cursor struct {
 const eof = "eof"
 
 // String returns a string format of the cursor which is lexigraphically orderable.
-// Ex. path/to/file|01|9 or path/to/file|03|123 or path/to/file|eof.
+// Ex. path/to/file|01|9 or path/to/file|03|123|4567 or path/to/file|eof.
 func (c cursor) String() string {
 	if c.EOF {
 		return fmt.Sprintf("%s|%s", c.Key, eof)
@@ -393,17 +1103,54 @@ func (c cursor) String() string {
 
 	offset := strconv.FormatInt(c.Offset, 10)
 
+	if c.Bytes > 0 {
+		return fmt.Sprintf("%s|%02d|%s|%d", c.Key, len(offset), offset, c.Bytes)
+	}
+
 	return fmt.Sprintf("%s|%02d|%s", c.Key, len(offset), offset)
 }
 
+// Compact returns a compressed and base64 (URL) encoded format of the
+// cursor, which is opaque and not lexicographically orderable. It is
+// prefixed by reflex.CompactBlobCursorPrefix to identify it as a blob cursor.
+func (c cursor) Compact() string {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestCompression) // Valid level never errors.
+	_, _ = w.Write([]byte(c.String()))                   // Writes to a buffer never error.
+	_ = w.Close()
+
+	return reflex.CompactBlobCursorPrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes())
+}
+
+// parseCursor returns the cursor of the default or compact string format.
 func parseCursor(cur string) (cursor, error) {
 	if cur == "" {
 		return cursor{}, nil
 	}
 
+	if !strings.Contains(cur, "|") {
+		// Compact format (see Compact) since it never contains pipes.
+		encoded := strings.TrimPrefix(cur, reflex.CompactBlobCursorPrefix)
+		if encoded == cur {
+			return cursor{}, errors.Wrap(ErrInvalidCursor, "compact cursor prefix", j.KS("cursor", cur))
+		}
+
+		b, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return cursor{}, errors.Wrap(ErrInvalidCursor, "decode compact cursor", j.KS("cursor", cur))
+		}
+
+		b, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(b)))
+		if err != nil || !bytes.Contains(b, []byte("|")) {
+			return cursor{}, errors.Wrap(ErrInvalidCursor, "decompress compact cursor", j.KS("cursor", cur))
+		}
+
+		cur = string(b)
+	}
+
 	split := strings.Split(cur, "|")
-	if len(split) < 2 || len(split) > 3 {
-		return cursor{}, errors.New("invalid cursor", j.KS("cursor", cur))
+	if len(split) < 2 || len(split) > 4 {
+		return cursor{}, errors.Wrap(ErrInvalidCursor, "parse cursor", j.KS("cursor", cur))
 	}
 
 	if split[1] == eof {
@@ -413,19 +1160,34 @@ func parseCursor(cur string) (cursor, error) {
 		}, nil
 	}
 
+	var byteOffset int64
+	if len(split) == 4 {
+		var err error
+		byteOffset, err = strconv.ParseInt(split[3], 10, 64)
+		if err != nil || byteOffset <= 0 {
+			return cursor{}, errors.Wrap(ErrInvalidCursor, "invalid cursor byte offset", j.KS("cursor", cur))
+		}
+		split = split[:3]
+	}
+
 	i, err := strconv.ParseInt(split[len(split)-1], 10, 64)
 	if err != nil {
-		return cursor{}, errors.New("invalid cursor offset", j.KS("cursor", cur))
+		return cursor{}, errors.Wrap(ErrInvalidCursor, "invalid cursor offset", j.KS("cursor", cur))
 	}
 
 	return cursor{
 		Key:    split[0],
 		Offset: i,
+		Bytes:  byteOffset,
 	}, nil
 }
 
-type etype struct{}
+// BlobCompletedType is the type of the synthetic event emitted at
+// the end of each blob if WithEmitBlobBoundaries is enabled.
+var BlobCompletedType reflex.EventType = etype(1)
+
+type etype int
 
 func (e etype) ReflexType() int {
-	return 0
+	return int(e)
 }
@@ -3,15 +3,23 @@ package rblob
 import (
 	"context"
 	"io"
+	"math/rand"
 	"os"
 	"path"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 	_ "gocloud.dev/blob/fileblob"
+	"gocloud.dev/blob/memblob"
 )
 
 func TestClose(t *testing.T) {
@@ -77,7 +85,17 @@ func TestCursor(t *testing.T) {
 	test(t, c, "path/to/file|03|999")
 	order = append(order, c.String())
 
+	c.Bytes = 12345
+	test(t, c, "path/to/file|03|999|12345")
+	order = append(order, c.String())
+
+	c.Offset = 1000
+	c.Bytes = 12356
+	test(t, c, "path/to/file|04|1000|12356")
+	order = append(order, c.String())
+
 	c.Offset = 0
+	c.Bytes = 0
 	c.EOF = true
 	test(t, c, "path/to/file|eof")
 	order = append(order, c.String())
@@ -87,3 +105,169 @@ func TestCursor(t *testing.T) {
 	sort.Strings(order)
 	require.Equal(t, clone, order)
 }
+
+func TestCompactCursor(t *testing.T) {
+	prefix := strings.Repeat("region=eu-west-1/service=payments/", 8)
+
+	test := func(t *testing.T, c cursor) {
+		t.Helper()
+
+		compact := c.Compact()
+		require.NotContains(t, compact, "|")
+		require.True(t, strings.HasPrefix(compact, reflex.CompactBlobCursorPrefix))
+		require.Equal(t, reflex.CursorKindBlob, reflex.ParseCursor(compact).Kind())
+		require.Less(t, len(compact), len(c.String()))
+
+		// Both forms are round-trippable.
+		for _, cur := range []string{compact, c.String()} {
+			actual, err := parseCursor(cur)
+			jtest.RequireNil(t, err)
+			require.Equal(t, c, actual)
+		}
+	}
+
+	test(t, cursor{Key: prefix + "file", Offset: 12})
+	test(t, cursor{Key: prefix + "file", Offset: 999, Bytes: 12345})
+	test(t, cursor{Key: prefix + "file", EOF: true})
+
+	// Random long keys.
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		var parts []string
+		for j := 0; j < 5+r.Intn(10); j++ {
+			parts = append(parts, strings.Repeat(string(rune('a'+r.Intn(26))), 1+r.Intn(20)))
+		}
+
+		c := cursor{
+			Key:    prefix + strings.Join(parts, "/"),
+			Offset: r.Int63n(1e6),
+			Bytes:  r.Int63n(1e9) + 1,
+		}
+		if r.Intn(4) == 0 {
+			// EOF overrides the offsets.
+			c = cursor{Key: c.Key, EOF: true}
+		}
+
+		test(t, c)
+	}
+
+	unprefixed := strings.TrimPrefix(cursor{Key: "file"}.Compact(), reflex.CompactBlobCursorPrefix)
+	for _, invalid := range []string{"file", "!!!", unprefixed, cursor{}.Compact()[:10]} {
+		_, err := parseCursor(invalid)
+		jtest.Require(t, ErrInvalidCursor, err, invalid)
+	}
+}
+
+func TestProgressMetrics(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+
+	const label = "progress"
+
+	bucket, err := OpenBucket(context.Background(), label, "file:///"+path.Join(dir, "testdata"))
+	require.NoError(t, err)
+	defer bucket.Close()
+
+	sc, err := bucket.Stream(context.Background(), "")
+	require.NoError(t, err)
+
+	processed := blobsProcessedCounter.WithLabelValues(label)
+	offset := keyOffsetGauge.WithLabelValues(label)
+	base := testutil.ToFloat64(processed)
+
+	// Blobs: 1to3, empty, 4to6, empty, 7.
+	expBlobs := []float64{0, 0, 1, 2, 2, 3, 5}
+	expOffsets := []float64{0, 1, 2, 0, 1, 2, 0}
+
+	for i := range expBlobs {
+		_, err := sc.Recv()
+		require.NoError(t, err)
+
+		require.Equal(t, base+expBlobs[i], testutil.ToFloat64(processed))
+		require.Equal(t, expOffsets[i], testutil.ToFloat64(offset))
+	}
+}
+
+func TestBlobSizeMetrics(t *testing.T) {
+	ctx := context.Background()
+	const label = "sizes"
+
+	b := memblob.OpenBucket(nil)
+	content := []byte(`{"id":1}{"id":2}{"id":3}`)
+	require.NoError(t, b.WriteAll(ctx, "a", content, nil))
+	require.NoError(t, b.WriteAll(ctx, "b", nil, nil))
+	require.NoError(t, b.WriteAll(ctx, "c", []byte(`{"id":4}`), nil))
+
+	bucket := NewBucket(label, b)
+	defer bucket.Close()
+
+	sc, err := bucket.Stream(ctx, "")
+	require.NoError(t, err)
+
+	// Blob c is completed when its only record is streamed.
+	for i := 0; i < 4; i++ {
+		_, err := sc.Recv()
+		require.NoError(t, err)
+	}
+
+	observed := func(h *prometheus.HistogramVec) (uint64, float64) {
+		var m dto.Metric
+		err := h.WithLabelValues(label).(prometheus.Metric).Write(&m)
+		require.NoError(t, err)
+		return m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum()
+	}
+
+	count, sum := observed(blobRecordsHistogram)
+	require.Equal(t, uint64(3), count)
+	require.Equal(t, 3.0+0+1, sum)
+
+	count, sum = observed(blobBytesHistogram)
+	require.Equal(t, uint64(3), count)
+	require.Equal(t, float64(len(content)+0+8), sum)
+}
+
+func TestStableBlobCheck(t *testing.T) {
+	ctx := context.Background()
+	const label = "stable"
+
+	b := memblob.OpenBucket(nil)
+	require.NoError(t, b.WriteAll(ctx, "a", []byte(`{"id":1}`), nil))
+
+	var offset int64 // Clock offset in nanoseconds.
+	bucket := NewBucket(label, b, WithStableBlobCheck(time.Minute),
+		WithBackoff(time.Millisecond))
+	bucket.now = func() time.Time {
+		return time.Now().Add(time.Duration(atomic.LoadInt64(&offset)))
+	}
+	defer bucket.Close()
+
+	reads := readCounter.WithLabelValues(label)
+	baseReads := testutil.ToFloat64(reads)
+	deferred := unstableDeferCounter.WithLabelValues(label)
+	baseDeferred := testutil.ToFloat64(deferred)
+
+	sc, err := bucket.Stream(ctx, "")
+	require.NoError(t, err)
+
+	res := make(chan error, 1)
+	go func() {
+		_, err := sc.Recv()
+		res <- err
+	}()
+
+	// The fresh blob is deferred.
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(deferred) > baseDeferred+1
+	}, time.Second, time.Millisecond)
+	require.Len(t, res, 0)
+	require.Equal(t, baseReads, testutil.ToFloat64(reads))
+
+	// The blob is streamed once old enough.
+	atomic.StoreInt64(&offset, int64(time.Minute))
+	select {
+	case err := <-res:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		require.Fail(t, "stable blob not streamed")
+	}
+}
@@ -3,6 +3,7 @@ package rblob_test
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -10,6 +11,7 @@ import (
 	"time"
 
 	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex"
 	"github.com/luno/reflex/rblob"
 	"github.com/stretchr/testify/require"
 	_ "gocloud.dev/blob/fileblob"
@@ -147,3 +149,67 @@ func TestCancelWait(t *testing.T) {
 	_, err = sc.Recv()
 	jtest.Require(t, context.DeadlineExceeded, err)
 }
+
+func TestBlobBoundaries(t *testing.T) {
+	dir, err := os.Getwd()
+	require.NoError(t, err)
+
+	url := "file:///" + path.Join(dir, "testdata")
+
+	bucket, err := rblob.OpenBucket(context.Background(), "", url,
+		rblob.WithEmitBlobBoundaries())
+	require.NoError(t, err)
+	defer bucket.Close()
+
+	const (
+		blob1 = "2019/12/31/Test-2019-12-31-17-56-01-1to3"
+		blob2 = "2019/12/31/Test-2019-12-31-18-02-02-empty"
+		blob3 = "2020/01/01/Test-2020-01-01-05-15-56-4to6"
+		blob4 = "2020/01/02/Test-2020-01-02-10-00-00-empty"
+		blob5 = "2020/02/10/Test-2020-02-10-01-02-03-7"
+	)
+
+	// Expected sequence; either DTO IDs or completed blob keys.
+	expected := []interface{}{
+		1, 2, 3, blob1, blob2, 4, 5, 6, blob3, blob4, 7, blob5,
+	}
+
+	assertNext := func(t *testing.T, sc reflex.StreamClient, exp interface{}) *reflex.Event {
+		t.Helper()
+
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+
+		if key, ok := exp.(string); ok {
+			require.True(t, reflex.IsType(e.Type, rblob.BlobCompletedType))
+			require.Equal(t, key, e.ForeignID)
+			require.Equal(t, key+"|eof", e.ID)
+			return e
+		}
+
+		require.False(t, reflex.IsType(e.Type, rblob.BlobCompletedType))
+		var dto TestDTO
+		err = json.Unmarshal(e.MetaData, &dto)
+		require.NoError(t, err)
+		require.Equal(t, int64(exp.(int)), dto.ID)
+		return e
+	}
+
+	sc, err := bucket.Stream(context.Background(), "")
+	require.NoError(t, err)
+
+	var ids []string
+	for _, exp := range expected {
+		e := assertNext(t, sc, exp)
+		ids = append(ids, e.ID)
+	}
+
+	// Resuming from any cursor neither skips nor re-emits events.
+	for i := 0; i < len(ids)-1; i++ {
+		sc, err := bucket.Stream(context.Background(), ids[i])
+		require.NoError(t, err)
+
+		assertNext(t, sc, expected[i+1])
+		require.NoError(t, sc.(io.Closer).Close())
+	}
+}
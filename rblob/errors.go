@@ -0,0 +1,21 @@
+package rblob
+
+import (
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+)
+
+var (
+	ErrInvalidCursor       = errors.New("invalid cursor", j.C("ERR_87370bd1154a543c"))
+	ErrCursorOutOfRange    = errors.New("cursor out of range", j.C("ERR_1c180e58ccb10341"))
+	ErrCursorEOF           = errors.New("cursor was eof", j.C("ERR_6ea8fe927fada01c"))
+	ErrUnexpectedState     = errors.New("unexpected stream state", j.C("ERR_7c3cc388431cc53e"))
+	ErrKeysNotIncreasing   = errors.New("blob key not strictly increasing", j.C("ERR_8de053075b74d6be"))
+	ErrOptionsNotSupported = errors.New("options not supported yet", j.C("ERR_6e5e53a9277b5ae8"))
+	ErrStreamClosed        = errors.New("stream closed", j.C("ERR_485f8fd3d06d876c"))
+	ErrInvalidPrefix       = errors.New("prefix should end with '/'", j.C("ERR_3af8622bfe19f9c3"))
+	ErrChecksumMismatch    = errors.New("blob checksum mismatch", j.C("ERR_4d0a9c71e3b85f26"))
+	ErrChecksumUnavailable = errors.New("blob checksum not available", j.C("ERR_b82e61f0c74d3a95"))
+	ErrNoBuckets           = errors.New("no buckets to merge", j.C("ERR_5e91c7a20f4b6d38"))
+	ErrFrameTooLarge       = errors.New("frame exceeds max size", j.C("ERR_9cfe2eb5aa873180"))
+)
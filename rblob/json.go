@@ -1,20 +1,39 @@
 package rblob
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"io"
 )
 
+// utf8BOM is the UTF-8 byte order mark some exporters prepend to blobs.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
 // JSONDecoder is the default decoder function that decodes blobs into
-// raw json byte slices.
+// raw json byte slices. A leading UTF-8 byte order mark and insignificant
+// whitespace are skipped.
 var JSONDecoder = func(r io.Reader) (Decoder, error) {
+	br := bufio.NewReader(r)
+
+	var skipped int64
+	if b, _ := br.Peek(len(utf8BOM)); bytes.Equal(b, utf8BOM) {
+		n, err := br.Discard(len(utf8BOM))
+		if err != nil {
+			return nil, err
+		}
+		skipped = int64(n)
+	}
+
 	return &jsonDecoder{
-		decoder: json.NewDecoder(r),
+		decoder: json.NewDecoder(br),
+		skipped: skipped,
 	}, nil
 }
 
 type jsonDecoder struct {
 	decoder *json.Decoder
+	skipped int64 // Bytes of the byte order mark skipped.
 }
 
 func (d *jsonDecoder) Decode() ([]byte, error) {
@@ -27,3 +46,9 @@ func (d *jsonDecoder) Decode() ([]byte, error) {
 
 	return raw, nil
 }
+
+// InputOffset returns the byte offset including the skipped byte order mark
+// so that it remains valid for range reads of the original blob.
+func (d *jsonDecoder) InputOffset() int64 {
+	return d.skipped + d.decoder.InputOffset()
+}
@@ -0,0 +1,83 @@
+package rblob_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex/rblob"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONDecoder(t *testing.T) {
+	bom := "\xEF\xBB\xBF"
+
+	cases := []struct {
+		name  string
+		input string
+	}{
+		{
+			name:  "plain",
+			input: "{\"id\":1}\n{\"id\":2}\n",
+		},
+		{
+			name:  "bom",
+			input: bom + "{\"id\":1}\n{\"id\":2}\n",
+		},
+		{
+			name:  "leading blank lines",
+			input: "\n\n  \r\n{\"id\":1}\n{\"id\":2}\n",
+		},
+		{
+			name:  "bom and blank lines",
+			input: bom + "\n\t\n{\"id\":1}\n\n{\"id\":2}",
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := rblob.JSONDecoder(bytes.NewReader([]byte(test.input)))
+			jtest.RequireNil(t, err)
+
+			var res []string
+			for {
+				b, err := d.Decode()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				jtest.RequireNil(t, err)
+				res = append(res, string(b))
+			}
+			require.Equal(t, []string{"{\"id\":1}", "{\"id\":2}"}, res)
+		})
+	}
+}
+
+func TestJSONDecoderBOMResume(t *testing.T) {
+	p := newMemProvider(nil)
+	p.blobs["a"] = []byte("\xEF\xBB\xBF\n{\"id\":1}\n{\"id\":2}\n{\"id\":3}\n")
+
+	b := rblob.NewBucketFromProvider("", p)
+	defer b.Close()
+
+	sc, err := b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	e, err := sc.Recv()
+	jtest.RequireNil(t, err)
+	require.Equal(t, "{\"id\":1}", string(e.MetaData))
+
+	// The BOM is not a record and the byte offset in the cursor
+	// includes it, so resuming with a range read works.
+	sc, err = b.Stream(context.Background(), e.ID)
+	jtest.RequireNil(t, err)
+
+	for _, exp := range []string{"{\"id\":2}", "{\"id\":3}"} {
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+		require.Equal(t, exp, string(e.MetaData))
+	}
+}
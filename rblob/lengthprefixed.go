@@ -0,0 +1,117 @@
+package rblob
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+)
+
+// defaultMaxFrameSize is the default maximum payload size of length prefixed frames.
+const defaultMaxFrameSize = 64 << 20
+
+// frameChunkSize is the size of the payload buffer allocated up front, larger
+// payloads are buffered as they are read so that a corrupt length prefix
+// doesn't allocate more than the actual payload.
+const frameChunkSize = 64 << 10
+
+// LengthPrefixedOption configures a length prefixed decoder.
+type LengthPrefixedOption func(*lengthPrefixedDecoder)
+
+// WithMaxFrameSize returns an option to set the maximum payload size of
+// length prefixed frames. Decode returns ErrFrameTooLarge for larger frames,
+// which are assumed to be corrupt. It defaults to 64MiB.
+func WithMaxFrameSize(n uint32) LengthPrefixedOption {
+	return func(d *lengthPrefixedDecoder) {
+		d.maxSize = n
+	}
+}
+
+// NewLengthPrefixedDecoder returns a decoder of framed binary messages, each
+// consisting of a uint32 length prefix in the provided byte order followed by
+// that many payload bytes. It returns io.EOF at the end of the reader and an
+// error wrapping io.ErrUnexpectedEOF if the last frame is truncated, or
+// ErrFrameTooLarge if a frame exceeds the max size (see WithMaxFrameSize).
+// Use it with WithDecoder:
+//
+//	rblob.WithDecoder(func(r io.Reader) (rblob.Decoder, error) {
+//	  return rblob.NewLengthPrefixedDecoder(r, binary.BigEndian), nil
+//	})
+func NewLengthPrefixedDecoder(r io.Reader, order binary.ByteOrder,
+	opts ...LengthPrefixedOption) Decoder {
+
+	d := &lengthPrefixedDecoder{
+		r:       r,
+		order:   order,
+		maxSize: defaultMaxFrameSize,
+	}
+	for _, o := range opts {
+		o(d)
+	}
+	return d
+}
+
+type lengthPrefixedDecoder struct {
+	r       io.Reader
+	order   binary.ByteOrder
+	maxSize uint32
+	offset  int64
+}
+
+func (d *lengthPrefixedDecoder) Decode() ([]byte, error) {
+	var prefix [4]byte
+	_, err := io.ReadFull(d.r, prefix[:])
+	if errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read length prefix",
+			j.KV("offset", d.offset))
+	}
+
+	length := d.order.Uint32(prefix[:])
+	if length > d.maxSize {
+		return nil, errors.Wrap(ErrFrameTooLarge, "read length prefix",
+			j.MKV{"offset": d.offset, "length": length, "max": d.maxSize})
+	}
+
+	b, err := d.readPayload(int64(length))
+	if err != nil {
+		return nil, errors.Wrap(err, "read payload",
+			j.MKV{"offset": d.offset, "length": length})
+	}
+
+	d.offset += int64(len(prefix) + len(b))
+
+	return b, nil
+}
+
+// readPayload returns the next n bytes. It only allocates up to
+// frameChunkSize up front and grows the buffer as data is read.
+func (d *lengthPrefixedDecoder) readPayload(n int64) ([]byte, error) {
+	if n <= frameChunkSize {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(d.r, b); errors.Is(err, io.EOF) {
+			// Length prefix without payload.
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(frameChunkSize)
+	if _, err := io.CopyN(&buf, d.r, n); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *lengthPrefixedDecoder) InputOffset() int64 {
+	return d.offset
+}
@@ -0,0 +1,147 @@
+package rblob_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex/rblob"
+	"github.com/stretchr/testify/require"
+)
+
+func frame(order binary.ByteOrder, payload string) []byte {
+	b := make([]byte, 4, 4+len(payload))
+	order.PutUint32(b, uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func TestLengthPrefixedDecoder(t *testing.T) {
+	cases := []struct {
+		name   string
+		input  []byte
+		exp    []string
+		expErr error
+	}{
+		{
+			name: "empty stream",
+		},
+		{
+			name: "well formed",
+			input: bytes.Join([][]byte{
+				frame(binary.BigEndian, "one"),
+				frame(binary.BigEndian, ""),
+				frame(binary.BigEndian, "three"),
+			}, nil),
+			exp: []string{"one", "", "three"},
+		},
+		{
+			name:   "truncated prefix",
+			input:  append(frame(binary.BigEndian, "one"), 0, 0),
+			exp:    []string{"one"},
+			expErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "truncated payload",
+			input:  frame(binary.BigEndian, "one")[:5],
+			expErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "missing payload",
+			input:  frame(binary.BigEndian, "one")[:4],
+			expErr: io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			d := rblob.NewLengthPrefixedDecoder(bytes.NewReader(test.input), binary.BigEndian)
+
+			var res []string
+			for {
+				b, err := d.Decode()
+				if errors.Is(err, io.EOF) {
+					require.Nil(t, test.expErr)
+					break
+				} else if err != nil {
+					require.True(t, errors.Is(err, test.expErr), err)
+					break
+				}
+				res = append(res, string(b))
+			}
+			require.Equal(t, test.exp, res)
+		})
+	}
+}
+
+func TestLengthPrefixedDecoderMaxSize(t *testing.T) {
+	corrupt := func(length uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, length)
+		return append(b, "short"...)
+	}
+
+	// Huge prefixes exceeding the max are rejected.
+	d := rblob.NewLengthPrefixedDecoder(bytes.NewReader(corrupt(math.MaxUint32)), binary.BigEndian)
+	_, err := d.Decode()
+	jtest.Require(t, rblob.ErrFrameTooLarge, err)
+
+	d = rblob.NewLengthPrefixedDecoder(bytes.NewReader(frame(binary.BigEndian, "12345")),
+		binary.BigEndian, rblob.WithMaxFrameSize(4))
+	_, err = d.Decode()
+	jtest.Require(t, rblob.ErrFrameTooLarge, err)
+
+	// Large prefixes below the max only allocate what is read.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	d = rblob.NewLengthPrefixedDecoder(bytes.NewReader(corrupt(50<<20)), binary.BigEndian)
+	_, err = d.Decode()
+	runtime.ReadMemStats(&after)
+	require.True(t, errors.Is(err, io.ErrUnexpectedEOF), err)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	// Large frames are decoded.
+	large := strings.Repeat("x", 1<<20)
+	d = rblob.NewLengthPrefixedDecoder(bytes.NewReader(frame(binary.BigEndian, large)), binary.BigEndian)
+	b, err := d.Decode()
+	jtest.RequireNil(t, err)
+	require.Equal(t, large, string(b))
+}
+
+func TestLengthPrefixedStream(t *testing.T) {
+	p := newMemProvider(nil)
+	p.blobs["a"] = bytes.Join([][]byte{
+		frame(binary.LittleEndian, "one"),
+		frame(binary.LittleEndian, "two"),
+		frame(binary.LittleEndian, "three"),
+	}, nil)
+
+	b := rblob.NewBucketFromProvider("", p, rblob.WithDecoder(
+		func(r io.Reader) (rblob.Decoder, error) {
+			return rblob.NewLengthPrefixedDecoder(r, binary.LittleEndian), nil
+		}))
+	defer b.Close()
+
+	sc, err := b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	e, err := sc.Recv()
+	jtest.RequireNil(t, err)
+	require.Equal(t, "one", string(e.MetaData))
+
+	// Resume with a range read from the byte offset.
+	sc, err = b.Stream(context.Background(), e.ID)
+	jtest.RequireNil(t, err)
+
+	for _, exp := range []string{"two", "three"} {
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+		require.Equal(t, exp, string(e.MetaData))
+	}
+}
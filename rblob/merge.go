@@ -0,0 +1,248 @@
+package rblob
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+	"github.com/luno/reflex"
+)
+
+// MergeBuckets returns a reflex.StreamFunc that streams the events of all the
+// buckets merged in timestamp order. Each bucket is streamed in parallel and
+// Recv returns the event with the earliest timestamp (see blob timestamps
+// and WithTimestampFromKey) of the buckets, preferring the first provided
+// bucket on ties.
+//
+// If some buckets have no next event available, Recv waits at most the
+// longest backoff of the buckets (see WithBackoff) for them before returning
+// the earliest available event. Events of such lagging buckets may therefore
+// be streamed after later events of other buckets.
+//
+// The event IDs are composite cursors containing the position of each bucket,
+// so the buckets must always be provided in the same order.
+func MergeBuckets(buckets ...*Bucket) reflex.StreamFunc {
+	return func(ctx context.Context, after string,
+		opts ...reflex.StreamOption) (reflex.StreamClient, error) {
+
+		if len(opts) > 0 {
+			return nil, ErrOptionsNotSupported
+		} else if len(buckets) == 0 {
+			return nil, ErrNoBuckets
+		}
+
+		cursors, err := parseMergeCursor(after, len(buckets))
+		if err != nil {
+			return nil, err
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+
+		m := &mergedStream{
+			ctx:     ctx,
+			cancel:  cancel,
+			cursors: cursors,
+			heads:   make([]*reflex.Event, len(buckets)),
+			pending: make([]bool, len(buckets)),
+			demands: make([]chan struct{}, len(buckets)),
+			results: make(chan mergeResult, len(buckets)),
+		}
+
+		for i, b := range buckets {
+			c, err := parseCursor(cursors[i])
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+
+			if b.backoff > m.backoff {
+				m.backoff = b.backoff
+			}
+
+			m.demands[i] = make(chan struct{}, 1)
+			go m.recvBucket(i, b.newStream(ctx, c))
+		}
+
+		return m, nil
+	}
+}
+
+var (
+	_ reflex.StreamClient = (*mergedStream)(nil)
+	_ io.Closer           = (*mergedStream)(nil)
+)
+
+type mergeResult struct {
+	index int
+	event *reflex.Event
+	err   error
+}
+
+// mergedStream streams the events of multiple buckets in timestamp order.
+type mergedStream struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	backoff time.Duration
+
+	cursors []string        // Cursor of the last event returned per bucket.
+	heads   []*reflex.Event // Next event received per bucket, nil if none.
+	pending []bool          // Next event requested but not yet received per bucket.
+	demands []chan struct{}
+	results chan mergeResult
+	err     error
+}
+
+// recvBucket receives one event from the bucket stream per demand and sends
+// it as result until the context is cancelled or an error is received.
+func (m *mergedStream) recvBucket(i int, s *stream) {
+	defer s.Close()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-m.demands[i]:
+		}
+
+		e, err := s.Recv()
+
+		// Results is buffered for a result per bucket, so this never blocks.
+		m.results <- mergeResult{index: i, event: e, err: err}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Close closes this stream and the underlying bucket streams.
+// Subsequent calls to Close or Recv always return an error.
+func (m *mergedStream) Close() error {
+	if m.err != nil {
+		// Already closed.
+		return m.err
+	}
+
+	m.err = ErrStreamClosed
+	m.cancel()
+
+	return nil
+}
+
+func (m *mergedStream) Recv() (*reflex.Event, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	e, err := m.recv()
+	if err != nil {
+		m.err = err
+		m.cancel()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (m *mergedStream) recv() (*reflex.Event, error) {
+	for i, head := range m.heads {
+		if head == nil && !m.pending[i] {
+			m.demands[i] <- struct{}{}
+			m.pending[i] = true
+		}
+	}
+
+	t := time.NewTimer(m.backoff)
+	defer t.Stop()
+
+wait:
+	for m.anyPending() {
+		select {
+		case <-m.ctx.Done():
+			return nil, m.ctx.Err()
+		case res := <-m.results:
+			if res.err != nil {
+				return nil, errors.Wrap(res.err, "recv bucket", j.KV("bucket", res.index))
+			}
+			m.heads[res.index] = res.event
+			m.pending[res.index] = false
+		case <-t.C:
+			if m.anyHead() {
+				// Don't block available events on lagging buckets.
+				break wait
+			}
+			t.Reset(m.backoff)
+		}
+	}
+
+	next := -1
+	for i, head := range m.heads {
+		if head == nil {
+			continue
+		}
+		if next < 0 || head.Timestamp.Before(m.heads[next].Timestamp) {
+			next = i
+		}
+	}
+
+	e := *m.heads[next]
+	m.heads[next] = nil
+	m.cursors[next] = e.ID
+
+	id, err := formatMergeCursor(m.cursors)
+	if err != nil {
+		return nil, err
+	}
+	e.ID = id
+
+	return &e, nil
+}
+
+func (m *mergedStream) anyPending() bool {
+	for _, p := range m.pending {
+		if p {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mergedStream) anyHead() bool {
+	for _, head := range m.heads {
+		if head != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// formatMergeCursor returns the composite cursor of the bucket cursors
+// formatted as a JSON array. Ex. ["a/1|eof","b/1|01|3"].
+func formatMergeCursor(cursors []string) (string, error) {
+	b, err := json.Marshal(cursors)
+	if err != nil {
+		return "", errors.Wrap(err, "marshal merge cursor")
+	}
+	return string(b), nil
+}
+
+// parseMergeCursor returns the bucket cursors of the composite cursor.
+// It returns empty cursors if the composite cursor is empty.
+func parseMergeCursor(cur string, n int) ([]string, error) {
+	if cur == "" {
+		return make([]string, n), nil
+	}
+
+	var cursors []string
+	if err := json.Unmarshal([]byte(cur), &cursors); err != nil {
+		return nil, errors.Wrap(ErrInvalidCursor, "parse merge cursor", j.KS("cursor", cur))
+	} else if len(cursors) != n {
+		return nil, errors.Wrap(ErrInvalidCursor, "merge cursor bucket count mismatch",
+			j.MKV{"cursor": cur, "buckets": n})
+	}
+
+	return cursors, nil
+}
@@ -0,0 +1,131 @@
+package rblob_test
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex/rblob"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+)
+
+// newMemBucket returns a memblob bucket containing the DTOs of each key
+// timestamped by the key base name (RFC3339).
+func newMemBucket(t *testing.T, label string, blobs map[string][]TestDTO) *rblob.Bucket {
+	ctx := context.Background()
+	bucket := memblob.OpenBucket(nil)
+
+	for key, dtos := range blobs {
+		var data []byte
+		for _, dto := range dtos {
+			b, err := json.Marshal(dto)
+			require.NoError(t, err)
+			data = append(data, b...)
+		}
+		require.NoError(t, bucket.WriteAll(ctx, key, data, &blob.WriterOptions{}))
+	}
+
+	parse := func(key string) (time.Time, error) {
+		return time.Parse(time.RFC3339, path.Base(key))
+	}
+
+	return rblob.NewBucket(label, bucket,
+		rblob.WithTimestampFromKey(parse),
+		rblob.WithBackoff(time.Millisecond*10))
+}
+
+func TestMergeBuckets(t *testing.T) {
+	b1 := newMemBucket(t, "eu", map[string][]TestDTO{
+		"eu/2024-06-01T10:00:00Z": {{ID: 1}, {ID: 2}},
+		"eu/2024-06-01T12:00:00Z": {{ID: 4}},
+		"eu/2024-06-01T14:00:00Z": {{ID: 6}},
+	})
+	defer b1.Close()
+
+	b2 := newMemBucket(t, "us", map[string][]TestDTO{
+		"us/2024-06-01T11:00:00Z": {{ID: 3}},
+		"us/2024-06-01T13:00:00Z": {{ID: 5}},
+	})
+	defer b2.Close()
+
+	stream := rblob.MergeBuckets(b1, b2)
+
+	sc, err := stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	var cursors []string
+	for i := 1; i <= 6; i++ {
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+
+		var dto TestDTO
+		require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+		require.Equal(t, int64(i), dto.ID)
+		cursors = append(cursors, e.ID)
+	}
+	require.Equal(t, `["eu/2024-06-01T12:00:00Z|eof","us/2024-06-01T11:00:00Z|eof"]`, cursors[3])
+
+	// Resume from each composite cursor.
+	for i, cursor := range cursors[:5] {
+		sc, err := stream(context.Background(), cursor)
+		jtest.RequireNil(t, err)
+
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+
+		var dto TestDTO
+		require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+		require.Equal(t, int64(i+2), dto.ID)
+		require.Equal(t, cursors[i+1], e.ID)
+	}
+}
+
+func TestMergeBucketsLagging(t *testing.T) {
+	b1 := newMemBucket(t, "eu", map[string][]TestDTO{
+		"eu/2024-06-01T10:00:00Z": {{ID: 1}, {ID: 2}},
+	})
+	defer b1.Close()
+
+	b2 := newMemBucket(t, "us", nil)
+	defer b2.Close()
+
+	sc, err := rblob.MergeBuckets(b1, b2)(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	for i := 1; i <= 2; i++ {
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+
+		var dto TestDTO
+		require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+		require.Equal(t, int64(i), dto.ID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	sc, err = rblob.MergeBuckets(b1, b2)(ctx, `["eu/2024-06-01T10:00:00Z|eof",""]`)
+	jtest.RequireNil(t, err)
+
+	_, err = sc.Recv()
+	jtest.Require(t, context.DeadlineExceeded, err)
+}
+
+func TestMergeBucketsInvalid(t *testing.T) {
+	b1 := newMemBucket(t, "eu", nil)
+	defer b1.Close()
+
+	_, err := rblob.MergeBuckets()(context.Background(), "")
+	jtest.Require(t, rblob.ErrNoBuckets, err)
+
+	_, err = rblob.MergeBuckets(b1)(context.Background(), "a|eof")
+	jtest.Require(t, rblob.ErrInvalidCursor, err)
+
+	_, err = rblob.MergeBuckets(b1)(context.Background(), `["a|eof","b|eof"]`)
+	jtest.Require(t, rblob.ErrInvalidCursor, err)
+}
@@ -17,11 +17,61 @@ var (
 		Subsystem: "rblob",
 		Name:      "list_skip_total",
 		Help: "Number of list results skipped per bucket. " +
-			"This should be zero, otherwise fix makeStartAfter",
+			"This should be zero, otherwise fix makeBeforeList",
+	}, []string{"bucket"})
+
+	bucketRetryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reflex",
+		Subsystem: "rblob",
+		Name:      "retry_total",
+		Help:      "Number of bucket operations retried due to transient errors per bucket",
+	}, []string{"bucket"})
+
+	keyOffsetGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "reflex",
+		Subsystem: "rblob",
+		Name:      "current_key_offset",
+		Help:      "Offset of the last streamed event within the current blob per bucket",
+	}, []string{"bucket"})
+
+	blobsProcessedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reflex",
+		Subsystem: "rblob",
+		Name:      "blobs_processed_total",
+		Help:      "Number of blobs streamed to completion per bucket",
+	}, []string{"bucket"})
+
+	blobBytesHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "reflex",
+		Subsystem: "rblob",
+		Name:      "blob_bytes",
+		Help:      "Size in bytes of blobs streamed to completion per bucket",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10), // 1KiB to 256MiB.
+	}, []string{"bucket"})
+
+	blobRecordsHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "reflex",
+		Subsystem: "rblob",
+		Name:      "records_per_blob",
+		Help:      "Number of records of blobs streamed to completion per bucket",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"bucket"})
+
+	unstableDeferCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reflex",
+		Subsystem: "rblob",
+		Name:      "unstable_defer_total",
+		Help:      "Number of times a blob was deferred since it was too recently modified per bucket",
 	}, []string{"bucket"})
 )
 
 func init() {
 	prometheus.MustRegister(readCounter)
 	prometheus.MustRegister(listSkipCounter)
+	prometheus.MustRegister(keyOffsetGauge)
+	prometheus.MustRegister(blobsProcessedCounter)
+	prometheus.MustRegister(blobBytesHistogram)
+	prometheus.MustRegister(blobRecordsHistogram)
+	prometheus.MustRegister(bucketRetryCounter)
+	prometheus.MustRegister(unstableDeferCounter)
 }
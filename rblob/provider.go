@@ -0,0 +1,128 @@
+package rblob
+
+import (
+	"context"
+	"io"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"gocloud.dev/blob"
+)
+
+// Provider abstracts the underlying store of a bucket of blobs. It allows
+// streaming from stores that are not supported by gocloud drivers.
+type Provider interface {
+	// List returns an iterator of the keys in the store in lexicographical
+	// order starting after the provided key. Implementations should
+	// skip keys before or equal to startAfter if possible, but
+	// such keys are ignored.
+	List(startAfter string) Iterator
+
+	// NewReader returns a reader of the blob with the provided key.
+	NewReader(ctx context.Context, key string) (Reader, error)
+
+	// Close releases any resources used by the provider.
+	Close() error
+}
+
+// RangeProvider is an optional interface implemented by providers that
+// support reading blobs from a byte offset. It allows resuming
+// streams mid-blob without reading the preceding content.
+type RangeProvider interface {
+	// NewRangeReader returns a reader of the blob with the provided key
+	// starting at the provided byte offset.
+	NewRangeReader(ctx context.Context, key string, offset int64) (Reader, error)
+}
+
+// ChecksumProvider is an optional interface implemented by providers that
+// expose the checksum of blobs, see WithChecksumVerification.
+type ChecksumProvider interface {
+	// MD5 returns the MD5 checksum of the blob with the provided key
+	// or nil if it is not available.
+	MD5(ctx context.Context, key string) ([]byte, error)
+}
+
+// Iterator iterates over the keys of a Provider.
+type Iterator interface {
+	// Next returns the next key or io.EOF if no more keys are available.
+	Next(ctx context.Context) (string, error)
+}
+
+// Reader reads the content of a blob.
+type Reader interface {
+	io.ReadCloser
+
+	// ModTime returns the time the blob was last modified.
+	ModTime() time.Time
+}
+
+// gocloudProvider implements Provider for gocloud buckets.
+type gocloudProvider struct {
+	bucket   *blob.Bucket
+	pageSize int // Zero for the driver default.
+}
+
+func (p *gocloudProvider) List(startAfter string) Iterator {
+	return &gocloudIterator{
+		iter: p.bucket.List(&blob.ListOptions{
+			BeforeList: makeBeforeList(startAfter, p.pageSize),
+		}),
+	}
+}
+
+func (p *gocloudProvider) NewReader(ctx context.Context, key string) (Reader, error) {
+	return p.bucket.NewReader(ctx, key, nil)
+}
+
+func (p *gocloudProvider) NewRangeReader(ctx context.Context, key string,
+	offset int64) (Reader, error) {
+	return p.bucket.NewRangeReader(ctx, key, offset, -1, nil)
+}
+
+// MD5 returns the MD5 checksum from the blob attributes. Note that it is
+// not available for all blobs, eg. s3 multipart uploads.
+func (p *gocloudProvider) MD5(ctx context.Context, key string) ([]byte, error) {
+	attrs, err := p.bucket.Attributes(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return attrs.MD5, nil
+}
+
+func (p *gocloudProvider) Close() error {
+	return p.bucket.Close()
+}
+
+type gocloudIterator struct {
+	iter *blob.ListIterator
+}
+
+func (i *gocloudIterator) Next(ctx context.Context) (string, error) {
+	o, err := i.iter.Next(ctx)
+	if err != nil {
+		return "", err
+	}
+	return o.Key, nil
+}
+
+// makeBeforeList returns a blob.BeforeList function that starts listing after
+// the provided key for improved performance when scanning large buckets. It
+// also limits the number of keys per list page if pageSize is positive.
+// Both are only supported by the s3 driver.
+func makeBeforeList(key string, pageSize int) func(func(interface{}) bool) error {
+	return func(asFunc func(interface{}) bool) error {
+		s3input := new(s3.ListObjectsV2Input)
+		if asFunc(&s3input) {
+			if s3input.Prefix != nil {
+				key = path.Join(*s3input.Prefix, key)
+			}
+			s3input.StartAfter = &key
+			if pageSize > 0 {
+				s3input.MaxKeys = aws.Int64(int64(pageSize))
+			}
+		}
+		return nil
+	}
+}
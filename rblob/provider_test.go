@@ -0,0 +1,972 @@
+package rblob_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex"
+	"github.com/luno/reflex/rblob"
+	"github.com/stretchr/testify/require"
+	"gocloud.dev/gcerrors"
+)
+
+// memProvider is an in-memory implementation of rblob.Provider.
+type memProvider struct {
+	blobs     map[string][]byte
+	t0        time.Time
+	readBytes int64
+}
+
+func newMemProvider(blobs map[string][]TestDTO) *memProvider {
+	res := &memProvider{
+		blobs: make(map[string][]byte),
+		t0:    time.Now(),
+	}
+	for key, dtos := range blobs {
+		var buf bytes.Buffer
+		for _, dto := range dtos {
+			b, _ := json.Marshal(dto)
+			buf.Write(b)
+		}
+		res.blobs[key] = buf.Bytes()
+	}
+	return res
+}
+
+func (p *memProvider) List(startAfter string) rblob.Iterator {
+	var keys []string
+	for key := range p.blobs {
+		if key > startAfter {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return &memIterator{keys: keys}
+}
+
+func (p *memProvider) NewReader(_ context.Context, key string) (rblob.Reader, error) {
+	b, ok := p.blobs[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &memReader{ReadCloser: ioutil.NopCloser(bytes.NewReader(b)), p: p}, nil
+}
+
+func (p *memProvider) NewRangeReader(_ context.Context, key string,
+	offset int64) (rblob.Reader, error) {
+	b, ok := p.blobs[key]
+	if !ok {
+		return nil, errors.New("not found")
+	} else if offset > int64(len(b)) {
+		return nil, errors.New("offset out of range")
+	}
+	return &memReader{ReadCloser: ioutil.NopCloser(bytes.NewReader(b[offset:])), p: p}, nil
+}
+
+func (p *memProvider) Close() error {
+	return nil
+}
+
+type memIterator struct {
+	keys []string
+}
+
+func (i *memIterator) Next(_ context.Context) (string, error) {
+	if len(i.keys) == 0 {
+		return "", io.EOF
+	}
+	key := i.keys[0]
+	i.keys = i.keys[1:]
+	return key, nil
+}
+
+type memReader struct {
+	io.ReadCloser
+	p *memProvider
+}
+
+func (r *memReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.p.readBytes += int64(n)
+	return n, err
+}
+
+func (r *memReader) ModTime() time.Time {
+	return r.p.t0
+}
+
+func TestProvider(t *testing.T) {
+	p := newMemProvider(map[string][]TestDTO{
+		"a": {{ID: 1}, {ID: 2}},
+		"b": {},
+		"c": {{ID: 3}},
+	})
+
+	b := rblob.NewBucketFromProvider("", p)
+	defer b.Close()
+
+	sc, err := b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	for i := 1; i <= 3; i++ {
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+		require.Equal(t, p.t0, e.Timestamp)
+
+		var dto TestDTO
+		err = json.Unmarshal(e.MetaData, &dto)
+		require.NoError(t, err)
+		require.Equal(t, int64(i), dto.ID)
+	}
+
+	// Resume from the middle of a blob.
+	sc, err = b.Stream(context.Background(), "a|01|0")
+	jtest.RequireNil(t, err)
+
+	e, err := sc.Recv()
+	jtest.RequireNil(t, err)
+	require.Equal(t, "a|eof", e.ID)
+}
+
+func TestTimestampFromKey(t *testing.T) {
+	p := newMemProvider(map[string][]TestDTO{
+		"events/2024-06-01T10:00:00Z.json": {{ID: 1}},
+		"events/2024-06-02T10:00:00Z.json": {{ID: 2}},
+		"events/invalid.json":              {{ID: 3}},
+	})
+
+	parse := func(key string) (time.Time, error) {
+		return time.Parse(time.RFC3339, strings.TrimSuffix(path.Base(key), ".json"))
+	}
+
+	b := rblob.NewBucketFromProvider("", p, rblob.WithTimestampFromKey(parse))
+	defer b.Close()
+
+	sc, err := b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	expected := []time.Time{
+		time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(2024, 6, 2, 10, 0, 0, 0, time.UTC),
+		p.t0, // Fallback to mod time.
+	}
+
+	for _, exp := range expected {
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+		require.True(t, exp.Equal(e.Timestamp), "expected %v, got %v", exp, e.Timestamp)
+	}
+}
+
+func TestRecvCtx(t *testing.T) {
+	p := newMemProvider(map[string][]TestDTO{
+		"a": {{ID: 1}, {ID: 2}},
+	})
+
+	b := rblob.NewBucketFromProvider("", p, rblob.WithBackoff(time.Millisecond))
+	defer b.Close()
+
+	sc, err := b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	rc := sc.(interface {
+		RecvCtx(context.Context) (*reflex.Event, error)
+	})
+
+	assertNext := func(id int64) {
+		t.Helper()
+		e, err := rc.RecvCtx(context.Background())
+		jtest.RequireNil(t, err)
+		var dto TestDTO
+		require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+		require.Equal(t, id, dto.ID)
+	}
+
+	// Cancelled call mid blob.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = rc.RecvCtx(ctx)
+	jtest.Require(t, context.Canceled, err)
+
+	assertNext(1)
+	assertNext(2)
+
+	// Timeout waiting for the next blob.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	_, err = rc.RecvCtx(ctx)
+	jtest.Require(t, context.DeadlineExceeded, err)
+
+	// Stream remains usable.
+	p.blobs["b"] = []byte(`{"id":3}`)
+	assertNext(3)
+}
+
+func TestRangeResume(t *testing.T) {
+	const n = 1000
+
+	var dtos []TestDTO
+	for i := 1; i <= n; i++ {
+		dtos = append(dtos, TestDTO{ID: int64(i)})
+	}
+	p := newMemProvider(map[string][]TestDTO{"a": dtos})
+
+	b := rblob.NewBucketFromProvider("", p)
+	defer b.Close()
+
+	sc, err := b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	var last *reflex.Event
+	for i := 0; i < n-10; i++ {
+		last, err = sc.Recv()
+		jtest.RequireNil(t, err)
+	}
+	require.True(t, strings.HasPrefix(last.ID, "a|03|989|"), last.ID)
+
+	resume := func(after string) int64 {
+		t.Helper()
+		p.readBytes = 0
+
+		sc, err := b.Stream(context.Background(), after)
+		jtest.RequireNil(t, err)
+
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+
+		var dto TestDTO
+		require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+		require.Equal(t, int64(n-9), dto.ID)
+
+		return p.readBytes
+	}
+
+	// Range read from the byte offset in the cursor.
+	ranged := resume(last.ID)
+
+	// Fallback to gobbling without a byte offset.
+	gobbled := resume("a|03|989")
+
+	require.Less(t, ranged*10, gobbled)
+}
+
+func TestDecoderSelector(t *testing.T) {
+	p := newMemProvider(map[string][]TestDTO{
+		"a.json": {{ID: 1}, {ID: 2}},
+		"c.json": {{ID: 5}},
+	})
+	p.blobs["b.csv"] = []byte("3,three\n4,four\n")
+
+	selector := func(key string) (func(io.Reader) (rblob.Decoder, error), error) {
+		switch path.Ext(key) {
+		case ".csv":
+			return csvDecoder, nil
+		case ".json":
+			return nil, nil // Use default.
+		default:
+			return nil, errors.New("unknown format")
+		}
+	}
+
+	b := rblob.NewBucketFromProvider("", p, rblob.WithDecoderSelector(selector))
+	defer b.Close()
+
+	assertStream := func(after string, ids ...int64) {
+		t.Helper()
+
+		sc, err := b.Stream(context.Background(), after)
+		jtest.RequireNil(t, err)
+
+		for _, id := range ids {
+			e, err := sc.Recv()
+			jtest.RequireNil(t, err)
+
+			var dto TestDTO
+			require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+			require.Equal(t, id, dto.ID)
+		}
+	}
+
+	assertStream("", 1, 2, 3, 4, 5)
+
+	// Resume mid csv blob.
+	assertStream("b.csv|01|0", 4, 5)
+
+	// Selector errors are returned.
+	p.blobs["d.xml"] = []byte("<id>6</id>")
+	sc, err := b.Stream(context.Background(), "c.json|eof")
+	jtest.RequireNil(t, err)
+	_, err = sc.Recv()
+	require.Error(t, err)
+}
+
+// csvDecoder decodes "id,field" csv rows into json TestDTOs.
+func csvDecoder(r io.Reader) (rblob.Decoder, error) {
+	return &csvDec{r: csv.NewReader(r)}, nil
+}
+
+type csvDec struct {
+	r *csv.Reader
+}
+
+func (d *csvDec) Decode() ([]byte, error) {
+	rec, err := d.r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseInt(rec[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(TestDTO{ID: id, Field: rec[1]})
+}
+
+func TestEmptyRecords(t *testing.T) {
+	content := []byte("{}\n\n# comment\n{\"id\":1}\n\n")
+
+	readAll := func(t *testing.T, b *rblob.Bucket, after string) []string {
+		t.Helper()
+
+		sc, err := b.Stream(context.Background(), after)
+		jtest.RequireNil(t, err)
+
+		var res []string
+		for {
+			e, err := sc.Recv()
+			jtest.RequireNil(t, err)
+			res = append(res, string(e.MetaData))
+			if strings.HasSuffix(e.ID, "|eof") {
+				return res
+			}
+		}
+	}
+
+	cases := []struct {
+		name    string
+		opts    []rblob.Option
+		exp     []string
+		after   string // Resume cursor.
+		expRest []string
+	}{
+		{
+			name:    "lines skip empty",
+			opts:    []rblob.Option{rblob.WithDecoder(lineDecoder)},
+			exp:     []string{"{}", `{"id":1}`},
+			after:   "a|01|0",
+			expRest: []string{`{"id":1}`},
+		},
+		{
+			name:    "lines keep empty",
+			opts:    []rblob.Option{rblob.WithDecoder(lineDecoder), rblob.WithKeepEmptyRecords(true)},
+			exp:     []string{"{}", "", `{"id":1}`, ""},
+			after:   "a|01|1",
+			expRest: []string{`{"id":1}`, ""},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			p := newMemProvider(nil)
+			p.blobs["a"] = content
+
+			b := rblob.NewBucketFromProvider("", p, test.opts...)
+			defer b.Close()
+
+			require.Equal(t, test.exp, readAll(t, b, ""))
+			require.Equal(t, test.expRest, readAll(t, b, test.after))
+		})
+	}
+
+	t.Run("json empty objects", func(t *testing.T) {
+		p := newMemProvider(nil)
+		p.blobs["a"] = []byte("{}\n\n{\"id\":1}\n\n{}")
+
+		b := rblob.NewBucketFromProvider("", p)
+		defer b.Close()
+
+		require.Equal(t, []string{"{}", `{"id":1}`, "{}"}, readAll(t, b, ""))
+	})
+}
+
+// lineDecoder decodes blobs into lines. It returns empty non-nil slices
+// for blank lines and nil slices for comment lines.
+func lineDecoder(r io.Reader) (rblob.Decoder, error) {
+	return &lineDec{s: bufio.NewScanner(r)}, nil
+}
+
+type lineDec struct {
+	s *bufio.Scanner
+}
+
+func (d *lineDec) Decode() ([]byte, error) {
+	if !d.s.Scan() {
+		if err := d.s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	if strings.HasPrefix(d.s.Text(), "#") {
+		return nil, nil
+	}
+
+	return append([]byte{}, d.s.Bytes()...), nil
+}
+
+func TestBucketRetry(t *testing.T) {
+	newFlaky := func(fails int) *flakyProvider {
+		return &flakyProvider{
+			memProvider: newMemProvider(map[string][]TestDTO{
+				"a": {{ID: 1}, {ID: 2}},
+				"b": {{ID: 3}},
+			}),
+			listFails: fails,
+			readFails: fails,
+		}
+	}
+
+	recvN := func(t *testing.T, b *rblob.Bucket, after string, n int) error {
+		t.Helper()
+
+		sc, err := b.Stream(context.Background(), after)
+		jtest.RequireNil(t, err)
+
+		for i := 0; i < n; i++ {
+			_, err := sc.Recv()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	t.Run("retried", func(t *testing.T) {
+		p := newFlaky(2)
+		b := rblob.NewBucketFromProvider("", p, rblob.WithBucketRetry(3, time.Millisecond))
+		jtest.RequireNil(t, recvN(t, b, "", 3))
+
+		// Resume mid blob reads the current blob.
+		p.readFails = 2
+		jtest.RequireNil(t, recvN(t, b, "a|01|0", 1))
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		p := newFlaky(3)
+		b := rblob.NewBucketFromProvider("", p, rblob.WithBucketRetry(3, time.Millisecond))
+		jtest.Require(t, errTransient, recvN(t, b, "", 1))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		p := newFlaky(1)
+		b := rblob.NewBucketFromProvider("", p)
+		jtest.Require(t, errTransient, recvN(t, b, "", 1))
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		dir, err := os.Getwd()
+		require.NoError(t, err)
+
+		b, err := rblob.OpenBucket(context.Background(), "", "file:///"+path.Join(dir, "testdata"),
+			rblob.WithBucketRetry(3, time.Hour))
+		jtest.RequireNil(t, err)
+		defer b.Close()
+
+		// Not found returned immediately.
+		err = recvN(t, b, "missing|01|0", 1)
+		require.Error(t, err)
+		require.Equal(t, gcerrors.NotFound, gcerrors.Code(err))
+	})
+}
+
+var errTransient = errors.New("service unavailable")
+
+// flakyProvider wraps a memProvider and returns transient errors
+// for the first list and read calls.
+type flakyProvider struct {
+	*memProvider
+	listFails int
+	readFails int
+}
+
+func (p *flakyProvider) List(startAfter string) rblob.Iterator {
+	if p.listFails > 0 {
+		p.listFails--
+		return &errIterator{err: errTransient}
+	}
+	return p.memProvider.List(startAfter)
+}
+
+func (p *flakyProvider) NewReader(ctx context.Context, key string) (rblob.Reader, error) {
+	if p.readFails > 0 {
+		p.readFails--
+		return nil, errTransient
+	}
+	return p.memProvider.NewReader(ctx, key)
+}
+
+type errIterator struct {
+	err error
+}
+
+func (i *errIterator) Next(context.Context) (string, error) {
+	return "", i.err
+}
+
+// listCountingProvider wraps a memProvider and counts list calls.
+type listCountingProvider struct {
+	*memProvider
+	lists int
+}
+
+func (p *listCountingProvider) List(startAfter string) rblob.Iterator {
+	p.lists++
+	return p.memProvider.List(startAfter)
+}
+
+func newManyKeysProvider(n int) *listCountingProvider {
+	p := newMemProvider(nil)
+	for i := 0; i < n; i++ {
+		p.blobs[fmt.Sprintf("%06d", i)] = []byte(fmt.Sprintf(`{"id":%d}`, i))
+	}
+	return &listCountingProvider{memProvider: p}
+}
+
+func TestManyKeys(t *testing.T) {
+	const n = 500
+	p := newManyKeysProvider(n)
+
+	b := rblob.NewBucketFromProvider("", p, rblob.WithBackoff(time.Millisecond))
+	defer b.Close()
+
+	sc, err := b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	recv := func(id int64) {
+		t.Helper()
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+		var dto TestDTO
+		require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+		require.Equal(t, id, dto.ID)
+	}
+
+	for i := 0; i < n; i++ {
+		recv(int64(i))
+	}
+
+	// A single listing is reused for all keys.
+	require.Equal(t, 1, p.lists)
+
+	// Keys added after the listing reached the end are found by relisting.
+	p.blobs[fmt.Sprintf("%06d", n)] = []byte(fmt.Sprintf(`{"id":%d}`, n))
+	recv(n)
+	require.Greater(t, p.lists, 1)
+
+	// Resuming from a cursor starts a new listing.
+	sc, err = b.Stream(context.Background(), "000100|eof")
+	jtest.RequireNil(t, err)
+	lists := p.lists
+	recv(101)
+	require.Equal(t, lists+1, p.lists)
+}
+
+func BenchmarkManyKeys(b *testing.B) {
+	p := newManyKeysProvider(b.N)
+
+	bucket := rblob.NewBucketFromProvider("", p)
+	defer bucket.Close()
+
+	sc, err := bucket.Stream(context.Background(), "")
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := sc.Recv()
+		require.NoError(b, err)
+	}
+}
+
+// unsortedProvider wraps a memProvider and lists keys in the configured order.
+type unsortedProvider struct {
+	*memProvider
+	keys []string
+}
+
+func (p *unsortedProvider) List(string) rblob.Iterator {
+	return &memIterator{keys: append([]string(nil), p.keys...)}
+}
+
+func TestValidate(t *testing.T) {
+	newProvider := func() *memProvider {
+		return newMemProvider(map[string][]TestDTO{
+			"a": {{ID: 1}},
+			"b": {},
+			"c": {{ID: 2}, {ID: 3}},
+		})
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		b := rblob.NewBucketFromProvider("", newProvider())
+		jtest.RequireNil(t, b.Validate(context.Background()))
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		p := &unsortedProvider{memProvider: newProvider(), keys: []string{"a", "c", "b"}}
+		b := rblob.NewBucketFromProvider("", p)
+		err := b.Validate(context.Background())
+		jtest.Require(t, rblob.ErrKeysNotIncreasing, err)
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		p := &unsortedProvider{memProvider: newProvider(), keys: []string{"a", "a"}}
+		b := rblob.NewBucketFromProvider("", p)
+		err := b.Validate(context.Background())
+		jtest.Require(t, rblob.ErrKeysNotIncreasing, err)
+	})
+
+	t.Run("not decodable", func(t *testing.T) {
+		p := newProvider()
+		p.blobs["b"] = []byte("not json")
+		b := rblob.NewBucketFromProvider("", p)
+		err := b.Validate(context.Background())
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "decode first record")
+	})
+
+	t.Run("decoder selector", func(t *testing.T) {
+		p := newProvider()
+		p.blobs["b"] = []byte("1,one\n")
+		selector := func(key string) (func(io.Reader) (rblob.Decoder, error), error) {
+			if key == "b" {
+				return csvDecoder, nil
+			}
+			return nil, nil
+		}
+		b := rblob.NewBucketFromProvider("", p, rblob.WithDecoderSelector(selector))
+		jtest.RequireNil(t, b.Validate(context.Background()))
+	})
+}
+
+func TestStreamFrom(t *testing.T) {
+	dtos := func(ids ...int64) []TestDTO {
+		var res []TestDTO
+		for _, id := range ids {
+			res = append(res, TestDTO{ID: id})
+		}
+		return res
+	}
+	p := newMemProvider(map[string][]TestDTO{
+		"a": dtos(1, 2, 3),
+		"b": dtos(4, 5, 6),
+		"c": dtos(7, 8, 9),
+	})
+
+	b := rblob.NewBucketFromProvider("", p)
+	defer b.Close()
+
+	tests := []struct {
+		Name    string
+		Key     string
+		Offset  int64
+		Expect  []int64
+		FirstID string
+	}{
+		{
+			Name:    "start of blob",
+			Key:     "b",
+			Offset:  0,
+			Expect:  []int64{4, 5, 6, 7, 8, 9},
+			FirstID: "b|01|0",
+		}, {
+			Name:    "mid blob",
+			Key:     "b",
+			Offset:  1,
+			Expect:  []int64{5, 6, 7, 8, 9},
+			FirstID: "b|01|1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			sc, err := b.StreamFrom(context.Background(), test.Key, test.Offset)
+			jtest.RequireNil(t, err)
+
+			for i, id := range test.Expect {
+				e, err := sc.Recv()
+				jtest.RequireNil(t, err)
+
+				var dto TestDTO
+				require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+				require.Equal(t, id, dto.ID)
+				if i == 0 {
+					require.True(t, strings.HasPrefix(e.ID, test.FirstID), e.ID)
+				}
+			}
+		})
+	}
+
+	_, err := b.StreamFrom(context.Background(), "missing", 0)
+	require.Error(t, err)
+
+	_, err = b.StreamFrom(context.Background(), "b", -1)
+	require.Error(t, err)
+
+	sc, err := b.StreamFrom(context.Background(), "b", 4)
+	jtest.RequireNil(t, err)
+	_, err = sc.Recv()
+	jtest.Require(t, rblob.ErrCursorOutOfRange, err)
+}
+
+func TestStreamErrors(t *testing.T) {
+	p := newMemProvider(map[string][]TestDTO{
+		"a": {{ID: 1}, {ID: 2}},
+	})
+
+	b := rblob.NewBucketFromProvider("", p)
+	defer b.Close()
+
+	ctx := context.Background()
+
+	for _, cursor := range []string{"a", "a|01|x", "a|01|1|0", "a|01|1|2|3"} {
+		_, err := b.Stream(ctx, cursor)
+		jtest.Require(t, rblob.ErrInvalidCursor, err, cursor)
+	}
+
+	_, err := b.StreamFrom(ctx, "a", -1)
+	jtest.Require(t, rblob.ErrInvalidCursor, err)
+
+	_, err = b.Stream(ctx, "", reflex.WithStreamToHead())
+	jtest.Require(t, rblob.ErrOptionsNotSupported, err)
+
+	_, err = b.StreamFrom(ctx, "a", 0, reflex.WithStreamToHead())
+	jtest.Require(t, rblob.ErrOptionsNotSupported, err)
+
+	// Cursor after the last record.
+	sc, err := b.Stream(ctx, "a|01|2")
+	jtest.RequireNil(t, err)
+	_, err = sc.Recv()
+	jtest.Require(t, rblob.ErrCursorOutOfRange, err)
+
+	// Cursor at the last record that isn't marked eof.
+	sc, err = b.Stream(ctx, "a|01|1")
+	jtest.RequireNil(t, err)
+	_, err = sc.Recv()
+	jtest.Require(t, rblob.ErrCursorEOF, err)
+
+	sc, err = b.Stream(ctx, "")
+	jtest.RequireNil(t, err)
+	jtest.RequireNil(t, sc.(io.Closer).Close())
+	_, err = sc.Recv()
+	jtest.Require(t, rblob.ErrStreamClosed, err)
+
+	_, err = rblob.OpenBucket(ctx, "", "mem://?prefix=a")
+	jtest.Require(t, rblob.ErrInvalidPrefix, err)
+}
+
+func TestKeyStream(t *testing.T) {
+	p := newMemProvider(map[string][]TestDTO{
+		"shard=01/2024-06.json": {{ID: 1}, {ID: 2}},
+		"shard=01/2024-08.json": {{ID: 5}},
+		"shard=02/2024-05.json": {{ID: 0}},
+		"shard=02/2024-07.json": {{ID: 3}, {ID: 4}},
+	})
+
+	// Stream the keys of all shards ordered by the month in the key.
+	month := func(key string) string {
+		return path.Base(key)
+	}
+	keyStream := func(ctx context.Context, bucket, prev string) (string, error) {
+		require.Equal(t, "sharded", bucket)
+
+		var keys []string
+		for key := range p.blobs {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return month(keys[i]) < month(keys[j])
+		})
+
+		for _, key := range keys {
+			if prev == "" || month(key) > month(prev) {
+				return key, nil
+			}
+		}
+		return "", io.EOF
+	}
+
+	b := rblob.NewBucketFromProvider("sharded", p, rblob.WithKeyStream(keyStream),
+		rblob.WithBackoff(time.Millisecond))
+	defer b.Close()
+
+	jtest.RequireNil(t, b.Validate(context.Background()))
+
+	recv := func(after string, ids ...int64) string {
+		t.Helper()
+		sc, err := b.Stream(context.Background(), after)
+		jtest.RequireNil(t, err)
+
+		var last string
+		for _, id := range ids {
+			e, err := sc.Recv()
+			jtest.RequireNil(t, err)
+
+			var dto TestDTO
+			require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+			require.Equal(t, id, dto.ID)
+			last = e.ID
+		}
+		return last
+	}
+
+	last := recv("", 0, 1, 2, 3)
+	require.True(t, strings.HasPrefix(last, "shard=02/2024-07.json|01|0"), last)
+
+	// Cursors contain the key returned by the key stream.
+	recv(last, 4, 5)
+
+	// Key stream errors are returned.
+	errStream := errors.New("key stream")
+	b = rblob.NewBucketFromProvider("", p, rblob.WithKeyStream(
+		func(context.Context, string, string) (string, error) {
+			return "", errStream
+		}))
+	sc, err := b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+	_, err = sc.Recv()
+	jtest.Require(t, errStream, err)
+}
+
+// checksumProvider is a memProvider that exposes the MD5 checksum of blobs.
+type checksumProvider struct {
+	*memProvider
+	md5s map[string][]byte
+}
+
+func (p *checksumProvider) MD5(_ context.Context, key string) ([]byte, error) {
+	return p.md5s[key], nil
+}
+
+func TestChecksumVerification(t *testing.T) {
+	p := &checksumProvider{
+		memProvider: newMemProvider(map[string][]TestDTO{
+			"1.json": {{ID: 1}, {ID: 2}},
+			"2.json": {{ID: 3}, {ID: 4}},
+		}),
+		md5s: make(map[string][]byte),
+	}
+	for key, b := range p.blobs {
+		sum := md5.Sum(b)
+		p.md5s[key] = sum[:]
+	}
+
+	// Tamper with the second blob after upload.
+	p.blobs["2.json"] = newMemProvider(map[string][]TestDTO{
+		"2.json": {{ID: 3}, {ID: 5}},
+	}).blobs["2.json"]
+
+	b := rblob.NewBucketFromProvider("checksum", p, rblob.WithChecksumVerification())
+
+	err := b.Validate(context.Background())
+	jtest.Require(t, rblob.ErrChecksumMismatch, err)
+
+	sc, err := b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	var cursors []string
+	for _, id := range []int64{1, 2} {
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+
+		var dto TestDTO
+		require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+		require.Equal(t, id, dto.ID)
+		cursors = append(cursors, e.ID)
+	}
+
+	// Cursor after the first record of the second blob.
+	cursor := strings.Replace(cursors[0], "1.json", "2.json", 1)
+
+	// No records of the tampered blob are streamed.
+	_, err = sc.Recv()
+	jtest.Require(t, rblob.ErrChecksumMismatch, err)
+
+	// Blobs resumed from the middle are also verified.
+	sc, err = b.Stream(context.Background(), cursor)
+	jtest.RequireNil(t, err)
+	_, err = sc.Recv()
+	jtest.Require(t, rblob.ErrChecksumMismatch, err)
+
+	// Untampered blobs resumed from the middle are streamed.
+	p.blobs["2.json"] = newMemProvider(map[string][]TestDTO{
+		"2.json": {{ID: 3}, {ID: 4}},
+	}).blobs["2.json"]
+	sc, err = b.Stream(context.Background(), cursor)
+	jtest.RequireNil(t, err)
+	e, err := sc.Recv()
+	jtest.RequireNil(t, err)
+	var dto TestDTO
+	require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+	require.Equal(t, int64(4), dto.ID)
+
+	// Providers without checksums are not supported.
+	b = rblob.NewBucketFromProvider("checksum", p.memProvider, rblob.WithChecksumVerification())
+	sc, err = b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+	_, err = sc.Recv()
+	jtest.Require(t, rblob.ErrChecksumUnavailable, err)
+}
+
+func TestCompactCursors(t *testing.T) {
+	prefix := strings.Repeat("year=2024/month=06/day=01/", 4)
+	p := newMemProvider(map[string][]TestDTO{
+		prefix + "a": {{ID: 1}, {ID: 2}},
+		prefix + "b": {{ID: 3}},
+	})
+
+	b := rblob.NewBucketFromProvider("", p, rblob.WithCompactCursors())
+	defer b.Close()
+
+	sc, err := b.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	var ids []string
+	for i := 1; i <= 3; i++ {
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+		require.NotContains(t, e.ID, "|")
+		require.Less(t, len(e.ID), len(prefix))
+		ids = append(ids, e.ID)
+	}
+
+	// Resume from compact and legacy cursors.
+	for _, after := range []string{ids[0], prefix + "a|01|0"} {
+		sc, err = b.Stream(context.Background(), after)
+		jtest.RequireNil(t, err)
+
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+		require.Equal(t, ids[1], e.ID)
+
+		var dto TestDTO
+		require.NoError(t, json.Unmarshal(e.MetaData, &dto))
+		require.Equal(t, int64(2), dto.ID)
+	}
+}
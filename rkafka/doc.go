@@ -0,0 +1,12 @@
+// Package rkafka provides a reflex stream for messages of a kafka topic
+// partition. It wraps a kafka client via the minimal Consumer interface
+// so that it does not depend on a specific kafka library.
+//
+// Each partition is streamed independently since kafka only orders
+// messages within a partition. The message partition and offset is used as
+// the event ID (and therefore cursor), ex. "1:42", the message key as the
+// foreign ID and the message value as the metadata. Consumers of multiple
+// partitions should therefore store a cursor per partition, e.g. by
+// including the partition in the consumer name. Cursors of other
+// partitions are rejected.
+package rkafka
@@ -0,0 +1,12 @@
+package rkafka
+
+import (
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+)
+
+var (
+	ErrOptionsNotSupported = errors.New("options not supported", j.C("ERR_a828d78a1152a5fc"))
+	ErrInvalidCursor       = errors.New("invalid cursor", j.C("ERR_7b1b35c069187455"))
+	ErrStreamClosed        = errors.New("stream closed", j.C("ERR_f3494a8ba5f01bd6"))
+)
@@ -0,0 +1,208 @@
+package rkafka
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+	"github.com/luno/jettison/log"
+	"github.com/luno/reflex"
+)
+
+const (
+	// OffsetNewest requests a partition consumer starting at the next
+	// message produced to the partition.
+	OffsetNewest int64 = -1
+
+	// OffsetOldest requests a partition consumer starting at the oldest
+	// message available in the partition.
+	OffsetOldest int64 = -2
+)
+
+// Consumer abstracts a kafka client. It is usually implemented by a thin
+// wrapper around the kafka library of choice.
+type Consumer interface {
+	// ConsumePartition returns a consumer of the topic partition starting at
+	// the provided offset (inclusive) or at OffsetNewest or OffsetOldest.
+	ConsumePartition(ctx context.Context, topic string, partition int32,
+		offset int64) (PartitionConsumer, error)
+}
+
+// PartitionConsumer consumes the messages of a single topic partition.
+type PartitionConsumer interface {
+	// Recv blocks until the next message is available and returns it.
+	Recv(ctx context.Context) (*Message, error)
+
+	// Close releases any resources used by the partition consumer.
+	Close() error
+}
+
+// Message is a kafka message.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Timestamp time.Time
+}
+
+// NewPartition returns a partition of the kafka topic that can be streamed.
+func NewPartition(consumer Consumer, topic string, partition int32) *Partition {
+	return &Partition{
+		consumer:  consumer,
+		topic:     topic,
+		partition: partition,
+	}
+}
+
+// Partition provides a reflex stream of the messages of a kafka topic partition.
+type Partition struct {
+	consumer  Consumer
+	topic     string
+	partition int32
+}
+
+// Stream implements reflex.StreamFunc and returns a StreamClient that
+// streams messages of the partition after the provided cursor.
+// The cursor is the partition and offset of the last consumed message,
+// see FormatCursor. An empty cursor streams from the oldest available
+// message and cursors of other partitions return ErrInvalidCursor.
+//
+// Only the reflex.WithStreamFromHead option is supported.
+//
+// Note: The returned StreamClient implementation also exposes a
+// Close method which releases the underlying partition consumer.
+// Close is called internally when Recv returns an error.
+func (p *Partition) Stream(ctx context.Context, after string,
+	opts ...reflex.StreamOption) (reflex.StreamClient, error) {
+
+	var o reflex.StreamOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.StreamToHead || o.Lag > 0 || o.Limit > 0 || o.SkipMetadata != nil {
+		return nil, ErrOptionsNotSupported
+	}
+
+	offset, err := p.startOffset(after, o.StreamFromHead)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := p.consumer.ConsumePartition(ctx, p.topic, p.partition, offset)
+	if err != nil {
+		return nil, errors.Wrap(err, "consume partition",
+			j.MKV{"topic": p.topic, "partition": p.partition})
+	}
+
+	return &stream{
+		ctx: ctx,
+		pc:  pc,
+	}, nil
+}
+
+// startOffset returns the offset to consume from given the cursor.
+func (p *Partition) startOffset(after string, fromHead bool) (int64, error) {
+	if fromHead {
+		return OffsetNewest, nil
+	} else if after == "" {
+		return OffsetOldest, nil
+	}
+
+	partition, offset, err := ParseCursor(after)
+	if err != nil {
+		return 0, err
+	} else if partition != p.partition {
+		return 0, errors.Wrap(ErrInvalidCursor, "cursor of another partition",
+			j.MKV{"cursor": after, "partition": p.partition})
+	}
+
+	return offset + 1, nil
+}
+
+// FormatCursor returns the cursor of the message at the partition offset
+// formatted as "partition:offset", ex. "1:42". It is the event ID of
+// streamed messages.
+func FormatCursor(partition int32, offset int64) string {
+	return strconv.FormatInt(int64(partition), 10) + ":" + strconv.FormatInt(offset, 10)
+}
+
+// ParseCursor returns the partition and offset of the cursor or
+// ErrInvalidCursor, see FormatCursor.
+func ParseCursor(cursor string) (int32, int64, error) {
+	i := strings.Index(cursor, ":")
+	if i < 0 {
+		return 0, 0, errors.Wrap(ErrInvalidCursor, "missing partition", j.KS("cursor", cursor))
+	}
+
+	partition, err := strconv.ParseInt(cursor[:i], 10, 32)
+	if err != nil || partition < 0 {
+		return 0, 0, errors.Wrap(ErrInvalidCursor, "invalid partition", j.KS("cursor", cursor))
+	}
+
+	offset, err := strconv.ParseInt(cursor[i+1:], 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, errors.Wrap(ErrInvalidCursor, "invalid offset", j.KS("cursor", cursor))
+	}
+
+	return int32(partition), offset, nil
+}
+
+var (
+	_ reflex.StreamClient = (*stream)(nil)
+	_ io.Closer           = (*stream)(nil)
+)
+
+type stream struct {
+	ctx context.Context
+	pc  PartitionConsumer
+	err error
+}
+
+// Close closes this stream and the partition consumer.
+// Subsequent calls to Close or Recv always return an error.
+func (s *stream) Close() error {
+	if s.err != nil {
+		// Already closed.
+		return s.err
+	}
+
+	s.err = ErrStreamClosed
+
+	return s.pc.Close()
+}
+
+func (s *stream) Recv() (*reflex.Event, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	m, err := s.pc.Recv(s.ctx)
+	if err != nil {
+		s.err = err
+		if closeErr := s.pc.Close(); closeErr != nil {
+			log.Error(s.ctx, errors.Wrap(closeErr, "partition consumer close"))
+		}
+		return nil, err
+	}
+
+	return &reflex.Event{
+		ID:        FormatCursor(m.Partition, m.Offset),
+		Type:      etype(0),
+		ForeignID: string(m.Key),
+		Timestamp: m.Timestamp,
+		MetaData:  m.Value,
+	}, nil
+}
+
+type etype int
+
+func (e etype) ReflexType() int {
+	return int(e)
+}
@@ -0,0 +1,207 @@
+package rkafka_test
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/luno/fate"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex"
+	"github.com/luno/reflex/rkafka"
+	"github.com/luno/reflex/rpatterns"
+	"github.com/stretchr/testify/require"
+)
+
+const topic = "test"
+
+func TestStream(t *testing.T) {
+	tests := []struct {
+		Name   string
+		After  string
+		Opts   []reflex.StreamOption
+		Offset int64 // Requested offset.
+		Expect []int64
+	}{
+		{
+			Name:   "empty cursor",
+			Offset: rkafka.OffsetOldest,
+			Expect: []int64{0, 1, 2, 3, 4},
+		}, {
+			Name:   "resume",
+			After:  "1:2",
+			Offset: 3,
+			Expect: []int64{3, 4},
+		}, {
+			Name:   "from head",
+			After:  "1:2",
+			Opts:   []reflex.StreamOption{reflex.WithStreamFromHead()},
+			Offset: rkafka.OffsetNewest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			c := newMockConsumer(5)
+			p := rkafka.NewPartition(c, topic, 1)
+
+			sc, err := p.Stream(context.Background(), test.After, test.Opts...)
+			jtest.RequireNil(t, err)
+			require.Equal(t, []int64{test.Offset}, c.offsets)
+
+			for _, offset := range test.Expect {
+				e, err := sc.Recv()
+				jtest.RequireNil(t, err)
+				id := strconv.FormatInt(offset, 10)
+				require.Equal(t, "1:"+id, e.ID)
+				require.Equal(t, "key"+id, e.ForeignID)
+				require.Equal(t, "value"+id, string(e.MetaData))
+				require.Equal(t, time.Unix(offset, 0), e.Timestamp)
+				require.Equal(t, 0, e.Type.ReflexType())
+			}
+
+			_, err = sc.Recv()
+			jtest.Require(t, io.EOF, err)
+			require.True(t, c.closed)
+
+			// Stream remains closed.
+			_, err = sc.Recv()
+			jtest.Require(t, io.EOF, err)
+		})
+	}
+}
+
+func TestStreamErrors(t *testing.T) {
+	p := rkafka.NewPartition(newMockConsumer(1), topic, 0)
+
+	for _, cursor := range []string{"invalid", "2", "0:-3", "-1:2", "0:x", "1:2"} {
+		_, err := p.Stream(context.Background(), cursor)
+		jtest.Require(t, rkafka.ErrInvalidCursor, err)
+	}
+
+	_, err := p.Stream(context.Background(), "0:2")
+	jtest.RequireNil(t, err)
+
+	_, err = p.Stream(context.Background(), "", reflex.WithStreamToHead())
+	jtest.Require(t, rkafka.ErrOptionsNotSupported, err)
+
+	_, err = p.Stream(context.Background(), "", reflex.WithStreamLag(time.Minute))
+	jtest.Require(t, rkafka.ErrOptionsNotSupported, err)
+}
+
+func TestClose(t *testing.T) {
+	c := newMockConsumer(5)
+	p := rkafka.NewPartition(c, topic, 0)
+
+	sc, err := p.Stream(context.Background(), "")
+	jtest.RequireNil(t, err)
+
+	_, err = sc.Recv()
+	jtest.RequireNil(t, err)
+
+	closer, ok := sc.(io.Closer)
+	require.True(t, ok)
+	jtest.RequireNil(t, closer.Close())
+	require.True(t, c.closed)
+
+	_, err = sc.Recv()
+	jtest.Require(t, rkafka.ErrStreamClosed, err)
+}
+
+func TestResumeFromCursorStore(t *testing.T) {
+	var errStop = errors.New("stop")
+	cstore := rpatterns.MemCursorStore()
+
+	run := func(stopAt int64) []string {
+		var ids []string
+		consumer := reflex.NewConsumer("kafka_1",
+			func(ctx context.Context, f fate.Fate, e *reflex.Event) error {
+				_, offset, err := rkafka.ParseCursor(e.ID)
+				if err != nil {
+					return err
+				} else if offset == stopAt {
+					return errStop
+				}
+				ids = append(ids, e.ID)
+				return nil
+			})
+
+		p := rkafka.NewPartition(newMockConsumer(5), topic, 1)
+		err := reflex.Run(context.Background(),
+			reflex.NewSpec(p.Stream, cstore, consumer))
+		require.Error(t, err)
+
+		return ids
+	}
+
+	require.Equal(t, []string{"1:0", "1:1", "1:2"}, run(3))
+	require.Equal(t, []string{"1:3", "1:4"}, run(-1))
+}
+
+// mockConsumer is a Consumer of a single partition of n messages.
+// Partition consumers return io.EOF after the last message.
+type mockConsumer struct {
+	n       int64
+	offsets []int64 // Requested offsets.
+	closed  bool
+}
+
+func newMockConsumer(n int64) *mockConsumer {
+	return &mockConsumer{n: n}
+}
+
+func (c *mockConsumer) ConsumePartition(_ context.Context, topic string,
+	partition int32, offset int64) (rkafka.PartitionConsumer, error) {
+
+	c.offsets = append(c.offsets, offset)
+
+	next := offset
+	if offset == rkafka.OffsetOldest {
+		next = 0
+	} else if offset == rkafka.OffsetNewest {
+		next = c.n
+	}
+
+	return &mockPartitionConsumer{
+		consumer:  c,
+		topic:     topic,
+		partition: partition,
+		next:      next,
+	}, nil
+}
+
+type mockPartitionConsumer struct {
+	consumer  *mockConsumer
+	topic     string
+	partition int32
+	next      int64
+}
+
+func (pc *mockPartitionConsumer) Recv(ctx context.Context) (*rkafka.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	} else if pc.next >= pc.consumer.n {
+		return nil, io.EOF
+	}
+
+	offset := pc.next
+	pc.next++
+
+	id := strconv.FormatInt(offset, 10)
+	return &rkafka.Message{
+		Topic:     pc.topic,
+		Partition: pc.partition,
+		Offset:    offset,
+		Key:       []byte("key" + id),
+		Value:     []byte("value" + id),
+		Timestamp: time.Unix(offset, 0),
+	}, nil
+}
+
+func (pc *mockPartitionConsumer) Close() error {
+	pc.consumer.closed = true
+	return nil
+}
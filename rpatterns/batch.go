@@ -32,6 +32,9 @@ var flushSleep = time.Second
 // when the next event is received from the stream.
 // It assumes that the stream is reset to the previous cursor
 // before sending subsequent events.
+//
+// If the run context is cancelled, a partial batch is flushed when
+// the run returns, avoiding redelivery of the events on the next run.
 type BatchConsumer struct {
 	*AckConsumer
 	consume func(context.Context, fate.Fate, Batch) error
@@ -77,7 +80,7 @@ func (c *BatchConsumer) enqueue(ctx context.Context, f fate.Fate, e *AckEvent) e
 		c.mu.Lock()
 		defer c.mu.Unlock()
 
-		return len(c.buf) >= c.flushLen
+		return c.flushLen > 0 && len(c.buf) >= c.flushLen
 	}
 
 	for waitFlush() {
@@ -131,32 +134,53 @@ func (c *BatchConsumer) flushForever() {
 		}
 
 		// Time to flush
-		buf := c.buf
-		c.buf = nil
-		c.start = time.Time{}
-
-		var (
-			b    Batch
-			last *AckEvent
-		)
-		for _, e := range buf {
-			b = append(b, &e.Event)
-			last = e
-		}
-
-		err := c.consume(c.ctx, c.fate, b)
-		if err != nil {
-			log.Error(c.ctx, errors.Wrap(err, "batch consumer error"))
-			c.err = err
-		} else if err = last.Ack(c.ctx); err != nil {
-			log.Error(c.ctx, errors.Wrap(err, "batch ack error"))
-			c.err = err
-		}
+		c.flushUnsafe(c.ctx)
 
 		c.mu.Unlock()
 	}
 }
 
+// flushUnsafe consumes and acks the buffered events as a batch, storing any error.
+// Note it is unsafe, locks are managed outside.
+func (c *BatchConsumer) flushUnsafe(ctx context.Context) {
+	buf := c.buf
+	c.buf = nil
+	c.start = time.Time{}
+
+	var (
+		b    Batch
+		last *AckEvent
+	)
+	for _, e := range buf {
+		b = append(b, &e.Event)
+		last = e
+	}
+
+	err := c.consume(ctx, c.fate, b)
+	if err != nil {
+		log.Error(ctx, errors.Wrap(err, "batch consumer error"))
+		c.err = err
+	} else if err = last.Ack(ctx); err != nil {
+		log.Error(ctx, errors.Wrap(err, "batch ack error"))
+		c.err = err
+	}
+}
+
+// flushCancelled flushes a partial batch using the provided context
+// if the context of the buffered events was cancelled.
+func (c *BatchConsumer) flushCancelled(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.buf) == 0 || c.ctx == nil || c.ctx.Err() == nil || c.err != nil {
+		return nil
+	}
+
+	c.flushUnsafe(ctx)
+
+	return c.err
+}
+
 // NewBatchConsumer returns a new BatchConsumer. Either batchPeriod or batchLen
 // must be configured (non-zero).
 func NewBatchConsumer(name string, cstore reflex.CursorStore,
@@ -188,7 +212,21 @@ func NewBatchSpec(stream reflex.StreamFunc, bc *BatchConsumer,
 		Consumer: reflex.NewConsumer(bc.name, bc.Consume, bc.opts...),
 		reset:    bc.Reset,
 	}
-	return reflex.NewSpec(stream, &noSetStore{bc.cstore}, c, opts...)
+	return reflex.NewSpec(stream, &batchStore{noSetStore{bc.cstore}, bc}, c, opts...)
+}
+
+// batchStore flushes partial batches of a cancelled run before flushing
+// the underlying cursor store.
+type batchStore struct {
+	noSetStore
+	bc *BatchConsumer
+}
+
+func (s *batchStore) Flush(ctx context.Context) error {
+	if err := s.bc.flushCancelled(ctx); err != nil {
+		return err
+	}
+	return s.noSetStore.Flush(ctx)
 }
 
 type resetConsumer struct {
@@ -193,3 +193,74 @@ func TestInvalidConfig(t *testing.T) {
 	err := reflex.Run(ctx, spec)
 	jtest.Assert(t, errors.New("batchPeriod or batchLen must be non-zero"), err)
 }
+
+func TestBatchFlushOnCancel(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		results []rpatterns.Batch
+	)
+
+	b := &bootstrapMock{
+		events:     ItoEList(1, 2, 3, 4, 5),
+		emptyDelay: time.Millisecond * 100,
+		gets:       []string{""},
+	}
+
+	f := func(ctx context.Context, f fate.Fate, b rpatterns.Batch) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		results = append(results, b)
+		return nil
+	}
+
+	consumer := rpatterns.NewBatchConsumer("flush_on_cancel", b, f, 0, 10)
+	spec := rpatterns.NewBatchSpec(b.Stream, consumer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	err := reflex.Run(ctx, spec)
+	jtest.Assert(t, errEvents, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, results, 1)
+	require.Len(t, results[0], 5)
+	require.Equal(t, []string{"5"}, b.sets)
+}
+
+func TestBatchFlushPeriod(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		results []rpatterns.Batch
+	)
+
+	b := &bootstrapMock{
+		events:     ItoEList(1, 2, 3),
+		emptyDelay: time.Millisecond * 1500, // Longer than flush sleep.
+		gets:       []string{""},
+	}
+
+	f := func(ctx context.Context, f fate.Fate, b rpatterns.Batch) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		results = append(results, b)
+		return nil
+	}
+
+	consumer := rpatterns.NewBatchConsumer("flush_period", b, f, time.Millisecond*10, 0)
+	spec := rpatterns.NewBatchSpec(b.Stream, consumer)
+
+	err := reflex.Run(context.Background(), spec)
+	jtest.Assert(t, errEvents, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, results, 1)
+	require.Len(t, results[0], 3)
+	require.Equal(t, []string{"3"}, b.sets)
+}
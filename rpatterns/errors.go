@@ -0,0 +1,16 @@
+package rpatterns
+
+import (
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+)
+
+var (
+	// ErrInvalidWorkers is returned by NewParallelConsumer if the number
+	// of workers is not positive.
+	ErrInvalidWorkers = errors.New("non-positive parallel consumer workers", j.C("ERR_ceece4a27c43ff5a"))
+
+	// ErrParallelStopped is returned by ParallelConsumer.Consume if the
+	// workers of the run were stopped without an error, ie. by Reset.
+	ErrParallelStopped = errors.New("parallel consumer stopped", j.C("ERR_1a7321ceb7984583"))
+)
@@ -0,0 +1,245 @@
+package rpatterns
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/luno/fate"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+	"github.com/luno/jettison/log"
+	"github.com/luno/reflex"
+)
+
+// parallelQueueLen is the number of events buffered per worker.
+const parallelQueueLen = 16
+
+// ParallelConsumer provides a reflex consumer that consumes events
+// concurrently in a single stream using a number of worker goroutines.
+// Events are partitioned to workers by the hash of their key, so events
+// with the same key are consumed in stream order.
+//
+// It leverages the AckConsumer internally and acks (updates the cursor)
+// up to the last event before the first event not yet consumed, so all
+// events after the cursor are redelivered if the consumer is restarted,
+// ie. at-least-once delivery.
+//
+// This consumer is stateful and implements the resetter interface.
+// Consume errors are asynchronous and returned by subsequent calls to
+// Consume and by Reset which also stops the workers of the previous run.
+// Note that the consumer metrics (see reflex.NewConsumer) therefore
+// measure queueing, not processing, of events.
+type ParallelConsumer struct {
+	*AckConsumer
+	consume handleFn
+	keyFn   func(*reflex.Event) string
+	workers int
+
+	mu  sync.Mutex
+	run *parallelRun // Workers of the current run, nil if not started.
+}
+
+// parallelRun is the state of the workers of a single run.
+type parallelRun struct {
+	ctx     context.Context
+	queues  []chan parallelJob
+	stop    chan struct{} // Closed when the run is stopped.
+	stopped bool
+	err     error
+	wg      sync.WaitGroup
+
+	// pending are the events queued but not yet acked in stream order.
+	pending []*parallelJob
+}
+
+type parallelJob struct {
+	fate fate.Fate
+	e    *AckEvent
+	done bool
+}
+
+// Reset stops the workers of the previous run, waiting for in-flight
+// events to be consumed, and returns any consume error of the run.
+func (c *ParallelConsumer) Reset() error {
+	c.mu.Lock()
+	run := c.run
+	c.run = nil
+	if run != nil {
+		run.stopUnsafe(nil)
+	}
+	c.mu.Unlock()
+
+	if run == nil {
+		return nil
+	}
+
+	run.wg.Wait()
+
+	return run.err
+}
+
+// enqueue queues the event to the worker of its key or returns the run error.
+func (c *ParallelConsumer) enqueue(ctx context.Context, f fate.Fate, e *AckEvent) error {
+	c.mu.Lock()
+	if c.run == nil {
+		c.run = c.startRun(ctx)
+	}
+	run := c.run
+
+	if run.err != nil {
+		c.mu.Unlock()
+		return run.err
+	}
+
+	hasher := fnv.New32()
+	_, _ = hasher.Write([]byte(c.keyFn(&e.Event)))
+	queue := run.queues[hasher.Sum32()%uint32(c.workers)]
+
+	job := &parallelJob{fate: f, e: e}
+	run.pending = append(run.pending, job)
+	c.mu.Unlock()
+
+	select {
+	case queue <- *job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-run.stop:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if run.err != nil {
+			return run.err
+		}
+		return ErrParallelStopped
+	}
+}
+
+// startRun starts the workers of a new run.
+func (c *ParallelConsumer) startRun(ctx context.Context) *parallelRun {
+	run := &parallelRun{
+		ctx:  ctx,
+		stop: make(chan struct{}),
+	}
+
+	for i := 0; i < c.workers; i++ {
+		q := make(chan parallelJob, parallelQueueLen)
+		run.queues = append(run.queues, q)
+
+		run.wg.Add(1)
+		go func() {
+			defer run.wg.Done()
+			c.work(run, q)
+		}()
+	}
+
+	return run
+}
+
+// work consumes the jobs of the queue until the run is stopped or fails.
+func (c *ParallelConsumer) work(run *parallelRun, q <-chan parallelJob) {
+	for {
+		var job parallelJob
+		select {
+		case <-run.ctx.Done():
+			return
+		case <-run.stop:
+			return
+		case job = <-q:
+		}
+
+		if err := c.consume(run.ctx, job.fate, &job.e.Event); err != nil {
+			log.Error(run.ctx, errors.Wrap(err, "parallel consumer error"))
+			c.mu.Lock()
+			run.stopUnsafe(err)
+			c.mu.Unlock()
+			return
+		}
+
+		if err := c.complete(run, job.e); err != nil {
+			log.Error(run.ctx, errors.Wrap(err, "parallel ack error"))
+			c.mu.Lock()
+			run.stopUnsafe(err)
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+// complete marks the event as consumed and acks the last event
+// before the first pending event if any were completed.
+func (c *ParallelConsumer) complete(run *parallelRun, e *AckEvent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, job := range run.pending {
+		if job.e == e {
+			job.done = true
+			break
+		}
+	}
+
+	var last *AckEvent
+	for len(run.pending) > 0 && run.pending[0].done {
+		last = run.pending[0].e
+		run.pending = run.pending[1:]
+	}
+
+	if last == nil || run.err != nil {
+		return nil
+	}
+
+	// Ack while holding the lock so that cursors are set in order.
+	return last.Ack(run.ctx)
+}
+
+// stopUnsafe stops the run with the error if not already stopped.
+// Note it is unsafe, locks are managed outside.
+func (r *parallelRun) stopUnsafe(err error) {
+	if r.stopped {
+		return
+	}
+
+	r.stopped = true
+	r.err = err
+	close(r.stop)
+}
+
+// NewParallelConsumer returns a new ParallelConsumer that consumes events
+// with the provided number of workers partitioned by the key returned
+// by keyFn, eg. the event foreign ID. It returns ErrInvalidWorkers if
+// workers is not positive.
+func NewParallelConsumer(name string, cstore reflex.CursorStore, workers int,
+	keyFn func(*reflex.Event) string, consume func(context.Context, fate.Fate, *reflex.Event) error,
+	opts ...reflex.ConsumerOption) (*ParallelConsumer, error) {
+
+	if workers <= 0 {
+		return nil, errors.Wrap(ErrInvalidWorkers, "new parallel consumer",
+			j.MKV{"consumer": name, "workers": workers})
+	}
+
+	pc := &ParallelConsumer{
+		consume: consume,
+		keyFn:   keyFn,
+		workers: workers,
+	}
+
+	fn := func(ctx context.Context, f fate.Fate, e *AckEvent) error {
+		return pc.enqueue(ctx, f, e)
+	}
+
+	pc.AckConsumer = NewAckConsumer(name, cstore, fn, opts...)
+
+	return pc, nil
+}
+
+// NewParallelSpec returns a reflex spec for the ParallelConsumer.
+func NewParallelSpec(stream reflex.StreamFunc, pc *ParallelConsumer,
+	opts ...reflex.StreamOption) reflex.Spec {
+
+	c := &resetConsumer{
+		Consumer: reflex.NewConsumer(pc.name, pc.Consume, pc.opts...),
+		reset:    pc.Reset,
+	}
+	return reflex.NewSpec(stream, &noSetStore{pc.cstore}, c, opts...)
+}
@@ -0,0 +1,195 @@
+package rpatterns_test
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luno/fate"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex"
+	"github.com/luno/reflex/mock"
+	"github.com/luno/reflex/rpatterns"
+	"github.com/stretchr/testify/require"
+)
+
+func foreignIDKey(e *reflex.Event) string {
+	return e.ForeignID
+}
+
+func (b *bootstrapMock) getSets() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.sets...)
+}
+
+// runParallel runs the parallel consumer spec in the background and
+// returns a function that stops it and returns the run error.
+func runParallel(pc *rpatterns.ParallelConsumer,
+	events []*reflex.Event) func() error {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	spec := rpatterns.NewParallelSpec(mock.NewStream(events, mock.WithBlockAtHead()), pc)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- reflex.Run(ctx, spec)
+	}()
+
+	return func() error {
+		cancel()
+		return <-errChan
+	}
+}
+
+func TestParallelConsumerOrder(t *testing.T) {
+	const n = 200
+
+	var events []*reflex.Event
+	for i := 1; i <= n; i++ {
+		e := ItoE(i)
+		e.ForeignID = strconv.Itoa(i % 7)
+		events = append(events, e)
+	}
+
+	var (
+		mu    sync.Mutex
+		total int
+		byKey = make(map[string][]int64)
+	)
+	b := &bootstrapMock{gets: []string{""}}
+	pc, err := rpatterns.NewParallelConsumer("test", b, 4, foreignIDKey,
+		func(ctx context.Context, f fate.Fate, e *reflex.Event) error {
+			time.Sleep(time.Duration(rand.Intn(500)) * time.Microsecond)
+			mu.Lock()
+			defer mu.Unlock()
+			total++
+			byKey[e.ForeignID] = append(byKey[e.ForeignID], e.IDInt())
+			return nil
+		})
+	jtest.RequireNil(t, err)
+
+	stop := runParallel(pc, events)
+
+	require.Eventually(t, func() bool {
+		sets := b.getSets()
+		return len(sets) > 0 && sets[len(sets)-1] == strconv.Itoa(n)
+	}, time.Second*5, time.Millisecond)
+
+	jtest.Require(t, context.Canceled, stop())
+	jtest.RequireNil(t, pc.Reset())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, n, total)
+	for key, ids := range byKey {
+		for i := 1; i < len(ids); i++ {
+			require.Less(t, ids[i-1], ids[i], "key %s out of order", key)
+		}
+	}
+
+	// Cursors only move forward.
+	var prev int
+	for _, set := range b.getSets() {
+		id, err := strconv.Atoi(set)
+		jtest.RequireNil(t, err)
+		require.Greater(t, id, prev)
+		prev = id
+	}
+}
+
+func TestParallelConsumerCursor(t *testing.T) {
+	release := make(chan struct{})
+
+	var (
+		mu   sync.Mutex
+		done []int64
+	)
+	// Note the keys of the events are hashed to different workers.
+	b := &bootstrapMock{gets: []string{""}}
+	pc, err := rpatterns.NewParallelConsumer("test", b, 6, foreignIDKey,
+		func(ctx context.Context, f fate.Fate, e *reflex.Event) error {
+			if e.IDInt() == 2 {
+				<-release
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			done = append(done, e.IDInt())
+			return nil
+		})
+	jtest.RequireNil(t, err)
+
+	stop := runParallel(pc, ItoEList(1, 2, 3, 4, 5, 6))
+
+	// All events except the blocked one are consumed...
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(done) == 5
+	}, time.Second*5, time.Millisecond)
+
+	// ...but the cursor doesn't pass the blocked event.
+	require.Equal(t, []string{"1"}, b.getSets())
+
+	close(release)
+
+	require.Eventually(t, func() bool {
+		sets := b.getSets()
+		return sets[len(sets)-1] == "6"
+	}, time.Second*5, time.Millisecond)
+
+	jtest.Require(t, context.Canceled, stop())
+	jtest.RequireNil(t, pc.Reset())
+}
+
+func TestParallelConsumerError(t *testing.T) {
+	errFoo := errors.New("foo", errors.WithoutStackTrace())
+
+	b := &bootstrapMock{}
+	pc, err := rpatterns.NewParallelConsumer("test", b, 2, foreignIDKey,
+		func(ctx context.Context, f fate.Fate, e *reflex.Event) error {
+			if e.IDInt() == 1 {
+				return errFoo
+			}
+			return nil
+		})
+	jtest.RequireNil(t, err)
+
+	ctx := context.Background()
+	f := fate.New()
+
+	jtest.RequireNil(t, pc.Consume(ctx, f, ItoE(1)))
+
+	// The error is returned by subsequent calls to Consume.
+	require.Eventually(t, func() bool {
+		return errors.Is(pc.Consume(ctx, f, ItoE(2)), errFoo)
+	}, time.Second*5, time.Millisecond)
+
+	// The cursor never passes the failed event.
+	require.Empty(t, b.getSets())
+
+	jtest.Require(t, errFoo, pc.Reset())
+
+	// Reset starts a new run.
+	jtest.RequireNil(t, pc.Reset())
+	jtest.RequireNil(t, pc.Consume(ctx, f, ItoE(3)))
+	require.Eventually(t, func() bool {
+		sets := b.getSets()
+		return len(sets) == 1 && sets[0] == "3"
+	}, time.Second*5, time.Millisecond)
+	jtest.RequireNil(t, pc.Reset())
+}
+
+func TestParallelConsumerNoWorkers(t *testing.T) {
+	for _, workers := range []int{0, -1} {
+		_, err := rpatterns.NewParallelConsumer("test", &bootstrapMock{}, workers, foreignIDKey,
+			func(ctx context.Context, f fate.Fate, e *reflex.Event) error {
+				return nil
+			})
+		jtest.Require(t, rpatterns.ErrInvalidWorkers, err)
+	}
+}
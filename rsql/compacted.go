@@ -0,0 +1,124 @@
+package rsql
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/luno/reflex"
+)
+
+// StreamCompacted returns a StreamClient that first streams a compacted view
+// of the events after the provided cursor up to the current head, ie. only the
+// latest event per foreign ID, and then switches to streaming all subsequent
+// events like Stream.
+//
+// Compacted events are streamed in ID order so their IDs are valid cursors:
+// resuming after a compacted event's ID compacts the remaining events
+// again, which still includes the latest event of every foreign ID not
+// yet streamed. Note that the catch-up range is compacted in memory on the
+// first call to Recv, so it requires memory proportional to the number of
+// foreign IDs.
+//
+// If a tombstone type is configured (see WithTombstoneType), foreign IDs whose
+// latest event is a tombstone are streamed as tombstones, or omitted if
+// compacting from the start of the table.
+//
+// If the reflex.WithStreamFromHead option is provided, or the cursor is empty
+// and the table is configured with WithEmptyCursorMeansHead, there is nothing
+// to compact and it is equivalent to Stream.
+func (t *EventsTable) StreamCompacted(ctx context.Context, dbc *sql.DB, after string,
+	opts ...reflex.StreamOption) reflex.StreamClient {
+
+	var o reflex.StreamOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.StreamFromHead || (after == "" && t.emptyCursorHead) {
+		return t.Stream(ctx, dbc, after, opts...)
+	}
+
+	return &compactedclient{
+		ctx:   ctx,
+		table: t,
+		dbc:   dbc,
+		after: after,
+		opts:  opts,
+	}
+}
+
+type compactedclient struct {
+	ctx   context.Context
+	table *EventsTable
+	dbc   *sql.DB
+	after string
+	opts  []reflex.StreamOption
+
+	buf  []*reflex.Event // Compacted events not yet received.
+	tail reflex.StreamClient
+}
+
+// Recv returns the next compacted event until the head at the time of the
+// first call is reached after which it returns subsequent events.
+func (c *compactedclient) Recv() (*reflex.Event, error) {
+	if c.tail == nil {
+		head, err := c.compact()
+		if err != nil {
+			return nil, err
+		}
+		c.tail = c.table.Stream(c.ctx, c.dbc, head, c.opts...)
+	}
+
+	if len(c.buf) > 0 {
+		e := c.buf[0]
+		c.buf = c.buf[1:]
+		return e, nil
+	}
+
+	return c.tail.Recv()
+}
+
+// compact buffers the latest event per foreign ID up to the current head
+// in ID order and returns the head cursor.
+func (c *compactedclient) compact() (string, error) {
+	latest := make(map[string]*reflex.Event)
+	head, err := c.table.Each(c.ctx, c.dbc, c.after, func(e *reflex.Event) error {
+		latest[e.ForeignID] = e
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	fromStart := c.after == ""
+	if !fromStart {
+		prev, err := cursorID(c.after)
+		if err != nil {
+			return "", err
+		}
+		fromStart = prev == 0
+	}
+
+	buf := make([]*reflex.Event, 0, len(latest))
+	for _, e := range latest {
+		if fromStart && c.isTombstone(e) {
+			// Nothing to remove when compacting from the start.
+			continue
+		}
+		buf = append(buf, e)
+	}
+	sort.Slice(buf, func(i, j int) bool {
+		return idLess(eventID(buf[i]), eventID(buf[j]))
+	})
+
+	c.buf = buf
+
+	return head, nil
+}
+
+// isTombstone returns true if the event is a tombstone, see WithTombstoneType.
+func (c *compactedclient) isTombstone(e *reflex.Event) bool {
+	typ := c.table.tombstoneType
+	return typ != nil && reflex.IsType(e.Type, typ)
+}
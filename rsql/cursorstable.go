@@ -3,7 +3,6 @@ package rsql
 import (
 	"context"
 	"database/sql"
-	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -21,13 +20,13 @@ func (t CursorType) Cast(cursor string) (interface{}, error) {
 		return cursor, nil
 	}
 	if t != cursorTypeInt {
-		return nil, errors.New("unsupported cursor type")
+		return nil, ErrUnsupportedCursorType
 	}
-	i, err := strconv.ParseInt(cursor, 10, 64)
+	i, err := parseID(cursor)
 	if err != nil {
-		return nil, errors.New("invalid int cursor")
+		return nil, ErrInvalidIntCursor
 	}
-	return i, nil
+	return idArg(i), nil
 }
 
 const (
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,6 +20,10 @@ const (
 	defaultEventTypeField      = "type"
 	defaultEventForeignIDField = "foreign_id"
 	defaultMetadataField       = "" // disabled
+	defaultNoopForeignID       = "0"
+	defaultNoopType            = 0
+
+	defaultBatchLimit = 1000
 )
 
 // eventType is the rsql internal implementation of EventType interface.
@@ -28,81 +33,361 @@ func (t eventType) ReflexType() int {
 	return int(t)
 }
 
+// parseID returns the int64 of an event ID. IDs of unsigned ID columns
+// that exceed math.MaxInt64 are returned as the int64 with the same bits,
+// ie. negative. Such IDs are formatted by formatID, compared by idLess and
+// passed to queries by idArg. Consecutive IDs remain consecutive since int64
+// addition wraps around.
+func parseID(id string) (int64, error) {
+	i, err := strconv.ParseInt(id, 10, 64)
+	if err == nil {
+		return i, nil
+	}
+
+	u, uerr := strconv.ParseUint(id, 10, 64)
+	if uerr != nil {
+		return 0, err
+	}
+
+	return int64(u), nil
+}
+
+// formatID returns the string of an event ID returned by parseID.
+func formatID(id int64) string {
+	if id < 0 {
+		return strconv.FormatUint(uint64(id), 10)
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+// idLess returns true if event ID a is less than b. Event IDs are never
+// negative, so they are compared as unsigned to order IDs returned by
+// parseID that exceed math.MaxInt64.
+func idLess(a, b int64) bool {
+	return uint64(a) < uint64(b)
+}
+
+// idArg returns the query argument of an event ID returned by parseID.
+func idArg(id int64) interface{} {
+	if id < 0 {
+		return uint64(id)
+	}
+	return id
+}
+
+// eventID returns the ID of the event as returned by parseID or 0 if it is not an integer.
+func eventID(e *reflex.Event) int64 {
+	id, _ := parseID(e.ID)
+	return id
+}
+
+// cursorID returns the event ID of the int cursor as returned by parseID.
+func cursorID(after string) (int64, error) {
+	c := reflex.ParseCursor(after)
+	if _, err := c.Uint(); errors.Is(err, reflex.ErrCursorKind) {
+		return 0, err
+	}
+
+	id, err := parseID(c.String())
+	if err != nil {
+		return 0, ErrInvalidIntID
+	}
+
+	return id, nil
+}
+
 // makeDefaultInserter returns the default sql inserter configured via WithEventsXField options.
-func makeDefaultInserter(schema etableSchema) inserter {
-	return func(ctx context.Context, tx *sql.Tx,
-		foreignID string, typ reflex.EventType, metadata []byte) error {
-
-		q := "insert into " + schema.name +
-			" set " + schema.foreignIDField + "=?, " + schema.timeField + "=now(6), " + schema.typeField + "=?"
-		args := []interface{}{foreignID, typ.ReflexType()}
-
-		if schema.metadataField != "" {
-			q += ", " + schema.metadataField + "=?"
-			args = append(args, metadata)
-		} else if metadata != nil {
-			return errors.New("metadata not enabled")
+func makeDefaultInserter(schema etableSchema) idInserter {
+	return func(ctx context.Context, tx *sql.Tx, foreignID string,
+		typ reflex.EventType, metadata []byte, ts time.Time) (int64, error) {
+
+		q, args, err := makeInsertQuery(schema, foreignID, typ, metadata, ts)
+		if err != nil {
+			return 0, err
 		}
 
-		_, err := tx.ExecContext(ctx, q, args...)
-		return errors.Wrap(err, "insert error")
+		res, err := tx.ExecContext(ctx, q, args...)
+		if err != nil {
+			return 0, errors.Wrap(err, "insert error")
+		}
+
+		// The ID is only used for notifications, so it is zero if unsupported.
+		id, _ := res.LastInsertId()
+
+		return id, nil
+	}
+}
+
+// makeInsertQuery returns the query and args inserting an event with the
+// timestamp or the current DB time if zero.
+func makeInsertQuery(schema etableSchema, foreignID string, typ reflex.EventType,
+	metadata []byte, ts time.Time) (string, []interface{}, error) {
+
+	args := []interface{}{foreignID}
+	timeValue := "now(6)"
+	if !ts.IsZero() {
+		timeValue = "?"
+		args = append(args, ts)
+	}
+	args = append(args, typ.ReflexType())
+
+	q := "insert into " + schema.name +
+		" set " + schema.foreignIDField + "=?, " + schema.timeField + "=" + timeValue + ", " + schema.typeField + "=?"
+
+	if schema.metadataField != "" {
+		q += ", " + schema.metadataField + "=?"
+		args = append(args, metadata)
+	} else if metadata != nil {
+		return "", nil, ErrMetadataNotEnabled
+	}
+
+	return q, args, nil
+}
+
+// insertOnce inserts an event with the transaction ID and returns its ID and
+// true, or returns the ID of the event previously inserted with the
+// transaction ID and false. It inserts first instead of selecting since a
+// locking read of an absent transaction ID takes a gap lock which deadlocks
+// concurrent inserts of other transaction IDs.
+func insertOnce(ctx context.Context, tx *sql.Tx, schema etableSchema, foreignID string,
+	typ reflex.EventType, metadata []byte, txID string) (int64, bool, error) {
+
+	q, args, err := makeInsertQuery(schema, foreignID, typ, metadata, time.Time{})
+	if err != nil {
+		return 0, false, err
+	}
+	// On duplicate, return the existing ID without updating the row.
+	q += ", " + schema.txIDField + "=? on duplicate key update id=last_insert_id(id)"
+	args = append(args, txID)
+
+	res, err := tx.ExecContext(ctx, q, args...)
+	if err != nil {
+		return 0, false, errors.Wrap(err, "insert error")
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, false, errors.Wrap(err, "last insert id")
 	}
+
+	// An insert affects one row, an unchanged duplicate none.
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, false, errors.Wrap(err, "rows affected")
+	}
+
+	return id, n == 1, nil
 }
 
 type row interface {
 	Scan(dest ...interface{}) error
 }
 
-func scan(row row) (*reflex.Event, error) {
+func scan(row row, schema etableSchema) (*reflex.Event, error) {
 	var (
 		e  reflex.Event
-		id int64
+		id string // Supports unsigned IDs exceeding math.MaxInt64.
 		t  eventType
+		ts sql.NullTime // Null if not queried.
 	)
-	err := row.Scan(&id, &e.ForeignID, &e.Timestamp, &t, &e.MetaData)
+	dest := []interface{}{&id, &e.ForeignID, &ts, &t, &e.MetaData}
+
+	extra := make([]interface{}, len(schema.extraFields))
+	for i := range extra {
+		dest = append(dest, &extra[i])
+	}
+
+	err := row.Scan(dest...)
 	if err != nil {
 		return nil, err
 	}
-	e.ID = strconv.FormatInt(id, 10)
+
+	i, err := parseID(id)
+	if err != nil {
+		return nil, ErrInvalidIntID
+	}
+	e.ID = formatID(i)
 	e.Type = t
-	return &e, err
+	e.Timestamp = ts.Time
+
+	if schema.scanExtra == nil {
+		return &e, nil
+	}
+
+	return schema.scanExtra(e, extra), nil
 }
 
+// getLatestID returns the id of the latest event or 0 if the table is empty,
+// since max(id) returns a single null row and not sql.ErrNoRows. Streams
+// from head on an empty table therefore start from the first event.
 func getLatestID(ctx context.Context, dbc *sql.DB, schema etableSchema) (int64, error) {
-	var id sql.NullInt64
+	var id sql.NullString
 	err := dbc.QueryRowContext(ctx, "select max(id) from "+schema.name).Scan(&id)
 	if err != nil {
 		return 0, err
+	} else if !id.Valid {
+		return 0, nil
 	}
-	return id.Int64, nil
+	return parseID(id.String)
+}
+
+// getLatestIDForForeignID returns the max ID of the events with the foreign ID
+// and true or false if there are none.
+func getLatestIDForForeignID(ctx context.Context, dbc *sql.DB, schema etableSchema,
+	foreignID string) (int64, bool, error) {
+
+	var id sql.NullString
+	err := dbc.QueryRowContext(ctx, "select max(id) from "+schema.name+
+		" where "+schema.foreignIDField+"=?", foreignID).Scan(&id)
+	if err != nil {
+		return 0, false, err
+	} else if !id.Valid {
+		return 0, false, nil
+	}
+
+	latest, err := parseID(id.String)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return latest, true, nil
+}
+
+// getEarliestID returns the min ID of the table or zero if it is empty.
+func getEarliestID(ctx context.Context, dbc *sql.DB, schema etableSchema) (int64, error) {
+	var id sql.NullString
+	err := dbc.QueryRowContext(ctx, "select min(id) from "+schema.name).Scan(&id)
+	if err != nil {
+		return 0, err
+	} else if !id.Valid {
+		return 0, nil
+	}
+	return parseID(id.String)
 }
 
 func getNextEvents(ctx context.Context, dbc *sql.DB, schema etableSchema,
 	after int64, lag time.Duration) ([]*reflex.Event, error) {
 
+	return getNextEventsUpTo(ctx, dbc, schema, after, 0, lag)
+}
+
+// getNextEventsUpTo returns the next events after the cursor up to and
+// including the upper bound. A zero upper bound is ignored.
+func getNextEventsUpTo(ctx context.Context, dbc *sql.DB, schema etableSchema,
+	after int64, upTo int64, lag time.Duration) ([]*reflex.Event, error) {
+
+	q, args := makeNextEventsQuery(schema, after, upTo, lag, defaultBatchLimit)
+
+	rows, err := dbc.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var el []*reflex.Event
+	for rows.Next() {
+		batch, err := scan(rows, schema)
+		if err != nil {
+			return nil, err
+		}
+
+		el = append(el, batch)
+	}
+
+	return el, rows.Err()
+}
+
+// makeNextEventsQuery returns the query and args selecting the next events
+// after the provided cursor.
+func makeNextEventsQuery(schema etableSchema, after int64, upTo int64,
+	lag time.Duration, limit int) (string, []interface{}) {
+
 	var (
 		q    string
 		args []interface{}
 	)
 
-	q += "select id, " + schema.foreignIDField + ", " + schema.timeField + ", " + schema.typeField
-	if schema.metadataField != "" {
+	timeField := schema.timeField
+	if !includesColumn(schema.columns, ColumnTimestamp) {
+		timeField = "null"
+	}
+
+	q += "select id, " + schema.foreignIDField + ", " + timeField + ", " + schema.typeField
+	if schema.metadataField != "" && includesColumn(schema.columns, ColumnMetadata) {
 		q += " , " + schema.metadataField
 	} else {
 		q += ", null"
 	}
 
+	for _, field := range schema.extraFields {
+		q += ", " + field
+	}
+
 	q += " from " + schema.name + " where id>?"
-	args = append(args, after)
+	args = append(args, idArg(after))
+
+	if upTo != 0 {
+		q += " and id<=?"
+		args = append(args, idArg(upTo))
+	}
 
 	if lag > 0 {
 		q += " and " + schema.timeField + "<timestamp(now()-interval ? second) "
 		args = append(args, lag.Seconds())
 	}
 
-	q += " order by id asc limit 1000"
+	q += " order by id asc limit " + strconv.Itoa(limit)
 
-	rows, err := dbc.QueryContext(ctx, q, args...)
+	return q, args
+}
+
+// getRawRows returns up to limit rows of the table after the provided id
+// with all columns keyed by column name.
+func getRawRows(ctx context.Context, dbc *sql.DB, table string, after int64,
+	limit int) ([]map[string]interface{}, error) {
+
+	rows, err := dbc.QueryContext(ctx, "select * from "+table+
+		" where id>? order by id asc limit "+strconv.Itoa(limit), idArg(after))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []map[string]interface{}
+	for rows.Next() {
+		vals := make([]interface{}, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			row[col] = vals[i]
+		}
+		res = append(res, row)
+	}
+
+	return res, rows.Err()
+}
+
+// getNextEventsTx returns the next events after the provided cursor
+// queried within the transaction.
+func getNextEventsTx(ctx context.Context, tx *sql.Tx, schema etableSchema,
+	after int64, limit int) ([]*reflex.Event, error) {
+
+	q, args := makeNextEventsQuery(schema, after, 0, 0, limit)
+
+	rows, err := tx.QueryContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -110,17 +395,143 @@ func getNextEvents(ctx context.Context, dbc *sql.DB, schema etableSchema,
 
 	var el []*reflex.Event
 	for rows.Next() {
-		batch, err := scan(rows)
+		e, err := scan(rows, schema)
 		if err != nil {
 			return nil, err
 		}
 
-		el = append(el, batch)
+		el = append(el, e)
 	}
 
 	return el, rows.Err()
 }
 
+// claimNextEvents returns the next events after the provided cursor that are not
+// locked by other transactions and locks them for the duration of the transaction.
+func claimNextEvents(ctx context.Context, tx *sql.Tx, schema etableSchema,
+	after int64, limit int) ([]*reflex.Event, error) {
+
+	q, args := makeNextEventsQuery(schema, after, 0, 0, limit)
+
+	rows, err := tx.QueryContext(ctx, q+" for update skip locked", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var el []*reflex.Event
+	for rows.Next() {
+		e, err := scan(rows, schema)
+		if err != nil {
+			return nil, err
+		}
+
+		el = append(el, e)
+	}
+
+	return el, rows.Err()
+}
+
+// explainNextEvents returns the query plan of the next events query. Each
+// plan row is returned on a separate line with tab separated columns.
+func explainNextEvents(ctx context.Context, dbc *sql.DB, schema etableSchema,
+	after int64) (string, error) {
+
+	q, args := makeNextEventsQuery(schema, after, 0, 0, defaultBatchLimit)
+
+	rows, err := dbc.QueryContext(ctx, "explain "+q, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+
+		if err := rows.Scan(ptrs...); err != nil {
+			return "", err
+		}
+
+		var fields []string
+		for i, val := range vals {
+			fields = append(fields, cols[i]+"="+val.String)
+		}
+		lines = append(lines, strings.Join(fields, "\t"))
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// getDistinctTypes returns the distinct event types in ascending order of the
+// latest limit events or of all events if limit is zero.
+func getDistinctTypes(ctx context.Context, dbc *sql.DB, schema etableSchema,
+	limit int) ([]int, error) {
+
+	q := "select distinct " + schema.typeField + " from " + schema.name
+	var args []interface{}
+	if limit > 0 {
+		q = "select distinct " + schema.typeField + " from (select " + schema.typeField +
+			" from " + schema.name + " order by id desc limit ?) as sample"
+		args = append(args, limit)
+	}
+	q += " order by " + schema.typeField + " asc"
+
+	rows, err := dbc.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []int
+	for rows.Next() {
+		var typ int
+		if err := rows.Scan(&typ); err != nil {
+			return nil, err
+		}
+		res = append(res, typ)
+	}
+
+	return res, rows.Err()
+}
+
+// getColumnTypes returns the data types of the columns of the table in the
+// current database keyed by lower case column name. It returns an empty map
+// if the table doesn't exist. Note that temporary tables are not included
+// in information_schema.
+func getColumnTypes(ctx context.Context, dbc *sql.DB, table string) (map[string]string, error) {
+	rows, err := dbc.QueryContext(ctx, "select column_name, data_type "+
+		"from information_schema.columns where table_schema=database() and table_name=?", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			return nil, err
+		}
+		res[strings.ToLower(name)] = strings.ToLower(typ)
+	}
+
+	return res, rows.Err()
+}
+
 func GetNextEventsForTesting(t *testing.T, ctx context.Context, dbc *sql.DB,
 	table *EventsTable, after int64, lag time.Duration) ([]*reflex.Event, error) {
 	return getNextEvents(ctx, dbc, table.schema, after, lag)
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	"github.com/luno/reflex"
 	"github.com/luno/reflex/rsql"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -228,6 +229,29 @@ func TestGetLatestID(t *testing.T) {
 	assert.Equal(t, int64(n), id)
 }
 
+func TestStreamFromHeadEmpty(t *testing.T) {
+	dbc := ConnectTestDB(t, eventsTable, "")
+	defer dbc.Close()
+
+	table := rsql.NewEventsTable(eventsTable, rsql.WithEventsBackoff(time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	sc := table.Stream(ctx, dbc, "", reflex.WithStreamFromHead())
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		err := insertTestEvent(dbc, table, "first", testEventType(1))
+		assert.NoError(t, err)
+	}()
+
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), e.IDInt())
+	require.Equal(t, "first", e.ForeignID)
+}
+
 func TestCursorTableInt(t *testing.T) {
 	const id = "test"
 	const name = "cursors"
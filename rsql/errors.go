@@ -9,4 +9,15 @@ var (
 	ErrConsecEvent        = errors.New("non-consecutive event ids", j.C("ERR_bc3dcacb92b9761f"))
 	ErrInvalidIntID       = errors.New("invalid id, only int supported", j.C("ERR_82d0368b5478d378"))
 	ErrNextCursorMismatch = errors.New("next cursor and last event id mismatch", j.C("ERR_f647fa25c00140d2"))
+	ErrMetadataTooLarge   = errors.New("event metadata too large", j.C("ERR_3c9a1f7e08d2b645"))
+
+	ErrMetadataNotEnabled    = errors.New("metadata not enabled", j.C("ERR_2ef4652f5bdf2dbc"))
+	ErrTxIDNotEnabled        = errors.New("tx id not enabled", j.C("ERR_e07b3d9a51c2f846"))
+	ErrInsertNoop            = errors.New("inserting invalid noop event", j.C("ERR_d9fe57582859a9e1"))
+	ErrInvalidRange          = errors.New("invalid range", j.C("ERR_ab13d72bff9b070d"))
+	ErrInvalidLoaderResult   = errors.New("invalid loader result", j.C("ERR_6afbf84abd33ce64"))
+	ErrCursorWentBackwards   = errors.New("loader cursor went backwards", j.C("ERR_9a4c27e1b05d6f38"))
+	ErrUnsupportedCursorType = errors.New("unsupported cursor type", j.C("ERR_038d03d92cd3667c"))
+	ErrInvalidIntCursor      = errors.New("invalid int cursor", j.C("ERR_40d1c8d37bb64158"))
+	ErrSchemaMismatch        = errors.New("events table schema mismatch", j.C("ERR_7c25e0b4a9f61d38"))
 )
@@ -3,21 +3,61 @@ package rsql
 import (
 	"context"
 	"database/sql"
-	"strconv"
+	"fmt"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/luno/jettison/errors"
 	"github.com/luno/jettison/j"
+	"github.com/luno/jettison/log"
 	"github.com/luno/reflex"
 )
 
-const (
+// minIdleBackoff is the backoff period used instead of a zero backoff if
+// streams cannot rely on notifications, see WithEventsBackoff.
+const minIdleBackoff = time.Millisecond * 100
+
+var (
 	defaultStreamBackoff = time.Second * 10
+
+	// tableCreated is set when the first events table is created after
+	// which the defaults may not be overridden.
+	tableCreated int32
 )
 
+// SetDefaultStreamBackoff overrides the default backoff period between polling
+// the DB for new events, see WithEventsBackoff. It is intended for tests and
+// must be called before any events table is created.
+func SetDefaultStreamBackoff(d time.Duration) error {
+	if atomic.LoadInt32(&tableCreated) == 1 {
+		return errors.New("default stream backoff set after events table created")
+	} else if d < 0 {
+		return errors.New("negative default stream backoff")
+	}
+	defaultStreamBackoff = d
+	return nil
+}
+
+// SetDefaultRCacheLimit overrides the default maximum number of events in the
+// read-through cache. It is intended for tests and must be called before
+// any events table is created.
+func SetDefaultRCacheLimit(n int) error {
+	if atomic.LoadInt32(&tableCreated) == 1 {
+		return errors.New("default rcache limit set after events table created")
+	} else if n <= 0 {
+		return errors.New("non-positive default rcache limit")
+	}
+	defaultRCacheLimit = n
+	return nil
+}
+
 // NewEventsTable returns a new events table.
 func NewEventsTable(name string, opts ...EventsOption) *EventsTable {
+	atomic.StoreInt32(&tableCreated, 1)
+
 	table := &EventsTable{
 		schema: etableSchema{
 			name:           name,
@@ -25,6 +65,8 @@ func NewEventsTable(name string, opts ...EventsOption) *EventsTable {
 			typeField:      defaultEventTypeField,
 			foreignIDField: defaultEventForeignIDField,
 			metadataField:  defaultMetadataField,
+			noopForeignID:  defaultNoopForeignID,
+			noopType:       defaultNoopType,
 		},
 		options: options{
 			notifier: &stubNotifier{},
@@ -39,8 +81,11 @@ func NewEventsTable(name string, opts ...EventsOption) *EventsTable {
 		table.inserter = makeDefaultInserter(table.schema)
 	}
 
-	table.gapCh = make(chan Gap)
-	table.currentLoader = buildLoader(table.baseLoader, table.gapCh, table.disableCache, table.schema)
+	table.schema.columns = queryColumns(table.columns, table.cacheConfig.Disabled)
+	table.configErr = table.Validate()
+	table.gaps = &gapListeners{ch: make(chan Gap)}
+	table.currentLoader, table.cache = buildLoader(table.baseLoader, table.middleware,
+		table.gaps.ch, table.cacheConfig, table.schema)
 
 	return table
 }
@@ -80,6 +125,37 @@ func WithEventMetadataField(field string) EventsOption {
 	}
 }
 
+// WithEventTxIDField provides an option to set the event DB transaction ID
+// field used by InsertOnce. The field requires a unique index. It is
+// disabled by default; ie. ''.
+func WithEventTxIDField(field string) EventsOption {
+	return func(table *EventsTable) {
+		table.schema.txIDField = field
+	}
+}
+
+// WithEventScanner provides an option to select additional columns from the
+// events table. The scan function is called with each event and the
+// additional column values (in order) and returns the event to stream,
+// usually populating reflex.Event.Extra.
+func WithEventScanner(cols []string,
+	scan func(reflex.Event, []interface{}) *reflex.Event) EventsOption {
+	return func(table *EventsTable) {
+		table.schema.extraFields = cols
+		table.schema.scanExtra = scan
+	}
+}
+
+// WithNoopSentinel provides an option to set the foreign ID and type of noop
+// events inserted by the gap filler. Noop events are filtered from streams and
+// may not be inserted. It defaults to foreign ID "0" and type 0.
+func WithNoopSentinel(foreignID string, typ reflex.EventType) EventsOption {
+	return func(table *EventsTable) {
+		table.schema.noopForeignID = foreignID
+		table.schema.noopType = typ.ReflexType()
+	}
+}
+
 // WithEventsNotifier provides an option to receive event notifications
 // and trigger StreamClients when new events are available.
 func WithEventsNotifier(notifier EventsNotifier) EventsOption {
@@ -89,7 +165,7 @@ func WithEventsNotifier(notifier EventsNotifier) EventsOption {
 }
 
 // WithEventsInMemNotifier provides an option that enables an in-memory
-// notifier.
+// notifier. The notifier is shared by clones of the events table.
 //
 // Note: This can have a significant impact on database load
 // if the cache is disabled since all consumers might query
@@ -100,13 +176,64 @@ func WithEventsInMemNotifier() EventsOption {
 	}
 }
 
+// WithEventsPollOnly provides an option that explicitly configures streams
+// to only poll the DB for new events every backoff period without any
+// notifier. This is the default behaviour, but the option documents the
+// intent and Validate (and streams) return an error if a notifier is also
+// configured.
+func WithEventsPollOnly() EventsOption {
+	return func(table *EventsTable) {
+		table.pollOnly = true
+	}
+}
+
+// WithEventsCoalescingNotifier provides an option that enables an in-memory
+// notifier that coalesces notifications within the window into a single
+// wakeup. This reduces contention at high insert rates since woken
+// StreamClients drain all available events anyway.
+func WithEventsCoalescingNotifier(window time.Duration) EventsOption {
+	return func(table *EventsTable) {
+		table.notifier = newCoalescingNotifier(window)
+	}
+}
+
+// CacheConfig configures the read-through cache of an events table.
+// The zero value enables the cache with the default limit.
+type CacheConfig struct {
+	// Disabled disables the cache, see WithoutEventsCache.
+	Disabled bool
+
+	// Limit is the maximum number of cached events. It defaults to
+	// the value set by SetDefaultRCacheLimit if zero.
+	Limit int
+
+	// BypassOnLag bypasses the cache for lag streams, see WithCacheBypassOnLag.
+	BypassOnLag bool
+
+	// BypassBehind bypasses the cache for streams behind the cache head,
+	// see WithBackfillCacheBypass.
+	BypassBehind bool
+
+	// BehindLRU is the number of recently loaded event ranges before the
+	// cache head to retain, see WithCacheBehindLRU. Zero disables it.
+	BehindLRU int
+}
+
+// WithEventsCache provides an option to configure all read-through cache
+// behaviour of the events table. It overrides previous cache options.
+func WithEventsCache(conf CacheConfig) EventsOption {
+	return func(table *EventsTable) {
+		table.cacheConfig = conf
+	}
+}
+
 // WithEventsCacheEnabled provides an option to enable the read-through
 // cache on the events table.
 //
 // Deprecated: Cache enabled by default.
 func WithEventsCacheEnabled() EventsOption {
 	return func(table *EventsTable) {
-		table.disableCache = false
+		table.cacheConfig.Disabled = false
 	}
 }
 
@@ -114,34 +241,294 @@ func WithEventsCacheEnabled() EventsOption {
 // cache on the events table.
 func WithoutEventsCache() EventsOption {
 	return func(table *EventsTable) {
-		table.disableCache = true
+		table.cacheConfig.Disabled = true
+	}
+}
+
+// WithCacheBypassOnLag provides an option to bypass the read-through cache
+// for streams with a lag (see reflex.WithStreamLag), loading events directly
+// from the DB instead. For some workloads this is cheaper than the cache misses
+// caused by the cache tail being too new to satisfy the lag.
+func WithCacheBypassOnLag() EventsOption {
+	return func(table *EventsTable) {
+		table.cacheConfig.BypassOnLag = true
+	}
+}
+
+// WithBackfillCacheBypass provides an option to bypass the read-through cache
+// for streams that are behind the cache head, loading events directly from the
+// DB without locking or updating the cache. This prevents far-behind backfill
+// streams from contending with and evicting the cache used by head streams.
+// Backfill streams are served from the cache again once they catch up.
+func WithBackfillCacheBypass() EventsOption {
+	return func(table *EventsTable) {
+		table.cacheConfig.BypassBehind = true
+	}
+}
+
+// WithCacheBehindLRU provides an option to retain up to size recently loaded
+// event ranges before the read-through cache head in a secondary least recently
+// used cache. This absorbs repeated misses of streams that reconnect just
+// below the cache head. It has no effect with WithBackfillCacheBypass.
+// It is disabled by default.
+func WithCacheBehindLRU(size int) EventsOption {
+	return func(table *EventsTable) {
+		table.cacheConfig.BehindLRU = size
+	}
+}
+
+// WithStreamColumns provides an option to only populate the provided columns
+// on streamed events, other columns are left zero. The event ID is always
+// populated. Unselected timestamp and metadata columns are not queried by the
+// default loader, unless the timestamp is required by the read-through cache.
+// The foreign ID and type are always queried since they identify noop events.
+// Use Clone to create a table with this option for specific streams.
+func WithStreamColumns(cols ...Column) EventsOption {
+	return func(table *EventsTable) {
+		table.columns = append([]Column{}, cols...)
 	}
 }
 
 // WithEventsBackoff provides an option to set the backoff period between polling
 // the DB for new events. It defaults to 10s.
+//
+// A zero backoff is only valid with a notifier (see WithEventsNotifier), in which
+// case idle streams only poll the DB when notified. Streams blocked by a gap
+// therefore rely on the gap filler (see FillGaps) which notifies once filled.
+// Without a notifier, or if streams are lagged, a zero backoff falls back to
+// 100ms to avoid spinning on the DB.
 func WithEventsBackoff(d time.Duration) EventsOption {
 	return func(table *EventsTable) {
 		table.backoff = d
 	}
 }
 
+// WithStreamMaxBuffered provides an option to limit the number of events
+// buffered by each stream to n. If the loader returns more than n events,
+// the remainder is held and moved to the buffer in batches of n as it is
+// drained, so no events are dropped and the cursor advances as usual, while
+// drained batches are released early. Since loaders are not limited, use a
+// custom loader (see WithEventsLoader) returning at most n events to also
+// bound the events loaded per query, trading more queries for less memory.
+// It defaults to zero, no limit.
+func WithStreamMaxBuffered(n int) EventsOption {
+	return func(table *EventsTable) {
+		table.maxBuffered = n
+	}
+}
+
+// WithEventsTracer provides an option to start spans with the tracer for
+// streams of the table. A "reflex.rsql.recv" span is started for each call
+// to Recv with the table name attribute and, if an event is returned, its
+// ID and type attributes. A nested "reflex.rsql.load" span is started around
+// each loader query with the table name and cursor attributes, and the
+// loader's context contains it. It defaults to no tracing.
+func WithEventsTracer(t reflex.Tracer) EventsOption {
+	return func(table *EventsTable) {
+		table.tracer = t
+	}
+}
+
+// WithEventsIDStep provides an option to set the increment between consecutive
+// event ids for tables with auto increment ids configured with an increment
+// larger than 1, ex. MySQL's auto_increment_increment or Postgres sequences.
+// Ids differing by step are then consecutive, not gaps, for gap detection,
+// the read-through cache and gap filling (see FillGaps). Note that all ids
+// must be multiples of step apart. It defaults to 1.
+func WithEventsIDStep(step int64) EventsOption {
+	return func(table *EventsTable) {
+		if step > 0 {
+			table.schema.idStep = step
+		}
+	}
+}
+
+// WithEventsExponentialBackoff provides an option to grow the backoff period
+// between polling the DB for new events while no new events are found. The
+// backoff starts at min and is multiplied by factor after each empty poll up
+// to max. It is reset to min as soon as a poll returns events. A factor of 1
+// or less results in a fixed backoff of min.
+func WithEventsExponentialBackoff(min, max time.Duration, factor float64) EventsOption {
+	return func(table *EventsTable) {
+		table.backoff = min
+		table.backoffMax = max
+		table.backoffFactor = factor
+	}
+}
+
+// WithEventsSettleDelay provides an option to only stream events once they are
+// older than d, ie. a minimum lag (see reflex.WithStreamLag) for all streams.
+//
+// Under concurrent inserts, auto increment IDs may become visible out of order,
+// since a lower ID can commit after a higher ID. Gaps after the first streamed
+// event are detected and block streams until the missing event is committed or
+// filled with a noop (see FillGaps), but a gap before the first event of a new
+// stream (or of a custom loader without gap detection) results in the missing
+// event being skipped. A settle delay longer than typical insert transactions
+// allows the sequence to settle before it is streamed, avoiding such skips and
+// reducing blocking gaps, at the cost of increasing latency by d.
+func WithEventsSettleDelay(d time.Duration) EventsOption {
+	return func(table *EventsTable) {
+		table.settleDelay = d
+	}
+}
+
+// WithEventsQueryHook provides an option to derive the context of each
+// stream DB query from the stream context, ex. to inject tracing spans or
+// query tags. The hook is called before each poll of the events loader and
+// before querying the head for reflex.WithStreamFromHead.
+func WithEventsQueryHook(hook func(context.Context) context.Context) EventsOption {
+	return func(table *EventsTable) {
+		table.queryHook = hook
+	}
+}
+
+// WithEmptyCursorMeansHead provides an option for streams with an empty cursor
+// to start from head like reflex.WithStreamFromHead, instead of from the
+// beginning of the table. This avoids accidental full replays by new
+// consumers without a stored cursor. Note that Each (and thereby Replay
+// and WaitForHead) still streams an empty cursor from the beginning.
+func WithEmptyCursorMeansHead() EventsOption {
+	return func(table *EventsTable) {
+		table.emptyCursorHead = true
+	}
+}
+
+// WithTombstoneType provides an option to define the event type that marks the
+// deletion of its foreign ID for compacted streams, see StreamCompacted. If the
+// latest event of a foreign ID is a tombstone, it is streamed as such so that
+// consumers can remove the foreign ID from their projection. When compacting
+// from the start of the table (an empty or zero cursor) there is nothing to
+// remove, so the foreign ID is omitted instead. Consumers distinguish
+// tombstones by their type, see reflex.IsType.
+func WithTombstoneType(typ reflex.EventType) EventsOption {
+	return func(table *EventsTable) {
+		table.tombstoneType = typ
+	}
+}
+
+// WithHeartbeat provides an option for streams to return a heartbeat event from
+// Recv every interval while idle at the head of the events table. Heartbeat
+// events have type HeartbeatType and the ID of the previous event (or the
+// starting cursor), so storing it as cursor does not advance the stream.
+// Consumers can ignore heartbeats (see IsHeartbeat) while liveness tooling
+// can distinguish a quiet stream from a stalled consumer.
+func WithHeartbeat(interval time.Duration) EventsOption {
+	return func(table *EventsTable) {
+		table.heartbeat = interval
+	}
+}
+
+// HeartbeatType is the type of heartbeat events returned by streams
+// configured with WithHeartbeat.
+var HeartbeatType reflex.EventType = eventType(-1)
+
+// IsHeartbeat returns true if the event is a heartbeat event returned by
+// streams configured with WithHeartbeat.
+func IsHeartbeat(e *reflex.Event) bool {
+	return e.Type != nil && reflex.IsType(e.Type, HeartbeatType)
+}
+
+// WithEventsPollRateLimit provides an option to limit the rate of DB queries
+// of the events loader to rps, shared by all streams of the table and its
+// clones. Unlike backoff, this caps the query rate even if notifications cause
+// immediate re-polls. The limit is applied as loader middleware (see
+// WithLoaderMiddleware), so polls served by the read-through cache are not
+// limited. It is disabled by default.
+func WithEventsPollRateLimit(rps float64) EventsOption {
+	return func(table *EventsTable) {
+		if rps > 0 {
+			table.middleware = append(table.middleware, rateLimit(rps))
+		}
+	}
+}
+
+// WithEventsAutoReconnect provides an option for streams to wait for the DB to
+// recover instead of returning loader errors caused by connectivity issues.
+// On a loader error, the DB is pinged. If the ping fails, it is retried every
+// interval until it succeeds after which the load is retried. Errors are
+// returned as usual if the ping succeeds.
+func WithEventsAutoReconnect(interval time.Duration) EventsOption {
+	return func(table *EventsTable) {
+		table.reconnectInterval = interval
+	}
+}
+
 // WithEventsLoader provides an option to set the base event loader function.
 // The base event loader loads events returns the next available events and
 // the associated next cursor after the previous cursor or an error.
 // The default loader is configured with the WithEventsXField options.
-func WithEventsLoader(loader loader) EventsOption {
+func WithEventsLoader(loader Loader) EventsOption {
 	return func(table *EventsTable) {
 		table.baseLoader = loader
 	}
 }
 
+// WithSnapshotLoader provides an option for streams to catch up from a
+// snapshot table, ie. a compacted copy of the events table, instead of
+// scanning all events. Streams behind the maximum ID of the snapshot table
+// (its head) read the snapshot events after their cursor up to the head,
+// and then switch to the events table near head.
+//
+// The snapshot table must have the same columns as the events table and be
+// consistent to its head: it must contain exactly the latest event (with the
+// same ID) per foreign ID of all events up to and including its head. It
+// must therefore be refreshed atomically, eg. in a single transaction.
+// Consumers catching up from the snapshot only receive the latest event per
+// foreign ID, like StreamCompacted, so the handoff produces the same final
+// state per foreign ID as a full replay.
+//
+// The snapshot head is read when a stream starts (or is rewound) and the
+// snapshot bypasses the loader layers, ie. the cache, gap detection and
+// middleware.
+func WithSnapshotLoader(snapshotTable string) EventsOption {
+	return func(table *EventsTable) {
+		table.snapshotTable = snapshotTable
+	}
+}
+
+// WithLoaderMiddleware provides an option to wrap the base event loader
+// with middleware, ex. to add tracing or rate limiting of DB queries.
+// Middleware is applied in order, so the first is the outermost. It wraps
+// the base loader (see WithEventsLoader) and is wrapped by the built-in
+// layers as follows (from outer to inner):
+//
+//	noop filter
+//	read-through cache (if enabled)
+//	gap detector
+//	middleware
+//	base loader
+//
+// It is therefore only called on cache misses and sees noop events.
+func WithLoaderMiddleware(mws ...LoaderMiddleware) EventsOption {
+	return func(table *EventsTable) {
+		table.middleware = append(table.middleware, mws...)
+	}
+}
+
+// WithMaxMetadataBytes provides an option to limit the size of inserted event
+// metadata. InsertWithMetadata returns ErrMetadataTooLarge without touching
+// the DB if the metadata exceeds n bytes. It defaults to zero, ie. unlimited.
+func WithMaxMetadataBytes(n int) EventsOption {
+	return func(table *EventsTable) {
+		table.maxMetadata = n
+	}
+}
+
 // WithEventsInserter provides an option to set the event inserter
 // which inserts event into a sql table. The default inserter is
-// configured with the WithEventsXField options.
+// configured with the WithEventsXField options. Note that the ID of
+// events inserted by custom inserters is unknown, so a DetailedNotifier
+// is notified with a zero ID.
 func WithEventsInserter(inserter inserter) EventsOption {
 	return func(table *EventsTable) {
-		table.inserter = inserter
+		table.inserter = func(ctx context.Context, tx *sql.Tx, foreignID string,
+			typ reflex.EventType, metadata []byte, ts time.Time) (int64, error) {
+			if !ts.IsZero() {
+				return 0, errors.New("custom inserter doesn't support timestamps")
+			}
+			return 0, inserter(ctx, tx, foreignID, typ, metadata)
+		}
 	}
 }
 
@@ -149,20 +536,36 @@ func WithEventsInserter(inserter inserter) EventsOption {
 type inserter func(ctx context.Context, tx *sql.Tx,
 	foreignID string, typ reflex.EventType, metadata []byte) error
 
+// idInserter abstracts the insertion of an event into a sql table
+// returning the inserted event ID or zero if unknown. A zero
+// timestamp defaults to the current DB time.
+type idInserter func(ctx context.Context, tx *sql.Tx, foreignID string,
+	typ reflex.EventType, metadata []byte, ts time.Time) (int64, error)
+
 // EventsTable provides reflex event insertion and streaming
 // for a sql db table.
 type EventsTable struct {
 	options
-	schema       etableSchema
-	disableCache bool
-	baseLoader   loader
-	inserter     inserter
+	schema      etableSchema
+	cacheConfig CacheConfig
+	pollOnly    bool
+	maxMetadata int
+	baseLoader  Loader
+	middleware  []LoaderMiddleware
+	inserter    idInserter
 
 	// Stateful fields not cloned
 	currentLoader filterLoader
-	gapCh         chan Gap
-	gapFns        []func(Gap)
-	gapMu         sync.Mutex
+	cache         *rcache
+	gaps          *gapListeners
+}
+
+// gapListeners serves gaps detected by a loader to the registered listeners.
+// It is shared by tables sharing the loader, see CloneSharingCache.
+type gapListeners struct {
+	ch  chan Gap
+	mu  sync.Mutex
+	fns []func(Gap)
 }
 
 // Insert inserts an event into the EventsTable and returns a function that
@@ -184,25 +587,237 @@ func (t *EventsTable) Insert(ctx context.Context, tx *sql.Tx, foreignID string,
 // Note metadata is disabled by default, enable with WithEventMetadataField option.
 func (t *EventsTable) InsertWithMetadata(ctx context.Context, tx *sql.Tx, foreignID string,
 	typ reflex.EventType, metadata []byte) (NotifyFunc, error) {
-	if isNoop(foreignID, typ) {
-		return nil, errors.New("inserting invalid noop event")
+	return t.insert(ctx, tx, foreignID, typ, metadata, time.Time{})
+}
+
+// InsertWithTimestamp is like InsertWithMetadata but sets the event timestamp
+// to the provided time instead of the current DB time. It is intended for
+// backfilling historical events. It returns an error if the time is zero or
+// if a custom inserter is configured via WithEventsInserter.
+//
+// Note that events are still streamed in ID order, so timestamps of
+// backfilled events are not increasing which affects the WithStreamLag
+// option and consumer lag metrics.
+func (t *EventsTable) InsertWithTimestamp(ctx context.Context, tx *sql.Tx, foreignID string,
+	typ reflex.EventType, metadata []byte, ts time.Time) (NotifyFunc, error) {
+	if ts.IsZero() {
+		return nil, errors.New("zero event timestamp")
+	}
+
+	return t.insert(ctx, tx, foreignID, typ, metadata, ts)
+}
+
+// insert inserts an event with the timestamp or the current DB time if zero.
+func (t *EventsTable) insert(ctx context.Context, tx *sql.Tx, foreignID string,
+	typ reflex.EventType, metadata []byte, ts time.Time) (NotifyFunc, error) {
+	if t.schema.isNoop(foreignID, typ) {
+		eventsInsertNoopCounter.WithLabelValues(t.schema.name).Inc()
+		return nil, ErrInsertNoop
+	}
+
+	if t.maxMetadata > 0 && len(metadata) > t.maxMetadata {
+		return nil, errors.Wrap(ErrMetadataTooLarge, "insert",
+			j.MKV{"size": len(metadata), "max": t.maxMetadata})
 	}
-	err := t.inserter(ctx, tx, foreignID, typ, metadata)
+
+	t0 := time.Now()
+	id, err := t.inserter(ctx, tx, foreignID, typ, metadata, ts)
+	eventsInsertLatency.WithLabelValues(t.schema.name).Observe(time.Since(t0).Seconds())
 	if err != nil {
 		return noopFunc, err
 	}
+	eventsInsertCounter.WithLabelValues(t.schema.name).Inc()
+
+	if dn, ok := t.notifier.(DetailedNotifier); ok {
+		return func() {
+			dn.NotifyEvent(id, foreignID, typ)
+		}, nil
+	}
 
 	return t.notifier.Notify, nil
 }
 
+// InsertOnce inserts an event with metadata recording the caller's business
+// transaction ID and returns its ID, or returns the ID of the event previously
+// inserted with the same transaction ID without inserting again. This provides
+// idempotent inserts for retried business transactions. The returned notify
+// function is a noop if no event was inserted.
+//
+// It requires the transaction ID field (see WithEventTxIDField) with a unique
+// index, otherwise it returns ErrTxIDNotEnabled. It always uses the default
+// insert query, ignoring any custom inserter (see WithEventsInserter).
+// Note that a concurrent insert of the same transaction ID blocks until the
+// other DB transaction completes, while inserts of other transaction IDs
+// don't block. The DB connection must not use the clientFoundRows option,
+// otherwise repeat calls are reported as inserts.
+func (t *EventsTable) InsertOnce(ctx context.Context, tx *sql.Tx, foreignID string,
+	typ reflex.EventType, metadata []byte, txID string) (int64, NotifyFunc, error) {
+	if t.schema.txIDField == "" {
+		return 0, nil, ErrTxIDNotEnabled
+	} else if txID == "" {
+		return 0, nil, errors.New("empty tx id")
+	} else if t.schema.isNoop(foreignID, typ) {
+		eventsInsertNoopCounter.WithLabelValues(t.schema.name).Inc()
+		return 0, nil, ErrInsertNoop
+	}
+
+	if t.maxMetadata > 0 && len(metadata) > t.maxMetadata {
+		return 0, nil, errors.Wrap(ErrMetadataTooLarge, "insert once",
+			j.MKV{"size": len(metadata), "max": t.maxMetadata})
+	}
+
+	t0 := time.Now()
+	id, inserted, err := insertOnce(ctx, tx, t.schema, foreignID, typ, metadata, txID)
+	eventsInsertLatency.WithLabelValues(t.schema.name).Observe(time.Since(t0).Seconds())
+	if err != nil {
+		return 0, noopFunc, err
+	} else if !inserted {
+		return id, noopFunc, nil
+	}
+	eventsInsertCounter.WithLabelValues(t.schema.name).Inc()
+
+	if dn, ok := t.notifier.(DetailedNotifier); ok {
+		return id, func() {
+			dn.NotifyEvent(id, foreignID, typ)
+		}, nil
+	}
+
+	return id, t.notifier.Notify, nil
+}
+
+// Notify notifies the table's EventsNotifier which triggers waiting StreamClients.
+// It is useful when events are inserted by external writers, not via Insert.
+// Note that it is a noop if no notifier is configured.
+func (t *EventsTable) Notify() {
+	t.notifier.Notify()
+}
+
+// ClaimEvents returns up to limit non-noop events after the provided cursor that
+// are not claimed by other transactions, claiming them for this transaction
+// using "select ... for update skip locked" semantics. This allows multiple
+// workers to process events concurrently with each event claimed by only one
+// worker at a time. Claims are released when the transaction completes, so
+// side effects and a record of processed events should be committed in the
+// same transaction. Requires MySQL 8.0 or later.
+func (t *EventsTable) ClaimEvents(ctx context.Context, tx *sql.Tx, after int64,
+	limit int) ([]*reflex.Event, error) {
+
+	if limit <= 0 {
+		return nil, errors.New("non-positive claim limit")
+	}
+
+	el, err := claimNextEvents(ctx, tx, t.schema, after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*reflex.Event
+	for _, e := range el {
+		if t.schema.isNoopEvent(e) {
+			continue
+		}
+		res = append(res, e)
+	}
+
+	return res, nil
+}
+
+// LoadTx returns up to limit non-noop events after the provided cursor
+// queried within the transaction, so it includes events inserted by the
+// transaction itself but not yet committed, eg. to validate them before
+// committing. Events inserted by other uncommitted transactions are not
+// visible, and depending on the transaction isolation level (repeatable read
+// by default in MySQL) events committed after the transaction's first read
+// may not be visible either. The events are not cached and since they may
+// be rolled back, their IDs should not be used as cursors outside the
+// transaction.
+func (t *EventsTable) LoadTx(ctx context.Context, tx *sql.Tx, after int64,
+	limit int) ([]*reflex.Event, error) {
+
+	if limit <= 0 {
+		return nil, errors.New("non-positive load limit")
+	}
+
+	el, err := getNextEventsTx(ctx, tx, t.schema, after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*reflex.Event
+	for _, e := range el {
+		if t.schema.isNoopEvent(e) {
+			continue
+		}
+		res = append(res, e)
+	}
+
+	return res, nil
+}
+
+// ExplainStreamQuery returns the query plan of the default base loader's
+// query after the provided cursor. It is useful to confirm that the
+// query uses the intended index. Each plan row is returned on a separate
+// line as tab separated "column=value" pairs.
+func (t *EventsTable) ExplainStreamQuery(ctx context.Context, dbc *sql.DB,
+	after int64) (string, error) {
+	return explainNextEvents(ctx, dbc, t.schema, after)
+}
+
+// Validate returns an error if the configured schema fields are empty
+// (except the optional metadata field) or not distinct, since that
+// results in invalid or incorrect queries. It also returns an error
+// if WithEventsPollOnly is combined with a notifier. Streams of a table
+// failing validation return the error from Recv.
+func (t *EventsTable) Validate() error {
+	if _, ok := t.notifier.(*stubNotifier); t.pollOnly && !ok {
+		return errors.New("poll only events table with notifier")
+	}
+
+	return t.schema.validate()
+}
+
+// DistinctTypes returns the distinct event types present in the events table
+// in ascending order. It scans the whole table, see DistinctTypesSample
+// for large tables.
+func (t *EventsTable) DistinctTypes(ctx context.Context, dbc *sql.DB) ([]int, error) {
+	return getDistinctTypes(ctx, dbc, t.schema, 0)
+}
+
+// DistinctTypesSample is like DistinctTypes but only considers the latest n events.
+func (t *EventsTable) DistinctTypesSample(ctx context.Context, dbc *sql.DB, n int) ([]int, error) {
+	if n <= 0 {
+		return nil, errors.New("non-positive sample size")
+	}
+	return getDistinctTypes(ctx, dbc, t.schema, n)
+}
+
+// EnsureSchema returns an error if any of the configured columns are missing
+// from the events table or have incompatible types, as reported by
+// information_schema. It returns ErrSchemaMismatch listing all missing and
+// mismatched columns, which is easier to diagnose than the driver error
+// of the first failing query. Note that temporary tables are not supported.
+func (t *EventsTable) EnsureSchema(ctx context.Context, dbc *sql.DB) error {
+	types, err := getColumnTypes(ctx, dbc, t.schema.name)
+	if err != nil {
+		return err
+	}
+
+	return t.schema.check(types)
+}
+
 // Clone returns a new etable cloned from the config of t with the new options applied.
-// Note that the stateful fields are not clone, so the cache is not shared.
+// Note that the stateful fields are not clone, so the cache is not shared,
+// see CloneSharingCache. The notifier is shared, so inserts on one clone
+// wake streams of the other clones.
 func (t *EventsTable) Clone(opts ...EventsOption) *EventsTable {
 	table := &EventsTable{
-		options:      t.options,
-		schema:       t.schema,
-		disableCache: t.disableCache,
-		baseLoader:   nil,
+		options:     t.options,
+		schema:      t.schema,
+		cacheConfig: t.cacheConfig,
+		pollOnly:    t.pollOnly,
+		maxMetadata: t.maxMetadata,
+		baseLoader:  nil,
+		middleware:  append([]LoaderMiddleware(nil), t.middleware...),
 	}
 	for _, opt := range opts {
 		opt(table)
@@ -212,18 +827,86 @@ func (t *EventsTable) Clone(opts ...EventsOption) *EventsTable {
 		table.inserter = makeDefaultInserter(table.schema)
 	}
 
-	table.gapCh = make(chan Gap)
-	table.currentLoader = buildLoader(table.baseLoader, table.gapCh,
-		table.disableCache, table.schema)
+	table.schema.columns = queryColumns(table.columns, table.cacheConfig.Disabled)
+	table.configErr = table.Validate()
+	table.gaps = &gapListeners{ch: make(chan Gap)}
+	table.currentLoader, table.cache = buildLoader(table.baseLoader, table.middleware,
+		table.gaps.ch, table.cacheConfig, table.schema)
 
 	return table
 }
 
+// CloneSharingCache returns a new etable cloned from the config of t with the new
+// options applied that shares the event loader and read-through cache of t.
+// It returns an error if the options change the cache config, base loader or
+// schema, since those are defined by the shared loader. Gaps detected by the
+// shared loader are served to all listeners registered on t or any of its
+// sharing clones, see ListenGaps.
+func (t *EventsTable) CloneSharingCache(opts ...EventsOption) (*EventsTable, error) {
+	table := &EventsTable{
+		options:     t.options,
+		schema:      t.schema,
+		cacheConfig: t.cacheConfig,
+		pollOnly:    t.pollOnly,
+		maxMetadata: t.maxMetadata,
+		baseLoader:  nil,
+		middleware:  append([]LoaderMiddleware(nil), t.middleware...),
+	}
+	for _, opt := range opts {
+		opt(table)
+	}
+
+	if table.cacheConfig != t.cacheConfig {
+		return nil, errors.New("shared cache clone with conflicting cache config")
+	} else if table.baseLoader != nil || len(table.middleware) != len(t.middleware) {
+		return nil, errors.New("shared cache clone with conflicting loader")
+	}
+
+	table.schema.columns = queryColumns(table.columns, table.cacheConfig.Disabled)
+	if !sameSchema(table.schema, t.schema) {
+		return nil, errors.New("shared cache clone with conflicting schema")
+	}
+
+	if table.inserter == nil {
+		table.inserter = makeDefaultInserter(table.schema)
+	}
+
+	table.configErr = table.Validate()
+	table.baseLoader = t.baseLoader
+	table.gaps = t.gaps
+	table.currentLoader, table.cache = t.currentLoader, t.cache
+
+	return table, nil
+}
+
 // Stream implements reflex.StreamFunc and returns a StreamClient that
 // streams events from the db. It is only safe for a single goroutine to use.
+//
+// Note: The returned StreamClient implementation also exposes Pause, Resume
+// and AtHead methods which are safe to call from other goroutines.
+// It also exposes a BufferedLen method which returns the number of
+// buffered events not yet received, a RecvBatch method which receives
+// multiple events at once and a Rewind method which resets the stream
+// to an earlier cursor; like Recv these are not safe to call from other
+// goroutines.
+//
+// If the table is configured with WithEmptyCursorMeansHead, an empty cursor
+// streams from head.
 func (t *EventsTable) Stream(ctx context.Context, dbc *sql.DB, after string,
 	opts ...reflex.StreamOption) reflex.StreamClient {
 
+	sc := t.newStreamClient(ctx, dbc, after, opts...)
+	if after == "" && t.emptyCursorHead {
+		sc.StreamFromHead = true
+	}
+
+	return sc
+}
+
+// newStreamClient returns a new stream client after the cursor.
+func (t *EventsTable) newStreamClient(ctx context.Context, dbc *sql.DB, after string,
+	opts ...reflex.StreamOption) *streamclient {
+
 	sc := &streamclient{
 		schema:  t.schema,
 		after:   after,
@@ -231,17 +914,37 @@ func (t *EventsTable) Stream(ctx context.Context, dbc *sql.DB, after string,
 		ctx:     ctx,
 		options: t.options,
 		loader:  t.currentLoader,
+		created: time.Now(),
 	}
 
 	for _, o := range opts {
 		o(&sc.StreamOptions)
 	}
 
+	if sc.SkipMetadata != nil {
+		sc.loader = wrapSkipFilter(sc.loader, sc.SkipMetadata)
+	}
+
 	eventsGapListenGauge.WithLabelValues(t.schema.name) // Init zero gap filling gauge.
 
 	return sc
 }
 
+// StreamWithReady is like Stream but also returns a channel that is closed the
+// first time the stream reaches the head of the events table, ie. when
+// Recv finds no more events. It is intended for services that should only
+// serve traffic once their projection has caught up at startup. Note that
+// the channel is only closed while the stream is being consumed by calling
+// Recv and it is never closed if the stream errors before reaching head.
+func (t *EventsTable) StreamWithReady(ctx context.Context, dbc *sql.DB, after string,
+	opts ...reflex.StreamOption) (reflex.StreamClient, <-chan struct{}) {
+
+	sc := t.Stream(ctx, dbc, after, opts...).(*streamclient)
+	sc.readyCh = make(chan struct{})
+
+	return sc, sc.readyCh
+}
+
 // ToStream returns a reflex StreamFunc interface of this EventsTable.
 func (t *EventsTable) ToStream(dbc *sql.DB, opts1 ...reflex.StreamOption) reflex.StreamFunc {
 	return func(ctx context.Context, after string,
@@ -250,25 +953,159 @@ func (t *EventsTable) ToStream(dbc *sql.DB, opts1 ...reflex.StreamOption) reflex
 	}
 }
 
-// ListenGaps adds f to a slice of functions that are called when a gap is detected.
+// Each streams events after the provided cursor up to the current head and
+// calls fn with each event. It stops at the first fn error and returns it.
+// It returns the cursor of the last successfully processed event, or after
+// if none were processed, which can be persisted to resume from. An empty
+// cursor always streams from the beginning, see WithEmptyCursorMeansHead.
+func (t *EventsTable) Each(ctx context.Context, dbc *sql.DB, after string,
+	fn func(*reflex.Event) error) (string, error) {
+
+	sc := t.newStreamClient(ctx, dbc, after, reflex.WithStreamToHead())
+
+	for {
+		e, err := sc.Recv()
+		if reflex.IsHeadReachedErr(err) {
+			return after, nil
+		} else if err != nil {
+			return after, err
+		}
+
+		if err := fn(e); err != nil {
+			return after, err
+		}
+
+		after = e.ID
+	}
+}
+
+// Replay is like Each but only calls fn with events for which skip returns
+// false given the event's foreign ID. It is intended for projection rebuilds
+// that can skip events of foreign IDs already at their latest state. Skipped
+// events still advance the returned cursor.
+func (t *EventsTable) Replay(ctx context.Context, dbc *sql.DB, after string,
+	skip func(foreignID string) bool, fn func(*reflex.Event) error) (string, error) {
+
+	return t.Each(ctx, dbc, after, func(e *reflex.Event) error {
+		if skip(e.ForeignID) {
+			return nil
+		}
+		return fn(e)
+	})
+}
+
+// WaitForHead streams events after the provided cursor until the current
+// head is reached. It returns nil when the head is reached or the context
+// error if it is cancelled or its deadline exceeded first. It is useful
+// for readiness checks.
+func (t *EventsTable) WaitForHead(ctx context.Context, dbc *sql.DB, after string) error {
+	_, err := t.Each(ctx, dbc, after, func(*reflex.Event) error {
+		return nil
+	})
+	return err
+}
+
+// LoadRange returns all non-noop events with IDs between fromID and toID (inclusive)
+// by paging through the DB in batches. It is intended for replay tooling of
+// bounded windows, use Stream for open-ended streams. IDs of unsigned ID columns
+// that exceed math.MaxInt64 are provided as the int64 with the same bits.
+func (t *EventsTable) LoadRange(ctx context.Context, dbc *sql.DB, fromID,
+	toID int64) ([]*reflex.Event, error) {
+
+	if idLess(toID, fromID) {
+		return nil, errors.Wrap(ErrInvalidRange, "load range", j.MKV{"from": fromID, "to": toID})
+	} else if toID == 0 {
+		// Event IDs start at 1, also a zero upper bound isn't a bound.
+		return nil, nil
+	}
+
+	var (
+		res   []*reflex.Event
+		after int64
+	)
+	if fromID > 1 || fromID < 0 {
+		// Negative IDs are unsigned IDs exceeding math.MaxInt64.
+		after = fromID - 1
+	}
+	for idLess(after, toID) {
+		el, err := getNextEventsUpTo(ctx, dbc, t.schema, after, toID, 0)
+		if err != nil {
+			return nil, err
+		} else if len(el) == 0 {
+			break
+		}
+
+		for _, e := range el {
+			if t.schema.isNoopEvent(e) {
+				continue
+			}
+			res = append(res, e)
+		}
+
+		after = eventID(el[len(el)-1])
+	}
+
+	return res, nil
+}
+
+// LatestIDForForeignID returns the ID of the latest event with the foreign ID
+// and true, or false if there are none. It is useful to checkpoint projections
+// per entity, eg. to only resume those that are behind. Note that it queries
+// the DB directly, so it is not limited by stream lag or the cache, and an
+// index on the foreign ID field is recommended.
+func (t *EventsTable) LatestIDForForeignID(ctx context.Context, dbc *sql.DB,
+	foreignID string) (int64, bool, error) {
+	return getLatestIDForForeignID(ctx, dbc, t.schema, foreignID)
+}
+
+// ListenGaps adds f to a slice of functions that are called when a gap is detected
+// and again when it is resolved, see Gap.IsResolved.
 // One first call, it starts a goroutine that serves these functions.
+// Tables sharing a loader (see CloneSharingCache) share their listeners,
+// so each gap is served to the listeners registered on any of them.
 func (t *EventsTable) ListenGaps(f func(Gap)) {
-	t.gapMu.Lock()
-	defer t.gapMu.Unlock()
-	if len(t.gapFns) == 0 {
+	g := t.gaps
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.fns) == 0 {
 		// Start serving gaps.
 		eventsGapListenGauge.WithLabelValues(t.schema.name).Set(1)
 		go func() {
-			for gap := range t.gapCh {
-				t.gapMu.Lock()
-				for _, f := range t.gapFns {
-					f(gap)
+			for gap := range g.ch {
+				g.mu.Lock()
+				for _, f := range g.fns {
+					t.serveGap(f, gap)
 				}
-				t.gapMu.Unlock()
+				g.mu.Unlock()
 			}
 		}()
 	}
-	t.gapFns = append(t.gapFns, f)
+	g.fns = append(g.fns, f)
+}
+
+// serveGap calls f with the gap, recovering and logging any panic so
+// that a faulty listener doesn't stop gap delivery to other listeners.
+func (t *EventsTable) serveGap(f func(Gap), gap Gap) {
+	defer func() {
+		if r := recover(); r != nil {
+			eventsGapListenerPanicCounter.WithLabelValues(t.schema.name).Inc()
+			log.Error(context.Background(), errors.New("gap listener panic",
+				j.MKV{"table": t.schema.name, "panic": fmt.Sprint(r),
+					"prev": gap.Prev, "next": gap.Next}))
+		}
+	}()
+
+	f(gap)
+}
+
+// CacheStats returns whether the read-through cache is enabled and if so,
+// its current size and the range of event IDs it contains.
+func (t *EventsTable) CacheStats() (enabled bool, size int, headID, tailID int64) {
+	if t.cache == nil {
+		return false, 0, 0, 0
+	}
+	size, headID, tailID = t.cache.Stats()
+	return true, size, headID, tailID
 }
 
 // getSchema returns the table schema and implements the gapTable interface for FillGaps.
@@ -276,16 +1113,45 @@ func (t *EventsTable) getSchema() etableSchema {
 	return t.schema
 }
 
-// buildLoader returns a new layered event loader.
-func buildLoader(baseLoader loader, ch chan<- Gap, disableCache bool, schema etableSchema) filterLoader {
+// buildLoader returns a new layered event loader and the read-through cache
+// if enabled.
+func buildLoader(baseLoader Loader, mws []LoaderMiddleware, ch chan<- Gap,
+	conf CacheConfig, schema etableSchema) (filterLoader, *rcache) {
+
+	var (
+		rangeLoader rangeLoader
+		minID       minIDLoader
+	)
 	if baseLoader == nil {
 		baseLoader = makeBaseLoader(schema)
+		rangeLoader = makeRangeLoader(schema)
+		minID = makeMinIDLoader(schema)
+	}
+	if len(mws) > 0 {
+		// Range loads bypass the base loader, so they would bypass middleware.
+		rangeLoader = nil
 	}
-	loader := wrapGapDetector(baseLoader, ch, schema.name)
-	if !disableCache /* ie. enableCache */ {
-		loader = newRCache(loader, schema.name).Load
+	for i := len(mws) - 1; i >= 0; i-- {
+		baseLoader = mws[i](baseLoader)
 	}
-	return wrapNoopFilter(loader)
+	loader := wrapGapDetector(baseLoader, ch, schema.name, minID, schema.step())
+
+	var cache *rcache
+	if !conf.Disabled {
+		cache = newRCache(loader, schema.name)
+		cache.step = schema.step()
+		cache.bypassOnLag = conf.BypassOnLag
+		cache.bypassBehind = conf.BypassBehind
+		if conf.Limit > 0 {
+			cache.limit = conf.Limit
+		}
+		cache.rangeLoader = rangeLoader
+		if conf.BehindLRU > 0 {
+			cache.lru = newRangeLRU(conf.BehindLRU, cache.step)
+		}
+		loader = cache.Load
+	}
+	return wrapNoopFilter(loader, schema), cache
 }
 
 // options define config/state defined in EventsTable used by the streamclients.
@@ -294,6 +1160,89 @@ type options struct {
 
 	notifier EventsNotifier
 	backoff  time.Duration
+
+	// backoffMax and backoffFactor configure exponential backoff if non-zero.
+	backoffMax    time.Duration
+	backoffFactor float64
+
+	// reconnectInterval enables waiting for the DB to recover on loader errors if non-zero.
+	reconnectInterval time.Duration
+
+	// emptyCursorHead streams empty cursors from head, see WithEmptyCursorMeansHead.
+	emptyCursorHead bool
+
+	// configErr is returned by streams if the table is misconfigured, see Validate.
+	configErr error
+
+	// columns populated on streamed events, nil for all.
+	columns []Column
+
+	// snapshotTable to catch up from if not empty, see WithSnapshotLoader.
+	snapshotTable string
+
+	// tombstoneType marks deletions in compacted streams if not nil.
+	tombstoneType reflex.EventType
+
+	// settleDelay is the minimum lag of all streams.
+	settleDelay time.Duration
+
+	// queryHook derives the context of stream DB queries if not nil.
+	queryHook func(context.Context) context.Context
+
+	// heartbeat is the idle interval after which streams return a heartbeat event if non-zero.
+	heartbeat time.Duration
+
+	// maxBuffered limits the length of stream buffers if positive, see WithStreamMaxBuffered.
+	maxBuffered int
+
+	// tracer traces streams if not nil, see WithEventsTracer.
+	tracer reflex.Tracer
+}
+
+// Column identifies an event column that can be selected with WithStreamColumns.
+type Column int
+
+const (
+	ColumnForeignID Column = 1
+	ColumnTimestamp Column = 2
+	ColumnType      Column = 3
+	ColumnMetadata  Column = 4
+)
+
+// includesColumn returns true if the column is included in cols
+// where nil cols includes all columns.
+func includesColumn(cols []Column, col Column) bool {
+	if cols == nil {
+		return true
+	}
+	for _, c := range cols {
+		if c == col {
+			return true
+		}
+	}
+	return false
+}
+
+// queryColumns returns the columns that need to be queried to populate
+// the provided columns.
+func queryColumns(cols []Column, disableCache bool) []Column {
+	if cols == nil {
+		return nil
+	}
+
+	res := append([]Column{ColumnForeignID, ColumnType}, cols...)
+	if !disableCache {
+		// The cache requires timestamps for lag.
+		res = append(res, ColumnTimestamp)
+	}
+	return res
+}
+
+// sameSchema returns true if the schemas are equal, excluding the
+// scanExtra function which cannot be compared.
+func sameSchema(a, b etableSchema) bool {
+	a.scanExtra, b.scanExtra = nil, nil
+	return reflect.DeepEqual(a, b)
 }
 
 // etableSchema defines the mysql schema of an events table.
@@ -303,6 +1252,143 @@ type etableSchema struct {
 	typeField      string
 	foreignIDField string
 	metadataField  string
+	txIDField      string
+
+	// noopForeignID and noopType identify noop events.
+	noopForeignID string
+	noopType      int
+
+	// idStep is the increment between consecutive event ids, see step.
+	idStep int64
+
+	// columns queried by the default loaders, nil for all.
+	columns []Column
+
+	// extraFields are additional fields mapped by scanExtra onto events.
+	extraFields []string
+	scanExtra   func(reflex.Event, []interface{}) *reflex.Event
+}
+
+// step returns the increment between consecutive event ids, defaulting to 1.
+func (s etableSchema) step() int64 {
+	if s.idStep > 0 {
+		return s.idStep
+	}
+	return 1
+}
+
+// validate returns an error if the schema fields are empty or not distinct.
+func (s etableSchema) validate() error {
+	if s.name == "" {
+		return errors.New("empty events table name")
+	}
+
+	// Map of field to description, the id field is not configurable.
+	seen := map[string]string{"id": "id"}
+
+	add := func(desc, field string) error {
+		if field == "" {
+			return errors.New("empty events table field", j.KV("field", desc))
+		}
+
+		// MySQL column names are case insensitive.
+		key := strings.ToLower(field)
+		if prev, ok := seen[key]; ok {
+			return errors.New("duplicate events table field",
+				j.MKV{"field": field, "first": prev, "second": desc})
+		}
+		seen[key] = desc
+
+		return nil
+	}
+
+	if err := add("time", s.timeField); err != nil {
+		return err
+	}
+	if err := add("type", s.typeField); err != nil {
+		return err
+	}
+	if err := add("foreign id", s.foreignIDField); err != nil {
+		return err
+	}
+	if s.metadataField != "" {
+		// Metadata is optional.
+		if err := add("metadata", s.metadataField); err != nil {
+			return err
+		}
+	}
+	if s.txIDField != "" {
+		// Transaction ID is optional.
+		if err := add("tx id", s.txIDField); err != nil {
+			return err
+		}
+	}
+	for _, field := range s.extraFields {
+		if err := add("extra", field); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var (
+	intTypes    = []string{"tinyint", "smallint", "mediumint", "int", "bigint"}
+	timeTypes   = []string{"datetime", "timestamp"}
+	stringTypes = []string{"char", "varchar", "tinytext", "text", "mediumtext", "longtext"}
+	binaryTypes = []string{"binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob"}
+)
+
+// check returns ErrSchemaMismatch if any of the schema fields are missing from the
+// column types keyed by lower case column name or have incompatible types.
+// Extra fields are only required to exist.
+func (s etableSchema) check(types map[string]string) error {
+	var missing, mismatched []string
+
+	add := func(field string, compatible ...[]string) {
+		typ, ok := types[strings.ToLower(field)]
+		if !ok {
+			missing = append(missing, field)
+			return
+		}
+
+		if len(compatible) == 0 {
+			return
+		}
+		for _, list := range compatible {
+			for _, c := range list {
+				if typ == c {
+					return
+				}
+			}
+		}
+
+		mismatched = append(mismatched, field+" "+typ)
+	}
+
+	add("id", intTypes)
+	add(s.timeField, timeTypes)
+	add(s.typeField, intTypes)
+	add(s.foreignIDField, stringTypes, binaryTypes, intTypes)
+	if s.metadataField != "" {
+		add(s.metadataField, binaryTypes, stringTypes, []string{"json"})
+	}
+	if s.txIDField != "" {
+		add(s.txIDField, stringTypes, binaryTypes)
+	}
+	for _, field := range s.extraFields {
+		add(field)
+	}
+
+	if len(missing) == 0 && len(mismatched) == 0 {
+		return nil
+	}
+
+	return errors.Wrap(ErrSchemaMismatch, "events table columns missing or mismatched", j.MKV{
+		"table":      s.name,
+		"missing":    strings.Join(missing, ", "),
+		"mismatched": strings.Join(mismatched, ", "),
+	})
 }
 
 type streamclient struct {
@@ -312,11 +1398,136 @@ type streamclient struct {
 	after  string
 	prev   int64 // Previous (current) cursor.
 	buf    []*reflex.Event
+	held   []*reflex.Event // Loaded events exceeding maxBuffered, following buf.
 	dbc    *sql.DB
 	ctx    context.Context
 
 	// loader queries next events from the DB.
 	loader filterLoader
+
+	snapshotHead int64 // Max ID of the snapshot table, only valid if snapshotRead.
+	snapshotRead bool
+
+	pauseMu  sync.Mutex
+	resumeCh chan struct{} // Non-nil while paused.
+
+	curBackoff time.Duration // Next backoff period, zero if not started.
+	lastActive time.Time     // Time of the last returned event or heartbeat.
+
+	readyCh chan struct{} // Closed and cleared when head is first reached, if non-nil.
+
+	delivered int // Number of events returned, see reflex.WithStreamLimit.
+
+	pastStart bool // Events after the starting cursor have been loaded.
+
+	recvCtx context.Context // Context of the current Recv span, nil if not tracing.
+
+	created time.Time // Time the stream was created, zero once the first event is returned.
+
+	atHead int32 // 1 while idle at the head after an empty poll, accessed atomically.
+}
+
+// AtHead returns true if the last poll returned no events, ie. the stream
+// is idle at the head of the table, and false while it is behind. It is safe
+// to call from other goroutines and is used by reflex consumers to update
+// their lag while idle, see reflex.WithConsumerIdleLagUpdate.
+func (s *streamclient) AtHead() bool {
+	return atomic.LoadInt32(&s.atHead) == 1
+}
+
+// BufferedLen returns the number of events buffered from the last poll
+// that have not been returned by Recv yet. Like Recv, it is not safe
+// to call concurrently.
+func (s *streamclient) BufferedLen() int {
+	return len(s.buf)
+}
+
+// queryCtx returns the context for a DB query derived by the query hook if
+// configured. It contains the current Recv span if tracing.
+func (s *streamclient) queryCtx() context.Context {
+	ctx := s.ctx
+	if s.recvCtx != nil {
+		ctx = s.recvCtx
+	}
+
+	if s.queryHook == nil {
+		return ctx
+	}
+	return s.queryHook(ctx)
+}
+
+// lag returns the stream lag, at least the settle delay.
+func (s *streamclient) lag() time.Duration {
+	if s.Lag < s.settleDelay {
+		return s.settleDelay
+	}
+	return s.Lag
+}
+
+// Rewind resets the stream to continue after the provided cursor, which may be
+// empty to restart from the beginning. Buffered events are discarded and
+// subsequent calls to Recv return events after the cursor, served from the
+// cache if still resident. Like Recv, it is not safe to call concurrently,
+// so call it from the consuming goroutine between calls to Recv.
+func (s *streamclient) Rewind(after string) error {
+	var prev int64
+	if after != "" {
+		var err error
+		prev, err = cursorID(after)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.prev = prev
+	s.after = ""
+	s.StreamFromHead = false
+	s.buf = nil
+	s.held = nil
+	s.pastStart = false
+	s.snapshotRead = false
+	s.resetBackoff()
+
+	return nil
+}
+
+// Pause results in subsequent calls to Recv blocking until Resume is called.
+func (s *streamclient) Pause() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	if s.resumeCh == nil {
+		s.resumeCh = make(chan struct{})
+	}
+}
+
+// Resume unblocks calls to Recv after Pause.
+func (s *streamclient) Resume() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	if s.resumeCh != nil {
+		close(s.resumeCh)
+		s.resumeCh = nil
+	}
+}
+
+// awaitResume blocks while the stream is paused.
+func (s *streamclient) awaitResume() error {
+	s.pauseMu.Lock()
+	ch := s.resumeCh
+	s.pauseMu.Unlock()
+
+	if ch == nil {
+		return nil
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
 }
 
 // Recv blocks and returns the next event in the stream. It queries the db
@@ -325,46 +1536,106 @@ type streamclient struct {
 // before retrying. It blocks until it can return a non-nil event or an error.
 // It is only safe for a single goroutine to call Recv.
 func (s *streamclient) Recv() (*reflex.Event, error) {
+	if s.tracer == nil {
+		return s.recv()
+	}
+
+	ctx, span := s.tracer.Start(s.ctx, "reflex.rsql.recv", map[string]string{
+		reflex.SpanAttrTable: s.schema.name,
+	})
+	s.recvCtx = ctx
+	defer func() { s.recvCtx = nil }()
+
+	e, err := s.recv()
+	if e != nil {
+		span.SetAttribute(reflex.SpanAttrEventID, e.ID)
+		if e.Type != nil {
+			span.SetAttribute(reflex.SpanAttrEventType, reflex.EventTypeName(e.Type))
+		}
+	}
+	span.End(err)
+
+	return e, err
+}
+
+func (s *streamclient) recv() (*reflex.Event, error) {
 	if err := s.ctx.Err(); err != nil {
 		return nil, err
 	}
 
+	if s.configErr != nil {
+		return nil, s.configErr
+	}
+
+	if err := s.awaitResume(); err != nil {
+		return nil, err
+	}
+
+	if s.Limit > 0 && s.delivered >= s.Limit {
+		return nil, reflex.ErrLimitReached
+	}
+
 	// Initialise cursor s.prev once.
 	var err error
 	if s.StreamFromHead {
-		s.prev, err = getLatestID(s.ctx, s.dbc, s.schema)
+		s.prev, err = getLatestID(s.queryCtx(), s.dbc, s.schema)
 		if err != nil {
 			return nil, err
 		}
 		s.StreamFromHead = false
 		s.after = "" // StreamFromHead overrides after.
 	} else if s.after != "" {
-		s.prev, err = strconv.ParseInt(s.after, 10, 64)
+		s.prev, err = cursorID(s.after)
 		if err != nil {
-			return nil, ErrInvalidIntID
+			return nil, err
 		}
 		s.after = ""
 	}
 
+	if s.lastActive.IsZero() {
+		s.lastActive = time.Now()
+	}
+
+	if len(s.buf) == 0 && len(s.held) > 0 {
+		// Refill the buffer from the held events without polling.
+		s.fillBuffer(s.held)
+	}
+
 	for len(s.buf) == 0 {
 		eventsPollCounter.WithLabelValues(s.schema.name).Inc()
-		el, override, err := s.loader(s.ctx, s.dbc, s.prev, s.Lag)
+		el, override, err := s.load()
+		if err != nil && s.reconnectInterval > 0 && s.ctx.Err() == nil {
+			if recovered, err := s.awaitReconnect(); err != nil {
+				return nil, err
+			} else if recovered {
+				continue
+			}
+		}
 		if err != nil {
 			return nil, err
 		}
 
 		// Sanity check: override cursor if no events.
 		if override != 0 && len(el) > 0 {
-			return nil, errors.New("cursor override with events",
+			return nil, errors.Wrap(ErrInvalidLoaderResult, "cursor override with events",
 				j.MKV{"prev": s.prev, "override": override})
 		} else if len(el) == 0 && s.prev != 0 && override == 0 {
-			return nil, errors.New("no cursor override and no events",
+			return nil, errors.Wrap(ErrInvalidLoaderResult, "no cursor override and no events",
 				j.MKV{"prev": s.prev, "override": override})
+		} else if len(el) == 0 && idLess(override, s.prev) {
+			// Continuing from the override would re-read the same events forever.
+			return nil, errors.Wrap(ErrCursorWentBackwards, "cursor override before prev",
+				j.MKV{"table": s.schema.name, "prev": s.prev, "override": override})
 		}
 
-		s.buf = el
+		s.fillBuffer(el)
+		if len(el) > 0 || s.prev != override {
+			s.pastStart = true
+		}
 
 		if len(el) > 0 {
+			atomic.StoreInt32(&s.atHead, 0)
+			s.resetBackoff()
 			break
 		}
 
@@ -375,12 +1646,26 @@ func (s *streamclient) Recv() (*reflex.Event, error) {
 		}
 
 		// No cursor override or events, so current head reached.
+		atomic.StoreInt32(&s.atHead, 1)
+
+		if s.readyCh != nil {
+			close(s.readyCh)
+			s.readyCh = nil
+		}
 
 		if s.StreamToHead {
 			return nil, reflex.ErrHeadReached
 		}
 
-		if err := s.wait(s.backoff); err != nil {
+		if s.heartbeatDue() {
+			return s.heartbeatEvent(), nil
+		}
+
+		if err := s.wait(s.idleBackoff()); err != nil {
+			return nil, err
+		}
+
+		if err := s.awaitResume(); err != nil {
 			return nil, err
 		}
 	}
@@ -388,42 +1673,295 @@ func (s *streamclient) Recv() (*reflex.Event, error) {
 	// Pop next event from buffer.
 	e := s.buf[0]
 	s.buf = s.buf[1:]
-	next := e.IDInt()
+	next := eventID(e)
 
 	// Sanity check: next cursor must be greater than prev
-	if s.prev >= next {
+	if !idLess(s.prev, next) {
 		return nil, errors.Wrap(ErrConsecEvent, "pop error",
 			j.MKV{"prev": s.prev, "next": next})
 	}
 
 	s.prev = next
+	s.lastActive = time.Now()
+	s.delivered++
+
+	if !s.created.IsZero() {
+		eventsStreamFirstRecvLatency.WithLabelValues(s.schema.name).
+			Observe(s.lastActive.Sub(s.created).Seconds())
+		s.created = time.Time{}
+	}
+
+	return s.project(e), nil
+}
+
+// fillBuffer sets the buffer to the events, holding those exceeding
+// maxBuffered if configured. The held events are copied so that the
+// buffered events are released once drained.
+func (s *streamclient) fillBuffer(el []*reflex.Event) {
+	s.buf, s.held = el, nil
+	if s.maxBuffered > 0 && len(el) > s.maxBuffered {
+		s.buf = el[:s.maxBuffered:s.maxBuffered]
+		s.held = append([]*reflex.Event(nil), el[s.maxBuffered:]...)
+	}
+
+	eventsStreamBufferGauge.WithLabelValues(s.schema.name).Set(float64(len(s.buf)))
+}
+
+// RecvBatch returns up to max events and the cursor to resume after them.
+// It blocks like Recv (including backoff) until an event is available and
+// then also returns the events already buffered from the last poll, up to
+// max, without querying the DB again. Heartbeats (see WithHeartbeat) are
+// returned in a batch of their own. Like Recv, it is not safe to call
+// concurrently.
+func (s *streamclient) RecvBatch(max int) ([]*reflex.Event, string, error) {
+	if max <= 0 {
+		return nil, "", errors.New("non-positive batch max", j.KV("max", max))
+	}
+
+	e, err := s.Recv()
+	if err != nil {
+		return nil, "", err
+	}
+
+	res := []*reflex.Event{e}
+	for !IsHeartbeat(e) && len(res) < max && len(s.buf) > 0 {
+		if s.Limit > 0 && s.delivered >= s.Limit {
+			break
+		}
+
+		e, err = s.Recv()
+		if err != nil {
+			return nil, "", err
+		}
+		res = append(res, e)
+	}
+
+	return res, e.ID, nil
+}
+
+// load returns the next events from the snapshot table while behind the
+// snapshot head (see WithSnapshotLoader) or from the loader otherwise.
+func (s *streamclient) load() ([]*reflex.Event, int64, error) {
+	if s.tracer == nil {
+		return s.loadUntraced()
+	}
+
+	parent := s.recvCtx
+	if parent == nil {
+		parent = s.ctx
+	}
+
+	ctx, span := s.tracer.Start(parent, "reflex.rsql.load", map[string]string{
+		reflex.SpanAttrTable:  s.schema.name,
+		reflex.SpanAttrCursor: formatID(s.prev),
+	})
+	s.recvCtx = ctx
+
+	el, override, err := s.loadUntraced()
+	span.End(err)
+	s.recvCtx = parent
+
+	return el, override, err
+}
+
+// loadUntraced implements load without a span.
+func (s *streamclient) loadUntraced() ([]*reflex.Event, int64, error) {
+	ctx := s.queryCtx()
+	if !s.pastStart {
+		ctx = withStreamStart(ctx)
+	}
+
+	if s.snapshotTable == "" {
+		return s.loader(ctx, s.dbc, s.prev, s.lag())
+	}
+
+	schema := s.schema
+	schema.name = s.snapshotTable
+
+	if !s.snapshotRead {
+		head, err := getLatestID(s.queryCtx(), s.dbc, schema)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "snapshot head",
+				j.KV("table", s.snapshotTable))
+		}
+		s.snapshotHead = head
+		s.snapshotRead = true
+	}
+
+	if !idLess(s.prev, s.snapshotHead) {
+		return s.loader(ctx, s.dbc, s.prev, s.lag())
+	}
+
+	el, err := getNextEventsUpTo(s.queryCtx(), s.dbc, schema, s.prev,
+		s.snapshotHead, s.lag())
+	if err != nil {
+		return nil, 0, err
+	} else if len(el) == 0 {
+		// Nothing visible in the snapshot, the events table is always correct.
+		return s.loader(ctx, s.dbc, s.prev, s.lag())
+	}
+
+	var res []*reflex.Event
+	for _, e := range el {
+		if !schema.isNoopEvent(e) {
+			res = append(res, e)
+		}
+	}
+	if len(res) == 0 {
+		// All events are noops, override cursor.
+		return nil, eventID(el[len(el)-1]), nil
+	}
+	return res, 0, nil
+}
+
+// heartbeatDue returns true if a heartbeat is configured and
+// the stream has been idle for at least the heartbeat interval.
+func (s *streamclient) heartbeatDue() bool {
+	return s.heartbeat > 0 && time.Since(s.lastActive) >= s.heartbeat
+}
 
-	return e, nil
+// heartbeatEvent returns a heartbeat event at the current cursor
+// and resets the idle period.
+func (s *streamclient) heartbeatEvent() *reflex.Event {
+	s.lastActive = time.Now()
+	return &reflex.Event{
+		ID:        formatID(s.prev),
+		Type:      HeartbeatType,
+		Timestamp: s.lastActive,
+	}
+}
+
+// idleBackoff returns the backoff period to wait after an empty poll,
+// limited to the remaining idle period before the next heartbeat.
+// A zero backoff only waits for a notification.
+func (s *streamclient) idleBackoff() time.Duration {
+	d := s.nextBackoff()
+	if d <= 0 && !s.notifyOnly() {
+		d = minIdleBackoff
+	}
+
+	if s.heartbeat <= 0 {
+		return d
+	}
+
+	remaining := s.heartbeat - time.Since(s.lastActive)
+	if remaining <= 0 {
+		remaining = time.Nanosecond
+	}
+	if d <= 0 || remaining < d {
+		return remaining
+	}
+	return d
 }
 
+// notifyOnly returns true if idle streams may wait for a notification
+// without polling, ie. if a notifier is configured and events cannot
+// become visible due to lag without a new insert.
+func (s *streamclient) notifyOnly() bool {
+	_, stub := s.notifier.(*stubNotifier)
+	return !stub && s.lag() <= 0
+}
+
+// project returns a copy of the event with only the selected columns populated
+// or the event itself if all columns are selected.
+func (s *streamclient) project(e *reflex.Event) *reflex.Event {
+	if s.columns == nil {
+		return e
+	}
+
+	res := reflex.Event{ID: e.ID}
+	if includesColumn(s.columns, ColumnForeignID) {
+		res.ForeignID = e.ForeignID
+	}
+	if includesColumn(s.columns, ColumnTimestamp) {
+		res.Timestamp = e.Timestamp
+	}
+	if includesColumn(s.columns, ColumnType) {
+		res.Type = e.Type
+	}
+	if includesColumn(s.columns, ColumnMetadata) {
+		res.MetaData = e.MetaData
+	}
+	return &res
+}
+
+// awaitReconnect pings the DB and returns false if it is reachable. Otherwise
+// it blocks until the DB is reachable again and returns true.
+func (s *streamclient) awaitReconnect() (bool, error) {
+	if s.dbc.PingContext(s.ctx) == nil {
+		return false, nil
+	}
+
+	for {
+		t := time.NewTimer(s.reconnectInterval)
+		select {
+		case <-s.ctx.Done():
+			t.Stop()
+			return false, s.ctx.Err()
+		case <-t.C:
+		}
+
+		if s.dbc.PingContext(s.ctx) == nil {
+			return true, nil
+		}
+	}
+}
+
+// nextBackoff returns the backoff period to wait after an empty poll and
+// advances it if exponential backoff is configured.
+func (s *streamclient) nextBackoff() time.Duration {
+	if s.backoffFactor <= 1 || s.backoffMax <= s.backoff {
+		return s.backoff
+	}
+
+	if s.curBackoff == 0 {
+		s.curBackoff = s.backoff
+	}
+
+	d := s.curBackoff
+
+	next := time.Duration(float64(s.curBackoff) * s.backoffFactor)
+	if next > s.backoffMax || next <= 0 {
+		next = s.backoffMax
+	}
+	s.curBackoff = next
+
+	return d
+}
+
+// resetBackoff resets the exponential backoff period to the minimum.
+func (s *streamclient) resetBackoff() {
+	s.curBackoff = 0
+}
+
+// wait blocks for the period d or until notified. A zero period only
+// waits for a notification.
 func (s *streamclient) wait(d time.Duration) error {
-	if d == 0 {
-		return nil
+	var timeout <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
 	}
-	t := time.NewTimer(d)
+
 	select {
 	case <-s.notifier.C():
 		return nil
-	case <-t.C:
+	case <-timeout:
 		return nil
 	case <-s.ctx.Done():
 		return s.ctx.Err()
 	}
 }
 
-// isNoopEvent returns true if an event has "0" foreignID and 0 type.
-func isNoopEvent(e *reflex.Event) bool {
-	return isNoop(e.ForeignID, e.Type)
+// isNoopEvent returns true if an event has the noop sentinel foreignID and type.
+func (s etableSchema) isNoopEvent(e *reflex.Event) bool {
+	return s.isNoop(e.ForeignID, e.Type)
 }
 
-// isNoop returns true if the foreignID is "0" and the type 0.
-func isNoop(foreignID string, typ reflex.EventType) bool {
-	return foreignID == "0" && typ.ReflexType() == 0
+// isNoop returns true if the foreignID and type match the noop sentinel.
+func (s etableSchema) isNoop(foreignID string, typ reflex.EventType) bool {
+	return foreignID == s.noopForeignID && typ.ReflexType() == s.noopType
 }
 
 // NotifyFunc notifies an events table's underlying EventsNotifier.
@@ -471,6 +2009,44 @@ func (n *inmemNotifier) C() <-chan struct{} {
 	return ch
 }
 
+// newCoalescingNotifier returns a new coalescing in-memory notifier.
+func newCoalescingNotifier(window time.Duration) *coalescingNotifier {
+	return &coalescingNotifier{
+		inmemNotifier: &inmemNotifier{},
+		window:        window,
+	}
+}
+
+// coalescingNotifier is an in-memory implementation of EventsNotifier that
+// coalesces all notifications within a window into a single notification.
+type coalescingNotifier struct {
+	*inmemNotifier
+
+	window  time.Duration
+	mu      sync.Mutex
+	pending bool
+}
+
+func (n *coalescingNotifier) Notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.pending {
+		return
+	}
+
+	n.pending = true
+	time.AfterFunc(n.window, n.flush)
+}
+
+func (n *coalescingNotifier) flush() {
+	n.mu.Lock()
+	n.pending = false
+	n.mu.Unlock()
+
+	n.inmemNotifier.Notify()
+}
+
 // EventsNotifier provides a way to receive notifications when an event is
 // inserted in an EventsTable, and a way to trigger an EventsTable's
 // StreamClients when there are new events available.
@@ -484,6 +2060,21 @@ type EventsNotifier interface {
 	Notify()
 }
 
+// DetailedNotifier is an optional interface implemented by EventsNotifiers
+// that require the details of inserted events, ex. to publish them to
+// external subscribers. If the notifier implements it, NotifyEvent is called
+// instead of Notify by the NotifyFunc returned from Insert, so it must also
+// trigger the table's StreamClients. Notify is still called by
+// EventsTable.Notify.
+type DetailedNotifier interface {
+	EventsNotifier
+
+	// NotifyEvent is called by reflex every time an event is inserted into
+	// the EventsTable with the event details. The id is zero if unknown,
+	// see WithEventsInserter.
+	NotifyEvent(id int64, foreignID string, typ reflex.EventType)
+}
+
 // StreamWatcher provides the ability to trigger the streamer when new events are available.
 type StreamWatcher interface {
 	// C returns a channel that blocks until the next event is available in the
@@ -0,0 +1,2258 @@
+package rsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/reflex"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoalescingNotifier(t *testing.T) {
+	n := newCoalescingNotifier(time.Millisecond * 5)
+
+	var wakeups int64
+	done := make(chan struct{})
+	ch := n.C()
+	go func() {
+		for {
+			select {
+			case <-ch:
+				atomic.AddInt64(&wakeups, 1)
+				ch = n.C()
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	const burst = 10000
+	for i := 0; i < burst; i++ {
+		n.Notify()
+	}
+
+	waitFor := func(f func() bool) {
+		t0 := time.Now()
+		for !f() {
+			require.True(t, time.Since(t0) < time.Second, "timeout waiting for wakeup")
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(func() bool { return atomic.LoadInt64(&wakeups) > 0 })
+
+	time.Sleep(time.Millisecond * 20) // Wait for any trailing wakeups.
+
+	count := atomic.LoadInt64(&wakeups)
+	require.True(t, count >= 1)
+	require.True(t, count < burst/100, "wakeups: %d", count)
+}
+
+func TestSetDefaults(t *testing.T) {
+	cacheLimit, backoff := defaultRCacheLimit, defaultStreamBackoff
+	atomic.StoreInt32(&tableCreated, 0)
+	defer func() {
+		defaultRCacheLimit, defaultStreamBackoff = cacheLimit, backoff
+	}()
+
+	require.Error(t, SetDefaultRCacheLimit(0))
+	require.Error(t, SetDefaultStreamBackoff(-1))
+	require.NoError(t, SetDefaultRCacheLimit(5))
+	require.NoError(t, SetDefaultStreamBackoff(time.Millisecond))
+
+	var loads int64
+	q := newQ()
+	q.addEvents(10)
+	table := NewEventsTable("test", WithEventsLoader(
+		func(ctx context.Context, dbc *sql.DB, prev int64,
+			lag time.Duration) ([]*reflex.Event, error) {
+			atomic.AddInt64(&loads, 1)
+			if prev >= 10 {
+				return nil, nil
+			}
+			return q.events[prev:], nil
+		}))
+
+	require.Error(t, SetDefaultRCacheLimit(10))
+	require.Error(t, SetDefaultStreamBackoff(time.Second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	sc := table.Stream(ctx, nil, "")
+	for i := 0; i < 10; i++ {
+		_, err := sc.Recv()
+		require.NoError(t, err)
+	}
+
+	// Cache trimmed to the default limit.
+	_, size, _, _ := table.CacheStats()
+	require.Equal(t, 5, size)
+
+	// Polls with the default backoff until the context expires.
+	_, err := sc.Recv()
+	require.Error(t, err)
+	require.True(t, atomic.LoadInt64(&loads) > 10, "loads: %d", loads)
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	table := NewEventsTable("events",
+		WithEventsExponentialBackoff(time.Millisecond, time.Millisecond*8, 2))
+
+	sc := &streamclient{options: table.options}
+
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, sc.nextBackoff())
+	}
+	require.Equal(t, []time.Duration{
+		time.Millisecond,
+		time.Millisecond * 2,
+		time.Millisecond * 4,
+		time.Millisecond * 8,
+		time.Millisecond * 8,
+	}, got)
+
+	// First non-empty poll resets to min.
+	sc.resetBackoff()
+	require.Equal(t, time.Millisecond, sc.nextBackoff())
+	require.Equal(t, time.Millisecond*2, sc.nextBackoff())
+
+	// Factor of 1 results in a fixed backoff.
+	sc = &streamclient{options: NewEventsTable("events",
+		WithEventsExponentialBackoff(time.Millisecond, time.Millisecond*8, 1)).options}
+	require.Equal(t, time.Millisecond, sc.nextBackoff())
+	require.Equal(t, time.Millisecond, sc.nextBackoff())
+}
+
+func TestExplainStreamQuery(t *testing.T) {
+	conn := &fakeConn{
+		cols: []string{"id", "select_type", "table", "key"},
+		rows: [][]driver.Value{
+			{int64(1), "SIMPLE", "events", "PRIMARY"},
+			{int64(2), "SIMPLE", "events", nil},
+		},
+	}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	table := NewEventsTable("events", WithEventMetadataField("metadata"))
+
+	plan, err := table.ExplainStreamQuery(context.Background(), dbc, 5)
+	require.NoError(t, err)
+
+	require.Equal(t, "explain select id, foreign_id, timestamp, type , metadata "+
+		"from events where id>? order by id asc limit 1000", conn.query)
+	require.Equal(t, []driver.Value{int64(5)}, conn.args)
+	require.Equal(t, "id=1\tselect_type=SIMPLE\ttable=events\tkey=PRIMARY\n"+
+		"id=2\tselect_type=SIMPLE\ttable=events\tkey=", plan)
+}
+
+func TestAutoReconnect(t *testing.T) {
+	// The DB fails to connect while down.
+	down, connects := int32(1), int32(0)
+	conn := &fakeConn{
+		connectErr: func() error {
+			atomic.AddInt32(&connects, 1)
+			if atomic.LoadInt32(&down) == 1 {
+				return io.EOF
+			}
+			return nil
+		},
+		pingErr: func() error {
+			if atomic.LoadInt32(&down) == 1 {
+				return driver.ErrBadConn
+			}
+			return nil
+		},
+	}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	q := newQ()
+	q.addEvents(1)
+
+	// Loader fails while the DB is down.
+	loader := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, driver.ErrBadConn
+		}
+		return q.Load(ctx, dbc, prev, lag)
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(loader),
+		WithoutEventsCache(), WithEventsAutoReconnect(time.Millisecond))
+
+	go func() {
+		for atomic.LoadInt32(&connects) < 3 {
+			time.Sleep(time.Millisecond)
+		}
+		atomic.StoreInt32(&down, 0)
+	}()
+
+	sc := table.Stream(context.Background(), dbc, "")
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), e.IDInt())
+	require.True(t, atomic.LoadInt32(&connects) >= 3)
+
+	// Errors are returned if the DB is reachable.
+	table = NewEventsTable("events", WithEventsLoader(
+		func(context.Context, *sql.DB, int64, time.Duration) ([]*reflex.Event, error) {
+			return nil, io.ErrUnexpectedEOF
+		}), WithoutEventsCache(), WithEventsAutoReconnect(time.Millisecond))
+	_, err = table.Stream(context.Background(), dbc, "").Recv()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// Cancelling the context stops waiting.
+	atomic.StoreInt32(&down, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	table = NewEventsTable("events", WithEventsLoader(loader),
+		WithoutEventsCache(), WithEventsAutoReconnect(time.Millisecond))
+	_, err = table.Stream(ctx, dbc, "").Recv()
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestEach(t *testing.T) {
+	errTest := errors.New("test error")
+
+	cases := []struct {
+		name    string
+		events  int
+		after   string
+		failAt  int64
+		expIDs  []int64
+		expLast string
+		expErr  error
+	}{
+		{
+			name:    "empty",
+			expLast: "",
+		},
+		{
+			name:    "empty after",
+			after:   "3",
+			expLast: "3",
+		},
+		{
+			name:    "drain",
+			events:  5,
+			expIDs:  []int64{1, 2, 3, 4, 5},
+			expLast: "5",
+		},
+		{
+			name:    "drain after",
+			events:  5,
+			after:   "2",
+			expIDs:  []int64{3, 4, 5},
+			expLast: "5",
+		},
+		{
+			name:    "error",
+			events:  5,
+			failAt:  3,
+			expIDs:  []int64{1, 2},
+			expLast: "2",
+			expErr:  errTest,
+		},
+		{
+			name:    "error first",
+			events:  5,
+			after:   "2",
+			failAt:  3,
+			expLast: "2",
+			expErr:  errTest,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			q := newQ()
+			q.addEvents(test.events)
+
+			table := NewEventsTable("events", WithEventsLoader(q.Load),
+				WithoutEventsCache())
+
+			var ids []int64
+			last, err := table.Each(context.Background(), nil, test.after,
+				func(e *reflex.Event) error {
+					if e.IDInt() == test.failAt {
+						return errTest
+					}
+					ids = append(ids, e.IDInt())
+					return nil
+				})
+			require.Equal(t, test.expErr, err)
+			require.Equal(t, test.expIDs, ids)
+			require.Equal(t, test.expLast, last)
+		})
+	}
+}
+
+func TestGapListenerPanic(t *testing.T) {
+	table := NewEventsTable("gap_panic")
+
+	counter := eventsGapListenerPanicCounter.WithLabelValues("gap_panic")
+	base := testutil.ToFloat64(counter)
+
+	got := make(chan Gap, 2)
+	table.ListenGaps(func(Gap) { panic("bad listener") })
+	table.ListenGaps(func(gap Gap) { got <- gap })
+
+	for i := int64(1); i <= 2; i++ {
+		table.gaps.ch <- Gap{Prev: i, Next: i + 2}
+		require.Equal(t, i, (<-got).Prev)
+	}
+
+	require.Equal(t, base+2, testutil.ToFloat64(counter))
+}
+
+func TestWaitForHead(t *testing.T) {
+	q := newQ()
+	q.addEvents(5)
+
+	// Each load takes 10ms.
+	slow := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond * 10):
+		}
+
+		el, err := q.Load(ctx, dbc, prev, lag)
+		if len(el) > 1 {
+			el = el[:1]
+		}
+		return el, err
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(slow), WithoutEventsCache())
+
+	// Head reached before deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, table.WaitForHead(ctx, nil, ""))
+
+	// Timeout before head reached.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*25)
+	defer cancel()
+	err := table.WaitForHead(ctx, nil, "")
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	// Already at head.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*25)
+	defer cancel()
+	require.NoError(t, table.WaitForHead(ctx, nil, "5"))
+}
+
+func TestStreamColumns(t *testing.T) {
+	ts := time.Now()
+	loaded := &reflex.Event{
+		ID:        "1",
+		ForeignID: "9",
+		Type:      eventType(2),
+		Timestamp: ts,
+		MetaData:  []byte("meta"),
+	}
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		if prev > 0 {
+			return nil, nil
+		}
+		return []*reflex.Event{loaded}, nil
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(load),
+		WithStreamColumns(ColumnForeignID, ColumnMetadata))
+
+	sc := table.Stream(context.Background(), nil, "", reflex.WithStreamToHead())
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "1", e.ID)
+	require.Equal(t, "9", e.ForeignID)
+	require.Equal(t, []byte("meta"), e.MetaData)
+	require.Nil(t, e.Type)
+	require.True(t, e.Timestamp.IsZero())
+
+	// Loaded (and cached) events are not modified.
+	_, size, _, _ := table.CacheStats()
+	require.Equal(t, 1, size)
+	require.Equal(t, ts, loaded.Timestamp)
+	require.Equal(t, eventType(2), loaded.Type)
+}
+
+func TestStreamColumnsQuery(t *testing.T) {
+	schema := etableSchema{
+		name:           "events",
+		timeField:      "timestamp",
+		typeField:      "type",
+		foreignIDField: "foreign_id",
+		metadataField:  "metadata",
+	}
+
+	q, _ := makeNextEventsQuery(schema, 0, 0, 0, 1)
+	require.Equal(t, "select id, foreign_id, timestamp, type , metadata from events where id>? order by id asc limit 1", q)
+
+	schema.columns = queryColumns([]Column{ColumnForeignID}, true)
+	q, _ = makeNextEventsQuery(schema, 0, 0, 0, 1)
+	require.Equal(t, "select id, foreign_id, null, type, null from events where id>? order by id asc limit 1", q)
+
+	// Timestamp required by the cache.
+	schema.columns = queryColumns([]Column{ColumnForeignID}, false)
+	q, _ = makeNextEventsQuery(schema, 0, 0, 0, 1)
+	require.Equal(t, "select id, foreign_id, timestamp, type, null from events where id>? order by id asc limit 1", q)
+}
+
+func TestNoopSentinel(t *testing.T) {
+	q := newQ()
+	q.events = []*reflex.Event{
+		{ID: "1", ForeignID: "0", Type: eventType(0)},
+		{ID: "2", ForeignID: "noop", Type: eventType(-1)},
+		{ID: "3", ForeignID: "3", Type: eventType(3)},
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(q.Load),
+		WithNoopSentinel("noop", eventType(-1)))
+
+	var ids []string
+	_, err := table.Each(context.Background(), nil, "", func(e *reflex.Event) error {
+		ids = append(ids, e.ID)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "3"}, ids)
+
+	_, err = table.Insert(context.Background(), nil, "noop", eventType(-1))
+	require.EqualError(t, err, "inserting invalid noop event")
+	require.True(t, errors.Is(err, ErrInsertNoop))
+}
+
+func TestEventsCacheConfig(t *testing.T) {
+	q := newQ()
+	q.addEvents(5)
+
+	table := NewEventsTable("events", WithEventsLoader(q.Load),
+		WithEventsCache(CacheConfig{
+			Limit:        2,
+			BypassOnLag:  true,
+			BypassBehind: true,
+		}))
+	require.True(t, table.cache.bypassOnLag)
+	require.True(t, table.cache.bypassBehind)
+
+	_, err := table.Each(context.Background(), nil, "", func(*reflex.Event) error {
+		return nil
+	})
+	require.NoError(t, err)
+
+	enabled, size, head, tail := table.CacheStats()
+	require.True(t, enabled)
+	require.Equal(t, 2, size)
+	require.Equal(t, int64(4), head)
+	require.Equal(t, int64(5), tail)
+
+	table = table.Clone(WithEventsCache(CacheConfig{Disabled: true}))
+	enabled, _, _, _ = table.CacheStats()
+	require.False(t, enabled)
+
+	// Individual options are equivalent.
+	table = NewEventsTable("events", WithCacheBypassOnLag(), WithBackfillCacheBypass(),
+		WithCacheBehindLRU(3))
+	require.Equal(t, CacheConfig{BypassOnLag: true, BypassBehind: true, BehindLRU: 3},
+		table.cacheConfig)
+	require.Equal(t, 3, table.cache.lru.size)
+}
+
+func TestReplay(t *testing.T) {
+	q := newQ()
+	for i := int64(1); i <= 6; i++ {
+		q.events = append(q.events, &reflex.Event{
+			ID:        i2s(i),
+			ForeignID: i2s(i % 3),
+			Type:      eventType(1),
+		})
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(q.Load))
+
+	skip := func(foreignID string) bool {
+		return foreignID == "0"
+	}
+
+	var ids []int64
+	last, err := table.Replay(context.Background(), nil, "", skip,
+		func(e *reflex.Event) error {
+			ids = append(ids, e.IDInt())
+			return nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 4, 5}, ids)
+	require.Equal(t, "6", last) // Skipped events advance the cursor.
+}
+
+func TestRewind(t *testing.T) {
+	q := newQ()
+	q.addEvents(5)
+
+	table := NewEventsTable("events", WithEventsLoader(q.Load))
+
+	sc := table.Stream(context.Background(), nil, "", reflex.WithStreamToHead())
+	rewinder := sc.(interface{ Rewind(string) error })
+
+	assertNext := func(ids ...int64) {
+		t.Helper()
+		for _, id := range ids {
+			e, err := sc.Recv()
+			require.NoError(t, err)
+			require.Equal(t, id, e.IDInt())
+		}
+	}
+
+	assertNext(1, 2, 3)
+	q.assertTotal(t, 1)
+
+	// Rewind mid buffer, served from the cache.
+	require.NoError(t, rewinder.Rewind("1"))
+	assertNext(2, 3, 4, 5)
+	q.assertTotal(t, 1)
+
+	// Rewind to the start.
+	require.NoError(t, rewinder.Rewind(""))
+	assertNext(1, 2, 3, 4, 5)
+	_, err := sc.Recv()
+	require.True(t, reflex.IsHeadReachedErr(err))
+
+	// Invalid cursors are rejected.
+	err = rewinder.Rewind("a|01|0")
+	require.True(t, errors.Is(err, reflex.ErrCursorKind))
+	require.Equal(t, ErrInvalidIntID, rewinder.Rewind("abc"))
+}
+
+func TestMaxMetadataBytes(t *testing.T) {
+	var inserts int
+	inserter := func(ctx context.Context, tx *sql.Tx, foreignID string,
+		typ reflex.EventType, metadata []byte) error {
+		inserts++
+		return nil
+	}
+
+	cases := []struct {
+		name   string
+		max    int
+		size   int
+		expErr error
+	}{
+		{name: "unlimited", size: 100},
+		{name: "under", max: 10, size: 9},
+		{name: "at", max: 10, size: 10},
+		{name: "over", max: 10, size: 11, expErr: ErrMetadataTooLarge},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			inserts = 0
+			table := NewEventsTable("events", WithEventsInserter(inserter),
+				WithMaxMetadataBytes(test.max))
+
+			_, err := table.InsertWithMetadata(context.Background(), nil, "1",
+				eventType(1), make([]byte, test.size))
+			if test.expErr != nil {
+				require.True(t, errors.Is(err, test.expErr))
+				require.Zero(t, inserts)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, 1, inserts)
+		})
+	}
+}
+
+func TestCloneSharingCache(t *testing.T) {
+	const name = "shared_cache"
+
+	q := newQ()
+	q.addEvents(5)
+
+	table := NewEventsTable(name, WithEventsLoader(q.Load))
+
+	c1, err := table.CloneSharingCache(WithEventsBackoff(time.Millisecond))
+	require.NoError(t, err)
+	c2, err := table.CloneSharingCache(WithMaxMetadataBytes(10))
+	require.NoError(t, err)
+
+	hits := rcacheHitsCounter.WithLabelValues(name)
+	base := testutil.ToFloat64(hits)
+
+	for _, clone := range []*EventsTable{c1, c2} {
+		sc := clone.Stream(context.Background(), nil, "", reflex.WithStreamToHead())
+		for i := int64(1); i <= 5; i++ {
+			e, err := sc.Recv()
+			require.NoError(t, err)
+			require.Equal(t, i, e.IDInt())
+		}
+	}
+
+	// Only the first clone's first poll reads through to the DB.
+	q.assertQuery(t, 0, 1)
+	require.Equal(t, base+1, testutil.ToFloat64(hits))
+	require.Equal(t, table.cache, c1.cache)
+	require.Equal(t, table.cache, c2.cache)
+
+	conflicts := []EventsOption{
+		WithoutEventsCache(),
+		WithCacheBypassOnLag(),
+		WithEventsLoader(q.Load),
+		WithEventTypeField("kind"),
+		WithNoopSentinel("noop", eventType(0)),
+		WithStreamColumns(ColumnForeignID),
+	}
+	for _, opt := range conflicts {
+		_, err := table.CloneSharingCache(opt)
+		require.Error(t, err)
+	}
+}
+
+func TestSettleDelay(t *testing.T) {
+	// Event 1 commits after event 2 is visible.
+	t0 := time.Now()
+	events := []*reflex.Event{
+		{ID: "1", ForeignID: "1", Type: eventType(1), Timestamp: t0},
+		{ID: "2", ForeignID: "2", Type: eventType(1), Timestamp: t0},
+	}
+	var visible1 int32
+
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		var res []*reflex.Event
+		for _, e := range events {
+			if e.IDInt() <= prev {
+				continue
+			} else if e.ID == "1" && atomic.LoadInt32(&visible1) == 0 {
+				continue
+			} else if lag > 0 && e.Timestamp.After(time.Now().Add(-lag)) {
+				break
+			}
+			res = append(res, e)
+		}
+		return res, nil
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		atomic.StoreInt32(&visible1, 1)
+	}()
+
+	table := NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache(),
+		WithEventsSettleDelay(time.Millisecond*100), WithEventsBackoff(time.Millisecond))
+
+	sc := table.Stream(context.Background(), nil, "")
+	for _, id := range []int64{1, 2} {
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, id, e.IDInt())
+	}
+	require.True(t, time.Since(t0) >= time.Millisecond*100)
+
+	// Without a settle delay, event 1 is skipped.
+	atomic.StoreInt32(&visible1, 0)
+	table = NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache())
+	e, err := table.Stream(context.Background(), nil, "").Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), e.IDInt())
+}
+
+func TestEventsQueryHook(t *testing.T) {
+	type hookKey struct{}
+
+	// Record the hook value of each query.
+	var values []interface{}
+	conn := &fakeConn{
+		cols: []string{"id", "foreign_id", "timestamp", "type", "metadata"},
+		queryFunc: func(ctx context.Context, query string, args []driver.Value,
+			rows [][]driver.Value) ([]string, [][]driver.Value) {
+			values = append(values, ctx.Value(hookKey{}))
+			return nil, nil
+		},
+	}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	var calls int
+	hook := func(ctx context.Context) context.Context {
+		calls++
+		return context.WithValue(ctx, hookKey{}, calls)
+	}
+
+	table := NewEventsTable("events", WithoutEventsCache(), WithEventsQueryHook(hook))
+
+	for i := 0; i < 2; i++ {
+		sc := table.Stream(context.Background(), dbc, "", reflex.WithStreamToHead())
+		_, err := sc.Recv()
+		require.True(t, reflex.IsHeadReachedErr(err))
+	}
+
+	require.Equal(t, 2, calls)
+	require.Equal(t, []interface{}{1, 2}, values)
+}
+
+func TestHeartbeat(t *testing.T) {
+	var n int64 // Number of visible events.
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		var res []*reflex.Event
+		for id := prev + 1; id <= atomic.LoadInt64(&n); id++ {
+			res = append(res, &reflex.Event{
+				ID:        strconv.FormatInt(id, 10),
+				Type:      eventType(1),
+				Timestamp: time.Now(),
+			})
+		}
+		return res, nil
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache(),
+		WithHeartbeat(time.Millisecond*50), WithEventsBackoff(time.Second))
+
+	sc := table.Stream(context.Background(), nil, "")
+
+	// Heartbeats while idle at head, even if backoff is longer.
+	for i := 0; i < 2; i++ {
+		t0 := time.Now()
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.True(t, IsHeartbeat(e))
+		require.Equal(t, "0", e.ID)
+		require.True(t, time.Since(t0) >= time.Millisecond*40)
+	}
+
+	// No heartbeats while events flow.
+	atomic.StoreInt64(&n, 3)
+	for id := int64(1); id <= 3; id++ {
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.False(t, IsHeartbeat(e))
+		require.Equal(t, id, e.IDInt())
+	}
+
+	// Heartbeats do not advance the cursor.
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.True(t, IsHeartbeat(e))
+	require.Equal(t, "3", e.ID)
+
+	// No heartbeats by default.
+	table = NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache(),
+		WithEventsBackoff(time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = table.Stream(ctx, nil, "3").Recv()
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestStreamCompacted(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []*reflex.Event
+	)
+	add := func(foreignIDs ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, fid := range foreignIDs {
+			events = append(events, &reflex.Event{
+				ID:        strconv.Itoa(len(events) + 1),
+				ForeignID: fid,
+				Type:      eventType(1),
+				Timestamp: time.Now(),
+			})
+		}
+	}
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if prev >= int64(len(events)) {
+			return nil, nil
+		}
+		return append([]*reflex.Event(nil), events[prev:]...), nil
+	}
+
+	// latest returns the IDs of the latest events per foreign ID after the cursor in ID order.
+	latest := func(after int64) []int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		last := make(map[string]int64)
+		for _, e := range events[after:] {
+			last[e.ForeignID] = e.IDInt()
+		}
+		var res []int64
+		for _, e := range events[after:] {
+			if last[e.ForeignID] == e.IDInt() {
+				res = append(res, e.IDInt())
+			}
+		}
+		return res
+	}
+
+	add("a", "b", "a", "c", "b", "a", "d", "c")
+
+	table := NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache(),
+		WithEventsBackoff(time.Millisecond))
+
+	for _, after := range []int64{0, 2, 4, 7} {
+		t.Run(strconv.FormatInt(after, 10), func(t *testing.T) {
+			sc := table.StreamCompacted(context.Background(), nil,
+				strconv.FormatInt(after, 10), reflex.WithStreamToHead())
+
+			var ids []int64
+			for {
+				e, err := sc.Recv()
+				if reflex.IsHeadReachedErr(err) {
+					break
+				}
+				require.NoError(t, err)
+				ids = append(ids, e.IDInt())
+			}
+			require.Equal(t, latest(after), ids)
+		})
+	}
+
+	// Compacted events are followed by all subsequent events.
+	sc := table.StreamCompacted(context.Background(), nil, "")
+	for _, id := range latest(0) {
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, id, e.IDInt())
+	}
+
+	add("a", "a", "b")
+	for _, id := range []int64{9, 10, 11} {
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, id, e.IDInt())
+	}
+}
+
+func TestLoaderMiddleware(t *testing.T) {
+	var order []string
+	counting := func(name string, count *int) LoaderMiddleware {
+		return func(next Loader) Loader {
+			return func(ctx context.Context, dbc *sql.DB, prev int64,
+				lag time.Duration) ([]*reflex.Event, error) {
+				*count++
+				order = append(order, name)
+				return next(ctx, dbc, prev, lag)
+			}
+		}
+	}
+
+	var base int
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		base++
+		order = append(order, "base")
+		if prev >= 3 {
+			return nil, nil
+		}
+		return []*reflex.Event{
+			{ID: strconv.FormatInt(prev+1, 10), ForeignID: "1", Type: eventType(1)},
+		}, nil
+	}
+
+	var outer, inner int
+	table := NewEventsTable("events", WithEventsLoader(load),
+		WithLoaderMiddleware(counting("outer", &outer), counting("inner", &inner)))
+
+	for i := 0; i < 2; i++ {
+		// The second stream is served from the cache up to head, bypassing the middleware.
+		sc := table.Stream(context.Background(), nil, "", reflex.WithStreamToHead())
+		for {
+			_, err := sc.Recv()
+			if reflex.IsHeadReachedErr(err) {
+				break
+			}
+			require.NoError(t, err)
+		}
+	}
+
+	require.Equal(t, 5, base) // 4 for the first stream, 1 for the second at head.
+	require.Equal(t, base, outer)
+	require.Equal(t, base, inner)
+	require.Equal(t, []string{"outer", "inner", "base"}, order[:3])
+
+	// Middleware is cloned.
+	outer, inner, base = 0, 0, 0
+	_, err := table.Clone(WithEventsLoader(load)).Stream(context.Background(), nil, "2",
+		reflex.WithStreamToHead()).Recv()
+	require.NoError(t, err)
+	require.Equal(t, 1, outer)
+	require.Equal(t, 1, inner)
+
+	// Adding middleware conflicts with a shared loader.
+	_, err = table.CloneSharingCache(WithLoaderMiddleware(counting("other", &outer)))
+	require.Error(t, err)
+}
+
+func TestPollRateLimit(t *testing.T) {
+	var calls int64
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		atomic.AddInt64(&calls, 1)
+		return nil, nil
+	}
+
+	poll := func(opts ...EventsOption) int64 {
+		atomic.StoreInt64(&calls, 0)
+		opts = append(opts, WithEventsLoader(load), WithEventsBackoff(time.Millisecond))
+		table := NewEventsTable("events", opts...)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+		defer cancel()
+
+		// Concurrent streams share the limit.
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := table.Stream(ctx, nil, "").Recv()
+				require.True(t, errors.Is(err, context.DeadlineExceeded))
+			}()
+		}
+		wg.Wait()
+
+		return atomic.LoadInt64(&calls)
+	}
+
+	// At most 1 + 200ms * 50rps = 11 calls.
+	limited := poll(WithEventsPollRateLimit(50))
+	require.True(t, limited <= 11, limited)
+	require.True(t, limited >= 5, limited)
+
+	unlimited := poll()
+	require.True(t, unlimited > 30, unlimited)
+}
+
+func TestLoadRangeIDs(t *testing.T) {
+	toUint := func(v driver.Value) uint64 {
+		if u, ok := v.(uint64); ok {
+			return u
+		}
+		return uint64(v.(int64))
+	}
+
+	var ids []uint64
+	conn := &fakeConn{
+		cols: []string{"id", "foreign_id", "timestamp", "type", "metadata"},
+		queryFunc: func(ctx context.Context, query string, args []driver.Value,
+			rows [][]driver.Value) ([]string, [][]driver.Value) {
+			after, upTo := toUint(args[0]), toUint(args[1])
+			var res [][]driver.Value
+			for _, id := range ids {
+				if id > after && id <= upTo {
+					res = append(res, []driver.Value{
+						strconv.FormatUint(id, 10), "", nil, int64(1), nil})
+				}
+			}
+			return nil, res
+		},
+	}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	table := NewEventsTable("events")
+	max := uint64(math.MaxInt64)
+
+	cases := []struct {
+		name     string
+		ids      []uint64
+		from, to uint64
+		expect   []uint64
+	}{
+		{
+			name:   "from zero",
+			ids:    []uint64{1, 2, 3},
+			from:   0,
+			to:     2,
+			expect: []uint64{1, 2},
+		}, {
+			name: "to zero",
+			ids:  []uint64{1, 2, 3},
+		}, {
+			name:   "unsigned",
+			ids:    []uint64{max - 1, max, max + 1, max + 2, math.MaxUint64},
+			from:   max,
+			to:     max + 2,
+			expect: []uint64{max, max + 1, max + 2},
+		}, {
+			name:   "unsigned to max",
+			ids:    []uint64{max + 1, math.MaxUint64},
+			from:   max - 1,
+			to:     math.MaxUint64,
+			expect: []uint64{max + 1, math.MaxUint64},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			ids = test.ids
+			el, err := table.LoadRange(context.Background(), dbc, int64(test.from), int64(test.to))
+			require.NoError(t, err)
+
+			var actual []uint64
+			for _, e := range el {
+				actual = append(actual, e.IDUint())
+			}
+			require.Equal(t, test.expect, actual)
+		})
+	}
+
+	_, err := table.LoadRange(context.Background(), dbc, int64(max+2), int64(max))
+	require.True(t, errors.Is(err, ErrInvalidRange))
+}
+
+func TestStreamAtHead(t *testing.T) {
+	q := newQ()
+	q.events = []*reflex.Event{{ID: "1"}, {ID: "2"}}
+
+	table := NewEventsTable("events", WithEventsLoader(q.Load), WithoutEventsCache())
+	sc := table.Stream(context.Background(), nil, "", reflex.WithStreamToHead()).(*streamclient)
+	require.False(t, sc.AtHead())
+
+	for _, id := range []int64{1, 2} {
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, id, e.IDInt())
+		require.False(t, sc.AtHead())
+	}
+
+	_, err := sc.Recv()
+	require.True(t, reflex.IsHeadReachedErr(err))
+	require.True(t, sc.AtHead())
+
+	// Behind again once new events are loaded.
+	q.events = append(q.events, &reflex.Event{ID: "3"})
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), e.IDInt())
+	require.False(t, sc.AtHead())
+}
+
+func TestErrors(t *testing.T) {
+	_, err := CursorType(5).Cast("1")
+	require.True(t, errors.Is(err, ErrUnsupportedCursorType))
+
+	_, err = cursorTypeInt.Cast("x")
+	require.True(t, errors.Is(err, ErrInvalidIntCursor))
+
+	_, err = NewEventsTable("events").LoadRange(context.Background(), nil, 5, 1)
+	require.True(t, errors.Is(err, ErrInvalidRange))
+
+	loaders := map[string]filterLoader{
+		"override with events": func(ctx context.Context, dbc *sql.DB, prev int64,
+			lag time.Duration) ([]*reflex.Event, int64, error) {
+			return []*reflex.Event{{ID: "2"}}, 2, nil
+		},
+		"no override and no events": func(ctx context.Context, dbc *sql.DB, prev int64,
+			lag time.Duration) ([]*reflex.Event, int64, error) {
+			return nil, 0, nil
+		},
+	}
+	for name, loader := range loaders {
+		t.Run(name, func(t *testing.T) {
+			sc := &streamclient{
+				options: options{notifier: &stubNotifier{}},
+				after:   "1",
+				ctx:     context.Background(),
+				loader:  loader,
+			}
+			_, err := sc.Recv()
+			require.True(t, errors.Is(err, ErrInvalidLoaderResult), err)
+		})
+	}
+}
+
+func TestDetailedNotifier(t *testing.T) {
+	conn := &fakeConn{lastID: 41}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	n := &detailedNotifier{inmemNotifier: &inmemNotifier{}}
+	table := NewEventsTable("events", WithEventsNotifier(n))
+
+	insert := func(table *EventsTable, foreignID string, typ int) {
+		tx, err := dbc.Begin()
+		require.NoError(t, err)
+
+		notify, err := table.Insert(context.Background(), tx, foreignID, eventType(typ))
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+		notify()
+	}
+
+	insert(table, "a", 1)
+	insert(table, "b", 2)
+
+	require.Equal(t, []notifiedEvent{
+		{ID: 42, ForeignID: "a", Type: 1},
+		{ID: 43, ForeignID: "b", Type: 2},
+	}, n.events)
+	require.Zero(t, n.notifies)
+
+	// IDs are unknown with custom inserters.
+	table = NewEventsTable("events", WithEventsNotifier(n), WithEventsInserter(
+		func(ctx context.Context, tx *sql.Tx, foreignID string,
+			typ reflex.EventType, metadata []byte) error {
+			return nil
+		}))
+	insert(table, "c", 3)
+	require.Equal(t, notifiedEvent{ForeignID: "c", Type: 3}, n.events[2])
+
+	// Explicit notifications still call Notify.
+	table.Notify()
+	require.Equal(t, 1, n.notifies)
+}
+
+type notifiedEvent struct {
+	ID        int64
+	ForeignID string
+	Type      int
+}
+
+// detailedNotifier is a DetailedNotifier that records notifications.
+type detailedNotifier struct {
+	*inmemNotifier
+	events   []notifiedEvent
+	notifies int
+}
+
+func (n *detailedNotifier) Notify() {
+	n.notifies++
+	n.inmemNotifier.Notify()
+}
+
+func (n *detailedNotifier) NotifyEvent(id int64, foreignID string, typ reflex.EventType) {
+	n.events = append(n.events, notifiedEvent{ID: id, ForeignID: foreignID, Type: typ.ReflexType()})
+	n.inmemNotifier.Notify()
+}
+
+func TestUnsignedIDs(t *testing.T) {
+	ids := []string{
+		"9223372036854775806",
+		"9223372036854775807", // math.MaxInt64
+		"9223372036854775808",
+		"9223372036854775809",
+	}
+
+	var queries int
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		queries++
+		var res []*reflex.Event
+		for _, id := range ids {
+			u, err := strconv.ParseUint(id, 10, 64)
+			require.NoError(t, err)
+			if prev == 0 || u > uint64(prev) {
+				res = append(res, &reflex.Event{ID: id, ForeignID: "1", Type: eventType(1)})
+			}
+		}
+		return res, nil
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(load))
+
+	assertStream := func(after string, exp ...string) {
+		t.Helper()
+		sc := table.Stream(context.Background(), nil, after, reflex.WithStreamToHead())
+		for _, id := range exp {
+			e, err := sc.Recv()
+			require.NoError(t, err)
+			require.Equal(t, id, e.ID)
+		}
+		_, err := sc.Recv()
+		require.True(t, reflex.IsHeadReachedErr(err))
+	}
+
+	assertStream("", ids...)
+	require.Equal(t, 2, queries)
+
+	// Resuming is served from the cache.
+	assertStream(ids[1], ids[2:]...)
+	assertStream(ids[2], ids[3])
+	require.Equal(t, 4, queries)
+
+	sc := table.Stream(context.Background(), nil, ids[3])
+	rewinder := sc.(interface{ Rewind(string) error })
+	require.NoError(t, rewinder.Rewind(ids[0]))
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, ids[1], e.ID)
+
+	i, err := parseID(ids[2])
+	require.NoError(t, err)
+	require.True(t, idLess(math.MaxInt64, i))
+	require.Equal(t, ids[2], formatID(i))
+	require.Equal(t, uint64(1<<63), idArg(i))
+	require.Equal(t, int64(1), idArg(1))
+}
+
+func TestStreamWithReady(t *testing.T) {
+	assertReady := func(ready <-chan struct{}, exp bool) {
+		t.Helper()
+		select {
+		case <-ready:
+			require.True(t, exp)
+		case <-time.After(time.Millisecond * 100):
+			require.False(t, exp)
+		}
+	}
+
+	recvAsync := func(sc reflex.StreamClient) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := sc.Recv()
+			errs <- err
+		}()
+		return errs
+	}
+
+	t.Run("drained", func(t *testing.T) {
+		q := newQ()
+		q.addEvents(3)
+		table := NewEventsTable("events", WithEventsLoader(q.Load))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sc, ready := table.StreamWithReady(ctx, nil, "")
+
+		for i := 0; i < 3; i++ {
+			_, err := sc.Recv()
+			require.NoError(t, err)
+			assertReady(ready, false)
+		}
+
+		errs := recvAsync(sc)
+		assertReady(ready, true)
+
+		cancel()
+		require.Equal(t, context.Canceled, <-errs)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		table := NewEventsTable("events", WithEventsLoader(newQ().Load))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sc, ready := table.StreamWithReady(ctx, nil, "")
+
+		errs := recvAsync(sc)
+		assertReady(ready, true)
+
+		cancel()
+		require.Equal(t, context.Canceled, <-errs)
+	})
+}
+
+func TestSchemaCheck(t *testing.T) {
+	types := map[string]string{
+		"id":         "bigint",
+		"timestamp":  "datetime",
+		"type":       "int",
+		"foreign_id": "varchar",
+		"metadata":   "blob",
+		"extra":      "decimal",
+	}
+
+	schema := NewEventsTable("events",
+		WithEventTimeField("Timestamp"),
+		WithEventMetadataField("metadata"),
+	).schema
+	require.NoError(t, schema.check(types))
+
+	schema.extraFields = []string{"extra"}
+	require.NoError(t, schema.check(types))
+
+	delete(types, "metadata")
+	types["type"] = "varchar"
+	err := schema.check(types)
+	require.True(t, errors.Is(err, ErrSchemaMismatch))
+
+	var je *errors.JettisonError
+	require.True(t, errors.As(err, &je))
+	missing, _ := je.GetKey("missing")
+	require.Equal(t, "metadata", missing)
+	mismatched, _ := je.GetKey("mismatched")
+	require.Equal(t, "type varchar", mismatched)
+
+	// The tx id field is only checked if configured.
+	schema = NewEventsTable("events", WithEventTxIDField("tx_id")).schema
+	err = schema.check(map[string]string{
+		"id":         "bigint",
+		"timestamp":  "datetime",
+		"type":       "int",
+		"foreign_id": "varchar",
+	})
+	require.True(t, errors.Is(err, ErrSchemaMismatch))
+	require.True(t, errors.As(err, &je))
+	missing, _ = je.GetKey("missing")
+	require.Equal(t, "tx_id", missing)
+}
+
+func TestCloneSharingCacheListenGaps(t *testing.T) {
+	q := newQ()
+	q.events = []*reflex.Event{{ID: "1"}, {ID: "3"}}
+
+	table := NewEventsTable("events", WithEventsLoader(q.Load), WithoutEventsCache(),
+		WithEventsBackoff(time.Hour))
+	shared, err := table.CloneSharingCache()
+	require.NoError(t, err)
+
+	fromTable := make(chan Gap, 10)
+	fromShared := make(chan Gap, 10)
+	table.ListenGaps(func(gap Gap) { fromTable <- gap })
+	shared.ListenGaps(func(gap Gap) { fromShared <- gap })
+
+	// Gaps detected via either table are served to both listeners.
+	for _, tbl := range []*EventsTable{table, shared} {
+		sc := tbl.Stream(context.Background(), nil, "", reflex.WithStreamToHead())
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, int64(1), e.IDInt())
+		_, err = sc.Recv()
+		require.True(t, reflex.IsHeadReachedErr(err))
+
+		for _, ch := range []chan Gap{fromTable, fromShared} {
+			select {
+			case gap := <-ch:
+				require.Equal(t, int64(1), gap.Prev)
+				require.Equal(t, int64(3), gap.Next)
+			case <-time.After(time.Second):
+				require.Fail(t, "gap not served")
+			}
+		}
+	}
+}
+
+func TestCloneSharesInMemNotifier(t *testing.T) {
+	conn := &fakeConn{}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	q := newQ()
+	table := NewEventsTable("events", WithEventsLoader(q.Load),
+		WithEventsInMemNotifier(), WithEventsBackoff(time.Hour))
+
+	notifier := table.notifier.(*inmemNotifier)
+
+	shared, err := table.CloneSharingCache()
+	require.NoError(t, err)
+
+	for _, clone := range []*EventsTable{table.Clone(WithEventsLoader(q.Load)), shared} {
+		ctx, cancel := context.WithCancel(context.Background())
+		sc := clone.Stream(ctx, nil, strconv.Itoa(len(q.events)))
+
+		res := make(chan *reflex.Event, 1)
+		go func() {
+			e, _ := sc.Recv()
+			res <- e
+		}()
+
+		// Wait for the stream to block at head before inserting.
+		for {
+			notifier.mu.Lock()
+			n := len(notifier.listeners)
+			notifier.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		tx, err := dbc.Begin()
+		require.NoError(t, err)
+		notify, err := table.Insert(context.Background(), tx, "1", eventType(1))
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+		q.addEvents(1)
+		notify()
+
+		select {
+		case e := <-res:
+			require.NotNil(t, e)
+			require.Equal(t, int64(len(q.events)), e.IDInt())
+		case <-time.After(time.Second):
+			require.Fail(t, "clone stream not woken")
+		}
+		cancel()
+	}
+}
+
+func TestStreamRaw(t *testing.T) {
+	// Return the rows with ids greater than the first query argument.
+	conn := &fakeConn{
+		cols: []string{"id", "foreign_id", "type", "extra"},
+		rows: [][]driver.Value{
+			{int64(1), []byte("a"), int64(1), []byte("x")},
+			{int64(2), []byte("b"), int64(2), nil},
+			{int64(3), []byte("c"), int64(1), []byte("z")},
+		},
+		queryFunc: func(ctx context.Context, query string, args []driver.Value,
+			rows [][]driver.Value) ([]string, [][]driver.Value) {
+			var res [][]driver.Value
+			for _, row := range rows {
+				if row[0].(int64) > args[0].(int64) {
+					res = append(res, row)
+				}
+			}
+			return nil, res
+		},
+	}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	table := NewEventsTable("events")
+
+	next := table.StreamRaw(context.Background(), dbc, "")
+	var cursors []string
+	for {
+		row, cursor, err := next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.Len(t, row, 4)
+		cursors = append(cursors, cursor)
+	}
+	require.Equal(t, []string{"1", "2", "3"}, cursors)
+	require.Equal(t, "select * from events where id>? order by id asc limit 1000", conn.query)
+	require.Equal(t, []driver.Value{int64(3)}, conn.args) // Final query at head.
+
+	// Errors are sticky.
+	_, _, err := next()
+	require.Equal(t, io.EOF, err)
+
+	// Resume after a cursor.
+	row, cursor, err := table.StreamRaw(context.Background(), dbc, "2")()
+	require.NoError(t, err)
+	require.Equal(t, "3", cursor)
+	require.Equal(t, map[string]interface{}{
+		"id":         int64(3),
+		"foreign_id": []byte("c"),
+		"type":       int64(1),
+		"extra":      []byte("z"),
+	}, row)
+
+	_, _, err = table.StreamRaw(context.Background(), dbc, "a|01|0")()
+	require.True(t, errors.Is(err, reflex.ErrCursorKind))
+
+	_, _, err = table.StreamRaw(context.Background(), dbc, reflex.CompactBlobCursorPrefix+"Kkks")()
+	require.True(t, errors.Is(err, reflex.ErrCursorKind))
+}
+
+func TestInsertWithTimestamp(t *testing.T) {
+	conn := &fakeConn{}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	insert := func(table *EventsTable, ts time.Time) error {
+		tx, err := dbc.Begin()
+		require.NoError(t, err)
+		defer tx.Rollback()
+
+		_, err = table.InsertWithTimestamp(context.Background(), tx, "1", eventType(2), nil, ts)
+		return err
+	}
+
+	ts := time.Date(2019, 1, 2, 3, 4, 5, 6000, time.UTC)
+	table := NewEventsTable("events")
+	require.NoError(t, insert(table, ts))
+	require.Equal(t, "insert into events set foreign_id=?, timestamp=?, type=?", conn.query)
+	require.Equal(t, []driver.Value{"1", ts, int64(2)}, conn.args)
+
+	require.Error(t, insert(table, time.Time{}))
+
+	// Custom inserters don't support timestamps.
+	table = NewEventsTable("events", WithEventsInserter(
+		func(ctx context.Context, tx *sql.Tx, foreignID string,
+			typ reflex.EventType, metadata []byte) error {
+			return nil
+		}))
+	require.Error(t, insert(table, ts))
+}
+
+func TestDistinctTypes(t *testing.T) {
+	conn := &fakeConn{
+		cols: []string{"type"},
+		rows: [][]driver.Value{{int64(1)}, {int64(3)}},
+	}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	table := NewEventsTable("events", WithEventTypeField("kind"))
+
+	types, err := table.DistinctTypes(context.Background(), dbc)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 3}, types)
+	require.Equal(t, "select distinct kind from events order by kind asc", conn.query)
+	require.Empty(t, conn.args)
+
+	_, err = table.DistinctTypesSample(context.Background(), dbc, 100)
+	require.NoError(t, err)
+	require.Equal(t, "select distinct kind from (select kind from events "+
+		"order by id desc limit ?) as sample order by kind asc", conn.query)
+	require.Equal(t, []driver.Value{int64(100)}, conn.args)
+
+	_, err = table.DistinctTypesSample(context.Background(), dbc, 0)
+	require.Error(t, err)
+}
+
+func TestStreamLimit(t *testing.T) {
+	q := newQ()
+	q.events = []*reflex.Event{
+		{ID: "1", ForeignID: "1", Type: eventType(1)},
+		{ID: "2", ForeignID: "noop", Type: eventType(-1)},
+		{ID: "3", ForeignID: "3", Type: eventType(1)},
+		{ID: "4", ForeignID: "4", Type: eventType(1)},
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(q.Load),
+		WithNoopSentinel("noop", eventType(-1)))
+
+	tests := []struct {
+		Name   string
+		Limit  int
+		Expect []string
+		Err    error
+	}{
+		{
+			Name:   "smaller",
+			Limit:  2,
+			Expect: []string{"1", "3"},
+			Err:    reflex.ErrLimitReached,
+		}, {
+			Name:   "equal",
+			Limit:  3,
+			Expect: []string{"1", "3", "4"},
+			Err:    reflex.ErrLimitReached,
+		}, {
+			Name:   "larger",
+			Limit:  10,
+			Expect: []string{"1", "3", "4"},
+			Err:    reflex.ErrHeadReached,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			sc := table.Stream(context.Background(), nil, "",
+				reflex.WithStreamLimit(test.Limit), reflex.WithStreamToHead())
+
+			for _, id := range test.Expect {
+				e, err := sc.Recv()
+				require.NoError(t, err)
+				require.Equal(t, id, e.ID)
+			}
+
+			_, err := sc.Recv()
+			require.True(t, errors.Is(err, test.Err), err)
+		})
+	}
+}
+
+func TestZeroBackoff(t *testing.T) {
+	var calls int64
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		atomic.AddInt64(&calls, 1)
+		return nil, nil
+	}
+
+	recv := func(table *EventsTable, opts ...reflex.StreamOption) int64 {
+		atomic.StoreInt64(&calls, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*250)
+		defer cancel()
+
+		_, err := table.Stream(ctx, nil, "", opts...).Recv()
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+
+		return atomic.LoadInt64(&calls)
+	}
+
+	// Without a notifier a zero backoff falls back to the minimum instead of spinning.
+	table := NewEventsTable("events", WithEventsLoader(load), WithEventsBackoff(0))
+	n := recv(table)
+	require.True(t, n >= 2 && n <= 4, n)
+
+	// With a notifier it only polls when notified.
+	table = NewEventsTable("events", WithEventsLoader(load), WithEventsBackoff(0),
+		WithEventsInMemNotifier())
+	require.Equal(t, int64(1), recv(table))
+
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		table.notifier.Notify()
+	}()
+	require.Equal(t, int64(2), recv(table))
+
+	// Lagged streams still poll with the minimum backoff.
+	n = recv(table, reflex.WithStreamLag(time.Minute))
+	require.True(t, n >= 2 && n <= 4, n)
+}
+
+func TestSnapshotLoader(t *testing.T) {
+	var live []*reflex.Event
+	for i := 1; i <= 40; i++ {
+		live = append(live, &reflex.Event{
+			ID:        strconv.Itoa(i),
+			ForeignID: strconv.Itoa(i % 5),
+			Type:      eventType(1),
+			MetaData:  []byte(strconv.Itoa(i)),
+		})
+	}
+
+	var livePrevs []int64
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		livePrevs = append(livePrevs, prev)
+		if prev >= int64(len(live)) {
+			return nil, nil
+		}
+		return live[prev:], nil
+	}
+
+	// snapshotRows returns the latest event per foreign ID up to head.
+	snapshotRows := func(head int) [][]driver.Value {
+		var rows [][]driver.Value
+		for _, e := range live[head-5 : head] {
+			rows = append(rows, []driver.Value{e.IDInt(), []byte(e.ForeignID),
+				time.Time{}, int64(1), e.MetaData})
+		}
+		return rows
+	}
+
+	conn := &fakeConn{
+		cols:      []string{"id", "foreign_id", "timestamp", "type", "metadata"},
+		rows:      snapshotRows(30),
+		queryFunc: snapshotQuery,
+	}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	// state returns the final state per foreign ID after the events.
+	state := func(el []*reflex.Event) map[string]string {
+		res := make(map[string]string)
+		for _, e := range el {
+			res[e.ForeignID] = string(e.MetaData)
+		}
+		return res
+	}
+
+	stream := func(table *EventsTable, after string) []*reflex.Event {
+		sc := table.Stream(context.Background(), dbc, after, reflex.WithStreamToHead())
+		var res []*reflex.Event
+		for {
+			e, err := sc.Recv()
+			if errors.Is(err, reflex.ErrHeadReached) {
+				return res
+			}
+			require.NoError(t, err)
+			res = append(res, e)
+		}
+	}
+
+	ids := func(el []*reflex.Event) []int64 {
+		var res []int64
+		for _, e := range el {
+			res = append(res, e.IDInt())
+		}
+		return res
+	}
+
+	full := stream(NewEventsTable("events", WithEventsLoader(load)), "")
+	require.Len(t, full, 40)
+
+	table := NewEventsTable("events", WithEventsLoader(load),
+		WithSnapshotLoader("snapshot"))
+
+	// Catch up from the snapshot and then switch to the events table.
+	livePrevs = nil
+	el := stream(table, "")
+	require.Equal(t, []int64{26, 27, 28, 29, 30, 31, 32, 33, 34, 35,
+		36, 37, 38, 39, 40}, ids(el))
+	require.Equal(t, int64(30), livePrevs[0])
+	require.Equal(t, state(full), state(el))
+	require.Equal(t, "select max(id) from snapshot", conn.queries[0])
+
+	// Resume within the snapshot.
+	el = stream(table, "27")
+	require.Equal(t, int64(28), el[0].IDInt())
+	require.Equal(t, state(full[27:]), state(el))
+
+	// Resume after the snapshot head.
+	conn.queries = nil
+	el = stream(table, "35")
+	require.Equal(t, []int64{36, 37, 38, 39, 40}, ids(el))
+	require.Len(t, conn.queries, 1) // Only the snapshot head.
+
+	// Rewinding reads the refreshed snapshot head.
+	sc := table.Stream(context.Background(), dbc, "", reflex.WithStreamToHead())
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "26", e.ID)
+
+	conn.rows = snapshotRows(40)
+	require.NoError(t, sc.(*streamclient).Rewind(""))
+	e, err = sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "36", e.ID)
+}
+
+// snapshotQuery is a fakeConn query func of a snapshot table that returns
+// the max id or the rows in the requested id range.
+func snapshotQuery(ctx context.Context, query string, args []driver.Value,
+	rows [][]driver.Value) ([]string, [][]driver.Value) {
+
+	if strings.HasPrefix(query, "select max(id)") {
+		var max driver.Value
+		for _, row := range rows {
+			max = row[0]
+		}
+		return []string{"max(id)"}, [][]driver.Value{{max}}
+	}
+
+	after, upTo := args[0].(int64), args[1].(int64)
+
+	var res [][]driver.Value
+	for _, row := range rows {
+		if id := row[0].(int64); id > after && id <= upTo {
+			res = append(res, row)
+		}
+	}
+
+	return nil, res
+}
+
+func TestRecvBatch(t *testing.T) {
+	var (
+		n     int64 // Number of visible events.
+		loads int64
+	)
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		atomic.AddInt64(&loads, 1)
+		var res []*reflex.Event
+		for id := prev + 1; id <= atomic.LoadInt64(&n); id++ {
+			res = append(res, &reflex.Event{
+				ID:        strconv.FormatInt(id, 10),
+				Type:      eventType(1),
+				Timestamp: time.Now(),
+			})
+		}
+		return res, nil
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache(),
+		WithEventsBackoff(time.Millisecond*50))
+
+	sc := table.Stream(context.Background(), nil, "").(*streamclient)
+
+	ids := func(el []*reflex.Event) []int64 {
+		var res []int64
+		for _, e := range el {
+			res = append(res, e.IDInt())
+		}
+		return res
+	}
+
+	// Partial drain of the buffer.
+	atomic.StoreInt64(&n, 10)
+	el, cursor, err := sc.RecvBatch(4)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 3, 4}, ids(el))
+	require.Equal(t, "4", cursor)
+	require.Equal(t, 6, sc.BufferedLen())
+	require.Equal(t, int64(1), atomic.LoadInt64(&loads))
+
+	// Full drain only returns buffered events without polling.
+	el, cursor, err = sc.RecvBatch(100)
+	require.NoError(t, err)
+	require.Equal(t, []int64{5, 6, 7, 8, 9, 10}, ids(el))
+	require.Equal(t, "10", cursor)
+	require.Equal(t, 0, sc.BufferedLen())
+	require.Equal(t, int64(1), atomic.LoadInt64(&loads))
+
+	// Empty buffer blocks with backoff until events are available.
+	go func() {
+		time.Sleep(time.Millisecond * 120)
+		atomic.StoreInt64(&n, 12)
+	}()
+	t0 := time.Now()
+	el, cursor, err = sc.RecvBatch(100)
+	require.NoError(t, err)
+	require.Equal(t, []int64{11, 12}, ids(el))
+	require.Equal(t, "12", cursor)
+	require.True(t, time.Since(t0) >= time.Millisecond*100)
+	l := atomic.LoadInt64(&loads)
+	require.True(t, l >= 3 && l <= 5, l)
+
+	_, _, err = sc.RecvBatch(0)
+	require.Error(t, err)
+
+	// Respects the stream limit.
+	sc = table.Stream(context.Background(), nil, "", reflex.WithStreamLimit(3)).(*streamclient)
+	el, _, err = sc.RecvBatch(100)
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 3}, ids(el))
+	_, _, err = sc.RecvBatch(100)
+	require.True(t, errors.Is(err, reflex.ErrLimitReached))
+}
+
+func TestStreamCompactedTombstones(t *testing.T) {
+	const deleted = eventType(9)
+
+	var events []*reflex.Event
+	add := func(fid string, typ eventType) {
+		events = append(events, &reflex.Event{
+			ID:        strconv.Itoa(len(events) + 1),
+			ForeignID: fid,
+			Type:      typ,
+			Timestamp: time.Now(),
+		})
+	}
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		if prev >= int64(len(events)) {
+			return nil, nil
+		}
+		return events[prev:], nil
+	}
+
+	add("a", 1)       // 1
+	add("b", 1)       // 2
+	add("a", deleted) // 3: a deleted
+	add("c", 1)       // 4
+	add("b", deleted) // 5: b deleted
+	add("b", 1)       // 6: b recreated
+	add("c", deleted) // 7: c deleted
+
+	stream := func(table *EventsTable, after string) []string {
+		sc := table.StreamCompacted(context.Background(), nil, after, reflex.WithStreamToHead())
+		var res []string
+		for {
+			e, err := sc.Recv()
+			if reflex.IsHeadReachedErr(err) {
+				return res
+			}
+			require.NoError(t, err)
+			res = append(res, e.ID+":"+e.ForeignID+":"+strconv.Itoa(e.Type.ReflexType()))
+		}
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache(),
+		WithTombstoneType(deleted))
+
+	// Deleted foreign IDs are omitted from the start.
+	require.Equal(t, []string{"6:b:1"}, stream(table, ""))
+	require.Equal(t, []string{"6:b:1"}, stream(table, "0"))
+
+	// Tombstones are streamed when resuming.
+	require.Equal(t, []string{"3:a:9", "6:b:1", "7:c:9"}, stream(table, "1"))
+	require.Equal(t, []string{"7:c:9"}, stream(table, "6"))
+
+	// Without a tombstone type, deletions are regular events.
+	table = NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache())
+	require.Equal(t, []string{"3:a:9", "6:b:1", "7:c:9"}, stream(table, ""))
+}
+
+func TestStreamFirstRecvHistogram(t *testing.T) {
+	const name = "first_recv_events"
+
+	q := newQ()
+	q.addEvents(3)
+	table := NewEventsTable(name, WithEventsLoader(q.Load), WithoutEventsCache())
+
+	count := func() uint64 {
+		var m dto.Metric
+		h := eventsStreamFirstRecvLatency.WithLabelValues(name).(prometheus.Histogram)
+		require.NoError(t, h.Write(&m))
+		return m.Histogram.GetSampleCount()
+	}
+	baseline := count()
+
+	sc := table.Stream(context.Background(), nil, "")
+	require.Equal(t, baseline, count())
+
+	for i := 0; i < 3; i++ {
+		_, err := sc.Recv()
+		require.NoError(t, err)
+
+		// Only observed once after the first event.
+		require.Equal(t, baseline+1, count())
+	}
+}
+
+func TestEmptyCursorMeansHead(t *testing.T) {
+	// The fake DB only serves the head, ie. max(id), of 3.
+	conn := &fakeConn{
+		rows:      [][]driver.Value{{int64(1)}, {int64(2)}, {int64(3)}},
+		queryFunc: snapshotQuery,
+	}
+	dbc := sql.OpenDB(conn)
+	defer dbc.Close()
+
+	q := newQ()
+	q.addEvents(5)
+
+	recv := func(table *EventsTable, after string) string {
+		e, err := table.Stream(context.Background(), dbc, after).Recv()
+		require.NoError(t, err)
+		return e.ID
+	}
+
+	// Empty cursors stream from the beginning by default.
+	table := NewEventsTable("events", WithEventsLoader(q.Load), WithoutEventsCache())
+	require.Equal(t, "1", recv(table, ""))
+
+	// Empty cursors stream from head.
+	table = NewEventsTable("events", WithEventsLoader(q.Load), WithoutEventsCache(),
+		WithEmptyCursorMeansHead())
+	require.Equal(t, "4", recv(table, ""))
+	require.Equal(t, "2", recv(table, "1"))
+
+	sc := table.StreamCompacted(context.Background(), dbc, "")
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "4", e.ID)
+
+	// Each still streams from the beginning.
+	var n int
+	_, err = table.Each(context.Background(), dbc, "", func(*reflex.Event) error {
+		n++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+}
+
+func TestStreamMaxBuffered(t *testing.T) {
+	var loads []int64
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		loads = append(loads, prev)
+		var res []*reflex.Event
+		for id := prev + 1; id <= 10; id++ {
+			res = append(res, &reflex.Event{
+				ID:        strconv.FormatInt(id, 10),
+				Type:      eventType(1),
+				Timestamp: time.Now(),
+				MetaData:  make([]byte, 1<<16), // Wide events.
+			})
+		}
+		return res, nil
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache(),
+		WithStreamMaxBuffered(3))
+
+	sc := table.Stream(context.Background(), nil, "", reflex.WithStreamToHead()).(*streamclient)
+
+	for i := int64(1); i <= 10; i++ {
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, e.IDInt())
+		require.True(t, sc.BufferedLen() < 3)
+	}
+
+	_, err := sc.Recv()
+	require.True(t, reflex.IsHeadReachedErr(err))
+
+	// The remainder was held, not reloaded.
+	require.Equal(t, []int64{0, 10}, loads)
+
+	// Batches are limited to the buffer.
+	sc = table.Stream(context.Background(), nil, "8").(*streamclient)
+	el, cursor, err := sc.RecvBatch(100)
+	require.NoError(t, err)
+	require.Len(t, el, 2)
+	require.Equal(t, "10", cursor)
+
+	sc = table.Stream(context.Background(), nil, "").(*streamclient)
+	el, cursor, err = sc.RecvBatch(100)
+	require.NoError(t, err)
+	require.Len(t, el, 3)
+	require.Equal(t, "3", cursor)
+	require.Len(t, sc.held, 7)
+}
+
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]string
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttribute(key, value string) {
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End(error) {
+	s.ended = true
+}
+
+type spanKey struct{}
+
+type recordingTracer struct {
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string,
+	attrs map[string]string) (context.Context, reflex.Span) {
+
+	parent, _ := ctx.Value(spanKey{}).(*recordedSpan)
+	span := &recordedSpan{name: name, parent: parent, attrs: make(map[string]string)}
+	for k, v := range attrs {
+		span.attrs[k] = v
+	}
+	t.spans = append(t.spans, span)
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func TestEventsTracer(t *testing.T) {
+	var loadSpans []*recordedSpan
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		loadSpans = append(loadSpans, ctx.Value(spanKey{}).(*recordedSpan))
+		if prev >= 2 {
+			return nil, nil
+		}
+		return []*reflex.Event{
+			{ID: "1", Type: eventType(3), Timestamp: time.Now()},
+			{ID: "2", Type: eventType(4), Timestamp: time.Now()},
+		}[prev:], nil
+	}
+
+	var tracer recordingTracer
+	table := NewEventsTable("traced", WithEventsLoader(load), WithoutEventsCache(),
+		WithEventsTracer(&tracer))
+
+	sc := table.Stream(context.Background(), nil, "", reflex.WithStreamToHead())
+	for i := 0; i < 2; i++ {
+		_, err := sc.Recv()
+		require.NoError(t, err)
+	}
+	_, err := sc.Recv()
+	require.True(t, reflex.IsHeadReachedErr(err))
+
+	var names []string
+	for _, span := range tracer.spans {
+		names = append(names, span.name)
+		require.True(t, span.ended)
+		require.Equal(t, "traced", span.attrs[reflex.SpanAttrTable])
+	}
+	require.Equal(t, []string{
+		"reflex.rsql.recv", "reflex.rsql.load", // Event 1 loaded.
+		"reflex.rsql.recv",                     // Event 2 buffered.
+		"reflex.rsql.recv", "reflex.rsql.load", // Head reached.
+	}, names)
+
+	require.Equal(t, "1", tracer.spans[0].attrs[reflex.SpanAttrEventID])
+	require.Equal(t, "3", tracer.spans[0].attrs[reflex.SpanAttrEventType])
+	require.Equal(t, "2", tracer.spans[2].attrs[reflex.SpanAttrEventID])
+	require.Equal(t, "4", tracer.spans[2].attrs[reflex.SpanAttrEventType])
+	require.NotContains(t, tracer.spans[3].attrs, reflex.SpanAttrEventID)
+
+	// Load spans are nested in recv spans and passed to the loader.
+	require.Equal(t, tracer.spans[0], tracer.spans[1].parent)
+	require.Equal(t, "0", tracer.spans[1].attrs[reflex.SpanAttrCursor])
+	require.Equal(t, tracer.spans[3], tracer.spans[4].parent)
+	require.Equal(t, "2", tracer.spans[4].attrs[reflex.SpanAttrCursor])
+	require.Equal(t, []*recordedSpan{tracer.spans[1], tracer.spans[4]}, loadSpans)
+
+	// No-op without a tracer.
+	loadSpans = nil
+	table = NewEventsTable("traced", WithEventsLoader(func(ctx context.Context, dbc *sql.DB,
+		prev int64, lag time.Duration) ([]*reflex.Event, error) {
+		require.Nil(t, ctx.Value(spanKey{}))
+		return nil, nil
+	}), WithoutEventsCache())
+	_, err = table.Stream(context.Background(), nil, "", reflex.WithStreamToHead()).Recv()
+	require.True(t, reflex.IsHeadReachedErr(err))
+}
+
+func TestCursorWentBackwards(t *testing.T) {
+	noop := func(id string) *reflex.Event {
+		return &reflex.Event{ID: id, ForeignID: defaultNoopForeignID, Type: eventType(defaultNoopType)}
+	}
+
+	var loads int
+	// A buggy loader always returning the same noops, even before the cursor.
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		loads++
+		return []*reflex.Event{noop("2"), noop("3")}, nil
+	}
+
+	tables := map[string]*EventsTable{
+		"cache":    NewEventsTable("events", WithEventsLoader(load)),
+		"no cache": NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache()),
+	}
+
+	for name, table := range tables {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			// The noops after the cursor are skipped, then reloading them trips the guard.
+			loads = 0
+			sc := table.Stream(ctx, nil, "1")
+			_, err := sc.Recv()
+			require.True(t, errors.Is(err, ErrCursorWentBackwards), err)
+			require.Equal(t, 2, loads)
+
+			// Noops before the cursor trip the guard.
+			loads = 0
+			sc = table.Stream(ctx, nil, "5")
+			_, err = sc.Recv()
+			require.True(t, errors.Is(err, ErrCursorWentBackwards), err)
+			require.Equal(t, 1, loads)
+		})
+	}
+}
+
+func TestSkipMetadataPredicate(t *testing.T) {
+	q := newQ()
+	q.events = []*reflex.Event{
+		{ID: "1", ForeignID: "1", Type: eventType(1), MetaData: []byte("other")},
+		{ID: "2", ForeignID: "2", Type: eventType(1), MetaData: []byte("self")},
+		{ID: "3", ForeignID: "3", Type: eventType(1)},
+		{ID: "4", ForeignID: "4", Type: eventType(1), MetaData: []byte("self")},
+		{ID: "5", ForeignID: "5", Type: eventType(1), MetaData: []byte("self")},
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(q.Load))
+
+	skipSelf := func(metadata []byte) bool {
+		return string(metadata) == "self"
+	}
+
+	tests := []struct {
+		Name   string
+		After  string
+		Expect []string
+	}{
+		{
+			Name:   "from start",
+			Expect: []string{"1", "3"},
+		}, {
+			Name:   "skipped after cursor",
+			After:  "3",
+			Expect: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			sc := table.Stream(context.Background(), nil, test.After,
+				reflex.WithSkipMetadataPredicate(skipSelf), reflex.WithStreamToHead())
+
+			for _, id := range test.Expect {
+				e, err := sc.Recv()
+				require.NoError(t, err)
+				require.Equal(t, id, e.ID)
+			}
+
+			_, err := sc.Recv()
+			require.True(t, reflex.IsHeadReachedErr(err), err)
+
+			// The cursor advanced past the trailing skipped events.
+			require.Equal(t, int64(5), sc.(*streamclient).prev)
+		})
+	}
+}
+
+func TestEventsIDStep(t *testing.T) {
+	events := []*reflex.Event{
+		{ID: "2", ForeignID: "2", Type: eventType(1)},
+		{ID: "4", ForeignID: "4", Type: eventType(1)},
+		{ID: "6", ForeignID: "6", Type: eventType(1)},
+	}
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		for i, e := range events {
+			if idLess(prev, eventID(e)) {
+				return events[i:], nil
+			}
+		}
+		return nil, nil
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(load), WithEventsIDStep(2))
+
+	for _, after := range []string{"", "2"} {
+		sc := table.Stream(context.Background(), nil, after, reflex.WithStreamToHead())
+
+		var ids []string
+		for {
+			e, err := sc.Recv()
+			if reflex.IsHeadReachedErr(err) {
+				break
+			}
+			require.NoError(t, err)
+			ids = append(ids, e.ID)
+		}
+
+		if after == "" {
+			require.Equal(t, []string{"2", "4", "6"}, ids)
+		} else {
+			require.Equal(t, []string{"4", "6"}, ids)
+		}
+	}
+}
+
+func TestCloneMiddleware(t *testing.T) {
+	var calls []string
+	mw := func(name string) LoaderMiddleware {
+		return func(loader Loader) Loader {
+			return func(ctx context.Context, dbc *sql.DB, prev int64,
+				lag time.Duration) ([]*reflex.Event, error) {
+				calls = append(calls, name)
+				return loader(ctx, dbc, prev, lag)
+			}
+		}
+	}
+
+	q := newQ()
+
+	// The parent's middleware slice has spare capacity.
+	parent := NewEventsTable("events", WithLoaderMiddleware(mw("1")),
+		WithLoaderMiddleware(mw("2")), WithLoaderMiddleware(mw("3")))
+	require.Greater(t, cap(parent.middleware), len(parent.middleware))
+
+	a := parent.Clone(WithEventsLoader(q.Load), WithLoaderMiddleware(mw("a")))
+	b := parent.Clone(WithEventsLoader(q.Load), WithLoaderMiddleware(mw("b")))
+
+	// Clones of the clones retain their middleware.
+	for name, table := range map[string]*EventsTable{
+		"a": a.Clone(WithEventsLoader(q.Load)),
+		"b": b.Clone(WithEventsLoader(q.Load)),
+	} {
+		calls = nil
+		_, err := table.Stream(context.Background(), nil, "", reflex.WithStreamToHead()).Recv()
+		require.True(t, reflex.IsHeadReachedErr(err), err)
+		require.Equal(t, []string{"1", "2", "3", name}, calls)
+	}
+}
@@ -3,12 +3,14 @@ package rsql_test
 import (
 	"context"
 	"fmt"
+	"io"
 	"math/rand"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/luno/jettison/jtest"
 	"github.com/luno/reflex"
 	"github.com/luno/reflex/rsql"
 	"github.com/stretchr/testify/assert"
@@ -101,6 +103,47 @@ func TestGapCommitDetection(t *testing.T) {
 	assert.True(t, time.Since(t0) >= delay, "duration %v", time.Since(t0))
 }
 
+func TestGapFillNotifies(t *testing.T) {
+	// Idle streams with a zero backoff only poll when notified.
+	table := rsql.NewEventsTable(eventsTable, rsql.WithEventsBackoff(0),
+		rsql.WithEventsInMemNotifier())
+
+	dbc, close := ConnectAndCloseTestDB(t, eventsTable, "")
+	defer close()
+
+	rsql.FillGaps(dbc, table)
+
+	// Insert 1
+	err := insertTestEvent(dbc, table, i2s(1), testEventType(1))
+	require.NoError(t, err)
+
+	tx, err := dbc.Begin()
+	require.NoError(t, err)
+
+	// Gap at 2
+	_, err = table.Insert(context.Background(), tx, "2", testEventType(2))
+	require.NoError(t, err)
+
+	// Insert 3
+	err = insertTestEvent(dbc, table, i2s(3), testEventType(3))
+	require.NoError(t, err)
+
+	// Rollback gap after delay, without any subsequent inserts.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		require.NoError(t, tx.Rollback())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sc, err := table.ToStream(dbc)(ctx, "1")
+	require.NoError(t, err)
+
+	// The filler notifies the stream blocked by the gap.
+	assertEvent(t, sc, 3)
+}
+
 func TestNoDeadlockGap(t *testing.T) {
 	table := rsql.NewEventsTable(eventsTable, rsql.WithEventsBackoff(time.Millisecond))
 
@@ -418,8 +461,7 @@ func TestNoMetadata(t *testing.T) {
 	table := rsql.NewEventsTable(eventsTable)
 
 	err := insertTestEventMeta(dbc, table, "0", testEventType(11), []byte{1, 2, 3})
-	require.Error(t, err)
-	require.Contains(t, err.Error(), "metadata not enabled")
+	jtest.Require(t, rsql.ErrMetadataNotEnabled, err)
 }
 
 func TestMetadata(t *testing.T) {
@@ -459,6 +501,96 @@ func TestMetadata(t *testing.T) {
 	require.Equal(t, []byte(nil), e.MetaData)
 }
 
+func TestEnsureSchema(t *testing.T) {
+	dbc, close := ConnectAndCloseTestDB(t, eventsTable, "")
+	defer close()
+	ctx := context.Background()
+
+	table := rsql.NewEventsTable(eventsTable)
+	jtest.RequireNil(t, table.EnsureSchema(ctx, dbc))
+
+	// The test events table doesn't have a metadata column.
+	table = rsql.NewEventsTable(eventsTable, rsql.WithEventMetadataField("metadata"))
+	jtest.Require(t, rsql.ErrSchemaMismatch, table.EnsureSchema(ctx, dbc))
+
+	table = rsql.NewEventsTable("missing")
+	jtest.Require(t, rsql.ErrSchemaMismatch, table.EnsureSchema(ctx, dbc))
+}
+
+func TestStreamRawExtraColumns(t *testing.T) {
+	dbc, close := ConnectAndCloseTestDB(t, eventsTable, "")
+	defer close()
+
+	_, err := dbc.Exec("alter table " + eventsTable + " add column extra varchar(255) null")
+	require.NoError(t, err)
+
+	table := rsql.NewEventsTable(eventsTable)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, insertTestEvent(dbc, table, fmt.Sprint(i), testEventType(1)))
+	}
+	_, err = dbc.Exec("update " + eventsTable + " set extra=concat('x', foreign_id)")
+	require.NoError(t, err)
+
+	next := table.StreamRaw(context.Background(), dbc, "1")
+	for i := 1; i < 3; i++ {
+		row, cursor, err := next()
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(i+1), cursor)
+		require.Equal(t, []byte(fmt.Sprint(i)), row[eventsForeignIDField])
+		require.Equal(t, []byte(fmt.Sprint("x", i)), row["extra"])
+		require.Contains(t, row, eventsTimeField)
+		require.Contains(t, row, eventsTypeField)
+	}
+
+	_, _, err = next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestInsertWithTimestampStream(t *testing.T) {
+	dbc, close := ConnectAndCloseTestDB(t, eventsTable, "")
+	defer close()
+	ctx := context.Background()
+
+	table := rsql.NewEventsTable(eventsTable)
+	ts := time.Date(2019, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	tx, err := dbc.Begin()
+	require.NoError(t, err)
+	notify, err := table.InsertWithTimestamp(ctx, tx, "1", testEventType(1), nil, ts)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+	notify()
+
+	el, err := rsql.GetNextEventsForTesting(t, ctx, dbc, table, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, el, 1)
+	require.True(t, ts.Equal(el[0].Timestamp), el[0].Timestamp)
+
+	sc := table.Stream(ctx, dbc, "", reflex.WithStreamToHead())
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.True(t, ts.Equal(e.Timestamp), e.Timestamp)
+}
+
+func TestDistinctTypesDB(t *testing.T) {
+	dbc, close := ConnectAndCloseTestDB(t, eventsTable, "")
+	defer close()
+	ctx := context.Background()
+
+	table := rsql.NewEventsTable(eventsTable)
+	for _, typ := range []int{3, 1, 3, 2, 1, 5} {
+		require.NoError(t, insertTestEvent(dbc, table, "1", testEventType(typ)))
+	}
+
+	types, err := table.DistinctTypes(ctx, dbc)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 5}, types)
+
+	types, err = table.DistinctTypesSample(ctx, dbc, 3)
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 5}, types)
+}
+
 func TestInMemNotifier(t *testing.T) {
 	const name = "events"
 	dbc, close := ConnectAndCloseTestDB(t, name, "")
@@ -489,3 +621,463 @@ func TestInMemNotifier(t *testing.T) {
 	require.True(t, time.Since(t0) > lag, "want: %s\ngot: %s", lag, time.Since(t0))
 	require.True(t, time.Since(t0) < 5*time.Second, time.Since(t0))
 }
+
+func TestCacheStats(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    []rsql.EventsOption
+		enabled bool
+	}{
+		{
+			name:    "enabled",
+			enabled: true,
+		},
+		{
+			name: "disabled",
+			opts: []rsql.EventsOption{rsql.WithoutEventsCache()},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			mock := new(mockTable)
+			table := rsql.NewEventsTable(eventsTable, append(test.opts,
+				rsql.WithEventsLoader(mock.Load),
+				rsql.WithEventsInserter(mock.Insert))...)
+
+			enabled, size, head, tail := table.CacheStats()
+			require.Equal(t, test.enabled, enabled)
+			require.Zero(t, size)
+			require.Zero(t, head)
+			require.Zero(t, tail)
+
+			for i := 1; i <= 3; i++ {
+				err := mock.Insert(context.Background(), nil, i2s(i), testEventType(i), nil)
+				require.NoError(t, err)
+			}
+
+			sc, err := table.ToStream(nil)(context.Background(), "")
+			require.NoError(t, err)
+			assertEvent(t, sc, 1, 2, 3)
+
+			enabled, size, head, tail = table.CacheStats()
+			require.Equal(t, test.enabled, enabled)
+			if !test.enabled {
+				require.Zero(t, size)
+				return
+			}
+			require.Equal(t, 3, size)
+			require.Equal(t, int64(1), head)
+			require.Equal(t, int64(3), tail)
+		})
+	}
+}
+
+func TestLoadRange(t *testing.T) {
+	cases := []struct {
+		name     string
+		insert   int
+		from, to int64
+		expect   int
+	}{
+		{
+			name:   "empty",
+			insert: 3,
+			from:   4,
+			to:     10,
+		},
+		{
+			name:   "partial",
+			insert: 10,
+			from:   3,
+			to:     7,
+			expect: 5,
+		},
+		{
+			name:   "single",
+			insert: 3,
+			from:   2,
+			to:     2,
+			expect: 1,
+		},
+		{
+			name:   "multiple batches",
+			insert: 2500,
+			from:   10,
+			to:     2400,
+			expect: 2391,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			dbc := ConnectTestDB(t, eventsTable, "")
+			defer dbc.Close()
+
+			table := rsql.NewEventsTable(eventsTable)
+
+			tx, err := dbc.Begin()
+			require.NoError(t, err)
+			for i := 1; i <= test.insert; i++ {
+				_, err := table.Insert(context.Background(), tx, i2s(i), testEventType(i))
+				require.NoError(t, err)
+			}
+			require.NoError(t, tx.Commit())
+
+			el, err := table.LoadRange(context.Background(), dbc, test.from, test.to)
+			require.NoError(t, err)
+			require.Len(t, el, test.expect)
+
+			for i, e := range el {
+				require.Equal(t, test.from+int64(i), e.IDInt())
+			}
+		})
+	}
+}
+
+func TestLoadRangeInvalid(t *testing.T) {
+	table := rsql.NewEventsTable(eventsTable)
+	_, err := table.LoadRange(context.Background(), nil, 2, 1)
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	scan := func(e reflex.Event, _ []interface{}) *reflex.Event { return &e }
+
+	cases := []struct {
+		name  string
+		table string
+		opts  []rsql.EventsOption
+		err   bool
+	}{
+		{
+			name:  "defaults",
+			table: eventsTable,
+		},
+		{
+			name:  "metadata",
+			table: eventsTable,
+			opts:  []rsql.EventsOption{rsql.WithEventMetadataField("metadata")},
+		},
+		{
+			name:  "poll only",
+			table: eventsTable,
+			opts:  []rsql.EventsOption{rsql.WithEventsPollOnly()},
+		},
+		{
+			name:  "poll only with notifier",
+			table: eventsTable,
+			opts: []rsql.EventsOption{rsql.WithEventsPollOnly(),
+				rsql.WithEventsInMemNotifier()},
+			err: true,
+		},
+		{
+			name:  "notifier with poll only",
+			table: eventsTable,
+			opts: []rsql.EventsOption{rsql.WithEventsCoalescingNotifier(time.Millisecond),
+				rsql.WithEventsPollOnly()},
+			err: true,
+		},
+		{
+			name:  "empty name",
+			table: "",
+			err:   true,
+		},
+		{
+			name:  "type collides with foreign id",
+			table: eventsTable,
+			opts:  []rsql.EventsOption{rsql.WithEventTypeField("foreign_id")},
+			err:   true,
+		},
+		{
+			name:  "time collides with id",
+			table: eventsTable,
+			opts:  []rsql.EventsOption{rsql.WithEventTimeField("ID")},
+			err:   true,
+		},
+		{
+			name:  "metadata collides with type",
+			table: eventsTable,
+			opts:  []rsql.EventsOption{rsql.WithEventMetadataField("Type")},
+			err:   true,
+		},
+		{
+			name:  "extra collides with time",
+			table: eventsTable,
+			opts: []rsql.EventsOption{
+				rsql.WithEventScanner([]string{"timestamp"}, scan)},
+			err: true,
+		},
+		{
+			name:  "empty time",
+			table: eventsTable,
+			opts:  []rsql.EventsOption{rsql.WithEventTimeField("")},
+			err:   true,
+		},
+		{
+			name:  "empty foreign id",
+			table: eventsTable,
+			opts:  []rsql.EventsOption{rsql.WithEventForeignIDField("")},
+			err:   true,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			table := rsql.NewEventsTable(test.table, test.opts...)
+			err := table.Validate()
+			if test.err {
+				require.Error(t, err)
+
+				// Streams return the error without querying the DB.
+				_, recvErr := table.Stream(context.Background(), nil, "").Recv()
+				require.EqualError(t, recvErr, err.Error())
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestClaimEvents(t *testing.T) {
+	dbc := ConnectTestDB(t, eventsTable, "")
+	defer dbc.Close()
+
+	table := rsql.NewEventsTable(eventsTable)
+	ctx := context.Background()
+
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, insertTestEvent(dbc, table, i2s(i), testEventType(i)))
+	}
+
+	assertIDs := func(el []*reflex.Event, from, to int64) {
+		t.Helper()
+		require.Len(t, el, int(to-from+1))
+		for i, e := range el {
+			require.Equal(t, from+int64(i), e.IDInt())
+		}
+	}
+
+	tx1, err := dbc.Begin()
+	require.NoError(t, err)
+	el, err := table.ClaimEvents(ctx, tx1, 0, 5)
+	require.NoError(t, err)
+	assertIDs(el, 1, 5)
+
+	// Second worker skips events claimed by the first.
+	tx2, err := dbc.Begin()
+	require.NoError(t, err)
+	el, err = table.ClaimEvents(ctx, tx2, 0, 10)
+	require.NoError(t, err)
+	assertIDs(el, 6, 10)
+
+	// Nothing left to claim.
+	tx3, err := dbc.Begin()
+	require.NoError(t, err)
+	el, err = table.ClaimEvents(ctx, tx3, 0, 10)
+	require.NoError(t, err)
+	require.Empty(t, el)
+	require.NoError(t, tx3.Rollback())
+
+	// Claims are released when the transaction completes.
+	require.NoError(t, tx1.Rollback())
+	tx3, err = dbc.Begin()
+	require.NoError(t, err)
+	el, err = table.ClaimEvents(ctx, tx3, 0, 10)
+	require.NoError(t, err)
+	assertIDs(el, 1, 5)
+	require.NoError(t, tx3.Rollback())
+	require.NoError(t, tx2.Rollback())
+
+	_, err = table.ClaimEvents(ctx, nil, 0, 0)
+	require.Error(t, err)
+}
+
+func TestLatestIDForForeignID(t *testing.T) {
+	dbc := ConnectTestDB(t, eventsTable, "")
+	defer dbc.Close()
+
+	table := rsql.NewEventsTable(eventsTable)
+	ctx := context.Background()
+
+	for _, fid := range []string{"1", "2", "1", "3", "1", "2"} {
+		require.NoError(t, insertTestEvent(dbc, table, fid, testEventType(1)))
+	}
+
+	cases := []struct {
+		foreignID string
+		expID     int64
+		expOK     bool
+	}{
+		{foreignID: "1", expID: 5, expOK: true},
+		{foreignID: "2", expID: 6, expOK: true},
+		{foreignID: "3", expID: 4, expOK: true},
+		{foreignID: "4"},
+	}
+
+	for _, test := range cases {
+		id, ok, err := table.LatestIDForForeignID(ctx, dbc, test.foreignID)
+		require.NoError(t, err)
+		require.Equal(t, test.expOK, ok, test.foreignID)
+		require.Equal(t, test.expID, id, test.foreignID)
+	}
+}
+
+func TestInsertOnce(t *testing.T) {
+	dbc := ConnectTestDB(t, eventsTable, "")
+	defer dbc.Close()
+
+	_, err := dbc.Exec("alter table " + eventsTable +
+		" add column tx_id varchar(255) null, add unique index by_tx_id (tx_id)")
+	require.NoError(t, err)
+
+	table := rsql.NewEventsTable(eventsTable, rsql.WithEventTxIDField("tx_id"))
+	ctx := context.Background()
+
+	insert := func(foreignID, txID string) int64 {
+		tx, err := dbc.Begin()
+		require.NoError(t, err)
+		defer tx.Rollback()
+
+		id, notify, err := table.InsertOnce(ctx, tx, foreignID, testEventType(1), nil, txID)
+		require.NoError(t, err)
+		require.NoError(t, tx.Commit())
+		notify()
+
+		return id
+	}
+
+	// First calls insert events.
+	require.Equal(t, int64(1), insert("1", "tx1"))
+	require.Equal(t, int64(2), insert("2", "tx2"))
+
+	// Repeat calls return the original IDs.
+	require.Equal(t, int64(1), insert("1", "tx1"))
+	require.Equal(t, int64(2), insert("3", "tx2"))
+
+	el, err := table.LoadRange(ctx, dbc, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, el, 2)
+
+	// Repeat calls within the inserting transaction also return the original ID.
+	tx, err := dbc.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	id, _, err := table.InsertOnce(ctx, tx, "4", testEventType(1), nil, "tx3")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), id)
+	id, _, err = table.InsertOnce(ctx, tx, "4", testEventType(1), nil, "tx3")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), id)
+
+	_, _, err = rsql.NewEventsTable(eventsTable).InsertOnce(ctx, tx, "5", testEventType(1), nil, "tx4")
+	jtest.Require(t, rsql.ErrTxIDNotEnabled, err)
+}
+
+func TestInsertOnceConcurrent(t *testing.T) {
+	dbc := ConnectTestDB(t, eventsTable, "")
+	defer dbc.Close()
+
+	_, err := dbc.Exec("alter table " + eventsTable +
+		" add column tx_id varchar(255) null, add unique index by_tx_id (tx_id)")
+	require.NoError(t, err)
+
+	table := rsql.NewEventsTable(eventsTable, rsql.WithEventTxIDField("tx_id"))
+	ctx := context.Background()
+
+	// All transactions insert before any commits, which deadlocks
+	// if inserts of different tx ids lock the same gap.
+	const n = 5
+	var inserted, wg sync.WaitGroup
+	inserted.Add(n)
+	ids := make(chan int64, n)
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			tx, err := dbc.Begin()
+			if err != nil {
+				inserted.Done()
+				errs <- err
+				return
+			}
+			defer tx.Rollback()
+
+			id, _, err := table.InsertOnce(ctx, tx, i2s(i), testEventType(1), nil, fmt.Sprintf("tx%d", i))
+			inserted.Done()
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			inserted.Wait()
+			errs <- tx.Commit()
+			ids <- id
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	close(ids)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	unique := make(map[int64]bool)
+	for id := range ids {
+		unique[id] = true
+	}
+	require.Len(t, unique, n)
+
+	el, err := table.LoadRange(ctx, dbc, 1, 10)
+	require.NoError(t, err)
+	require.Len(t, el, n)
+}
+
+func TestLoadTx(t *testing.T) {
+	dbc := ConnectTestDB(t, eventsTable, "")
+	defer dbc.Close()
+
+	table := rsql.NewEventsTable(eventsTable)
+	ctx := context.Background()
+
+	require.NoError(t, insertTestEvent(dbc, table, "1", testEventType(1)))
+
+	tx, err := dbc.Begin()
+	require.NoError(t, err)
+
+	for i := 2; i <= 4; i++ {
+		_, err := table.Insert(ctx, tx, i2s(i), testEventType(i))
+		require.NoError(t, err)
+	}
+
+	// Uncommitted inserts are visible within the transaction.
+	el, err := table.LoadTx(ctx, tx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, el, 4)
+	for i, e := range el {
+		require.Equal(t, int64(i+1), e.IDInt())
+		require.Equal(t, i2s(i+1), e.ForeignID)
+	}
+
+	el, err = table.LoadTx(ctx, tx, 2, 1)
+	require.NoError(t, err)
+	require.Len(t, el, 1)
+	require.Equal(t, int64(3), el[0].IDInt())
+
+	_, err = table.LoadTx(ctx, tx, 0, 0)
+	require.Error(t, err)
+
+	// Rolled back inserts are gone.
+	require.NoError(t, tx.Rollback())
+	tx, err = dbc.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+
+	el, err = table.LoadTx(ctx, tx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, el, 1)
+}
@@ -0,0 +1,121 @@
+package rsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+)
+
+// fakeConn is a configurable fake driver connector and connection for tests
+// not requiring a DB. Queries return the configured rows, or those returned
+// by queryFunc if set. Execs return incrementing last insert ids and
+// transactions are no-ops. The last query or exec and its args are recorded,
+// as well as all queries.
+type fakeConn struct {
+	cols []string
+	rows [][]driver.Value
+
+	// queryFunc optionally returns the columns and rows of a query given the
+	// configured rows. Nil columns default to the configured columns.
+	queryFunc func(ctx context.Context, query string, args []driver.Value,
+		rows [][]driver.Value) ([]string, [][]driver.Value)
+
+	// connectErr and pingErr optionally return connect and ping errors.
+	connectErr func() error
+	pingErr    func() error
+
+	lastID  int64
+	query   string
+	args    []driver.Value
+	queries []string
+}
+
+func (c *fakeConn) Connect(context.Context) (driver.Conn, error) {
+	if c.connectErr != nil {
+		if err := c.connectErr(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *fakeConn) Driver() driver.Driver { return nil }
+func (c *fakeConn) Close() error          { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c, nil
+}
+func (c *fakeConn) Commit() error   { return nil }
+func (c *fakeConn) Rollback() error { return nil }
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+
+func (c *fakeConn) Ping(context.Context) error {
+	if c.pingErr != nil {
+		return c.pingErr()
+	}
+	return nil
+}
+
+// CheckNamedValue passes uint64 args to the fake as is, supporting IDs
+// exceeding math.MaxInt64, and converts other args as usual.
+func (c *fakeConn) CheckNamedValue(v *driver.NamedValue) error {
+	if _, ok := v.Value.(uint64); ok {
+		return nil
+	}
+	return driver.ErrSkip
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+	c.record(query, args)
+	c.queries = append(c.queries, query)
+
+	cols, rows := c.cols, c.rows
+	if c.queryFunc != nil {
+		cols, rows = c.queryFunc(ctx, query, c.args, c.rows)
+		if cols == nil {
+			cols = c.cols
+		}
+	}
+
+	return &fakeRows{cols: cols, rows: rows}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+	c.record(query, args)
+	c.lastID++
+	return fakeResult(c.lastID), nil
+}
+
+func (c *fakeConn) record(query string, args []driver.NamedValue) {
+	c.query = query
+	c.args = nil
+	for _, arg := range args {
+		c.args = append(c.args, arg.Value)
+	}
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) { return int64(r), nil }
+func (r fakeResult) RowsAffected() (int64, error) { return 1, nil }
@@ -12,40 +12,70 @@ import (
 
 // Gap represents a gap in monotonically incrementing events IDs.
 // The gap is after previous before next, so if Prev+1==Next,
-// then there is no gap.
+// then there is no gap (or Prev+step==Next, see WithEventsIDStep).
 type Gap struct {
 	// Prev(ious) event ID.
 	Prev int64
 
 	// Next event ID.
 	Next int64
+
+	// DetectedAt is the time the gap was first detected.
+	DetectedAt time.Time
+
+	// ResolvedAt is the time all the missing events were first loaded after
+	// the gap was detected. It is zero if the gap is still open.
+	ResolvedAt time.Time
+}
+
+// IsResolved returns true if the gap has been resolved.
+func (g Gap) IsResolved() bool {
+	return !g.ResolvedAt.IsZero()
+}
+
+// Dwell returns the duration the gap persisted before it was resolved
+// or zero if it is still open.
+func (g Gap) Dwell() time.Duration {
+	if !g.IsResolved() {
+		return 0
+	}
+	return g.ResolvedAt.Sub(g.DetectedAt)
 }
 
 // FillGaps registers the default gap filler with the events table. It
-// inserts noops into the events table when gaps are detected. Both
+// inserts noops into the events table when gaps are detected and notifies
+// the table's notifier once filled, since idle streams may only wait for
+// notifications (see WithEventsBackoff). Both
 // EventsTable and EventsTableInt satisfy the gapTable internal interface.
 //   Usage:
 //   var events = rsql.NewEventsTable()
 //   ...
 //   rsql.FillGaps(dbc, events)
 func FillGaps(dbc *sql.DB, gapTable gapTable) {
-	gapTable.ListenGaps(makeFill(dbc, gapTable.getSchema()))
+	gapTable.ListenGaps(makeFill(dbc, gapTable.getSchema(), gapTable.Notify))
 }
 
 // gapTable is a common interface between EventsTable and EventsTableInt
 // defining the subset of methods required for gap filling.
 type gapTable interface {
 	ListenGaps(f func(Gap))
+	Notify()
 	getSchema() etableSchema
 }
 
 // makeFill returns a fill function that ensures that rows exist
 // with the ids indicated by the Gap. It does so by either detecting
-// existing rows or by inserting noop events. It is idempotent.
-func makeFill(dbc *sql.DB, schema etableSchema) func(Gap) {
+// existing rows or by inserting noop events. It is idempotent. It calls
+// notify once the gap is filled.
+func makeFill(dbc *sql.DB, schema etableSchema, notify func()) func(Gap) {
 	return func(gap Gap) {
+		if gap.IsResolved() {
+			// Nothing to fill.
+			return
+		}
+
 		ctx := context.Background()
-		for i := gap.Prev + 1; i < gap.Next; i++ {
+		for i := gap.Prev + schema.step(); i < gap.Next; i += schema.step() {
 			err := fillGap(ctx, dbc, schema, i)
 			if err != nil {
 				log.Error(ctx, errors.Wrap(err, "errors filling gap",
@@ -53,6 +83,8 @@ func makeFill(dbc *sql.DB, schema etableSchema) func(Gap) {
 				return
 			}
 		}
+
+		notify()
 	}
 }
 
@@ -70,8 +102,8 @@ func fillGap(ctx context.Context, dbc *sql.DB, schema etableSchema, id int64) er
 
 	// It does not exists at all, so insert noop.
 	_, err = dbc.ExecContext(ctx, "insert into "+schema.name+
-		" set id=?, "+schema.foreignIDField+"=0, "+schema.timeField+"=now(), "+
-		schema.typeField+"=0", id)
+		" set id=?, "+schema.foreignIDField+"=?, "+schema.timeField+"=now(), "+
+		schema.typeField+"=?", idArg(id), schema.noopForeignID, schema.noopType)
 	if isMySQLErrDupEntry(err) {
 		// Someone got there first, but that's ok.
 		return nil
@@ -95,7 +127,7 @@ func exists(ctx context.Context, dbc *sql.DB, schema etableSchema, id int64,
 
 	var exists int
 	err = tx.QueryRow("select exists(select 1 from "+schema.name+
-		" where id=?)", id).Scan(&exists)
+		" where id=?)", idArg(id)).Scan(&exists)
 	if err != nil {
 		return false, err
 	}
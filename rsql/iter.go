@@ -0,0 +1,26 @@
+//go:build go1.23
+// +build go1.23
+
+package rsql
+
+import (
+	"context"
+	"database/sql"
+	"iter"
+
+	"github.com/luno/reflex"
+)
+
+// Events returns an iterator over the events after the provided cursor,
+// see reflex.Events. Each iteration streams from the cursor (like Stream)
+// and stops the stream when iteration ends, ex. on break.
+func (t *EventsTable) Events(ctx context.Context, dbc *sql.DB, after string,
+	opts ...reflex.StreamOption) iter.Seq2[*reflex.Event, error] {
+
+	return func(yield func(*reflex.Event, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		reflex.Events(ctx, t.Stream(ctx, dbc, after, opts...))(yield)
+	}
+}
@@ -0,0 +1,47 @@
+//go:build go1.23
+// +build go1.23
+
+package rsql
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/luno/jettison/jtest"
+	"github.com/luno/reflex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventsTableIter(t *testing.T) {
+	q := newQ()
+	q.addEvents(5)
+
+	var ctxs []context.Context
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		ctxs = append(ctxs, ctx)
+		return q.Load(ctx, dbc, prev, lag)
+	}
+
+	table := NewEventsTable("events", WithEventsLoader(load), WithoutEventsCache())
+	ctx := context.Background()
+
+	var ids []string
+	for e, err := range table.Events(ctx, nil, "2", reflex.WithStreamToHead()) {
+		jtest.RequireNil(t, err)
+		ids = append(ids, e.ID)
+	}
+	require.Equal(t, []string{"3", "4", "5"}, ids)
+
+	// Each iteration streams from the cursor and breaking stops the stream.
+	ids = nil
+	for e, err := range table.Events(ctx, nil, "2") {
+		jtest.RequireNil(t, err)
+		ids = append(ids, e.ID)
+		break
+	}
+	require.Equal(t, []string{"3"}, ids)
+	jtest.Require(t, context.Canceled, ctxs[len(ctxs)-1].Err())
+}
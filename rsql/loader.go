@@ -3,17 +3,29 @@ package rsql
 import (
 	"context"
 	"database/sql"
+	"sync"
 	"time"
 
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
 	"github.com/luno/reflex"
 )
 
-// loader defines a function type for loading events from a sql db.
+// Loader defines a function type for loading events from a sql db.
 // It either returns the next available events after prev cursor (exclusive)
-// or an error.
-type loader func(ctx context.Context, dbc *sql.DB, prevCursor int64,
+// or an error. Events must be returned in increasing ID order and only events
+// older than lag (if non-zero) may be returned.
+type Loader func(ctx context.Context, dbc *sql.DB, prevCursor int64,
 	lag time.Duration) (events []*reflex.Event, err error)
 
+// LoaderMiddleware wraps a Loader, see WithLoaderMiddleware.
+type LoaderMiddleware func(Loader) Loader
+
+// rangeLoader defines a function type for loading events from a sql db
+// after the previous cursor up to and including the upper bound.
+type rangeLoader func(ctx context.Context, dbc *sql.DB, prevCursor int64,
+	upTo int64, lag time.Duration) (events []*reflex.Event, err error)
+
 // filterLoader defines a function type for loading events from a sql db but
 // also supports filtering of whole ranges of events. It either returns the
 // next available events after prev cursor (exclusive), or a cursor override
@@ -21,17 +33,25 @@ type loader func(ctx context.Context, dbc *sql.DB, prevCursor int64,
 // as cursors, so supporting cursor override when no events are returned
 // allows skipping ranges of noops events.
 //
+// The cursor override is guaranteed to be the resume point if no events are
+// returned, including when events are filtered by lag: it is prev if nothing
+// was loaded or the last noop id if only noops were loaded. If events are
+// returned the override is zero and the last event id is the resume point.
+// The resume point therefore never decreases across subsequent calls.
+//
 // Loaders are layered as follows in streamclient.Recv (from outer to inner):
+//   skipFilter (if set) (filterLoader)
 //   noopFilter         (filterLoader)
-//   rCache (if enable) (loader)
-//   gapDetector        (loader)
-//   baseLoader         (loader)
+//   rCache (if enable) (Loader)
+//   gapDetector        (Loader)
+//   middleware         (Loader)
+//   baseLoader         (Loader)
 type filterLoader func(ctx context.Context, dbc *sql.DB, prevCursor int64,
 	lag time.Duration) (events []*reflex.Event, cursorOverride int64, err error)
 
 // makeBaseLoader returns the default base loader that queries the sql for next events.
 // This loader can be replaced with the WithBaseLoader option.
-func makeBaseLoader(schema etableSchema) loader {
+func makeBaseLoader(schema etableSchema) Loader {
 	return func(ctx context.Context, dbc *sql.DB,
 		prevCursor int64, lag time.Duration) ([]*reflex.Event, error) {
 
@@ -39,12 +59,48 @@ func makeBaseLoader(schema etableSchema) loader {
 	}
 }
 
+// makeRangeLoader returns the default range loader that queries the sql
+// for next events up to an upper bound.
+func makeRangeLoader(schema etableSchema) rangeLoader {
+	return func(ctx context.Context, dbc *sql.DB,
+		prevCursor int64, upTo int64, lag time.Duration) ([]*reflex.Event, error) {
+
+		return getNextEventsUpTo(ctx, dbc, schema, prevCursor, upTo, lag)
+	}
+}
+
+// minIDLoader defines a function type for loading the min event ID
+// of a sql db table, zero if it is empty.
+type minIDLoader func(ctx context.Context, dbc *sql.DB) (int64, error)
+
+// makeMinIDLoader returns the default min ID loader that queries the sql table.
+func makeMinIDLoader(schema etableSchema) minIDLoader {
+	return func(ctx context.Context, dbc *sql.DB) (int64, error) {
+		return getEarliestID(ctx, dbc, schema)
+	}
+}
+
+type streamStartKey struct{}
+
+// withStreamStart returns a context marking loads after the starting
+// cursor of a stream, see wrapGapDetector.
+func withStreamStart(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamStartKey{}, true)
+}
+
+// isStreamStart returns true if the context marks loads after the
+// starting cursor of a stream.
+func isStreamStart(ctx context.Context) bool {
+	ok, _ := ctx.Value(streamStartKey{}).(bool)
+	return ok
+}
+
 // wrapNoopFilter returns a filterloader that filters out all noop events returned
 // by the provided loader. Noops are required to ensure at-least-once event consistency for
 // event streams in the face of long running transactions. Consumers however
 // should not have to handle the special noop case. If all events returned
 // by loader are noops, it returns the last event id as the cursor override.
-func wrapNoopFilter(loader loader) filterLoader {
+func wrapNoopFilter(loader Loader, schema etableSchema) filterLoader {
 	return func(ctx context.Context, dbc *sql.DB,
 		prev int64, lag time.Duration) ([]*reflex.Event, int64, error) {
 
@@ -58,24 +114,128 @@ func wrapNoopFilter(loader loader) filterLoader {
 		}
 		var res []*reflex.Event
 		for _, e := range el {
-			if isNoopEvent(e) {
+			if schema.isNoopEvent(e) {
 				continue
 			}
 			res = append(res, e)
 		}
 		if len(res) == 0 {
 			// All events are noops, override cursor.
-			return nil, el[len(el)-1].IDInt(), nil
+			return nil, eventID(el[len(el)-1]), nil
 		}
 		return res, 0, nil
 	}
 }
 
+// wrapSkipFilter returns a filterLoader that filters out the events returned
+// by the provided loader for which skip returns true given the event metadata,
+// see reflex.WithSkipMetadataPredicate. Like noops, if all events are skipped,
+// it returns the last event id as the cursor override.
+func wrapSkipFilter(loader filterLoader, skip func(metadata []byte) bool) filterLoader {
+	return func(ctx context.Context, dbc *sql.DB,
+		prev int64, lag time.Duration) ([]*reflex.Event, int64, error) {
+
+		el, override, err := loader(ctx, dbc, prev, lag)
+		if err != nil || len(el) == 0 {
+			return el, override, err
+		}
+		var res []*reflex.Event
+		for _, e := range el {
+			if skip(e.MetaData) {
+				continue
+			}
+			res = append(res, e)
+		}
+		if len(res) == 0 {
+			// All events are skipped, override cursor.
+			return nil, eventID(el[len(el)-1]), nil
+		}
+		return res, 0, nil
+	}
+}
+
+// Open gaps are retained by the gap detector until resolved, but gaps may never
+// be resolved or be skipped by streams (eg. by rewinding or restarting from a
+// different cursor). So open gaps are evicted after openGapTTL and the oldest
+// are evicted beyond maxOpenGaps. Evicted gaps are detected again as new gaps.
+// Likewise, at most maxOpenGaps gaps are queued for delivery.
+var (
+	openGapTTL  = time.Hour
+	maxOpenGaps = 1000
+)
+
 // wrapGapDetector returns a loader that loads monotonically incremental
 // events (backed by auto increment int column). All events after `prev` cursor and before any
 // gap is returned. Gaps may be permanent, due to rollbacks, or temporary due to uncommitted
-// transactions. Detected gaps are sent on the channel.
-func wrapGapDetector(loader loader, ch chan<- Gap, name string) loader {
+// transactions. Detected gaps are sent on the channel stamped with the time they were
+// first detected. Once all the missing events are subsequently loaded, the gap is sent
+// again, this time also stamped with the time it was resolved. Gaps are identified by
+// Next, so a gap that narrows as some missing events are loaded remains the same gap.
+// Gaps are queued and sent asynchronously so that slow receivers don't block loads
+// or miss resolutions.
+//
+// Missing events between the starting cursor of a stream (see withStreamStart)
+// and the first loaded event are not a gap if the table's min ID is after the
+// cursor, since the head of the table was trimmed (eg. by retention) past the
+// cursor. This requires the optional min ID loader.
+func wrapGapDetector(loader Loader, ch chan<- Gap, name string, minID minIDLoader,
+	step int64) Loader {
+	var (
+		mu    sync.Mutex
+		open  = make(map[int64]Gap) // Open gaps by Next.
+		queue = &gapQueue{ch: ch}
+	)
+
+	// evictUnsafe evicts expired open gaps and the oldest open gap if full.
+	evictUnsafe := func(now time.Time) {
+		var oldest *Gap
+		for p, gap := range open {
+			if now.Sub(gap.DetectedAt) > openGapTTL {
+				delete(open, p)
+				continue
+			}
+			if oldest == nil || gap.DetectedAt.Before(oldest.DetectedAt) {
+				g := gap
+				oldest = &g
+			}
+		}
+		if len(open) >= maxOpenGaps && oldest != nil {
+			delete(open, oldest.Next)
+		}
+	}
+
+	// detect returns the gap stamped with the time it was first detected.
+	detect := func(prev, next int64) Gap {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if gap, ok := open[next]; ok {
+			// Same gap, possibly narrowed by loaded missing events.
+			return gap
+		}
+
+		gap := Gap{Prev: prev, Next: next, DetectedAt: time.Now()}
+		evictUnsafe(gap.DetectedAt)
+		open[next] = gap
+		return gap
+	}
+
+	// resolve returns the open gap before next stamped as resolved, or false
+	// if there is no open gap before next. It assumes the event before next
+	// was loaded, so all the missing events of the gap were loaded.
+	resolve := func(next int64) (Gap, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		gap, ok := open[next]
+		if !ok {
+			return Gap{}, false
+		}
+		delete(open, next)
+		gap.ResolvedAt = time.Now()
+		return gap, true
+	}
+
 	return func(ctx context.Context, dbc *sql.DB, prev int64,
 		lag time.Duration) ([]*reflex.Event, error) {
 
@@ -87,26 +247,137 @@ func wrapGapDetector(loader loader, ch chan<- Gap, name string) loader {
 		}
 
 		for i, e := range el {
-			if !e.IsIDInt() {
+			next, err := parseID(e.ID)
+			if err != nil {
 				return nil, ErrInvalidIntID
 			}
 
-			next := e.IDInt()
-			if prev != 0 && next != prev+1 {
+			if prev != 0 && !idLess(prev, next) {
+				// Not a gap, the loader returned an event at or before prev.
+				return nil, errors.Wrap(ErrCursorWentBackwards, "event not after prev",
+					j.MKV{"table": name, "prev": prev, "next": next})
+			}
+
+			if i == 0 && prev != 0 && next != prev+step && minID != nil && isStreamStart(ctx) {
+				min, err := minID(ctx, dbc)
+				if err != nil {
+					return nil, err
+				} else if idLess(prev, min) {
+					// Head trimmed past the starting cursor, not a gap.
+					prev = next - step
+				}
+			}
+
+			if prev != 0 && next != prev+step {
 				eventsBlockingGapGauge.WithLabelValues(name).Set(1)
 				// Gap detected, return everything before it.
 				eventsGapDetectCounter.WithLabelValues(name).Inc()
-				select {
-				case ch <- Gap{Prev: prev, Next: next}:
-				default:
-				}
+				queue.push(detect(prev, next))
 				return el[:i], nil
 			}
 			eventsBlockingGapGauge.WithLabelValues(name).Set(0)
 
+			if gap, ok := resolve(next); ok {
+				queue.push(gap)
+			}
+
 			prev = next
 		}
 
 		return el, nil
 	}
 }
+
+// gapQueue sends gaps on a channel in order without blocking. Gaps are
+// queued while the receiver is busy, or absent, by a single goroutine that
+// only runs while gaps are queued. Gaps already queued are not queued again
+// and the oldest gaps are dropped beyond maxOpenGaps.
+type gapQueue struct {
+	ch chan<- Gap
+
+	mu      sync.Mutex
+	pending []Gap
+	sending bool
+}
+
+// push queues the gap and starts sending if not already.
+func (q *gapQueue) push(gap Gap) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, p := range q.pending {
+		if p == gap {
+			return
+		}
+	}
+
+	if len(q.pending) >= maxOpenGaps {
+		q.pending = q.pending[1:]
+	}
+	q.pending = append(q.pending, gap)
+
+	if !q.sending {
+		q.sending = true
+		go q.send()
+	}
+}
+
+// send sends queued gaps until none remain.
+func (q *gapQueue) send() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.sending = false
+			q.mu.Unlock()
+			return
+		}
+		gap := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mu.Unlock()
+
+		q.ch <- gap
+	}
+}
+
+// rateLimit returns a loader middleware that limits the rate of calls to
+// the wrapped loader to rps using a token bucket with a burst of one.
+// The limit is shared by all streams of the loader.
+func rateLimit(rps float64) LoaderMiddleware {
+	var (
+		mu       sync.Mutex
+		interval = time.Duration(float64(time.Second) / rps)
+		next     time.Time // Time the next token is available.
+	)
+
+	// reserve returns the duration to wait for the next token.
+	reserve := func() time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		if next.Before(now) {
+			next = now
+		}
+		d := next.Sub(now)
+		next = next.Add(interval)
+		return d
+	}
+
+	return func(loader Loader) Loader {
+		return func(ctx context.Context, dbc *sql.DB, prev int64,
+			lag time.Duration) ([]*reflex.Event, error) {
+
+			if d := reserve(); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return nil, ctx.Err()
+				case <-t.C:
+				}
+			}
+
+			return loader(ctx, dbc, prev, lag)
+		}
+	}
+}
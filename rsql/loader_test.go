@@ -0,0 +1,344 @@
+package rsql
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/luno/reflex"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGapDetectorStamps(t *testing.T) {
+	q := newQ()
+	q.events = []*reflex.Event{{ID: "1"}, {ID: "3"}}
+
+	ch := make(chan Gap, 1)
+	l := wrapGapDetector(q.Load, ch, "test", nil, 1)
+
+	t0 := time.Now()
+	res, err := l(nil, nil, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
+	gap := <-ch
+	require.Equal(t, int64(1), gap.Prev)
+	require.Equal(t, int64(3), gap.Next)
+	require.False(t, gap.DetectedAt.Before(t0))
+	require.False(t, gap.IsResolved())
+	require.Zero(t, gap.Dwell())
+
+	// Detecting the same gap again retains the original detection time.
+	res, err = l(nil, nil, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+	require.Equal(t, gap.DetectedAt, (<-ch).DetectedAt)
+
+	// Fill the gap.
+	q.events = []*reflex.Event{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+
+	res, err = l(nil, nil, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+
+	resolved := <-ch
+	require.Equal(t, gap.Prev, resolved.Prev)
+	require.Equal(t, gap.Next, resolved.Next)
+	require.Equal(t, gap.DetectedAt, resolved.DetectedAt)
+	require.True(t, resolved.IsResolved())
+	require.Equal(t, resolved.ResolvedAt.Sub(resolved.DetectedAt), resolved.Dwell())
+
+	// Resolved only once.
+	_, err = l(nil, nil, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, ch, 0)
+}
+
+func TestGapDetectorSlowListener(t *testing.T) {
+	q := newQ()
+	q.events = []*reflex.Event{{ID: "1"}, {ID: "4"}}
+
+	// Unbuffered and not received while loading, like a busy gap filler.
+	ch := make(chan Gap)
+	l := wrapGapDetector(q.Load, ch, "test", nil, 1)
+
+	res, err := l(nil, nil, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, res, 0)
+
+	// Loading one of the missing events doesn't resolve the gap.
+	q.events = []*reflex.Event{{ID: "1"}, {ID: "2"}, {ID: "4"}}
+	res, err = l(nil, nil, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+
+	// Loading all the missing events resolves the gap.
+	q.events = []*reflex.Event{{ID: "1"}, {ID: "2"}, {ID: "3"}, {ID: "4"}}
+	res, err = l(nil, nil, 2, 0)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+
+	// The queued detection and resolution are delivered once received.
+	gap := <-ch
+	require.Equal(t, Gap{Prev: 1, Next: 4, DetectedAt: gap.DetectedAt}, gap)
+
+	resolved := <-ch
+	require.Equal(t, int64(1), resolved.Prev)
+	require.Equal(t, int64(4), resolved.Next)
+	require.Equal(t, gap.DetectedAt, resolved.DetectedAt)
+	require.True(t, resolved.IsResolved())
+
+	select {
+	case gap := <-ch:
+		require.Fail(t, "unexpected gap", gap)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestGapDetectorEviction(t *testing.T) {
+	defer func(ttl time.Duration, max int) {
+		openGapTTL, maxOpenGaps = ttl, max
+	}(openGapTTL, maxOpenGaps)
+
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		max  int
+	}{
+		{name: "ttl", ttl: time.Millisecond, max: 10},
+		{name: "max", ttl: time.Hour, max: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			openGapTTL, maxOpenGaps = test.ttl, test.max
+
+			var events []*reflex.Event
+			load := func(ctx context.Context, dbc *sql.DB, prev int64,
+				lag time.Duration) ([]*reflex.Event, error) {
+				for i, e := range events {
+					if idLess(prev, eventID(e)) {
+						return events[i:], nil
+					}
+				}
+				return nil, nil
+			}
+
+			ch := make(chan Gap, 10)
+			l := wrapGapDetector(load, ch, "test", nil, 1)
+
+			events = []*reflex.Event{{ID: "1"}, {ID: "3"}, {ID: "5"}}
+			_, err := l(nil, nil, 1, 0)
+			require.NoError(t, err)
+			first := <-ch
+
+			time.Sleep(time.Millisecond * 2)
+
+			// Detecting another gap evicts the first.
+			_, err = l(nil, nil, 3, 0)
+			require.NoError(t, err)
+			require.Equal(t, int64(3), (<-ch).Prev)
+
+			// The evicted gap is not resolved.
+			events = []*reflex.Event{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+			res, err := l(nil, nil, 1, 0)
+			require.NoError(t, err)
+			require.Len(t, res, 2)
+			require.Len(t, ch, 0)
+
+			// The evicted gap is detected again as a new gap.
+			events = []*reflex.Event{{ID: "1"}, {ID: "3"}}
+			_, err = l(nil, nil, 1, 0)
+			require.NoError(t, err)
+			require.True(t, (<-ch).DetectedAt.After(first.DetectedAt))
+		})
+	}
+}
+
+func TestGapDetectorIDStep(t *testing.T) {
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		return []*reflex.Event{{ID: "4"}, {ID: "6"}, {ID: "10"}}, nil
+	}
+
+	ch := make(chan Gap, 1)
+	l := wrapGapDetector(load, ch, "test", nil, 2)
+
+	res, err := l(nil, nil, 2, 0)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+
+	gap := <-ch
+	require.Equal(t, int64(6), gap.Prev)
+	require.Equal(t, int64(10), gap.Next)
+}
+
+func TestGapDetectorTrimmedHead(t *testing.T) {
+	events := []*reflex.Event{{ID: "5"}, {ID: "6"}, {ID: "8"}}
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		var res []*reflex.Event
+		for _, e := range events {
+			if e.IDInt() > prev {
+				res = append(res, e)
+			}
+		}
+		return res, nil
+	}
+
+	var min int64
+	minID := func(context.Context, *sql.DB) (int64, error) {
+		return min, nil
+	}
+
+	ids := func(el []*reflex.Event) []string {
+		res := []string{}
+		for _, e := range el {
+			res = append(res, e.ID)
+		}
+		return res
+	}
+
+	cases := []struct {
+		name  string
+		start bool
+		min   int64
+		prev  int64
+		exp   []string
+		gap   Gap
+	}{
+		{
+			name:  "trimmed head at start",
+			start: true,
+			min:   5,
+			prev:  2,
+			exp:   []string{"5", "6"},
+			gap:   Gap{Prev: 6, Next: 8},
+		}, {
+			name: "mid-stream gap",
+			min:  5,
+			prev: 2,
+			exp:  []string{},
+			gap:  Gap{Prev: 2, Next: 5},
+		}, {
+			name:  "gap after existing start",
+			start: true,
+			min:   1,
+			prev:  2,
+			exp:   []string{},
+			gap:   Gap{Prev: 2, Next: 5},
+		}, {
+			name:  "zero start",
+			start: true,
+			min:   5,
+			exp:   []string{"5", "6"},
+			gap:   Gap{Prev: 6, Next: 8},
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			min = test.min
+			ch := make(chan Gap, 1)
+			l := wrapGapDetector(load, ch, "test", minID, 1)
+
+			ctx := context.Background()
+			if test.start {
+				ctx = withStreamStart(ctx)
+			}
+
+			res, err := l(ctx, nil, test.prev, 0)
+			require.NoError(t, err)
+			require.Equal(t, test.exp, ids(res))
+
+			gap := <-ch
+			require.Equal(t, test.gap.Prev, gap.Prev)
+			require.Equal(t, test.gap.Next, gap.Next)
+		})
+	}
+}
+
+func TestNoopFilterAdvancesCursor(t *testing.T) {
+	noop := func(id string) *reflex.Event {
+		return &reflex.Event{ID: id, ForeignID: "0", Type: eventType(0)}
+	}
+
+	q := newQ()
+	q.events = []*reflex.Event{
+		noop("1"), noop("2"), noop("3"),
+		{ID: "4", ForeignID: "4", Type: eventType(4)},
+	}
+
+	// Load batches of at most 3 events.
+	l := wrapNoopFilter(func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		el, err := q.Load(ctx, dbc, prev, lag)
+		if len(el) > 3 {
+			el = el[:3]
+		}
+		return el, err
+	}, etableSchema{noopForeignID: defaultNoopForeignID})
+
+	el, override, err := l(nil, nil, 0, 0)
+	require.NoError(t, err)
+	require.Empty(t, el)
+	require.Equal(t, int64(3), override)
+
+	// Streamclient starts the next poll past the noops.
+	sc := &streamclient{
+		ctx:    context.Background(),
+		loader: l,
+	}
+
+	e, err := sc.Recv()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), e.IDInt())
+	q.assertQuery(t, 0, 2)
+	q.assertQuery(t, 3, 1)
+	q.assertTotal(t, 3)
+}
+
+func TestNoopFilterResumePoint(t *testing.T) {
+	noop := func(id string) *reflex.Event {
+		return &reflex.Event{ID: id, ForeignID: "0", Type: eventType(0)}
+	}
+	event := func(id string) *reflex.Event {
+		return &reflex.Event{ID: id, ForeignID: id, Type: eventType(1)}
+	}
+
+	// Each load returns the next batch, empty batches are head or lag filtered.
+	batches := [][]*reflex.Event{
+		nil,
+		{event("1"), event("2")},
+		nil,
+		{noop("3"), noop("4")},
+		nil,
+		{noop("5"), event("6")},
+		nil,
+	}
+	expected := []int64{0, 2, 2, 4, 4, 6, 6}
+
+	var i int
+	l := wrapNoopFilter(func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		el := batches[i]
+		i++
+		return el, nil
+	}, etableSchema{noopForeignID: defaultNoopForeignID})
+
+	var prev int64
+	for _, exp := range expected {
+		el, override, err := l(nil, nil, prev, time.Minute)
+		require.NoError(t, err)
+
+		next := override
+		if len(el) > 0 {
+			require.Zero(t, override)
+			next = el[len(el)-1].IDInt()
+		}
+		require.Equal(t, exp, next)
+		require.GreaterOrEqual(t, next, prev)
+		prev = next
+	}
+}
@@ -45,6 +45,50 @@ var (
 		Help:      "Wether or not any gap listeners have been registered.",
 	}, []string{"table"})
 
+	eventsGapListenerPanicCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reflex",
+		Subsystem: "events",
+		Name:      "gap_listener_panic_total",
+		Help:      "Total number of recovered gap listener panics per table",
+	}, []string{"table"})
+
+	eventsInsertCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reflex",
+		Subsystem: "events",
+		Name:      "insert_total",
+		Help:      "Total number of events inserted per table",
+	}, []string{"table"})
+
+	eventsInsertLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "reflex",
+		Subsystem: "events",
+		Name:      "insert_duration_seconds",
+		Help:      "Duration of event inserts per table in seconds",
+		Buckets:   []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1.0, 5.0},
+	}, []string{"table"})
+
+	eventsInsertNoopCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reflex",
+		Subsystem: "events",
+		Name:      "insert_noop_rejected_total",
+		Help:      "Total number of invalid noop event inserts rejected per table",
+	}, []string{"table"})
+
+	eventsStreamBufferGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "reflex",
+		Subsystem: "events",
+		Name:      "stream_buffer_size",
+		Help:      "Number of events buffered by a stream after the last poll per table",
+	}, []string{"table"})
+
+	eventsStreamFirstRecvLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "reflex",
+		Subsystem: "events",
+		Name:      "stream_first_recv_seconds",
+		Help:      "Duration from creating a stream to receiving its first event per table in seconds",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1.0, 5.0, 10.0, 60.0},
+	}, []string{"table"})
+
 	rcacheHitsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "reflex",
 		Subsystem: "events_table",
@@ -58,6 +102,27 @@ var (
 		Name:      "rcache_misses_total",
 		Help:      "Total number of read-through cache misses per table",
 	}, []string{"table"})
+
+	rcacheLRUHitsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reflex",
+		Subsystem: "events_table",
+		Name:      "rcache_lru_hits_total",
+		Help:      "Total number of read-through cache behind LRU hits per table",
+	}, []string{"table"})
+
+	rcacheLRUMissCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reflex",
+		Subsystem: "events_table",
+		Name:      "rcache_lru_misses_total",
+		Help:      "Total number of read-through cache behind LRU misses per table",
+	}, []string{"table"})
+
+	rcacheConsecErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "reflex",
+		Subsystem: "rcache",
+		Name:      "consec_error_total",
+		Help:      "Total number of non-consecutive event ids loaded by the read-through cache per table",
+	}, []string{"table"})
 )
 
 func makeCursorSetCounter(table string) func() {
@@ -69,8 +134,17 @@ func init() {
 	prometheus.MustRegister(eventsPollCounter)
 	prometheus.MustRegister(rcacheHitsCounter)
 	prometheus.MustRegister(rcacheMissCounter)
+	prometheus.MustRegister(rcacheLRUHitsCounter)
+	prometheus.MustRegister(rcacheLRUMissCounter)
+	prometheus.MustRegister(rcacheConsecErrorCounter)
 	prometheus.MustRegister(eventsGapDetectCounter)
 	prometheus.MustRegister(eventsGapFilledCounter)
 	prometheus.MustRegister(eventsGapListenGauge)
 	prometheus.MustRegister(eventsBlockingGapGauge)
+	prometheus.MustRegister(eventsInsertCounter)
+	prometheus.MustRegister(eventsInsertLatency)
+	prometheus.MustRegister(eventsInsertNoopCounter)
+	prometheus.MustRegister(eventsStreamBufferGauge)
+	prometheus.MustRegister(eventsStreamFirstRecvLatency)
+	prometheus.MustRegister(eventsGapListenerPanicCounter)
 }
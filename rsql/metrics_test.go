@@ -0,0 +1,79 @@
+package rsql
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/luno/reflex"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(eventsInsertCounter, eventsInsertLatency, eventsInsertNoopCounter)
+
+	eventsInsertCounter.Reset()
+	eventsInsertLatency.Reset()
+	eventsInsertNoopCounter.Reset()
+
+	table := NewEventsTable("insert_metrics", WithEventsInserter(
+		func(context.Context, *sql.Tx, string, reflex.EventType, []byte) error {
+			return nil
+		}))
+
+	_, err := table.Insert(context.Background(), nil, "1", eventType(1))
+	require.NoError(t, err)
+
+	_, err = table.Insert(context.Background(), nil, "0", eventType(0))
+	require.Error(t, err)
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	got := make(map[string]uint64)
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			if m.Label[0].GetValue() != "insert_metrics" {
+				continue
+			}
+			if m.Histogram != nil {
+				got[mf.GetName()] = m.Histogram.GetSampleCount()
+			} else {
+				got[mf.GetName()] = uint64(m.Counter.GetValue())
+			}
+		}
+	}
+
+	require.Equal(t, map[string]uint64{
+		"reflex_events_insert_total":               1,
+		"reflex_events_insert_duration_seconds":    1,
+		"reflex_events_insert_noop_rejected_total": 1,
+	}, got)
+}
+
+func TestStreamBufferSize(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(eventsStreamBufferGauge)
+
+	q := newQ()
+	q.addEvents(5)
+
+	table := NewEventsTable("buffer_size", WithEventsLoader(q.Load),
+		WithoutEventsCache())
+	sc := table.Stream(context.Background(), nil, "").(*streamclient)
+
+	require.Equal(t, 0, sc.BufferedLen())
+
+	for i := 4; i >= 0; i-- {
+		_, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, i, sc.BufferedLen())
+	}
+
+	// Gauge reflects the size of the last poll.
+	g := eventsStreamBufferGauge.WithLabelValues("buffer_size")
+	require.Equal(t, 5.0, testutil.ToFloat64(g))
+}
@@ -0,0 +1,84 @@
+package rsql
+
+import (
+	"context"
+	"database/sql"
+	"io"
+
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
+)
+
+// RawIterator returns the next raw row of an events table with all columns
+// keyed by column name and the cursor to resume after it. It returns io.EOF
+// once the end of the table is reached.
+type RawIterator func() (map[string]interface{}, string, error)
+
+// StreamRaw returns an iterator over the raw rows of the events table after
+// the provided cursor, including columns not mapped onto events. It is
+// intended as a tool for table migrations and bypasses event mapping, the
+// cache and noop filtering. Column values are returned as scanned by the
+// driver, eg. []byte for string columns.
+//
+// Unlike Stream, the iterator doesn't wait for new events; it returns io.EOF
+// when the head at the time of the last query is reached. The cursor of the
+// last returned row can be used to resume.
+func (t *EventsTable) StreamRaw(ctx context.Context, dbc *sql.DB, after string) RawIterator {
+	var (
+		buf []map[string]interface{}
+		err error
+	)
+
+	return func() (map[string]interface{}, string, error) {
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(buf) == 0 {
+			var prev int64
+			if after != "" {
+				prev, err = cursorID(after)
+				if err != nil {
+					return nil, "", err
+				}
+			}
+
+			buf, err = getRawRows(ctx, dbc, t.schema.name, prev, defaultBatchLimit)
+			if err != nil {
+				return nil, "", err
+			} else if len(buf) == 0 {
+				err = io.EOF
+				return nil, "", err
+			}
+		}
+
+		row := buf[0]
+		buf = buf[1:]
+
+		id, ok := rawID(row["id"])
+		if !ok {
+			err = errors.Wrap(ErrInvalidIntID, "raw row id", j.KV("id", row["id"]))
+			return nil, "", err
+		}
+		after = formatID(id)
+
+		return row, after, nil
+	}
+}
+
+// rawID returns the event ID of a raw id column value as returned by parseID.
+func rawID(v interface{}) (int64, bool) {
+	switch id := v.(type) {
+	case int64:
+		return id, true
+	case uint64:
+		return int64(id), true
+	case []byte:
+		i, err := parseID(string(id))
+		return i, err == nil
+	case string:
+		i, err := parseID(id)
+		return i, err == nil
+	}
+	return 0, false
+}
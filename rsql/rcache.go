@@ -6,10 +6,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/luno/jettison/errors"
+	"github.com/luno/jettison/j"
 	"github.com/luno/reflex"
 )
 
-const defaultRCacheLimit = 10000
+var defaultRCacheLimit = 10000
 
 // rcache provides a read-through cache for the head of an events table.
 // Note that only monotonic incremental int64 event ids are supported.
@@ -18,16 +20,33 @@ type rcache struct {
 	mu    sync.RWMutex
 
 	name   string
-	loader loader
+	loader Loader
 	limit  int
+
+	// step is the increment between consecutive event ids.
+	step int64
+
+	// bypassOnLag results in lag queries bypassing the cache.
+	bypassOnLag bool
+
+	// bypassBehind results in queries from before the cache head bypassing the cache.
+	bypassBehind bool
+
+	// rangeLoader is used to load only the events before the cache head
+	// if a read starts before it. It is optional.
+	rangeLoader rangeLoader
+
+	// lru retains recently loaded ranges before the cache head. It is optional.
+	lru *rangeLRU
 }
 
 // newRCache returns a new read-through cache.
-func newRCache(loader loader, name string) *rcache {
+func newRCache(loader Loader, name string) *rcache {
 	return &rcache{
 		name:   name,
 		loader: loader,
 		limit:  defaultRCacheLimit,
+		step:   1,
 	}
 }
 
@@ -37,6 +56,13 @@ func (c *rcache) Len() int {
 	return c.lenUnsafe()
 }
 
+// Stats returns the number of cached events and the head and tail event IDs.
+func (c *rcache) Stats() (size int, head, tail int64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lenUnsafe(), c.headUnsafe(), c.tailUnsafe()
+}
+
 func (c *rcache) lenUnsafe() int {
 	return len(c.cache)
 }
@@ -49,24 +75,40 @@ func (c *rcache) headUnsafe() int64 {
 	if c.emptyUnsafe() {
 		return 0
 	}
-	return c.cache[0].IDInt()
+	return eventID(c.cache[0])
 }
 
 func (c *rcache) tailUnsafe() int64 {
 	if c.emptyUnsafe() {
 		return 0
 	}
-	return c.cache[len(c.cache)-1].IDInt()
+	return eventID(c.cache[len(c.cache)-1])
 }
 
 func (c *rcache) Load(ctx context.Context, dbc *sql.DB,
 	prev int64, lag time.Duration) ([]*reflex.Event, error) {
 
-	if res, ok := c.maybeHit(prev+1, lag); ok {
+	if lag > 0 && c.bypassOnLag {
+		return c.loader(ctx, dbc, prev, lag)
+	}
+
+	if res, ok := c.maybeHit(prev+c.step, lag); ok {
 		rcacheHitsCounter.WithLabelValues(c.name).Inc()
 		return res, nil
 	}
 
+	if c.bypassBehind && c.isBehind(prev+c.step) {
+		return c.loader(ctx, dbc, prev, lag)
+	}
+
+	if c.lru != nil && c.isBehind(prev+c.step) {
+		if res, ok := c.lru.Get(prev+c.step, lag); ok {
+			rcacheLRUHitsCounter.WithLabelValues(c.name).Inc()
+			return res, nil
+		}
+		rcacheLRUMissCounter.WithLabelValues(c.name).Inc()
+	}
+
 	rcacheMissCounter.WithLabelValues(c.name).Inc()
 	return c.readThrough(ctx, dbc, prev, lag)
 }
@@ -77,28 +119,51 @@ func (c *rcache) maybeHit(from int64, lag time.Duration) ([]*reflex.Event, bool)
 	return c.maybeHitUnsafe(from, lag)
 }
 
+// isBehind returns true if from is before the cache head.
+func (c *rcache) isBehind(from int64) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.emptyUnsafe() && idLess(from, c.headUnsafe())
+}
+
 // maybeHitUnsafe returns a list of events from id (inclusive).
 // Note it is unsafe, locks are managed outside.
 func (c *rcache) maybeHitUnsafe(from int64, lag time.Duration) ([]*reflex.Event, bool) {
-	if from < c.headUnsafe() || from > c.tailUnsafe() {
+	return hitRange(c.cache, from, lag, c.step)
+}
+
+// hitRange returns a list of events from id (inclusive) if it is in the range
+// of consecutive events incremented by step.
+func hitRange(el []*reflex.Event, from int64, lag time.Duration,
+	step int64) ([]*reflex.Event, bool) {
+
+	if len(el) == 0 {
+		return nil, false
+	}
+
+	head := eventID(el[0])
+	if idLess(from, head) || idLess(eventID(el[len(el)-1]), from) {
+		return nil, false
+	} else if (from-head)%step != 0 {
+		// Not an event id.
 		return nil, false
 	}
 
-	offset := int(from - c.headUnsafe())
+	offset := int((from - head) / step)
 
 	if lag == 0 {
-		return c.cache[offset:], true
+		return el[offset:], true
 	}
 
 	cutOff := time.Now().Add(-lag)
 
 	var res []*reflex.Event
-	for i := offset; i < c.lenUnsafe(); i++ {
-		if c.cache[i].Timestamp.After(cutOff) {
+	for i := offset; i < len(el); i++ {
+		if el[i].Timestamp.After(cutOff) {
 			// Events too new
 			break
 		}
-		res = append(res, c.cache[i])
+		res = append(res, el[i])
 	}
 
 	return res, true
@@ -111,7 +176,13 @@ func (c *rcache) readThrough(ctx context.Context, dbc *sql.DB,
 	defer c.mu.Unlock()
 
 	// Recheck cache after waiting for lock
-	if res, ok := c.maybeHitUnsafe(prev+1, lag); ok {
+	if res, ok := c.maybeHitUnsafe(prev+c.step, lag); ok {
+		return res, nil
+	}
+
+	if res, ok, err := c.maybeStitchUnsafe(ctx, dbc, prev, lag); err != nil {
+		return nil, err
+	} else if ok {
 		return res, nil
 	}
 
@@ -125,23 +196,75 @@ func (c *rcache) readThrough(ctx context.Context, dbc *sql.DB,
 
 	// Sanity check: Validate consecutive event ids.
 	for i := 1; i < len(res); i++ {
-		if res[i].IDInt() != res[i-1].IDInt()+1 {
-			return nil, ErrConsecEvent
+		expect, actual := eventID(res[i-1])+c.step, eventID(res[i])
+		if actual != expect {
+			rcacheConsecErrorCounter.WithLabelValues(c.name).Inc()
+			return nil, errors.Wrap(ErrConsecEvent, "rcache consecutive check",
+				j.MKV{"table": c.name, "expected": expect, "actual": actual})
 		}
 	}
 
+	if c.lru != nil && !c.emptyUnsafe() && idLess(eventID(res[0]), c.headUnsafe()) {
+		// Events before the head are not cached below.
+		c.lru.Add(res)
+	}
+
 	c.maybeUpdateUnsafe(res)
 	c.maybeTrimUnsafe()
 
 	return res, nil
 }
 
+// maybeStitchUnsafe returns the events after prev by only loading the events
+// before the cache head from the DB and appending the cached events. It returns
+// false if the range loader isn't configured, prev isn't before the cache head
+// or the loaded events are not consecutive from prev, in which case a full
+// read-through is required.
+// Note it is unsafe, locks are managed outside.
+func (c *rcache) maybeStitchUnsafe(ctx context.Context, dbc *sql.DB,
+	prev int64, lag time.Duration) ([]*reflex.Event, bool, error) {
+
+	head := c.headUnsafe()
+	if c.rangeLoader == nil || c.emptyUnsafe() || !idLess(prev+c.step, head) {
+		return nil, false, nil
+	}
+
+	res, err := c.rangeLoader(ctx, dbc, prev, head-c.step, lag)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Only stitch consecutive events, gaps are handled by the read-through.
+	if len(res) == 0 || eventID(res[0]) != prev+c.step {
+		return nil, false, nil
+	}
+	for i := 1; i < len(res); i++ {
+		if eventID(res[i]) != eventID(res[i-1])+c.step {
+			return nil, false, nil
+		}
+	}
+
+	if c.lru != nil {
+		c.lru.Add(res)
+	}
+
+	if eventID(res[len(res)-1]) != head-c.step {
+		// Range not fully loaded (limited or lagged), cached events not consecutive.
+		return res, true, nil
+	}
+
+	cached, _ := c.maybeHitUnsafe(head, lag)
+
+	// Limit capacity to avoid appending to a shared backing array.
+	return append(res[:len(res):len(res)], cached...), true, nil
+}
+
 func (c *rcache) maybeUpdateUnsafe(el []*reflex.Event) {
 	if len(el) == 0 {
 		return
 	}
 
-	next := el[0].IDInt()
+	next := eventID(el[0])
 
 	// If empty, init
 	if c.emptyUnsafe() {
@@ -150,13 +273,13 @@ func (c *rcache) maybeUpdateUnsafe(el []*reflex.Event) {
 	}
 
 	// If gap, re-init
-	if c.tailUnsafe()+1 < next {
+	if idLess(c.tailUnsafe()+c.step, next) {
 		c.cache = el
 		return
 	}
 
 	// If consecutive, append
-	if c.tailUnsafe()+1 == next {
+	if c.tailUnsafe()+c.step == next {
 		c.cache = append(c.cache, el...)
 		return
 	}
@@ -170,3 +293,52 @@ func (c *rcache) maybeTrimUnsafe() {
 		c.cache = c.cache[offset:]
 	}
 }
+
+// rangeLRU is a least recently used cache of ranges of consecutive events.
+type rangeLRU struct {
+	mu     sync.Mutex
+	size   int
+	step   int64
+	ranges [][]*reflex.Event // Most recently used first.
+}
+
+func newRangeLRU(size int, step int64) *rangeLRU {
+	return &rangeLRU{size: size, step: step}
+}
+
+// Get returns a list of events from id (inclusive) if any cached range
+// contains it and marks the range as most recently used.
+func (l *rangeLRU) Get(from int64, lag time.Duration) ([]*reflex.Event, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, el := range l.ranges {
+		res, ok := hitRange(el, from, lag, l.step)
+		if !ok {
+			continue
+		}
+
+		copy(l.ranges[1:i+1], l.ranges[:i])
+		l.ranges[0] = el
+
+		return res, true
+	}
+
+	return nil, false
+}
+
+// Add adds the range of consecutive events as most recently used,
+// evicting the least recently used range if full.
+func (l *rangeLRU) Add(el []*reflex.Event) {
+	if len(el) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.ranges = append([][]*reflex.Event{el}, l.ranges...)
+	if len(l.ranges) > l.size {
+		l.ranges = l.ranges[:l.size]
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/luno/jettison/jtest"
 	"github.com/luno/reflex"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -26,7 +28,7 @@ func TestGap(t *testing.T) {
 		}, {
 			name: "Gap at 5",
 			add:  []int64{4, 6},
-			err:  ErrConsecEvent.Error(),
+			err:  "rcache consecutive check: " + ErrConsecEvent.Error(),
 		}, {
 			name: "No gap",
 			add:  []int64{4, 5, 6},
@@ -62,6 +64,82 @@ func TestGap(t *testing.T) {
 
 }
 
+func TestRCacheConsecError(t *testing.T) {
+	loader := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		return []*reflex.Event{{ID: "1"}, {ID: "2"}, {ID: "4"}}, nil
+	}
+
+	name := "consec_error"
+	c := newRCache(loader, name)
+
+	_, err := c.Load(nil, nil, 0, 0)
+	jtest.Require(t, ErrConsecEvent, err)
+	require.EqualError(t, err, "rcache consecutive check: non-consecutive event ids")
+	require.Equal(t, 1.0, testutil.ToFloat64(rcacheConsecErrorCounter.WithLabelValues(name)))
+	require.Equal(t, 0, c.Len())
+}
+
+func TestRCacheIDStep(t *testing.T) {
+	var (
+		events []*reflex.Event
+		loads  int
+	)
+	add := func(ids ...int64) {
+		for _, id := range ids {
+			events = append(events, &reflex.Event{ID: i2s(id)})
+		}
+	}
+	loader := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		loads++
+		for i, e := range events {
+			if idLess(prev, eventID(e)) {
+				return events[i:], nil
+			}
+		}
+		return nil, nil
+	}
+	add(2, 4, 6, 8)
+
+	// Step 1 errors on the step 2 sequence.
+	_, err := newRCache(loader, "step").Load(nil, nil, 0, 0)
+	jtest.Require(t, ErrConsecEvent, err)
+
+	c := newRCache(loader, "step")
+	c.step = 2
+	loads = 0
+
+	res, err := c.Load(nil, nil, 0, 0)
+	jtest.RequireNil(t, err)
+	require.Len(t, res, 4)
+	require.Equal(t, 4, c.Len())
+	require.Equal(t, 1, loads)
+
+	// Hit from the middle.
+	res, err = c.Load(nil, nil, 4, 0)
+	jtest.RequireNil(t, err)
+	require.Equal(t, "6", res[0].ID)
+	require.Len(t, res, 2)
+	require.Equal(t, 1, loads)
+
+	// Consecutive events are appended.
+	add(10, 12)
+	res, err = c.Load(nil, nil, 8, 0)
+	jtest.RequireNil(t, err)
+	require.Len(t, res, 2)
+	require.Equal(t, 6, c.Len())
+	require.Equal(t, 2, loads)
+
+	// Events after a gap re-init the cache.
+	add(16)
+	res, err = c.Load(nil, nil, 12, 0)
+	jtest.RequireNil(t, err)
+	require.Len(t, res, 1)
+	require.Equal(t, 1, c.Len())
+	require.Equal(t, 3, loads)
+}
+
 func TestRCache(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -186,6 +264,201 @@ func TestRCache(t *testing.T) {
 	}
 }
 
+func TestRCacheBypassOnLag(t *testing.T) {
+	tests := []struct {
+		name     string
+		bypass   bool
+		totalLag int
+	}{
+		{
+			name:     "default",
+			totalLag: 1,
+		},
+		{
+			name:     "bypass",
+			bypass:   true,
+			totalLag: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newQ()
+			c := newRCache(q.Load, "test")
+			c.limit = rCacheLimit
+			c.bypassOnLag = test.bypass
+
+			q.addEvents(10)
+
+			res, err := c.Load(nil, nil, 0, 0)
+			require.NoError(t, err)
+			require.Len(t, res, 10)
+			q.assertTotal(t, 1)
+
+			res, err = c.Load(nil, nil, 0, time.Hour)
+			require.NoError(t, err)
+			require.Len(t, res, 10)
+
+			res, err = c.Load(nil, nil, 5, time.Hour)
+			require.NoError(t, err)
+			require.Len(t, res, 5)
+			q.assertTotal(t, test.totalLag)
+
+			// Non-lag queries are still served from the cache.
+			res, err = c.Load(nil, nil, 5, 0)
+			require.NoError(t, err)
+			require.Len(t, res, 5)
+			q.assertTotal(t, test.totalLag)
+			require.Equal(t, 10, c.Len())
+		})
+	}
+}
+
+func TestRCacheBypassBehind(t *testing.T) {
+	tests := []struct {
+		name      string
+		bypass    bool
+		totalBack int
+		misses    float64
+	}{
+		{
+			name:      "default",
+			totalBack: 3,
+			misses:    4,
+		},
+		{
+			name:      "bypass",
+			bypass:    true,
+			totalBack: 3,
+			misses:    1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := "bypass_behind_" + test.name
+			q := newQ()
+			c := newRCache(q.Load, name)
+			c.limit = 5
+			c.bypassBehind = test.bypass
+
+			q.addEvents(10)
+
+			// Head stream populates the cache.
+			res, err := c.Load(nil, nil, 5, 0)
+			require.NoError(t, err)
+			require.Len(t, res, 5)
+
+			// Backfill stream reads from before the cache head.
+			for _, prev := range []int64{0, 2, 4} {
+				_, err := c.Load(nil, nil, prev, 0)
+				require.NoError(t, err)
+			}
+			q.assertTotal(t, 1+test.totalBack)
+
+			// Head stream is still served from the cache.
+			for _, prev := range []int64{5, 7, 9} {
+				_, err := c.Load(nil, nil, prev, 0)
+				require.NoError(t, err)
+			}
+			q.assertTotal(t, 1+test.totalBack)
+
+			size, head, tail := c.Stats()
+			require.Equal(t, 5, size)
+			require.Equal(t, int64(6), head)
+			require.Equal(t, int64(10), tail)
+			require.Equal(t, 3.0, testutil.ToFloat64(rcacheHitsCounter.WithLabelValues(name)))
+			require.Equal(t, test.misses, testutil.ToFloat64(rcacheMissCounter.WithLabelValues(name)))
+		})
+	}
+}
+
+func TestRCacheBehindLRU(t *testing.T) {
+	tests := []struct {
+		name      string
+		lru       int
+		totalBack int
+		lruHits   float64
+	}{
+		{
+			name:      "default",
+			totalBack: 6,
+		},
+		{
+			name:      "lru",
+			lru:       2,
+			totalBack: 1,
+			lruHits:   5,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := "behind_lru_" + test.name
+			q := newQ()
+			c := newRCache(q.Load, name)
+			c.limit = 5
+			if test.lru > 0 {
+				c.lru = newRangeLRU(test.lru, 1)
+			}
+
+			q.addEvents(10)
+
+			// Head stream populates the cache.
+			_, err := c.Load(nil, nil, 5, 0)
+			require.NoError(t, err)
+
+			// Streams repeatedly reconnect just below the cache head.
+			for i := 0; i < 3; i++ {
+				for _, prev := range []int64{3, 4} {
+					res, err := c.Load(nil, nil, prev, 0)
+					require.NoError(t, err)
+					require.Equal(t, prev+1, res[0].IDInt())
+				}
+			}
+			q.assertTotal(t, 1+test.totalBack)
+
+			require.Equal(t, test.lruHits, testutil.ToFloat64(rcacheLRUHitsCounter.WithLabelValues(name)))
+			if test.lru > 0 {
+				require.Equal(t, 1.0, testutil.ToFloat64(rcacheLRUMissCounter.WithLabelValues(name)))
+			}
+
+			// The cache head is unaffected.
+			size, head, tail := c.Stats()
+			require.Equal(t, 5, size)
+			require.Equal(t, int64(6), head)
+			require.Equal(t, int64(10), tail)
+		})
+	}
+}
+
+func TestRangeLRU(t *testing.T) {
+	events := func(from, to int64) []*reflex.Event {
+		var res []*reflex.Event
+		for id := from; id <= to; id++ {
+			res = append(res, &reflex.Event{ID: i2s(id)})
+		}
+		return res
+	}
+
+	l := newRangeLRU(2, 1)
+	l.Add(events(1, 3))
+	l.Add(events(5, 6))
+
+	res, ok := l.Get(2, 0)
+	require.True(t, ok)
+	require.Len(t, res, 2)
+
+	_, ok = l.Get(4, 0)
+	require.False(t, ok)
+
+	// Evicts the least recently used 5-6 range.
+	l.Add(events(8, 9))
+	_, ok = l.Get(5, 0)
+	require.False(t, ok)
+	_, ok = l.Get(1, 0)
+	require.True(t, ok)
+	_, ok = l.Get(9, 0)
+	require.True(t, ok)
+}
+
 type query struct {
 	queried map[int64]int
 	events  []*reflex.Event
@@ -231,3 +504,106 @@ func (q *query) Load(ctx context.Context, dbc *sql.DB, prev int64,
 func i2s(i int64) string {
 	return strconv.FormatInt(i, 10)
 }
+
+func TestRCacheStitch(t *testing.T) {
+	ids := func(el []*reflex.Event) []int64 {
+		var res []int64
+		for _, e := range el {
+			res = append(res, e.IDInt())
+		}
+		return res
+	}
+
+	cases := []struct {
+		name     string
+		limit    int   // Max events returned by the range loader.
+		skip     int64 // Event skipped by the range loader.
+		noRange  bool
+		expIDs   []int64
+		expFull  bool // Expect a full read-through.
+		expRange bool // Expect a range query.
+	}{
+		{
+			name:     "stitched",
+			expIDs:   []int64{3, 4, 5, 6, 7, 8, 9, 10},
+			expRange: true,
+		},
+		{
+			name:     "no overlap",
+			limit:    1,
+			expIDs:   []int64{3},
+			expRange: true,
+		},
+		{
+			name:    "no range loader",
+			noRange: true,
+			expIDs:  []int64{3, 4, 5, 6, 7, 8, 9, 10},
+			expFull: true,
+		},
+		{
+			name:     "gap after prev",
+			skip:     3,
+			expIDs:   []int64{3, 4, 5, 6, 7, 8, 9, 10},
+			expFull:  true,
+			expRange: true,
+		},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			q := newQ()
+			q.addEvents(10)
+
+			c := newRCache(q.Load, "test")
+			c.limit = 6
+
+			var ranged []int64
+			if !test.noRange {
+				c.rangeLoader = func(ctx context.Context, dbc *sql.DB, prev int64,
+					upTo int64, lag time.Duration) ([]*reflex.Event, error) {
+					ranged = append(ranged, prev)
+
+					var res []*reflex.Event
+					for _, e := range q.events {
+						if e.IDInt() <= prev || e.IDInt() > upTo || e.IDInt() == test.skip {
+							continue
+						}
+						res = append(res, e)
+						if len(res) == test.limit {
+							break
+						}
+					}
+					return res, nil
+				}
+			}
+
+			// Populate the cache with the last 6 events.
+			_, err := c.Load(nil, nil, 0, 0)
+			require.NoError(t, err)
+			_, head, _ := c.Stats()
+			require.Equal(t, int64(5), head)
+
+			res, err := c.Load(nil, nil, 2, 0)
+			require.NoError(t, err)
+			require.Equal(t, test.expIDs, ids(res))
+
+			if test.expFull {
+				q.assertQuery(t, 2, 1)
+			} else {
+				q.assertQuery(t, 2, 0)
+			}
+
+			if test.expRange {
+				require.Equal(t, []int64{2}, ranged)
+			} else {
+				require.Empty(t, ranged)
+			}
+
+			// Cache unchanged.
+			size, head, tail := c.Stats()
+			require.Equal(t, 6, size)
+			require.Equal(t, int64(5), head)
+			require.Equal(t, int64(10), tail)
+		})
+	}
+}
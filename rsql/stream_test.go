@@ -466,6 +466,42 @@ func TestStreamMetadata(t *testing.T) {
 	}
 }
 
+func TestStreamEventScanner(t *testing.T) {
+	dbc := ConnectTestDB(t, eventsTable, "")
+	defer dbc.Close()
+
+	_, err := dbc.Exec("alter table " + eventsTable + " add column trace_id varchar(255) null")
+	require.NoError(t, err)
+
+	scan := func(e reflex.Event, extra []interface{}) *reflex.Event {
+		if b, ok := extra[0].([]byte); ok {
+			e.Extra = map[string]interface{}{"trace_id": string(b)}
+		}
+		return &e
+	}
+
+	table := rsql.NewEventsTable(eventsTable,
+		rsql.WithEventScanner([]string{"trace_id"}, scan))
+
+	for i := 1; i <= 3; i++ {
+		err := insertTestEvent(dbc, table, i2s(i), testEventType(i))
+		require.NoError(t, err)
+	}
+
+	_, err = dbc.Exec("update " + eventsTable + " set trace_id=concat('trace-', id)")
+	require.NoError(t, err)
+
+	sc, err := table.ToStream(dbc)(context.Background(), "")
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		e, err := sc.Recv()
+		require.NoError(t, err)
+		require.Equal(t, int64(i), e.IDInt())
+		require.Equal(t, "trace-"+i2s(i), e.Extra["trace_id"])
+	}
+}
+
 func TestStreamLag(t *testing.T) {
 	// Wrap baseloader to count sql queries.
 	loadCountCh := make(chan struct{}, 100)
@@ -634,6 +670,102 @@ func TestCancelError(t *testing.T) {
 	require.Contains(t, err.Error(), "context canceled") // Jettison doesn't support native grpc status errors properly.
 }
 
+func TestStreamPause(t *testing.T) {
+	mock := new(mockTable)
+	table := rsql.NewEventsTable(eventsTable,
+		rsql.WithEventsLoader(mock.Load),
+		rsql.WithEventsInserter(mock.Insert),
+		rsql.WithEventsBackoff(time.Millisecond))
+
+	for i := 1; i <= 2; i++ {
+		err := mock.Insert(context.Background(), nil, i2s(i), testEventType(i), nil)
+		require.NoError(t, err)
+	}
+
+	sc := table.Stream(context.Background(), nil, "")
+	pauser := sc.(interface {
+		Pause()
+		Resume()
+	})
+
+	e, err := sc.Recv()
+	jtest.RequireNil(t, err)
+	require.Equal(t, int64(1), e.IDInt())
+
+	pauser.Pause()
+
+	ch := make(chan *reflex.Event, 1)
+	go func() {
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+		ch <- e
+	}()
+
+	select {
+	case <-ch:
+		require.Fail(t, "recv not blocked while paused")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	pauser.Resume()
+
+	select {
+	case e := <-ch:
+		require.Equal(t, int64(2), e.IDInt())
+	case <-time.After(time.Second):
+		require.Fail(t, "recv blocked after resume")
+	}
+}
+
+func TestEventsTableNotify(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		mock = new(mockTable)
+	)
+	load := func(ctx context.Context, dbc *sql.DB, prev int64,
+		lag time.Duration) ([]*reflex.Event, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return mock.Load(ctx, dbc, prev, lag)
+	}
+
+	table := rsql.NewEventsTable(eventsTable,
+		rsql.WithEventsLoader(load),
+		rsql.WithEventsInMemNotifier(),
+		rsql.WithEventsBackoff(time.Hour))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sc := table.Stream(ctx, nil, "")
+
+	ch := make(chan *reflex.Event, 1)
+	go func() {
+		e, err := sc.Recv()
+		jtest.RequireNil(t, err)
+		ch <- e
+	}()
+
+	// Insert bypassing the table, so no notification.
+	mu.Lock()
+	err := mock.Insert(ctx, nil, i2s(1), testEventType(1), nil)
+	mu.Unlock()
+	require.NoError(t, err)
+
+	t0 := time.Now()
+	for {
+		table.Notify()
+
+		select {
+		case e := <-ch:
+			require.Equal(t, int64(1), e.IDInt())
+			return
+		case <-time.After(time.Millisecond * 10):
+			require.True(t, time.Since(t0) < time.Second, "stream not notified")
+		}
+	}
+}
+
 type teststate struct {
 	dbc    *sql.DB
 	etable *rsql.EventsTable
@@ -666,3 +798,14 @@ func setupState(t *testing.T, streamOptions []reflex.StreamOption,
 		stop:   stop,
 	}
 }
+
+func TestStreamCursorKind(t *testing.T) {
+	mock := new(mockTable)
+	table := rsql.NewEventsTable(eventsTable, rsql.WithEventsLoader(mock.Load))
+
+	_, err := table.Stream(context.Background(), nil, "path/to/file|01|9").Recv()
+	jtest.Require(t, reflex.ErrCursorKind, err)
+
+	_, err = table.Stream(context.Background(), nil, "abc").Recv()
+	jtest.Require(t, rsql.ErrInvalidIntID, err)
+}
@@ -3,6 +3,7 @@ package reflex
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/luno/fate"
 	"github.com/luno/jettison/errors"
@@ -22,6 +23,13 @@ func Run(in context.Context, s Spec) error {
 		return errors.Wrap(err, "get cursor error")
 	}
 
+	// Check if the consumer may start from the cursor.
+	if checker, ok := s.consumer.(startChecker); ok {
+		if err := checker.checkStart(cursor); err != nil {
+			return err
+		}
+	}
+
 	// Check if the consumer requires reset.
 	if resetter, ok := s.consumer.(resetter); ok {
 		err := resetter.Reset()
@@ -40,12 +48,29 @@ func Run(in context.Context, s Spec) error {
 		defer closer.Close()
 	}
 
+	observer, _ := s.consumer.(recvObserver)
+
+	// Update the consumer lag while idle until the run ends.
+	updater, _ := s.consumer.(idleLagUpdater)
+	if updater != nil {
+		head, _ := sc.(headReporter)
+		go updater.updateIdleLag(ctx, head)
+	}
+
 	for {
+		t0 := time.Now()
 		e, err := sc.Recv()
+		if IsHeadReachedErr(err) && updater != nil {
+			updater.headReached()
+		}
 		if err != nil {
 			return errors.Wrap(err, "recv error")
 		}
 
+		if observer != nil {
+			observer.observeRecv(time.Since(t0))
+		}
+
 		if err := s.consumer.Consume(ctx, fate.New(), e); err != nil {
 			return errors.Wrap(err, "consume error")
 		}
@@ -0,0 +1,43 @@
+package reflex
+
+import (
+	"context"
+)
+
+// Span attribute keys set on spans started by reflex.
+const (
+	SpanAttrConsumer  = "reflex.consumer"
+	SpanAttrTable     = "reflex.table"
+	SpanAttrEventID   = "reflex.event_id"
+	SpanAttrEventType = "reflex.event_type"
+	SpanAttrCursor    = "reflex.cursor"
+)
+
+// Tracer starts spans for streaming and consuming events, see
+// WithConsumerTracer and rsql.WithEventsTracer. It is usually implemented
+// by a thin adapter of an OpenTelemetry tracer which keeps reflex free of
+// tracing dependencies. Spans are linked by the SpanAttrEventID attribute.
+type Tracer interface {
+	// Start starts a span with the name and attributes as a child of any
+	// span in the context and returns a context containing the new span.
+	Start(ctx context.Context, name string, attrs map[string]string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute of the span.
+	SetAttribute(key, value string)
+
+	// End ends the span, recording the error if not nil.
+	End(err error)
+}
+
+// WithConsumerTracer provides an option to start a span with the tracer
+// around each handler invocation. The span is named "reflex.consume" and has
+// the consumer name, event ID and event type attributes. The handler's
+// context contains the span. It defaults to no tracing.
+func WithConsumerTracer(t Tracer) ConsumerOption {
+	return func(c *consumer) {
+		c.tracer = t
+	}
+}
@@ -0,0 +1,85 @@
+package reflex_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/luno/fate"
+	"github.com/luno/jettison/errors"
+	"github.com/luno/reflex"
+	"github.com/stretchr/testify/require"
+)
+
+type spanKey struct{}
+
+type recordedSpan struct {
+	name  string
+	attrs map[string]string
+	ended bool
+	err   error
+}
+
+func (s *recordedSpan) SetAttribute(key, value string) {
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+type recordingTracer struct {
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string,
+	attrs map[string]string) (context.Context, reflex.Span) {
+
+	span := &recordedSpan{name: name, attrs: make(map[string]string)}
+	for k, v := range attrs {
+		span.attrs[k] = v
+	}
+	t.spans = append(t.spans, span)
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func TestConsumerTracer(t *testing.T) {
+	errHandler := errors.New("handler error")
+
+	var tracer recordingTracer
+	var handled []*recordedSpan
+	c := reflex.NewConsumer("traced", func(ctx context.Context, f fate.Fate, e *reflex.Event) error {
+		handled = append(handled, ctx.Value(spanKey{}).(*recordedSpan))
+		if e.ID == "2" {
+			return errHandler
+		}
+		return nil
+	}, reflex.WithConsumerTracer(&tracer))
+
+	ctx := context.Background()
+	require.NoError(t, c.Consume(ctx, fate.New(), &reflex.Event{ID: "1", Type: TestEventType(1)}))
+	require.True(t, errors.Is(c.Consume(ctx, fate.New(), &reflex.Event{ID: "2", Type: TestEventType(2)}), errHandler))
+
+	require.Len(t, tracer.spans, 2)
+	require.Equal(t, tracer.spans, handled)
+
+	for i, span := range tracer.spans {
+		require.Equal(t, "reflex.consume", span.name)
+		require.Equal(t, map[string]string{
+			reflex.SpanAttrConsumer:  "traced",
+			reflex.SpanAttrEventID:   []string{"1", "2"}[i],
+			reflex.SpanAttrEventType: []string{"1", "2"}[i],
+		}, span.attrs)
+		require.True(t, span.ended)
+	}
+	require.NoError(t, tracer.spans[0].err)
+	require.True(t, errors.Is(tracer.spans[1].err, errHandler))
+
+	// No-op without a tracer.
+	c = reflex.NewConsumer("untraced", func(ctx context.Context, f fate.Fate, e *reflex.Event) error {
+		require.Nil(t, ctx.Value(spanKey{}))
+		return nil
+	})
+	require.NoError(t, c.Consume(ctx, fate.New(), &reflex.Event{ID: "1", Type: TestEventType(1)}))
+}